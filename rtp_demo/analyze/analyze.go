@@ -0,0 +1,429 @@
+// Package analyze collects per-stream statistics from parsed RTP packets and
+// H.264 NAL units and renders them as a text or JSON report.
+package analyze
+
+import (
+	"sort"
+	"time"
+
+	"rtp_demo/h264"
+)
+
+// Default settings
+const (
+	DefaultClockRate      = 90000
+	DefaultJitterInterval = 100 * time.Millisecond
+	DefaultBitrateWindow  = time.Second
+	DefaultLargestFrames  = 5
+)
+
+// Packet describes one received RTP packet
+type Packet struct {
+	Arrival     time.Time
+	SSRC        uint32
+	Sequence    uint16
+	Timestamp   uint32
+	PayloadType uint8
+	Marker      bool
+	Size        int // whole packet including the RTP header
+	PayloadSize int
+}
+
+// Analyzer accumulates statistics for every SSRC it sees. It is not safe for
+// concurrent use.
+type Analyzer struct {
+	ClockRate      int           // RTP clock rate used for jitter, 90kHz for video
+	JitterInterval time.Duration // spacing of jitter graph points
+	BitrateWindow  time.Duration // bucket size of the bitrate graph
+	LargestFrames  int           // how many of the largest frames to report
+
+	streams map[uint32]*stream
+	rtcp    int
+	start   time.Time
+	end     time.Time
+}
+
+// NewAnalyzer creates an analyzer with default settings
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{
+		ClockRate:      DefaultClockRate,
+		JitterInterval: DefaultJitterInterval,
+		BitrateWindow:  DefaultBitrateWindow,
+		LargestFrames:  DefaultLargestFrames,
+		streams:        make(map[uint32]*stream),
+	}
+}
+
+// stream holds the running state for one SSRC
+type stream struct {
+	ssrc        uint32
+	payloadType uint8
+	packets     int
+	bytes       int
+	first, last time.Time
+
+	// Sequence tracking with extended (wrap-counting) sequence numbers
+	started    bool
+	highest    int64
+	firstSeq   int64
+	seen       map[int64]bool
+	duplicates int
+	gaps       []gap // sequence gaps, some filled later by reordered packets
+	reorders   []ReorderEvent
+
+	// RFC 3550 interarrival jitter
+	jitter        float64
+	lastTransit   float64
+	haveTransit   bool
+	maxJitter     float64
+	jitterSamples []JitterSample
+	nextJitter    time.Time
+
+	bitrate []int // bytes per bitrate window
+
+	frames []*frameState
+	frame  *frameState // frame currently being received
+}
+
+// gap is a range of extended sequence numbers missing when first noticed
+type gap struct {
+	first, last int64
+	at          time.Duration
+}
+
+// lossEvents returns the runs of sequence numbers that never arrived
+func (st *stream) lossEvents() []LossEvent {
+	var events []LossEvent
+	for _, g := range st.gaps {
+		for ext := g.first; ext <= g.last; ext++ {
+			if st.seen[ext] {
+				continue
+			}
+			if n := len(events); n > 0 && events[n-1].end == ext-1 && events[n-1].At == g.at {
+				events[n-1].Count++
+				events[n-1].end = ext
+				continue
+			}
+			events = append(events, LossEvent{Sequence: uint16(ext), Count: 1, At: g.at, end: ext})
+		}
+	}
+	return events
+}
+
+// frameState is one access unit, grouped by RTP timestamp
+type frameState struct {
+	timestamp uint32
+	arrival   time.Time
+	size      int
+	packets   int
+	nalTypes  []uint8
+	sliceType string
+	idr       bool
+}
+
+// AddRTCP counts an RTCP packet
+func (a *Analyzer) AddRTCP(arrival time.Time) {
+	a.rtcp++
+	a.touch(arrival)
+}
+
+func (a *Analyzer) touch(t time.Time) {
+	if a.start.IsZero() || t.Before(a.start) {
+		a.start = t
+	}
+	if t.After(a.end) {
+		a.end = t
+	}
+}
+
+// AddPacket records an RTP packet and reports whether it is in order, i.e.
+// newer than every packet seen so far on its SSRC
+func (a *Analyzer) AddPacket(p Packet) bool {
+	a.touch(p.Arrival)
+
+	st, ok := a.streams[p.SSRC]
+	if !ok {
+		st = &stream{ssrc: p.SSRC, payloadType: p.PayloadType, first: p.Arrival}
+		a.streams[p.SSRC] = st
+	}
+
+	st.packets++
+	st.bytes += p.Size
+	st.last = p.Arrival
+
+	bucket := int(p.Arrival.Sub(st.first) / a.BitrateWindow)
+	for len(st.bitrate) <= bucket {
+		st.bitrate = append(st.bitrate, 0)
+	}
+	st.bitrate[bucket] += p.Size
+
+	a.updateJitter(st, p)
+
+	inOrder := st.updateSequence(p.Sequence, p.Arrival.Sub(a.start))
+	if inOrder {
+		if st.frame == nil || st.frame.timestamp != p.Timestamp {
+			st.frame = &frameState{timestamp: p.Timestamp, arrival: p.Arrival}
+			st.frames = append(st.frames, st.frame)
+		}
+		st.frame.size += p.PayloadSize
+		st.frame.packets++
+	} else if f := st.findFrame(p.Timestamp); f != nil {
+		// A reordered packet still counts towards its frame's size
+		f.size += p.PayloadSize
+		f.packets++
+	}
+	return inOrder
+}
+
+// findFrame returns a recent frame with the given timestamp
+func (st *stream) findFrame(timestamp uint32) *frameState {
+	for i := len(st.frames) - 1; i >= 0 && i >= len(st.frames)-recentFrames; i-- {
+		if st.frames[i].timestamp == timestamp {
+			return st.frames[i]
+		}
+	}
+	return nil
+}
+
+// recentFrames is how far back reordered packets are matched to frames
+const recentFrames = 8
+
+// updateSequence tracks loss, reordering and duplicates
+func (st *stream) updateSequence(seq uint16, at time.Duration) bool {
+	if st.seen == nil {
+		st.seen = make(map[int64]bool)
+	}
+	if !st.started {
+		st.started = true
+		st.highest = int64(seq)
+		st.firstSeq = st.highest
+		st.seen[st.highest] = true
+		return true
+	}
+
+	// Extend the sequence number to the cycle closest to the highest seen
+	ext := st.highest + int64(int16(seq-uint16(st.highest)))
+
+	if st.seen[ext] {
+		st.duplicates++
+		return false
+	}
+	st.seen[ext] = true
+
+	if ext < st.highest {
+		st.reorders = append(st.reorders, ReorderEvent{Sequence: seq, At: at, Distance: int(st.highest - ext)})
+		return false
+	}
+
+	if ext > st.highest+1 {
+		st.gaps = append(st.gaps, gap{first: st.highest + 1, last: ext - 1, at: at})
+	}
+	st.highest = ext
+	return true
+}
+
+// updateJitter applies the RFC 3550 interarrival jitter estimator
+func (a *Analyzer) updateJitter(st *stream, p Packet) {
+	arrival := p.Arrival.Sub(a.start).Seconds() * float64(a.ClockRate)
+	transit := arrival - float64(p.Timestamp)
+
+	if st.haveTransit {
+		d := transit - st.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		// Ignore timestamp jumps, e.g. after a sender restart
+		if d < float64(a.ClockRate) {
+			st.jitter += (d - st.jitter) / 16
+		}
+	}
+	st.lastTransit = transit
+	st.haveTransit = true
+
+	if st.jitter > st.maxJitter {
+		st.maxJitter = st.jitter
+	}
+
+	if !p.Arrival.Before(st.nextJitter) {
+		st.jitterSamples = append(st.jitterSamples, JitterSample{
+			At:     p.Arrival.Sub(a.start),
+			Jitter: a.clockToDuration(st.jitter),
+		})
+		st.nextJitter = p.Arrival.Add(a.JitterInterval)
+	}
+}
+
+func (a *Analyzer) clockToDuration(ticks float64) time.Duration {
+	return time.Duration(ticks / float64(a.ClockRate) * float64(time.Second))
+}
+
+// AddNALU records an H.264 NAL unit belonging to the frame of the most
+// recent in-order packet on the SSRC. For fragmented NAL units only the start
+// is needed.
+func (a *Analyzer) AddNALU(ssrc uint32, nalu []byte) {
+	st, ok := a.streams[ssrc]
+	if !ok || st.frame == nil || len(nalu) == 0 {
+		return
+	}
+
+	f := st.frame
+	nalType := nalu[0] & 0x1F
+	f.nalTypes = append(f.nalTypes, nalType)
+
+	switch nalType {
+	case 1, 5:
+		if nalType == 5 {
+			f.idr = true
+		}
+		if f.sliceType == "" {
+			f.sliceType = h264.SliceType(nalu)
+		}
+	}
+}
+
+// Report builds the report from everything added so far
+func (a *Analyzer) Report() *Report {
+	r := &Report{
+		RTCPPackets: a.rtcp,
+		Duration:    a.end.Sub(a.start),
+	}
+	if !a.start.IsZero() {
+		r.Start = a.start
+	}
+
+	ssrcs := make([]uint32, 0, len(a.streams))
+	for ssrc := range a.streams {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+
+	for _, ssrc := range ssrcs {
+		r.Streams = append(r.Streams, a.streamReport(a.streams[ssrc]))
+		r.Packets += a.streams[ssrc].packets
+	}
+	return r
+}
+
+func (a *Analyzer) streamReport(st *stream) *StreamReport {
+	expected := int(st.highest - st.firstSeq + 1)
+	unique := len(st.seen)
+
+	sr := &StreamReport{
+		SSRC:        st.ssrc,
+		PayloadType: st.payloadType,
+		Packets:     st.packets,
+		Bytes:       st.bytes,
+		Duration:    st.last.Sub(st.first),
+		Expected:    expected,
+		Lost:        expected - unique,
+		Duplicates:  st.duplicates,
+		LossEvents:  st.lossEvents(),
+		Reorders:    st.reorders,
+		Jitter:      a.clockToDuration(st.jitter),
+		MaxJitter:   a.clockToDuration(st.maxJitter),
+		JitterGraph: st.jitterSamples,
+	}
+	if sr.Lost < 0 {
+		sr.Lost = 0
+	}
+	if expected > 0 {
+		sr.LossRate = float64(sr.Lost) / float64(expected)
+	}
+
+	for i, b := range st.bitrate {
+		sr.Bitrate = append(sr.Bitrate, BitrateSample{
+			At:  time.Duration(i) * a.BitrateWindow,
+			Bps: int(int64(b) * 8 * int64(time.Second) / int64(a.BitrateWindow)),
+		})
+	}
+	if secs := sr.Duration.Seconds(); secs > 0 {
+		sr.AverageBitrate = int(float64(st.bytes*8) / secs)
+	}
+
+	a.frameReport(st, sr)
+	return sr
+}
+
+// frameReport derives frame rate, GOP structure and the largest frames
+func (a *Analyzer) frameReport(st *stream, sr *StreamReport) {
+	sr.Frames = len(st.frames)
+	if len(st.frames) == 0 {
+		return
+	}
+
+	if len(st.frames) > 1 {
+		span := st.frames[len(st.frames)-1].timestamp - st.frames[0].timestamp
+		if span > 0 && span < 0x80000000 {
+			sr.FrameRate = float64(len(st.frames)-1) * float64(a.ClockRate) / float64(span)
+		}
+	}
+
+	gop := &GOPReport{}
+	var current []byte
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		gop.Lengths = append(gop.Lengths, len(current))
+		if gop.Pattern == "" && current[0] == 'I' {
+			gop.Pattern = string(current)
+		}
+		current = current[:0]
+	}
+
+	frames := make([]FrameInfo, 0, len(st.frames))
+	for _, f := range st.frames {
+		typ := f.frameType()
+		if f.idr {
+			sr.Keyframes++
+			flush()
+		}
+		current = append(current, typ[0])
+		frames = append(frames, FrameInfo{
+			Timestamp: f.timestamp,
+			At:        f.arrival.Sub(a.start),
+			Type:      typ,
+			Size:      f.size,
+			Packets:   f.packets,
+			NALTypes:  f.nalTypes,
+		})
+	}
+	flush()
+
+	if len(gop.Lengths) > 0 {
+		total := 0
+		for _, n := range gop.Lengths {
+			total += n
+		}
+		gop.Average = float64(total) / float64(len(gop.Lengths))
+	}
+	if len(gop.Pattern) > maxPatternLength {
+		gop.Pattern = gop.Pattern[:maxPatternLength] + "..."
+	}
+	sr.GOP = gop
+
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Size > frames[j].Size })
+	if len(frames) > a.LargestFrames {
+		frames = frames[:a.LargestFrames]
+	}
+	sr.LargestFrames = frames
+}
+
+// maxPatternLength limits the GOP pattern shown in reports
+const maxPatternLength = 120
+
+// frameType returns "I" (IDR), "i" (non-IDR intra), "P", "B", or "?"
+func (f *frameState) frameType() string {
+	switch {
+	case f.idr:
+		return "I"
+	case f.sliceType == "I" || f.sliceType == "SI":
+		return "i"
+	case f.sliceType == "P" || f.sliceType == "SP":
+		return "P"
+	case f.sliceType == "B":
+		return "B"
+	default:
+		return "?"
+	}
+}
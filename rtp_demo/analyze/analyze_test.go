@@ -0,0 +1,118 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func TestLossReorderDuplicate(t *testing.T) {
+	a := NewAnalyzer()
+
+	// 0 1 3 2 5 5 8 (4, 6 and 7 never arrive)
+	for i, seq := range []uint16{0, 1, 3, 2, 5, 5, 8} {
+		a.AddPacket(Packet{Arrival: start.Add(time.Duration(i) * 10 * time.Millisecond), SSRC: 1, Sequence: seq, Timestamp: uint32(seq) * 900, Size: 100})
+	}
+
+	s := a.Report().Streams[0]
+	if s.Expected != 9 || s.Lost != 3 || s.Duplicates != 1 || len(s.Reorders) != 1 {
+		t.Errorf("Expected 9 expected, 3 lost, 1 duplicate, 1 reorder, got %d, %d, %d, %d",
+			s.Expected, s.Lost, s.Duplicates, len(s.Reorders))
+	}
+
+	// The gap at 2 was filled by the reordered packet
+	if len(s.LossEvents) != 2 || s.LossEvents[0].Sequence != 4 || s.LossEvents[1].Sequence != 6 || s.LossEvents[1].Count != 2 {
+		t.Errorf("Unexpected loss events %+v", s.LossEvents)
+	}
+}
+
+func TestSequenceWrap(t *testing.T) {
+	a := NewAnalyzer()
+	for i, seq := range []uint16{65534, 65535, 0, 1} {
+		a.AddPacket(Packet{Arrival: start.Add(time.Duration(i) * time.Millisecond), SSRC: 1, Sequence: seq})
+	}
+
+	if s := a.Report().Streams[0]; s.Expected != 4 || s.Lost != 0 || len(s.Reorders) != 0 {
+		t.Errorf("Expected 4 packets without loss across the wrap, got %+v", s)
+	}
+}
+
+func TestFramesAndGOP(t *testing.T) {
+	a := NewAnalyzer()
+	seq := uint16(0)
+
+	// Two GOPs of IPBP at 25 fps, with the keyframe split over 3 packets
+	for i := 0; i < 8; i++ {
+		ts := uint32(i) * 3600
+		arrival := start.Add(time.Duration(i) * 40 * time.Millisecond)
+
+		// Slice headers with first_mb_in_slice=0 and slice_type 7 (I), 1 (B), 0 (P)
+		var nalus [][]byte
+		switch i % 4 {
+		case 0:
+			nalus = [][]byte{{0x67, 0x42}, {0x68, 0xCE}, {0x65, 0x88, 0x80}, nil, nil}
+		case 2:
+			nalus = [][]byte{{0x61, 0xA8}}
+		default:
+			nalus = [][]byte{{0x61, 0xE0}}
+		}
+
+		for _, nalu := range nalus {
+			a.AddPacket(Packet{Arrival: arrival, SSRC: 7, Sequence: seq, Timestamp: ts, Size: 1012, PayloadSize: 1000})
+			if nalu != nil {
+				a.AddNALU(7, nalu)
+			}
+			seq++
+		}
+	}
+
+	s := a.Report().Streams[0]
+	if s.Frames != 8 || s.Keyframes != 2 {
+		t.Errorf("Expected 8 frames and 2 keyframes, got %d and %d", s.Frames, s.Keyframes)
+	}
+	if s.FrameRate < 24.9 || s.FrameRate > 25.1 {
+		t.Errorf("Expected 25 fps, got %f", s.FrameRate)
+	}
+	if s.GOP == nil || s.GOP.Pattern != "IPBP" || len(s.GOP.Lengths) != 2 || s.GOP.Average != 4 {
+		t.Errorf("Unexpected GOP %+v", s.GOP)
+	}
+	if f := s.LargestFrames[0]; f.Type != "I" || f.Size != 5000 || f.Packets != 5 {
+		t.Errorf("Expected the keyframe to be largest, got %+v", f)
+	}
+	if s.Jitter != 0 {
+		t.Errorf("Expected no jitter for perfectly paced frames, got %v", s.Jitter)
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	a := NewAnalyzer()
+	for i := 0; i < 30; i++ {
+		a.AddPacket(Packet{Arrival: start.Add(time.Duration(i) * 100 * time.Millisecond), SSRC: 3, Sequence: uint16(i), Timestamp: uint32(i) * 9000, Size: 1250})
+	}
+	a.AddRTCP(start)
+	r := a.Report()
+
+	if len(r.Streams[0].Bitrate) != 3 || r.Streams[0].Bitrate[0].Bps != 100000 {
+		t.Errorf("Expected 3 one-second samples of 100 kbit/s, got %+v", r.Streams[0].Bitrate)
+	}
+
+	var text bytes.Buffer
+	r.WriteText(&text)
+	if !strings.Contains(text.String(), "SSRC 3 ") || !strings.Contains(text.String(), "1 RTCP packets") {
+		t.Errorf("Unexpected text report:\n%s", text.String())
+	}
+
+	var js bytes.Buffer
+	r.WriteJSON(&js)
+	var decoded Report
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if decoded.Packets != 30 || decoded.Streams[0].SSRC != 3 {
+		t.Errorf("Unexpected decoded report %+v", decoded)
+	}
+}
@@ -0,0 +1,171 @@
+package analyze
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Report is the result of an analysis. Durations are encoded in JSON as
+// nanoseconds.
+type Report struct {
+	Start       time.Time       `json:"start"`
+	Duration    time.Duration   `json:"duration"`
+	Packets     int             `json:"packets"`
+	RTCPPackets int             `json:"rtcp_packets"`
+	Streams     []*StreamReport `json:"streams"`
+}
+
+// StreamReport holds the statistics of one SSRC
+type StreamReport struct {
+	SSRC           uint32          `json:"ssrc"`
+	PayloadType    uint8           `json:"payload_type"`
+	Packets        int             `json:"packets"`
+	Bytes          int             `json:"bytes"`
+	Duration       time.Duration   `json:"duration"`
+	AverageBitrate int             `json:"average_bitrate"`
+	Bitrate        []BitrateSample `json:"bitrate"`
+
+	Expected   int            `json:"expected"`
+	Lost       int            `json:"lost"`
+	LossRate   float64        `json:"loss_rate"`
+	Duplicates int            `json:"duplicates"`
+	LossEvents []LossEvent    `json:"loss_events"`
+	Reorders   []ReorderEvent `json:"reorders"`
+
+	Jitter      time.Duration  `json:"jitter"`
+	MaxJitter   time.Duration  `json:"max_jitter"`
+	JitterGraph []JitterSample `json:"jitter_graph"`
+
+	Frames        int         `json:"frames"`
+	Keyframes     int         `json:"keyframes"`
+	FrameRate     float64     `json:"frame_rate"`
+	GOP           *GOPReport  `json:"gop,omitempty"`
+	LargestFrames []FrameInfo `json:"largest_frames"`
+}
+
+// LossEvent is a run of missing sequence numbers
+type LossEvent struct {
+	Sequence uint16        `json:"sequence"` // first missing sequence number
+	Count    int           `json:"count"`
+	At       time.Duration `json:"at"`
+
+	end int64 // last extended sequence number, while building the list
+}
+
+// ReorderEvent is a packet that arrived after a newer one
+type ReorderEvent struct {
+	Sequence uint16        `json:"sequence"`
+	Distance int           `json:"distance"` // how many sequence numbers late
+	At       time.Duration `json:"at"`
+}
+
+// JitterSample is one point of the jitter graph
+type JitterSample struct {
+	At     time.Duration `json:"at"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+// BitrateSample is the bitrate over one window starting at At
+type BitrateSample struct {
+	At  time.Duration `json:"at"`
+	Bps int           `json:"bps"`
+}
+
+// GOPReport describes the group-of-pictures structure
+type GOPReport struct {
+	Lengths []int   `json:"lengths"` // frames per GOP, split at IDR frames
+	Average float64 `json:"average"`
+	Pattern string  `json:"pattern"` // frame types of the first complete GOP
+}
+
+// FrameInfo describes one frame
+type FrameInfo struct {
+	Timestamp uint32        `json:"timestamp"`
+	At        time.Duration `json:"at"`
+	Type      string        `json:"type"`
+	Size      int           `json:"size"`
+	Packets   int           `json:"packets"`
+	NALTypes  []uint8       `json:"nal_types"`
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report in human-readable form
+func (r *Report) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "Capture: %d RTP packets, %d RTCP packets, %v\n", r.Packets, r.RTCPPackets, r.Duration.Round(time.Millisecond))
+
+	for _, s := range r.Streams {
+		fmt.Fprintf(b, "\nSSRC %d (0x%08X), PT=%d\n", s.SSRC, s.SSRC, s.PayloadType)
+		fmt.Fprintf(b, "  Packets:    %d (%d bytes) over %v\n", s.Packets, s.Bytes, s.Duration.Round(time.Millisecond))
+		fmt.Fprintf(b, "  Loss:       %d of %d (%.2f%%) in %d event(s), %d duplicate(s), %d reordered\n",
+			s.Lost, s.Expected, s.LossRate*100, len(s.LossEvents), s.Duplicates, len(s.Reorders))
+		for i, e := range s.LossEvents {
+			if i == maxListed {
+				fmt.Fprintf(b, "    ... %d more\n", len(s.LossEvents)-maxListed)
+				break
+			}
+			fmt.Fprintf(b, "    -> %v: %d packet(s) lost from Seq=%d\n", e.At.Round(time.Millisecond), e.Count, e.Sequence)
+		}
+		for i, e := range s.Reorders {
+			if i == maxListed {
+				fmt.Fprintf(b, "    ... %d more\n", len(s.Reorders)-maxListed)
+				break
+			}
+			fmt.Fprintf(b, "    -> %v: Seq=%d arrived %d late\n", e.At.Round(time.Millisecond), e.Sequence, e.Distance)
+		}
+		fmt.Fprintf(b, "  Jitter:     %.2f ms (max %.2f ms)\n", ms(s.Jitter), ms(s.MaxJitter))
+		fmt.Fprintf(b, "  Bitrate:    %d kbps average\n", s.AverageBitrate/1000)
+		for _, p := range s.Bitrate {
+			fmt.Fprintf(b, "    %6.1fs %7d kbps %s\n", p.At.Seconds(), p.Bps/1000, bar(p.Bps, s.Bitrate))
+		}
+
+		fmt.Fprintf(b, "  Frames:     %d (%d keyframes) at %.2f fps\n", s.Frames, s.Keyframes, s.FrameRate)
+		if s.GOP != nil && len(s.GOP.Lengths) > 0 {
+			fmt.Fprintf(b, "  GOP:        %.1f frames average, lengths %v\n", s.GOP.Average, s.GOP.Lengths)
+			if s.GOP.Pattern != "" {
+				fmt.Fprintf(b, "    -> %s\n", s.GOP.Pattern)
+			}
+		}
+		if len(s.LargestFrames) > 0 {
+			fmt.Fprintf(b, "  Largest frames:\n")
+			for _, f := range s.LargestFrames {
+				fmt.Fprintf(b, "    -> TS=%d at %v: %s, %d bytes in %d packet(s)\n",
+					f.Timestamp, f.At.Round(time.Millisecond), f.Type, f.Size, f.Packets)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// maxListed caps how many loss and reorder events the text report lists
+const maxListed = 10
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// bar draws a bitrate sample relative to the largest one
+func bar(bps int, samples []BitrateSample) string {
+	peak := 0
+	for _, s := range samples {
+		if s.Bps > peak {
+			peak = s.Bps
+		}
+	}
+	if peak == 0 {
+		return ""
+	}
+	return strings.Repeat("#", bps*40/peak)
+}
@@ -0,0 +1,388 @@
+// Package bwe implements a delay-based bandwidth estimator driven by
+// transport-wide congestion control feedback, modelled on the trendline
+// filter, overuse detector and AIMD rate controller of Google Congestion
+// Control (draft-ietf-rmcat-gcc-02). As in GCC, a loss-based controller caps
+// the estimate when a shallow bottleneck queue drops packets before delay
+// can build up.
+package bwe
+
+import (
+	"sync"
+	"time"
+
+	"rtp_demo/rtcp"
+)
+
+// Tuning constants from the GCC draft and its reference implementation
+const (
+	burstInterval    = 5 * time.Millisecond // packets sent closer than this form one group
+	trendlineWindow  = 20                   // delay samples in the regression
+	smoothingCoeff   = 0.9
+	thresholdGain    = 4.0
+	initialThreshold = 12.5 // ms
+	kUp              = 0.0087
+	kDown            = 0.039
+	overuseTime      = 10 * time.Millisecond
+	decreaseFactor   = 0.85
+	increasePerSec   = 0.08 // multiplicative increase per second
+	historyLimit     = 4096 // sent packets remembered for feedback matching
+	highLoss         = 0.10 // loss fraction above which the loss-based rate decreases
+	lowLoss          = 0.02 // loss fraction below which the loss-based rate increases
+)
+
+// bandwidthUsage is the overuse detector state
+type bandwidthUsage int
+
+const (
+	usageNormal bandwidthUsage = iota
+	usageOverusing
+	usageUnderusing
+)
+
+// sentPacket remembers when a packet left the sender
+type sentPacket struct {
+	sendTime time.Time
+	size     int
+}
+
+// packetGroup is a burst of packets sent within burstInterval
+type packetGroup struct {
+	firstSend   time.Time
+	lastSend    time.Time
+	lastArrival time.Duration
+	size        int
+}
+
+// Estimator estimates the available bandwidth from packet send times and
+// the arrival times reported in transport-cc feedback
+type Estimator struct {
+	mu sync.Mutex
+
+	sent map[uint16]sentPacket
+
+	// Inter-group delay variation
+	group     *packetGroup
+	prevGroup *packetGroup
+
+	// Trendline filter
+	firstArrival  time.Duration
+	accumDelay    float64
+	smoothedDelay float64
+	samples       [][2]float64 // arrival time (ms), smoothed delay (ms)
+	numDeltas     int
+
+	// Overuse detector
+	threshold      float64
+	lastUpdate     time.Time
+	overuseStart   time.Time
+	prevTrend      float64
+	usage          bandwidthUsage
+	lastRateChange time.Time
+
+	acked *RateWindow
+
+	delayBased, lossBased int
+	target, min, max      int
+
+	// OnTargetBitrate is called whenever the target bitrate changes
+	OnTargetBitrate func(bps int)
+}
+
+// NewEstimator creates an estimator starting at initial bits per second and
+// kept within [min, max]
+func NewEstimator(initial, min, max int) *Estimator {
+	return &Estimator{
+		sent:       make(map[uint16]sentPacket),
+		threshold:  initialThreshold,
+		acked:      NewRateWindow(500 * time.Millisecond),
+		delayBased: initial,
+		lossBased:  initial,
+		target:     initial,
+		min:        min,
+		max:        max,
+	}
+}
+
+// TargetBitrate returns the current estimate in bits per second
+func (e *Estimator) TargetBitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.target
+}
+
+// OnPacketSent records a packet carrying a transport-wide sequence number
+func (e *Estimator) OnPacketSent(seq uint16, size int, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sent[seq] = sentPacket{sendTime: at, size: size}
+	delete(e.sent, seq-historyLimit)
+}
+
+// OnFeedback processes a transport-cc report received at now
+func (e *Estimator) OnFeedback(fb *rtcp.TransportCC, now time.Time) {
+	e.mu.Lock()
+
+	arrivals := fb.ArrivalTimes()
+	lost := 0
+	for i := range fb.Packets {
+		seq := fb.BaseSequence + uint16(i)
+		arrival, received := arrivals[seq]
+		sent, known := e.sent[seq]
+		delete(e.sent, seq)
+		if !received {
+			lost++
+		}
+		if !received || !known {
+			continue
+		}
+
+		e.acked.Add(sent.size, now)
+		e.onPacketArrival(sent, arrival, now)
+	}
+
+	old := e.target
+	e.updateDelayBased(now)
+	if len(fb.Packets) > 0 {
+		e.updateLossBased(float64(lost) / float64(len(fb.Packets)))
+	}
+	e.updateTarget()
+	changed := e.target != old
+	target, callback := e.target, e.OnTargetBitrate
+	e.mu.Unlock()
+
+	if changed && callback != nil {
+		callback(target)
+	}
+}
+
+// onPacketArrival groups packets into bursts and feeds the delay variation
+// between consecutive groups to the trendline filter
+func (e *Estimator) onPacketArrival(p sentPacket, arrival time.Duration, now time.Time) {
+	g := e.group
+	if g != nil && p.sendTime.Sub(g.firstSend) <= burstInterval {
+		if p.sendTime.After(g.lastSend) {
+			g.lastSend = p.sendTime
+		}
+		if arrival > g.lastArrival {
+			g.lastArrival = arrival
+		}
+		g.size += p.size
+		return
+	}
+
+	// A new group starts; the previous one is complete
+	if g != nil && e.prevGroup != nil {
+		sendDelta := g.lastSend.Sub(e.prevGroup.lastSend)
+		arrivalDelta := g.lastArrival - e.prevGroup.lastArrival
+		e.updateTrendline(float64(arrivalDelta-sendDelta)/float64(time.Millisecond), g.lastArrival, now)
+	}
+
+	if g != nil {
+		e.prevGroup = g
+	}
+	e.group = &packetGroup{firstSend: p.sendTime, lastSend: p.sendTime, lastArrival: arrival, size: p.size}
+}
+
+// updateTrendline estimates the slope of the queuing delay and runs the
+// overuse detector on it
+func (e *Estimator) updateTrendline(delayMs float64, arrival time.Duration, now time.Time) {
+	if e.numDeltas == 0 {
+		e.firstArrival = arrival
+	}
+	e.numDeltas++
+
+	e.accumDelay += delayMs
+	e.smoothedDelay = smoothingCoeff*e.smoothedDelay + (1-smoothingCoeff)*e.accumDelay
+
+	x := float64(arrival-e.firstArrival) / float64(time.Millisecond)
+	e.samples = append(e.samples, [2]float64{x, e.smoothedDelay})
+	if len(e.samples) > trendlineWindow {
+		e.samples = e.samples[1:]
+	}
+	if len(e.samples) < trendlineWindow {
+		return
+	}
+
+	slope := linearFitSlope(e.samples)
+	deltas := e.numDeltas
+	if deltas > 60 {
+		deltas = 60
+	}
+	e.detect(slope*float64(deltas)*thresholdGain, now)
+}
+
+// linearFitSlope returns the least squares slope of y over x
+func linearFitSlope(points [][2]float64) float64 {
+	var sumX, sumY float64
+	for _, p := range points {
+		sumX += p[0]
+		sumY += p[1]
+	}
+	meanX, meanY := sumX/float64(len(points)), sumY/float64(len(points))
+
+	var num, den float64
+	for _, p := range points {
+		num += (p[0] - meanX) * (p[1] - meanY)
+		den += (p[0] - meanX) * (p[0] - meanX)
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// detect compares the trend against an adaptive threshold
+func (e *Estimator) detect(trend float64, now time.Time) {
+	switch {
+	case trend > e.threshold:
+		if e.overuseStart.IsZero() {
+			e.overuseStart = now
+		}
+		if now.Sub(e.overuseStart) >= overuseTime && trend >= e.prevTrend {
+			e.usage = usageOverusing
+		}
+	case trend < -e.threshold:
+		e.overuseStart = time.Time{}
+		e.usage = usageUnderusing
+	default:
+		e.overuseStart = time.Time{}
+		e.usage = usageNormal
+	}
+	e.prevTrend = trend
+
+	// Adapt the threshold so it tracks the trend unless it jumps far away
+	abs := trend
+	if abs < 0 {
+		abs = -abs
+	}
+	if !e.lastUpdate.IsZero() && abs < e.threshold+15 {
+		k := kDown
+		if abs > e.threshold {
+			k = kUp
+		}
+		dt := now.Sub(e.lastUpdate)
+		if dt > 100*time.Millisecond {
+			dt = 100 * time.Millisecond
+		}
+		e.threshold += k * (abs - e.threshold) * float64(dt/time.Millisecond)
+		if e.threshold < 6 {
+			e.threshold = 6
+		} else if e.threshold > 600 {
+			e.threshold = 600
+		}
+	}
+	e.lastUpdate = now
+}
+
+// updateDelayBased runs the AIMD controller on the overuse detector output
+func (e *Estimator) updateDelayBased(now time.Time) {
+	acked := e.acked.Rate(now)
+
+	if e.lastRateChange.IsZero() {
+		e.lastRateChange = now
+	}
+	elapsed := now.Sub(e.lastRateChange)
+
+	switch e.usage {
+	case usageOverusing:
+		// Back off below what the network delivered, at most once per burst
+		if acked > 0 && elapsed >= 200*time.Millisecond {
+			e.delayBased = int(decreaseFactor * float64(acked))
+			e.lastRateChange = now
+		}
+		e.usage = usageNormal
+	case usageUnderusing:
+		// Queues are draining; hold the rate until they are empty
+		e.lastRateChange = now
+	default:
+		if elapsed > time.Second {
+			elapsed = time.Second
+		}
+		increased := int(float64(e.delayBased) * (1 + increasePerSec*elapsed.Seconds()))
+		// Do not run away from what the network has shown it can carry
+		if acked > 0 && increased > acked*3/2 {
+			increased = acked * 3 / 2
+		}
+		if increased > e.delayBased {
+			e.delayBased = increased
+		}
+		e.lastRateChange = now
+	}
+
+	e.delayBased = e.clamp(e.delayBased)
+}
+
+// updateLossBased adjusts the loss-based rate from the loss fraction of the
+// latest report
+func (e *Estimator) updateLossBased(loss float64) {
+	switch {
+	case loss > highLoss:
+		e.lossBased = int(float64(e.lossBased) * (1 - 0.5*loss))
+	case loss < lowLoss:
+		e.lossBased = int(float64(e.lossBased) * 1.05)
+	}
+
+	// Never let the loss-based rate drift far above the delay-based one
+	if e.lossBased > 2*e.delayBased {
+		e.lossBased = 2 * e.delayBased
+	}
+	e.lossBased = e.clamp(e.lossBased)
+}
+
+// updateTarget combines both controllers into the target bitrate
+func (e *Estimator) updateTarget() {
+	e.target = e.delayBased
+	if e.lossBased < e.target {
+		e.target = e.lossBased
+	}
+}
+
+func (e *Estimator) clamp(rate int) int {
+	if rate < e.min {
+		return e.min
+	}
+	if e.max > 0 && rate > e.max {
+		return e.max
+	}
+	return rate
+}
+
+// RateWindow measures a bitrate over a sliding time window
+type RateWindow struct {
+	window  time.Duration
+	entries []rateEntry
+	bytes   int
+}
+
+type rateEntry struct {
+	at   time.Time
+	size int
+}
+
+// NewRateWindow creates a rate meter averaging over window
+func NewRateWindow(window time.Duration) *RateWindow {
+	return &RateWindow{window: window}
+}
+
+// Add records size bytes at the given time
+func (w *RateWindow) Add(size int, at time.Time) {
+	w.entries = append(w.entries, rateEntry{at: at, size: size})
+	w.bytes += size
+	w.expire(at)
+}
+
+// Rate returns the bitrate over the window ending at now
+func (w *RateWindow) Rate(now time.Time) int {
+	w.expire(now)
+	return int(int64(w.bytes) * 8 * int64(time.Second) / int64(w.window))
+}
+
+func (w *RateWindow) expire(now time.Time) {
+	n := 0
+	for n < len(w.entries) && now.Sub(w.entries[n].at) > w.window {
+		w.bytes -= w.entries[n].size
+		n++
+	}
+	w.entries = w.entries[n:]
+}
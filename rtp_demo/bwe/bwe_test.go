@@ -0,0 +1,99 @@
+package bwe
+
+import (
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+
+	"rtp_demo/netsim"
+	"rtp_demo/rtcp"
+)
+
+// simulate sends 1200-byte packets at rate bits/s through the impairer for
+// the given duration, feeding transport-cc reports back every 100ms
+func simulate(e *Estimator, cfg netsim.Config, rate int, duration time.Duration) {
+	im := netsim.NewImpairer(cfg)
+	rec := rtcp.NewTWCCRecorder()
+	start := time.Unix(0, 0)
+	interval := time.Duration(1200*8) * time.Second / time.Duration(rate)
+
+	var inFlight []netsim.Delivery
+	nextFeedback := start.Add(100 * time.Millisecond)
+	seq := uint16(0)
+
+	for now := start; now.Sub(start) < duration; now = now.Add(interval) {
+		sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].At.Before(inFlight[j].At) })
+		for len(inFlight) > 0 && !inFlight[0].At.After(now) {
+			d := inFlight[0]
+			rec.Record(binary.BigEndian.Uint16(d.Data), d.At.Sub(start))
+			inFlight = inFlight[1:]
+		}
+
+		if !now.Before(nextFeedback) {
+			if fb := rec.BuildFeedback(1, 2); fb != nil {
+				e.OnFeedback(fb, now)
+			}
+			nextFeedback = nextFeedback.Add(100 * time.Millisecond)
+		}
+
+		packet := make([]byte, 1200)
+		binary.BigEndian.PutUint16(packet, seq)
+		e.OnPacketSent(seq, len(packet), now)
+		inFlight = append(inFlight, im.Process(packet, now)...)
+		seq++
+	}
+}
+
+func TestEstimatorBacksOffOnQueuing(t *testing.T) {
+	e := NewEstimator(2000000, 100000, 5000000)
+
+	var changes int
+	e.OnTargetBitrate = func(bps int) { changes++ }
+
+	// 2 Mbit/s into a 1 Mbit/s bottleneck builds a growing queue
+	simulate(e, netsim.Config{Bandwidth: 1000000, Delay: 20 * time.Millisecond}, 2000000, 5*time.Second)
+
+	if target := e.TargetBitrate(); target > 1200000 {
+		t.Errorf("Expected estimate near the 1 Mbit/s bottleneck, got %d", target)
+	}
+	if changes == 0 {
+		t.Error("Expected the target bitrate callback to fire")
+	}
+}
+
+func TestEstimatorRampsUpWithoutCongestion(t *testing.T) {
+	e := NewEstimator(300000, 100000, 5000000)
+
+	simulate(e, netsim.Config{Delay: 20 * time.Millisecond, Jitter: time.Millisecond, Seed: 1}, 1000000, 5*time.Second)
+
+	if target := e.TargetBitrate(); target <= 300000 {
+		t.Errorf("Expected estimate to grow from 300 kbit/s, got %d", target)
+	}
+}
+
+func TestEstimatorBacksOffOnLoss(t *testing.T) {
+	e := NewEstimator(1000000, 100000, 5000000)
+
+	// Heavy random loss without any queuing delay
+	simulate(e, netsim.Config{Loss: 0.3, Delay: 20 * time.Millisecond, Seed: 5}, 1000000, 2*time.Second)
+
+	if target := e.TargetBitrate(); target >= 500000 {
+		t.Errorf("Expected loss to cut the estimate, got %d", target)
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	w := NewRateWindow(time.Second)
+	start := time.Unix(0, 0)
+
+	for i := 0; i < 10; i++ {
+		w.Add(1000, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	if rate := w.Rate(start.Add(900 * time.Millisecond)); rate != 80000 {
+		t.Errorf("Expected 80000 bit/s, got %d", rate)
+	}
+	if rate := w.Rate(start.Add(3 * time.Second)); rate != 0 {
+		t.Errorf("Expected 0 bit/s after the window, got %d", rate)
+	}
+}
@@ -0,0 +1,157 @@
+package captions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// parity sets the odd parity bit of a CEA-608 byte
+func parity(b byte) byte {
+	ones := 0
+	for x := b; x != 0; x >>= 1 {
+		ones += int(x & 1)
+	}
+	if ones%2 == 0 {
+		return b | 0x80
+	}
+	return b
+}
+
+// pair is a byte pair pushed at a time
+type pair struct {
+	t      time.Duration
+	b1, b2 byte
+}
+
+// text returns the pairs of a string, padded with a zero byte
+func text(t time.Duration, s string) []pair {
+	var pairs []pair
+	for i := 0; i < len(s); i += 2 {
+		p := pair{t: t, b1: s[i]}
+		if i+1 < len(s) {
+			p.b2 = s[i+1]
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+// control returns a control code sent twice, as encoders do
+func control(t time.Duration, b1, b2 byte) []pair {
+	return []pair{{t, b1, b2}, {t, b1, b2}}
+}
+
+func push(d *Decoder, sequences ...[]pair) {
+	for _, pairs := range sequences {
+		for _, p := range pairs {
+			d.Push(p.t, parity(p.b1), parity(p.b2))
+		}
+	}
+}
+
+func TestPopOn(t *testing.T) {
+	var cues []Cue
+	d := NewDecoder(func(c Cue) { cues = append(cues, c) })
+	push(d,
+		control(0, 0x14, 0x20), // resume caption loading
+		control(0, 0x14, 0x50), // row 14
+		text(0, "HELLO"),
+		control(0, 0x14, 0x70), // row 15
+		text(0, "WORLD"),
+		control(time.Second, 0x14, 0x2F), // end of caption
+		control(time.Second, 0x14, 0x20),
+		control(time.Second, 0x14, 0x2E), // erase non-displayed memory
+		text(time.Second, "CAF"),
+		control(time.Second, 0x12, 0x21),  // É replacing the E before it
+		[]pair{{time.Second, 0x11, 0x37}}, // ♪
+		control(2*time.Second, 0x14, 0x2F),
+		control(3*time.Second, 0x14, 0x2C), // erase displayed memory
+	)
+	d.Close(4 * time.Second)
+
+	want := []Cue{
+		{Start: time.Second, End: 2 * time.Second, Text: "HELLO\nWORLD"},
+		{Start: 2 * time.Second, End: 3 * time.Second, Text: "CAÉ♪"},
+	}
+	if len(cues) != len(want) {
+		t.Fatalf("Expected %d cues, got %+v", len(want), cues)
+	}
+	for i := range want {
+		if cues[i] != want[i] {
+			t.Errorf("Cue %d: expected %+v, got %+v", i, want[i], cues[i])
+		}
+	}
+}
+
+func TestRollUp(t *testing.T) {
+	var cues []Cue
+	d := NewDecoder(func(c Cue) { cues = append(cues, c) })
+	push(d,
+		control(0, 0x14, 0x25), // roll-up, 2 rows
+		text(0, "ONE"),
+		control(time.Second, 0x14, 0x2D), // carriage return
+		text(time.Second, "TWO"),
+		control(2*time.Second, 0x14, 0x2D),
+		text(2*time.Second, "THREE"),
+		control(3*time.Second, 0x14, 0x2D),
+		control(0, 0x1C, 0x2D), // channel 2 is ignored
+		text(3*time.Second, "OTHER"),
+	)
+	d.Close(4 * time.Second)
+
+	want := []string{"ONE", "ONE\nTWO", "TWO\nTHREE", "THREE"}
+	if len(cues) != len(want) {
+		t.Fatalf("Expected %d cues, got %+v", len(want), cues)
+	}
+	for i, text := range want {
+		if cues[i].Text != text || cues[i].Start != time.Duration(i)*time.Second {
+			t.Errorf("Cue %d: expected %q at %ds, got %+v", i, text, i, cues[i])
+		}
+	}
+}
+
+func TestSRTWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSRTWriter(&buf)
+	for _, p := range [][]pair{
+		control(0, 0x14, 0x20),
+		text(0, "HI"),
+		control(1500*time.Millisecond, 0x14, 0x2F),
+	} {
+		for _, p := range p {
+			w.Push(p.t, parity(p.b1), parity(p.b2))
+		}
+	}
+	if err := w.Close(3723004 * time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := "1\n00:00:01,500 --> 01:02:03,004\nHI\n\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestSCCWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSCCWriter(&buf)
+	frame := time.Second / 30
+	w.Push(0, 0x94, 0x20)
+	w.Push(frame, 0x94, 0x20)
+	w.Push(2*frame, 0x80, 0x80) // padding ends the line
+	w.Push(3661*time.Second+5*frame, 0xC8, 0x49)
+	if err := w.Close(0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := "Scenarist_SCC V1.0\n\n00:00:00:00\t9420 9420\n\n01:01:01:05\tc849\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestCharacterTables(t *testing.T) {
+	if len(specialChars) != 16 || len(extendedChars[0]) != 32 || len(extendedChars[1]) != 32 {
+		t.Errorf("Expected 16 special and 2x32 extended characters, got %d, %d and %d",
+			len(specialChars), len(extendedChars[0]), len(extendedChars[1]))
+	}
+}
@@ -0,0 +1,288 @@
+// Package captions decodes CEA-608 closed captions, as carried in H.264 SEI
+// messages, and writes them as SRT subtitles or as Scenarist SCC files.
+// Only the CC1 channel is turned into text; SCC keeps the raw field 1 data,
+// so the other channel of field 1 survives in it.
+package captions
+
+import (
+	"strings"
+	"time"
+)
+
+// Cue is a caption shown from Start to End
+type Cue struct {
+	Start, End time.Duration
+	Text       string
+}
+
+// Caption modes (CEA-608 B.5)
+const (
+	popOn = iota
+	rollUp
+	paintOn
+)
+
+const (
+	rows    = 15
+	columns = 32
+)
+
+// screen is the characters of one caption memory, zero where empty
+type screen [rows][columns]rune
+
+// text returns the non-empty rows, trimmed, one per line
+func (sc *screen) text() string {
+	var lines []string
+	for _, row := range sc {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row[:])))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Decoder turns the field 1 byte pairs of CC1 into cues. Pairs must be
+// pushed in presentation order.
+type Decoder struct {
+	emit func(Cue)
+
+	mode              int
+	rollRows          int // rows shown in roll-up mode
+	displayed, hidden screen
+	row, col          int
+	shown             time.Duration // when the displayed memory last changed
+	channel           int           // of the latest control code, 1 or 2
+	lastControl       [2]byte       // control codes are usually sent twice
+}
+
+// NewDecoder creates a decoder calling emit for each cue as it ends
+func NewDecoder(emit func(Cue)) *Decoder {
+	return &Decoder{emit: emit, row: rows - 1, channel: 1}
+}
+
+// Push decodes one byte pair, with its parity bits, received at media time t
+func (d *Decoder) Push(t time.Duration, b1, b2 byte) {
+	b1, b2 = b1&0x7F, b2&0x7F
+	if b1 == 0 && b2 == 0 {
+		d.lastControl = [2]byte{}
+		return // padding
+	}
+
+	if b1 >= 0x10 && b1 <= 0x1F {
+		// A repeated control code is ignored once
+		if d.lastControl == [2]byte{b1, b2} {
+			d.lastControl = [2]byte{}
+			return
+		}
+		d.lastControl = [2]byte{b1, b2}
+		d.channel = 1
+		if b1 >= 0x18 {
+			d.channel = 2
+			b1 -= 8
+		}
+		if d.channel == 1 {
+			d.control(t, b1, b2)
+		}
+		return
+	}
+	d.lastControl = [2]byte{}
+
+	if d.channel != 1 || b1 < 0x20 {
+		return
+	}
+	d.put(basicChar(b1))
+	if b2 >= 0x20 {
+		d.put(basicChar(b2))
+	}
+}
+
+// Close ends the cue on screen at media time t
+func (d *Decoder) Close(t time.Duration) {
+	d.flush(t)
+}
+
+// control handles a channel 1 control code
+func (d *Decoder) control(t time.Duration, b1, b2 byte) {
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2F:
+		d.command(t, b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23: // tab offsets
+		d.col = min(d.col+int(b2-0x20), columns-1)
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2F: // mid-row code
+		d.put(' ')
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3F:
+		d.put(specialChars[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3F:
+		// Extended characters replace the basic one sent before them for
+		// decoders without them
+		if d.col > 0 {
+			d.col--
+		}
+		d.put(extendedChars[b1-0x12][b2-0x20])
+	case b2 >= 0x40:
+		d.preamble(b1, b2)
+	}
+}
+
+// command handles a miscellaneous control code
+func (d *Decoder) command(t time.Duration, code byte) {
+	switch code {
+	case 0x20: // resume caption loading
+		d.setMode(t, popOn)
+	case 0x25, 0x26, 0x27: // roll-up captions, 2 to 4 rows
+		d.setMode(t, rollUp)
+		d.rollRows = int(code-0x25) + 2
+	case 0x29: // resume direct captioning
+		d.setMode(t, paintOn)
+	case 0x21: // backspace
+		if d.col > 0 {
+			d.col--
+			d.memory()[d.row][d.col] = 0
+		}
+	case 0x24: // delete to end of row
+		for c := d.col; c < columns; c++ {
+			d.memory()[d.row][c] = 0
+		}
+	case 0x2C: // erase displayed memory
+		d.flush(t)
+		d.displayed = screen{}
+		d.shown = t
+	case 0x2D: // carriage return
+		if d.mode == rollUp {
+			d.flush(t)
+			d.roll()
+			d.shown = t
+		} else if d.row < rows-1 {
+			d.row++
+		}
+		d.col = 0
+	case 0x2E: // erase non-displayed memory
+		d.hidden = screen{}
+	case 0x2F: // end of caption, showing the loaded one
+		d.flush(t)
+		d.displayed, d.hidden = d.hidden, d.displayed
+		d.shown = t
+		d.mode = popOn
+	}
+}
+
+// setMode switches the caption mode. Leaving pop-on for roll-up or paint-on
+// clears the screen.
+func (d *Decoder) setMode(t time.Duration, mode int) {
+	if mode == d.mode {
+		return
+	}
+	if d.mode == popOn || mode == popOn {
+		d.flush(t)
+		if mode != popOn {
+			d.displayed = screen{}
+		}
+		d.shown = t
+	}
+	d.mode = mode
+	if mode == rollUp {
+		d.row, d.col = rows-1, 0
+	}
+}
+
+// preamble handles a preamble address code, which moves the cursor
+func (d *Decoder) preamble(b1, b2 byte) {
+	// Rows 1 to 15 by first byte, the second byte choosing between two
+	baseRows := map[byte]int{0x11: 1, 0x12: 3, 0x15: 5, 0x16: 7, 0x17: 9, 0x10: 11, 0x13: 12, 0x14: 14}
+	row, ok := baseRows[b1]
+	if !ok {
+		return
+	}
+	if b1 != 0x10 && b2&0x20 != 0 {
+		row++
+	}
+	if d.mode != rollUp {
+		d.row = row - 1
+	}
+	d.col = 0
+	if b2&0x10 != 0 {
+		d.col = int(b2&0x0E) * 2 // indent of 4 columns per step
+	}
+}
+
+// memory returns the memory characters go to in the current mode
+func (d *Decoder) memory() *screen {
+	if d.mode == popOn {
+		return &d.hidden
+	}
+	return &d.displayed
+}
+
+// put writes a character at the cursor
+func (d *Decoder) put(r rune) {
+	d.memory()[d.row][d.col] = r
+	if d.col < columns-1 {
+		d.col++
+	}
+}
+
+// roll moves the roll-up rows up by one, keeping rollRows of them
+func (d *Decoder) roll() {
+	sc := &d.displayed
+	for r := 0; r < rows; r++ {
+		switch {
+		case r < d.row-d.rollRows+1:
+			sc[r] = [columns]rune{}
+		case r < d.row:
+			sc[r] = sc[r+1]
+		}
+	}
+	sc[d.row] = [columns]rune{}
+}
+
+// flush emits the displayed caption as a cue ending at t
+func (d *Decoder) flush(t time.Duration) {
+	if text := d.displayed.text(); text != "" && t > d.shown {
+		d.emit(Cue{Start: d.shown, End: t, Text: text})
+	}
+	d.shown = t
+}
+
+// basicChar maps a standard character code to Unicode; CEA-608 replaces a
+// few ASCII characters with accented letters
+func basicChar(b byte) rune {
+	switch b {
+	case 0x2A:
+		return 'á'
+	case 0x5C:
+		return 'é'
+	case 0x5E:
+		return 'í'
+	case 0x5F:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7B:
+		return 'ç'
+	case 0x7C:
+		return '÷'
+	case 0x7D:
+		return 'Ñ'
+	case 0x7E:
+		return 'ñ'
+	case 0x7F:
+		return '█'
+	}
+	return rune(b)
+}
+
+// specialChars are the characters of codes 11 30 to 11 3F
+var specialChars = []rune("®°½¿™¢£♪à èâêîôû")
+
+// extendedChars are the Spanish, French, Portuguese and German characters
+// of codes 12 20 to 13 3F
+var extendedChars = [2][]rune{
+	[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"),
+}
@@ -0,0 +1,119 @@
+package captions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Writer is a caption file being written. Push takes the field 1 byte
+// pairs in presentation order.
+type Writer interface {
+	Push(t time.Duration, b1, b2 byte) error
+	Close(t time.Duration) error
+}
+
+// SRTWriter writes the CC1 captions as SubRip subtitles
+type SRTWriter struct {
+	w       *bufio.Writer
+	decoder *Decoder
+	n       int
+	err     error
+}
+
+// NewSRTWriter creates an SRT writer
+func NewSRTWriter(w io.Writer) *SRTWriter {
+	s := &SRTWriter{w: bufio.NewWriter(w)}
+	s.decoder = NewDecoder(s.write)
+	return s
+}
+
+// write writes one cue. Cues are flushed as they end, so the file is
+// complete up to the last one if the writer is never closed.
+func (s *SRTWriter) write(cue Cue) {
+	if s.err != nil {
+		return
+	}
+	s.n++
+	fmt.Fprintf(s.w, "%d\n%s --> %s\n%s\n\n", s.n, srtTime(cue.Start), srtTime(cue.End), cue.Text)
+	s.err = s.w.Flush()
+}
+
+// Push decodes a byte pair received at media time t
+func (s *SRTWriter) Push(t time.Duration, b1, b2 byte) error {
+	s.decoder.Push(t, b1, b2)
+	return s.err
+}
+
+// Close writes the caption still on screen, ending at t
+func (s *SRTWriter) Close(t time.Duration) error {
+	s.decoder.Close(t)
+	return s.err
+}
+
+// srtTime formats a time as HH:MM:SS,mmm
+func srtTime(t time.Duration) string {
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// SCCWriter writes the raw field 1 data as a Scenarist SCC file, one line
+// per run of consecutive non-padding pairs. Timecodes count frames at 30 per
+// second, non-drop frame.
+type SCCWriter struct {
+	w    *bufio.Writer
+	next int64 // frame of the next pair on the current line, -1 for none
+	err  error
+}
+
+// sccFrameRate is the frame rate of SCC timecodes
+const sccFrameRate = 30
+
+// NewSCCWriter creates an SCC writer and writes the header
+func NewSCCWriter(w io.Writer) *SCCWriter {
+	s := &SCCWriter{w: bufio.NewWriter(w), next: -1}
+	_, s.err = s.w.WriteString("Scenarist_SCC V1.0")
+	return s
+}
+
+// Push adds a byte pair received at media time t. A pair goes on the
+// current line unless it is padding or later than the line reaches.
+func (s *SCCWriter) Push(t time.Duration, b1, b2 byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if b1&0x7F == 0 && b2&0x7F == 0 {
+		s.next = -1
+		return nil
+	}
+
+	frame := (int64(t)*sccFrameRate + int64(time.Second)/2) / int64(time.Second)
+	if s.next < 0 || frame > s.next {
+		if err := s.w.Flush(); err != nil {
+			s.err = err
+			return err
+		}
+		fmt.Fprintf(s.w, "\n\n%s\t%02x%02x", sccTimecode(frame), b1, b2)
+		s.next = frame + 1
+	} else {
+		fmt.Fprintf(s.w, " %02x%02x", b1, b2)
+		s.next++
+	}
+	return nil
+}
+
+// Close ends the last line
+func (s *SCCWriter) Close(t time.Duration) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.w.WriteString("\n")
+	return s.w.Flush()
+}
+
+// sccTimecode formats a frame count as HH:MM:SS:FF
+func sccTimecode(frame int64) string {
+	seconds := frame / sccFrameRate
+	return fmt.Sprintf("%02d:%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60, frame%sccFrameRate)
+}
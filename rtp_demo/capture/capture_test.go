@@ -0,0 +1,184 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rtpPacket builds a minimal RTP packet
+func rtpPacket(seq uint16, ssrc uint32) []byte {
+	p := make([]byte, 16)
+	p[0] = 0x80
+	p[1] = 96
+	binary.BigEndian.PutUint16(p[2:4], seq)
+	binary.BigEndian.PutUint32(p[8:12], ssrc)
+	return p
+}
+
+func readAll(t *testing.T, name string) []*Packet {
+	t.Helper()
+
+	r, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	var packets []*Packet
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		packets = append(packets, p)
+	}
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	start := time.Unix(1700000000, 123456789)
+	want := []*Packet{
+		{Time: start, Src: netip.MustParseAddrPort("10.0.0.1:4000"), Dst: netip.MustParseAddrPort("10.0.0.2:5004"), Data: rtpPacket(1, 7)},
+		{Time: start.Add(20 * time.Millisecond), Src: netip.MustParseAddrPort("[2001:db8::1]:4000"), Dst: netip.MustParseAddrPort("[2001:db8::2]:5004"), Data: rtpPacket(2, 7)},
+	}
+
+	name := filepath.Join(t.TempDir(), "test.pcap")
+	w, err := Create(name, netip.MustParseAddrPort("10.0.0.2:5004"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for _, p := range want {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	w.Close()
+
+	got := readAll(t, name)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d packets, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Src != want[i].Src || got[i].Dst != want[i].Dst || !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("Packet %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestRTPDumpRoundTrip(t *testing.T) {
+	local := netip.MustParseAddrPort("127.0.0.1:5004")
+	name := filepath.Join(t.TempDir(), "test.rtpdump")
+
+	w, err := Create(name, local)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	start := time.Now()
+	w.WritePacket(&Packet{Time: start.Add(100 * time.Millisecond), Dst: local, Data: rtpPacket(1, 9)})
+	w.WritePacket(&Packet{Time: start.Add(150 * time.Millisecond), Dst: local, Data: rtpPacket(2, 9)})
+	w.Close()
+
+	got := readAll(t, name)
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(got))
+	}
+	if got[0].Dst != local || !bytes.Equal(got[1].Data, rtpPacket(2, 9)) {
+		t.Errorf("Unexpected packets %+v", got)
+	}
+	if gap := got[1].Time.Sub(got[0].Time); gap < 49*time.Millisecond || gap > 51*time.Millisecond {
+		t.Errorf("Expected 50ms between packets, got %v", gap)
+	}
+}
+
+// pcapngBlock builds a little-endian pcapng block
+func pcapngBlock(typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	buf := binary.LittleEndian.AppendUint32(nil, typ)
+	buf = binary.LittleEndian.AppendUint32(buf, length)
+	buf = append(buf, body...)
+	return binary.LittleEndian.AppendUint32(buf, length)
+}
+
+func TestPcapngEthernet(t *testing.T) {
+	p := &Packet{Src: netip.MustParseAddrPort("192.168.1.10:6000"), Dst: netip.MustParseAddrPort("192.168.1.20:5004"), Data: rtpPacket(5, 3)}
+	ip := encodeIPUDP(p)
+
+	// Ethernet with a VLAN tag
+	frame := make([]byte, 12)
+	frame = append(frame, 0x81, 0x00, 0x00, 0x01, 0x08, 0x00)
+	frame = append(frame, ip...)
+
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = append(shb, 1, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+
+	// Interface with if_tsresol = 10^-9
+	idb := []byte{linkTypeEthernet, 0, 0, 0, 0, 0, 0, 0, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0}
+
+	ts := uint64(1700000000) * 1000000000
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = append(epb, frame...)
+
+	var file []byte
+	file = append(file, pcapngBlock(blockSectionHeader, shb)...)
+	file = append(file, pcapngBlock(blockInterface, idb)...)
+	file = append(file, pcapngBlock(5, []byte{0, 0, 0, 0})...) // statistics block, skipped
+	file = append(file, pcapngBlock(blockEnhancedPacket, epb)...)
+
+	name := filepath.Join(t.TempDir(), "test.pcapng")
+	if err := os.WriteFile(name, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAll(t, name)
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 packet, got %d", len(got))
+	}
+	if got[0].Src != p.Src || got[0].Dst != p.Dst || !bytes.Equal(got[0].Data, p.Data) || got[0].Time.Unix() != 1700000000 {
+		t.Errorf("Unexpected packet %+v", got[0])
+	}
+}
+
+func TestFilter(t *testing.T) {
+	p := &Packet{Src: netip.MustParseAddrPort("10.0.0.1:4000"), Dst: netip.MustParseAddrPort("10.0.0.2:5004"), Data: rtpPacket(1, 42)}
+
+	cases := []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{}, true},
+		{Filter{Port: 5004}, true},
+		{Filter{Port: 4000}, true},
+		{Filter{Port: 6000}, false},
+		{Filter{SSRC: 42}, true},
+		{Filter{Port: 5004, SSRC: 43}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(p); got != c.match {
+			t.Errorf("Filter %+v: expected %v, got %v", c.filter, c.match, got)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.bin")
+	os.WriteFile(name, []byte("not a capture"), 0o644)
+
+	if _, err := Open(name); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
@@ -0,0 +1,499 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// Link-layer header types (https://www.tcpdump.org/linktypes.html)
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+// Some platforms use these values for raw IP in file headers
+const (
+	linkTypeRawBSD     = 12
+	linkTypeRawOpenBSD = 14
+)
+
+func isPcapMagic(magic []byte) bool {
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xA1B2C3D4, 0xD4C3B2A1, 0xA1B23C4D, 0x4D3CB2A1:
+		return true
+	}
+	return false
+}
+
+// pcapReader reads classic libpcap files
+type pcapReader struct {
+	r        *bufio.Reader
+	file     *os.File
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+}
+
+func newPcapReader(br *bufio.Reader, file *os.File) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	r := &pcapReader{r: br, file: file}
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case 0xA1B2C3D4:
+		r.order = binary.LittleEndian
+	case 0xA1B23C4D:
+		r.order, r.nano = binary.LittleEndian, true
+	case 0xD4C3B2A1:
+		r.order = binary.BigEndian
+	case 0x4D3CB2A1:
+		r.order, r.nano = binary.BigEndian, true
+	}
+	r.linkType = r.order.Uint32(hdr[20:24]) & 0x0FFFFFFF
+
+	return r, nil
+}
+
+// ReadPacket reads the next UDP datagram from the file
+func (r *pcapReader) ReadPacket() (*Packet, error) {
+	for {
+		var hdr [16]byte
+		if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errTruncated
+			}
+			return nil, err
+		}
+
+		sec := int64(r.order.Uint32(hdr[0:4]))
+		frac := int64(r.order.Uint32(hdr[4:8]))
+		capLen := r.order.Uint32(hdr[8:12])
+		if capLen > 1<<20 {
+			return nil, fmt.Errorf("capture: record of %d bytes is too large", capLen)
+		}
+
+		frame := make([]byte, capLen)
+		if _, err := io.ReadFull(r.r, frame); err != nil {
+			return nil, errTruncated
+		}
+
+		if !r.nano {
+			frac *= 1000
+		}
+		if p := decodeFrame(r.linkType, frame, time.Unix(sec, frac)); p != nil {
+			return p, nil
+		}
+	}
+}
+
+// Close closes the file
+func (r *pcapReader) Close() error {
+	return r.file.Close()
+}
+
+// pcapng block types
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 0x00000001
+	blockPacketObsolete  = 0x00000002
+	blockSimplePacket    = 0x00000003
+	blockEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+)
+
+// pcapngInterface describes one capture interface of a pcapng section
+type pcapngInterface struct {
+	linkType uint16
+	tsUnit   time.Duration // duration of one timestamp tick
+	tsPerSec int64         // ticks per second when tsUnit is below a nanosecond
+}
+
+// pcapngReader reads pcapng files
+type pcapngReader struct {
+	r          *bufio.Reader
+	file       *os.File
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+func newPcapngReader(br *bufio.Reader, file *os.File) (*pcapngReader, error) {
+	return &pcapngReader{r: br, file: file, order: binary.LittleEndian}, nil
+}
+
+// ReadPacket reads the next UDP datagram from the file
+func (r *pcapngReader) ReadPacket() (*Packet, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errTruncated
+			}
+			return nil, err
+		}
+
+		blockType := r.order.Uint32(hdr[0:4])
+		if blockType == blockSectionHeader {
+			// Each section may switch byte order; detect it from the body
+			var bom [4]byte
+			if _, err := io.ReadFull(r.r, bom[:]); err != nil {
+				return nil, errTruncated
+			}
+			if binary.LittleEndian.Uint32(bom[:]) == pcapngByteOrderMagic {
+				r.order = binary.LittleEndian
+			} else {
+				r.order = binary.BigEndian
+			}
+			r.interfaces = nil
+
+			length := r.order.Uint32(hdr[4:8])
+			if length < 16 {
+				return nil, fmt.Errorf("capture: invalid pcapng section header length %d", length)
+			}
+			if _, err := r.r.Discard(int(length) - 12); err != nil {
+				return nil, errTruncated
+			}
+			continue
+		}
+
+		length := r.order.Uint32(hdr[4:8])
+		if length < 12 || length > 1<<20 {
+			return nil, fmt.Errorf("capture: invalid pcapng block length %d", length)
+		}
+
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return nil, errTruncated
+		}
+		body = body[:len(body)-4] // trailing block length
+
+		if p := r.parseBlock(blockType, body); p != nil {
+			return p, nil
+		}
+	}
+}
+
+// parseBlock handles interface and packet blocks, returning a packet if the
+// block held a UDP datagram
+func (r *pcapngReader) parseBlock(blockType uint32, body []byte) *Packet {
+	switch blockType {
+	case blockInterface:
+		if len(body) < 8 {
+			return nil
+		}
+		iface := pcapngInterface{linkType: r.order.Uint16(body[0:2]), tsUnit: time.Microsecond}
+		r.parseInterfaceOptions(&iface, body[8:])
+		r.interfaces = append(r.interfaces, iface)
+
+	case blockEnhancedPacket:
+		if len(body) < 20 {
+			return nil
+		}
+		id := r.order.Uint32(body[0:4])
+		ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+		capLen := r.order.Uint32(body[12:16])
+		if int(id) >= len(r.interfaces) || int(capLen) > len(body)-20 {
+			return nil
+		}
+		iface := r.interfaces[id]
+		return decodeFrame(uint32(iface.linkType), body[20:20+capLen], iface.time(ts))
+
+	case blockPacketObsolete:
+		if len(body) < 20 {
+			return nil
+		}
+		id := r.order.Uint16(body[0:2])
+		ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+		capLen := r.order.Uint32(body[12:16])
+		if int(id) >= len(r.interfaces) || int(capLen) > len(body)-20 {
+			return nil
+		}
+		iface := r.interfaces[id]
+		return decodeFrame(uint32(iface.linkType), body[20:20+capLen], iface.time(ts))
+
+	case blockSimplePacket:
+		// No timestamp; always belongs to the first interface
+		if len(body) < 4 || len(r.interfaces) == 0 {
+			return nil
+		}
+		return decodeFrame(uint32(r.interfaces[0].linkType), body[4:], time.Time{})
+	}
+
+	return nil
+}
+
+// parseInterfaceOptions reads the if_tsresol option
+func (r *pcapngReader) parseInterfaceOptions(iface *pcapngInterface, opts []byte) {
+	for len(opts) >= 4 {
+		code := r.order.Uint16(opts[0:2])
+		length := int(r.order.Uint16(opts[2:4]))
+		if code == 0 || 4+length > len(opts) {
+			return
+		}
+
+		if code == 9 && length >= 1 { // if_tsresol
+			res := opts[4]
+			if res&0x80 == 0 {
+				// Power of ten: 10^-res seconds per tick
+				iface.tsUnit = 0
+				iface.tsPerSec = 1
+				for i := byte(0); i < res; i++ {
+					iface.tsPerSec *= 10
+				}
+			} else {
+				iface.tsUnit = 0
+				iface.tsPerSec = int64(1) << (res & 0x7F)
+			}
+			switch {
+			case iface.tsPerSec <= 0: // overflowed, fall back to the default
+				iface.tsUnit = time.Microsecond
+			case iface.tsPerSec <= int64(time.Second) && int64(time.Second)%iface.tsPerSec == 0:
+				iface.tsUnit = time.Second / time.Duration(iface.tsPerSec)
+			}
+		}
+
+		opts = opts[4+(length+3)&^3:]
+	}
+}
+
+// time converts a raw timestamp to wall clock time
+func (iface pcapngInterface) time(ts uint64) time.Time {
+	if iface.tsUnit > 0 {
+		return time.Unix(0, 0).Add(time.Duration(ts) * iface.tsUnit)
+	}
+	sec := int64(ts) / iface.tsPerSec
+	frac := int64(ts) % iface.tsPerSec
+	return time.Unix(sec, frac*int64(time.Second)/iface.tsPerSec)
+}
+
+// Close closes the file
+func (r *pcapngReader) Close() error {
+	return r.file.Close()
+}
+
+// decodeFrame extracts a UDP datagram from a link-layer frame
+func decodeFrame(linkType uint32, frame []byte, ts time.Time) *Packet {
+	var ip []byte
+
+	switch linkType {
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil
+		}
+		ip = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		offset := 14
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(frame) >= offset+4 {
+			etherType = binary.BigEndian.Uint16(frame[offset+2 : offset+4])
+			offset += 4
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil
+		}
+		ip = frame[offset:]
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		ip = frame[16:]
+	case linkTypeSLL2:
+		if len(frame) < 20 {
+			return nil
+		}
+		ip = frame[20:]
+	case linkTypeRaw, linkTypeRawBSD, linkTypeRawOpenBSD, linkTypeIPv4, linkTypeIPv6:
+		ip = frame
+	default:
+		return nil
+	}
+
+	return decodeIP(ip, ts)
+}
+
+// decodeIP extracts a UDP datagram from an unfragmented IPv4 or IPv6 packet
+func decodeIP(ip []byte, ts time.Time) *Packet {
+	if len(ip) < 1 {
+		return nil
+	}
+
+	var src, dst netip.Addr
+	var udp []byte
+
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return nil
+		}
+		ihl := int(ip[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		flagsFrag := binary.BigEndian.Uint16(ip[6:8])
+		if ip[9] != 17 || ihl < 20 || total < ihl || total > len(ip) || flagsFrag&0x3FFF != 0 {
+			return nil // not UDP, malformed or fragmented
+		}
+		src, _ = netip.AddrFromSlice(ip[12:16])
+		dst, _ = netip.AddrFromSlice(ip[16:20])
+		udp = ip[ihl:total]
+
+	case 6:
+		if len(ip) < 40 {
+			return nil
+		}
+		src, _ = netip.AddrFromSlice(ip[8:24])
+		dst, _ = netip.AddrFromSlice(ip[24:40])
+
+		next, offset := ip[6], 40
+		for next == 0 || next == 43 || next == 60 { // hop-by-hop, routing, destination options
+			if len(ip) < offset+8 {
+				return nil
+			}
+			next = ip[offset]
+			offset += (int(ip[offset+1]) + 1) * 8
+		}
+		end := 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		if next != 17 || end > len(ip) || offset > end {
+			return nil
+		}
+		udp = ip[offset:end]
+
+	default:
+		return nil
+	}
+
+	if len(udp) < 8 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return nil
+	}
+
+	return &Packet{
+		Time: ts,
+		Src:  netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp[0:2])),
+		Dst:  netip.AddrPortFrom(dst, binary.BigEndian.Uint16(udp[2:4])),
+		Data: udp[8:length],
+	}
+}
+
+// pcapWriter writes classic pcap files with raw IP frames
+type pcapWriter struct {
+	file *os.File
+}
+
+func newPcapWriter(file *os.File) (*pcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xA1B23C4D) // nanosecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+
+	if _, err := file.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{file: file}, nil
+}
+
+// WritePacket writes a datagram wrapped in synthesized IP and UDP headers.
+// Each record is written with a single call, so the file stays readable up
+// to the last complete packet if the process is killed.
+func (w *pcapWriter) WritePacket(p *Packet) error {
+	frame := encodeIPUDP(p)
+
+	rec := make([]byte, 16, 16+len(frame))
+	ns := p.Time.UnixNano()
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ns/int64(time.Second)))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ns%int64(time.Second)))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+	rec = append(rec, frame...)
+
+	_, err := w.file.Write(rec)
+	return err
+}
+
+// Close closes the file
+func (w *pcapWriter) Close() error {
+	return w.file.Close()
+}
+
+// encodeIPUDP builds an IPv4 or IPv6 packet carrying the datagram
+func encodeIPUDP(p *Packet) []byte {
+	udp := make([]byte, 8, 8+len(p.Data))
+	binary.BigEndian.PutUint16(udp[0:2], p.Src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], p.Dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(p.Data)))
+	udp = append(udp, p.Data...)
+
+	src, dst := p.Src.Addr().Unmap(), p.Dst.Addr().Unmap()
+	if src.Is4() && dst.Is4() {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		s4, d4 := src.As4(), dst.As4()
+		copy(ip[12:16], s4[:])
+		copy(ip[16:20], d4[:])
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+		// A zero UDP checksum means "not computed" over IPv4
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(udp)))
+	ip[6] = 17 // next header: UDP
+	ip[7] = 64 // hop limit
+	s16, d16 := src.As16(), dst.As16()
+	copy(ip[8:24], s16[:])
+	copy(ip[24:40], d16[:])
+
+	// The UDP checksum is mandatory over IPv6 and covers a pseudo-header
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, ip[8:40]...)
+	pseudo = append(pseudo, 0, 0, byte(len(udp)>>8), byte(len(udp)), 0, 0, 0, 17)
+	sum := checksum(udp, sumWords(pseudo))
+	if sum == 0 {
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+
+	return append(ip, udp...)
+}
+
+// sumWords adds big-endian 16-bit words without folding
+func sumWords(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum computes the Internet checksum of b plus an initial partial sum
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial + sumWords(b)
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
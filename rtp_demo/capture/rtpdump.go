@@ -0,0 +1,172 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rtpdump files (rtptools) start with a text line followed by a binary file
+// header; every packet then carries an 8-byte header:
+//
+//	length(16) plen(16) offset(32)
+//
+// where length covers this header and the data, plen is the RTP packet
+// length (0 for RTCP) and offset is milliseconds since the recording started.
+
+const rtpdumpPacketHeaderSize = 8
+
+// rtpdumpReader reads rtpdump files
+type rtpdumpReader struct {
+	r     *bufio.Reader
+	file  *os.File
+	start time.Time
+	dst   netip.AddrPort
+}
+
+func newRTPDumpReader(br *bufio.Reader, file *os.File) (*rtpdumpReader, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, errTruncated
+	}
+	if !strings.HasPrefix(line, "#!rtpplay1.0 ") {
+		return nil, ErrUnknownFormat
+	}
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, errTruncated
+	}
+
+	r := &rtpdumpReader{
+		r:     br,
+		file:  file,
+		start: time.Unix(int64(binary.BigEndian.Uint32(hdr[0:4])), int64(binary.BigEndian.Uint32(hdr[4:8]))*1000),
+	}
+
+	// Prefer the text form of the address, which also covers IPv6
+	if addr, err := parseRTPDumpAddress(strings.TrimSpace(line[len("#!rtpplay1.0 "):])); err == nil {
+		r.dst = addr
+	} else {
+		ip, _ := netip.AddrFromSlice(hdr[8:12])
+		r.dst = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(hdr[12:14]))
+	}
+
+	return r, nil
+}
+
+// parseRTPDumpAddress parses "address/port"
+func parseRTPDumpAddress(s string) (netip.AddrPort, error) {
+	host, port, ok := strings.Cut(s, "/")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("capture: invalid rtpdump address %q", s)
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// ReadPacket reads the next packet from the file. rtpdump does not store
+// the sender address, so Src is left empty.
+func (r *rtpdumpReader) ReadPacket() (*Packet, error) {
+	var hdr [rtpdumpPacketHeaderSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTruncated
+		}
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(hdr[0:2]))
+	if length < rtpdumpPacketHeaderSize {
+		return nil, fmt.Errorf("capture: invalid rtpdump packet length %d", length)
+	}
+
+	data := make([]byte, length-rtpdumpPacketHeaderSize)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, errTruncated
+	}
+
+	// plen may exceed the stored length when only headers were recorded
+	offset := time.Duration(binary.BigEndian.Uint32(hdr[4:8])) * time.Millisecond
+	return &Packet{
+		Time: r.start.Add(offset),
+		Dst:  r.dst,
+		Data: data,
+	}, nil
+}
+
+// Close closes the file
+func (r *rtpdumpReader) Close() error {
+	return r.file.Close()
+}
+
+// rtpdumpWriter writes rtpdump files
+type rtpdumpWriter struct {
+	file  *os.File
+	start time.Time
+}
+
+func newRTPDumpWriter(file *os.File, local netip.AddrPort) (*rtpdumpWriter, error) {
+	w := &rtpdumpWriter{file: file, start: time.Now()}
+
+	header := []byte(fmt.Sprintf("#!rtpplay1.0 %s/%d\n", local.Addr(), local.Port()))
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(w.start.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(w.start.Nanosecond()/1000))
+	if ip := local.Addr().Unmap(); ip.Is4() {
+		a := ip.As4()
+		copy(hdr[8:12], a[:])
+	}
+	binary.BigEndian.PutUint16(hdr[12:14], local.Port())
+
+	if _, err := file.Write(append(header, hdr...)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// WritePacket appends a packet in a single write
+func (w *rtpdumpWriter) WritePacket(p *Packet) error {
+	if len(p.Data) > 0xFFFF-rtpdumpPacketHeaderSize {
+		return fmt.Errorf("capture: packet of %d bytes too large for rtpdump", len(p.Data))
+	}
+
+	offset := p.Time.Sub(w.start)
+	if offset < 0 {
+		offset = 0
+	}
+
+	// plen is zero for RTCP
+	plen := len(p.Data)
+	if len(p.Data) >= 2 && p.Data[1] >= 192 && p.Data[1] <= 223 {
+		plen = 0
+	}
+
+	rec := make([]byte, rtpdumpPacketHeaderSize, rtpdumpPacketHeaderSize+len(p.Data))
+	binary.BigEndian.PutUint16(rec[0:2], uint16(rtpdumpPacketHeaderSize+len(p.Data)))
+	binary.BigEndian.PutUint16(rec[2:4], uint16(plen))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(offset/time.Millisecond))
+	rec = append(rec, p.Data...)
+
+	_, err := w.file.Write(rec)
+	return err
+}
+
+// Close closes the file
+func (w *rtpdumpWriter) Close() error {
+	return w.file.Close()
+}
@@ -1,13 +1,53 @@
 package main
 
 import (
+	"bufio"
 	_ "bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"rtp_demo/bwe"
+	"rtp_demo/capture"
+	"rtp_demo/config"
+	"rtp_demo/framedrop"
+	"rtp_demo/h264"
+	"rtp_demo/h265"
+	"rtp_demo/logging"
+	"rtp_demo/mp4"
+	"rtp_demo/mpegts"
+	"rtp_demo/multicast"
+	"rtp_demo/netsim"
+	"rtp_demo/rtcp"
+	"rtp_demo/rtpext"
+	"rtp_demo/rtph264"
+	"rtp_demo/rtph265"
+	"rtp_demo/whip"
+)
+
+// maxPayloadSize keeps RTP packets below a typical Ethernet MTU
+const maxPayloadSize = 1200
+
+// Bandwidth estimator limits in bits per second
+const (
+	initialBitrate = 1000000
+	minBitrate     = 100000
+	maxBitrate     = 20000000
 )
 
 // RTPHeader represents the RTP header
@@ -21,6 +61,9 @@ type RTPHeader struct {
 	SequenceNumber uint16 // 16 bits
 	Timestamp      uint32 // 32 bits
 	SSRC           uint32 // 32 bits
+
+	ExtensionProfile uint16
+	ExtensionData    []byte // padded to a multiple of 4 bytes
 }
 
 // RTPPacket represents an RTP packet
@@ -29,59 +72,707 @@ type RTPPacket struct {
 	Payload []byte
 }
 
+// FrameReader is a source of access units: H.264 from an MP4 file, or H.264
+// or H.265 from an Annex B elementary stream
+type FrameReader interface {
+	ReadNextFrame() (*Frame, error)
+	Seek(t time.Duration) (time.Duration, error)
+	Rewind() error
+	Length() time.Duration
+	SkipToNextKeyframe() bool
+	LastKeyframe() *Frame
+	ParameterSets() [][]byte
+	Close() error
+}
+
 // MP4Reader reads MP4 file and extracts video data
 type MP4Reader struct {
-	file      *os.File
-	buffer    []byte
-	pos       int64
-	chunkSize int
+	reader *mp4.Reader
+	track  *mp4.Track
+	next   int // index of the next sample to read
+	start  int // index of the sample Rewind returns to
+
+	// skipped is the duration jumped over by SkipToNextKeyframe or Seek,
+	// subtracted from sample times so timestamps stay continuous after a
+	// jump; looped is the duration of the loops played, added to them
+	skipped uint64
+	looped  uint64
+
+	lastKeyframe *Frame
+
+	// AAC track sent alongside, nil if there is none or it is disabled
+	audio     *mp4.Track
+	audioNext int
+}
+
+// AudioFrame is one AAC frame read from the file
+type AudioFrame struct {
+	Data      []byte
+	Timestamp uint32        // RTP timestamp (sample rate clock)
+	SendTime  time.Duration // on the same timeline as the video frames
+}
+
+// Frame is one access unit read from the file
+type Frame struct {
+	NALUs     [][]byte
+	Timestamp uint32        // RTP timestamp (90 kHz presentation time)
+	SendTime  time.Duration // decode time relative to the start of the stream
+	Keyframe  bool
 }
 
 // NewMP4Reader creates a new MP4 reader
 func NewMP4Reader(filename string) (*MP4Reader, error) {
-	file, err := os.Open(filename)
+	reader, err := mp4.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	track, err := reader.VideoTrack()
 	if err != nil {
+		reader.Close()
 		return nil, err
 	}
+	// A recording stopped before its first fragment has only the init
+	// segment
+	if len(track.Samples) == 0 {
+		reader.Close()
+		return nil, errors.New("the video track has no samples")
+	}
 
 	return &MP4Reader{
-		file:      file,
-		buffer:    make([]byte, 1024),
-		chunkSize: 1024,
+		reader: reader,
+		track:  track,
 	}, nil
 }
 
-// ReadNextChunk reads the next chunk of data from the MP4 file
-func (r *MP4Reader) ReadNextChunk() ([]byte, error) {
-	// For demonstration purposes, we'll just read chunks of data
-	n, err := r.file.Read(r.buffer)
-	if err != nil && err != io.EOF {
+// EnableAudio makes the reader return the frames of the file's AAC track,
+// if it has one, from ReadAudioFrame and returns its configuration
+func (r *MP4Reader) EnableAudio() (*mp4.AudioConfig, error) {
+	track, err := r.reader.AudioTrack()
+	if err != nil {
+		return nil, err
+	}
+	r.audio = track
+	r.seekAudio()
+	return track.Audio, nil
+}
+
+// ReadAudioFrame reads the next AAC frame if it is due before the video
+// frame sent at limit, and returns nil otherwise. Audio at the same time
+// goes after the video, which the receiver needs to start recording.
+func (r *MP4Reader) ReadAudioFrame(limit time.Duration) (*AudioFrame, error) {
+	if r.audio == nil || r.audioNext >= len(r.audio.Samples) {
+		return nil, nil
+	}
+	sample := &r.audio.Samples[r.audioNext]
+	t := r.audioTimeline(sample.DecodeTime)
+	sendTime := time.Duration(t * int64(time.Second) / int64(r.audio.Audio.SampleRate))
+	if sendTime >= limit {
+		return nil, nil
+	}
+	r.audioNext++
+
+	data, err := r.reader.ReadSample(sample)
+	if err != nil {
 		return nil, err
 	}
+	return &AudioFrame{Data: data, Timestamp: uint32(t), SendTime: sendTime}, nil
+}
+
+// audioTimeline converts an audio sample time to samples since the start
+// of sending, shifted by the same jumps and loops as the video so the two
+// stay in sync
+func (r *MP4Reader) audioTimeline(t uint64) int64 {
+	rate := int64(r.audio.Audio.SampleRate)
+	shift := (int64(r.looped) - int64(r.skipped)) * rate / int64(r.track.Timescale)
+	return int64(t)*rate/int64(r.audio.Timescale) + shift
+}
+
+// seekAudio moves the audio to the first frame at or after the next video
+// frame, after the video position jumped
+func (r *MP4Reader) seekAudio() {
+	if r.audio == nil || r.next >= len(r.track.Samples) {
+		return
+	}
+	rate := int64(r.audio.Audio.SampleRate)
+	video := int64(r.timeline(r.track.Samples[r.next].DecodeTime)) * rate / int64(r.track.Timescale)
+	r.audioNext = sort.Search(len(r.audio.Samples), func(i int) bool {
+		return r.audioTimeline(r.audio.Samples[i].DecodeTime) >= video
+	})
+}
 
-	if n == 0 {
+// ReadNextFrame reads the next access unit from the MP4 file
+func (r *MP4Reader) ReadNextFrame() (*Frame, error) {
+	if r.next >= len(r.track.Samples) {
 		return nil, io.EOF
 	}
 
-	// Return a copy of the buffer with actual data read
-	data := make([]byte, n)
-	copy(data, r.buffer[:n])
+	sample := &r.track.Samples[r.next]
+	r.next++
+
+	data, err := r.reader.ReadSample(sample)
+	if err != nil {
+		return nil, err
+	}
+
+	nalus, err := mp4.SplitNALUs(data, r.track.NALULengthSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parameter sets live in avcC, so repeat them in-band before every IDR
+	if sample.Keyframe {
+		nalus = append(r.ParameterSets(), nalus...)
+	}
+
+	timescale := uint64(r.track.Timescale)
+	frame := &Frame{
+		NALUs:     nalus,
+		Timestamp: uint32(r.timeline(sample.PresentationTime()) * 90000 / timescale),
+		SendTime:  time.Duration(r.timeline(sample.DecodeTime) * uint64(time.Second) / timescale),
+		Keyframe:  sample.Keyframe,
+	}
+
+	if frame.Keyframe {
+		r.lastKeyframe = frame
+	}
+
+	return frame, nil
+}
+
+// timeline converts a sample time to the time since the start of sending,
+// in track timescale units
+func (r *MP4Reader) timeline(t uint64) uint64 {
+	return t + r.looped - r.skipped
+}
+
+// Seek moves to the last keyframe at or before t, which becomes time zero
+// and the point Rewind returns to. It returns the time of that keyframe.
+func (r *MP4Reader) Seek(t time.Duration) (time.Duration, error) {
+	timescale := uint64(r.track.Timescale)
+	target := uint64(t) * timescale / uint64(time.Second)
+
+	start := -1
+	for i := range r.track.Samples {
+		sample := &r.track.Samples[i]
+		if sample.DecodeTime > target {
+			break
+		}
+		if sample.Keyframe {
+			start = i
+		}
+	}
+	if start < 0 {
+		return 0, errors.New("no keyframe at or before the start time")
+	}
+	if last := r.track.Samples[len(r.track.Samples)-1]; target >= last.DecodeTime+uint64(last.Duration) {
+		return 0, errors.New("start time is past the end of the file")
+	}
+
+	r.start, r.next = start, start
+	r.skipped = r.track.Samples[start].DecodeTime
+	r.looped = 0
+	r.seekAudio()
+	return time.Duration(r.skipped * uint64(time.Second) / timescale), nil
+}
+
+// Rewind returns to the start position, the beginning of the file unless
+// Seek moved it, continuing the timeline from the end of the file so
+// timestamps keep increasing across loops
+func (r *MP4Reader) Rewind() error {
+	r.looped += r.span()
+	r.next = r.start
+	r.seekAudio()
+	return nil
+}
+
+// span returns the time from the start position to the end of the last
+// sample, in track timescale units
+func (r *MP4Reader) span() uint64 {
+	last := r.track.Samples[len(r.track.Samples)-1]
+	return last.DecodeTime + uint64(last.Duration) - r.track.Samples[r.start].DecodeTime
+}
+
+// Length returns the time from the start position to the end of the file,
+// the time one loop takes
+func (r *MP4Reader) Length() time.Duration {
+	return time.Duration(r.span() * uint64(time.Second) / uint64(r.track.Timescale))
+}
+
+// SkipToNextKeyframe moves the read position to the next keyframe, returning
+// false if there is none left in the file
+func (r *MP4Reader) SkipToNextKeyframe() bool {
+	for i := r.next; i < len(r.track.Samples); i++ {
+		if r.track.Samples[i].Keyframe {
+			if i > r.next {
+				r.skipped += r.track.Samples[i].DecodeTime - r.track.Samples[r.next].DecodeTime
+			}
+			r.next = i
+			r.seekAudio()
+			return true
+		}
+	}
+	return false
+}
+
+// LastKeyframe returns the most recently read keyframe, including its
+// parameter sets, or nil if none has been read yet
+func (r *MP4Reader) LastKeyframe() *Frame {
+	return r.lastKeyframe
+}
 
-	return data, nil
+// ParameterSets returns the SPS and PPS NAL units of the video track
+func (r *MP4Reader) ParameterSets() [][]byte {
+	var sets [][]byte
+	sets = append(sets, r.track.SPS...)
+	sets = append(sets, r.track.PPS...)
+	return sets
 }
 
 // Close closes the MP4 file
 func (r *MP4Reader) Close() error {
+	return r.reader.Close()
+}
+
+// defaultFrameRate is assumed for elementary streams without VUI timing when
+// -fps is not given
+const defaultFrameRate = 25
+
+// AnnexBReader reads access units from an H.264 or H.265 elementary stream
+// (Annex B byte stream) and times them at a constant frame rate. Frames are
+// assumed to be in presentation order, since the stream carries no
+// timestamps.
+type AnnexBReader struct {
+	file      io.ReadCloser
+	codec     string // config.CodecH264 or CodecH265
+	nalus     *h264.NALUReader
+	aus       accessUnitBuilder
+	fps       float64
+	fpsSource string // "flag", "SPS" or "default"
+
+	// Set by TimeOnArrival; epoch is when the first frame was returned
+	arrival bool
+	epoch   time.Time
+
+	// Latest parameter sets, repeated before keyframes that come without
+	// them; vps is H.265 only
+	vps, sps, pps []byte
+
+	queued []*Frame // read ahead, not yet timed
+	start  int      // index in the file of the frame Rewind returns to
+	sent   uint64   // frames returned, the position on the timeline
+
+	// Frames from the start position to the end of the file, known after
+	// the first pass
+	passFrames, passStart uint64
+
+	lastKeyframe *Frame
+}
+
+// accessUnitBuilder groups NAL units into access units by the rules of a
+// codec, h264.AccessUnitBuilder or h265.AccessUnitBuilder
+type accessUnitBuilder interface {
+	Push(nalu []byte) [][]byte
+	Flush() [][]byte
+}
+
+// NewAnnexBReader creates a reader for the byte stream in file, of codec
+// config.CodecH264 or CodecH265, at fps frames per second, or if fps is 0
+// the rate in the first SPS
+func NewAnnexBReader(file io.ReadCloser, codec string, fps float64) (*AnnexBReader, error) {
+	r := &AnnexBReader{file: file, codec: codec, nalus: h264.NewNALUReader(file), fps: fps, fpsSource: "flag"}
+	r.resetAccessUnits()
+
+	// The first access unit carries the SPS with the frame rate
+	first, err := r.readAccessUnit()
+	if err == io.EOF {
+		return nil, fmt.Errorf("no %s access units in the stream", codecName(codec))
+	} else if err != nil {
+		return nil, err
+	}
+	r.queued = append(r.queued, first)
+
+	if r.fps <= 0 {
+		r.fps, r.fpsSource = defaultFrameRate, "default"
+		if rate := r.spsFrameRate(); rate > 0 {
+			r.fps, r.fpsSource = rate, "SPS"
+		}
+	}
+	return r, nil
+}
+
+// codecName returns the name of an elementary stream codec for messages
+func codecName(codec string) string {
+	if codec == config.CodecH265 {
+		return "H.265"
+	}
+	return "H.264"
+}
+
+// Codec returns the codec of the stream, config.CodecH264 or CodecH265
+func (r *AnnexBReader) Codec() string {
+	return r.codec
+}
+
+// resetAccessUnits starts grouping NAL units afresh
+func (r *AnnexBReader) resetAccessUnits() {
+	if r.codec == config.CodecH265 {
+		r.aus = &h265.AccessUnitBuilder{}
+	} else {
+		r.aus = &h264.AccessUnitBuilder{}
+	}
+}
+
+// spsFrameRate returns the frame rate in the VUI of the latest SPS, or 0
+func (r *AnnexBReader) spsFrameRate() float64 {
+	if r.codec == config.CodecH265 {
+		if sps, err := h265.ParseSPS(r.sps); err == nil {
+			return sps.FrameRate
+		}
+	} else if sps, err := h264.ParseSPS(r.sps); err == nil {
+		return sps.FrameRate
+	}
+	return 0
+}
+
+// FrameRate returns the frame rate and where it came from: "flag", "SPS"
+// or "default"
+func (r *AnnexBReader) FrameRate() (float64, string) {
+	return r.fps, r.fpsSource
+}
+
+// TimeOnArrival times frames by when they are read instead of at the frame
+// rate, for live input whose producer paces it
+func (r *AnnexBReader) TimeOnArrival() {
+	r.arrival = true
+}
+
+// readAccessUnit returns the next queued or read access unit, without timing
+func (r *AnnexBReader) readAccessUnit() (*Frame, error) {
+	if len(r.queued) > 0 {
+		frame := r.queued[0]
+		r.queued = r.queued[1:]
+		return frame, nil
+	}
+
+	for {
+		var au [][]byte
+		nalu, err := r.nalus.Next()
+		if err == io.EOF {
+			if au = r.aus.Flush(); au == nil {
+				return nil, io.EOF
+			}
+		} else if err != nil {
+			return nil, err
+		} else if au = r.aus.Push(nalu); au == nil {
+			continue
+		}
+
+		if frame := r.newFrame(au); frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+// newFrame builds a frame from an access unit, or returns nil if it has no
+// slices. Delimiters and filler are dropped since the marker bit ends an
+// access unit in RTP.
+func (r *AnnexBReader) newFrame(au [][]byte) *Frame {
+	if r.codec == config.CodecH265 {
+		return r.newH265Frame(au)
+	}
+
+	frame := &Frame{}
+	hasSPS, hasPPS, hasVCL := false, false, false
+	for _, nalu := range au {
+		switch nalu[0] & 0x1F {
+		case h264.NALUAUD, h264.NALUFiller:
+			continue
+		case h264.NALUSPS:
+			r.sps, hasSPS = nalu, true
+		case h264.NALUPPS:
+			r.pps, hasPPS = nalu, true
+		case h264.NALUIDR:
+			frame.Keyframe, hasVCL = true, true
+		case h264.NALUNonIDR:
+			hasVCL = true
+		}
+		frame.NALUs = append(frame.NALUs, nalu)
+	}
+	if !hasVCL {
+		return nil
+	}
+
+	if frame.Keyframe && !(hasSPS && hasPPS) && r.sps != nil && r.pps != nil {
+		frame.NALUs = append(r.ParameterSets(), frame.NALUs...)
+	}
+	return frame
+}
+
+// newH265Frame is newFrame for H.265, where IRAP pictures are the keyframes
+func (r *AnnexBReader) newH265Frame(au [][]byte) *Frame {
+	frame := &Frame{}
+	hasVPS, hasSPS, hasPPS, hasVCL := false, false, false, false
+	for _, nalu := range au {
+		switch nalType := h265.Type(nalu); {
+		case nalType == h265.NALUAUD, nalType == h265.NALUFiller:
+			continue
+		case nalType == h265.NALUVPS:
+			r.vps, hasVPS = nalu, true
+		case nalType == h265.NALUSPS:
+			r.sps, hasSPS = nalu, true
+		case nalType == h265.NALUPPS:
+			r.pps, hasPPS = nalu, true
+		case h265.IsVCL(nalType):
+			frame.Keyframe = frame.Keyframe || h265.IsIRAP(nalType)
+			hasVCL = true
+		}
+		frame.NALUs = append(frame.NALUs, nalu)
+	}
+	if !hasVCL {
+		return nil
+	}
+
+	if frame.Keyframe && !(hasVPS && hasSPS && hasPPS) && r.vps != nil && r.sps != nil && r.pps != nil {
+		frame.NALUs = append(r.ParameterSets(), frame.NALUs...)
+	}
+	return frame
+}
+
+// ReadNextFrame reads the next access unit
+func (r *AnnexBReader) ReadNextFrame() (*Frame, error) {
+	frame, err := r.readAccessUnit()
+	if err == io.EOF && r.passFrames == 0 {
+		r.passFrames = r.sent - r.passStart
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.arrival {
+		now := time.Now()
+		if r.epoch.IsZero() {
+			r.epoch = now
+		}
+		frame.SendTime = now.Sub(r.epoch)
+		frame.Timestamp = uint32(uint64(math.Round(frame.SendTime.Seconds() * 90000)))
+	} else {
+		frame.Timestamp = uint32(uint64(math.Round(float64(r.sent) * 90000 / r.fps)))
+		frame.SendTime = time.Duration(float64(r.sent) / r.fps * float64(time.Second))
+	}
+	r.sent++
+
+	if frame.Keyframe {
+		r.lastKeyframe = frame
+	}
+	return frame, nil
+}
+
+// Seek moves to the last keyframe at or before t, which becomes time zero
+// and the point Rewind returns to. It must be called before reading, and
+// returns the time of that keyframe.
+func (r *AnnexBReader) Seek(t time.Duration) (time.Duration, error) {
+	target := int(t.Seconds() * r.fps)
+
+	// Keep the frames from the latest keyframe on
+	var gop []*Frame
+	start := 0
+	for i := 0; i <= target; i++ {
+		frame, err := r.readAccessUnit()
+		if err == io.EOF {
+			return 0, errors.New("start time is past the end of the file")
+		} else if err != nil {
+			return 0, err
+		}
+		if frame.Keyframe {
+			gop, start = nil, i
+		}
+		gop = append(gop, frame)
+	}
+	if !gop[0].Keyframe {
+		return 0, errors.New("no keyframe at or before the start time")
+	}
+
+	r.queued, r.start = gop, start
+	return time.Duration(float64(start) / r.fps * float64(time.Second)), nil
+}
+
+// Rewind returns to the start position, continuing the timeline so
+// timestamps keep increasing across loops. The file must be seekable.
+func (r *AnnexBReader) Rewind() error {
+	seeker, ok := r.file.(io.Seeker)
+	if !ok {
+		return errors.New("cannot rewind a stream")
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.nalus = h264.NewNALUReader(r.file)
+	r.resetAccessUnits()
+	r.queued = nil
+	r.passStart = r.sent
+
+	for i := 0; i < r.start; i++ {
+		if _, err := r.readAccessUnit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Length returns the time from the start position to the end of the file,
+// once it has been read to the end, and 0 before
+func (r *AnnexBReader) Length() time.Duration {
+	return time.Duration(float64(r.passFrames) / r.fps * float64(time.Second))
+}
+
+// SkipToNextKeyframe reads ahead to the next keyframe, returning false if
+// there is none left in the stream
+func (r *AnnexBReader) SkipToNextKeyframe() bool {
+	for {
+		frame, err := r.readAccessUnit()
+		if err != nil {
+			return false
+		}
+		if frame.Keyframe {
+			r.queued = append([]*Frame{frame}, r.queued...)
+			return true
+		}
+	}
+}
+
+// LastKeyframe returns the most recently read keyframe, or nil if none has
+// been read yet
+func (r *AnnexBReader) LastKeyframe() *Frame {
+	return r.lastKeyframe
+}
+
+// ParameterSets returns the latest parameter set NAL units in the stream:
+// SPS and PPS, after the VPS for H.265
+func (r *AnnexBReader) ParameterSets() [][]byte {
+	var sets [][]byte
+	if r.vps != nil {
+		sets = append(sets, r.vps)
+	}
+	if r.sps != nil {
+		sets = append(sets, r.sps)
+	}
+	if r.pps != nil {
+		sets = append(sets, r.pps)
+	}
+	return sets
+}
+
+// Close closes the file
+func (r *AnnexBReader) Close() error {
 	return r.file.Close()
 }
 
+// annexBFileCodec returns the codec of an elementary stream file,
+// config.CodecH264 or CodecH265, by its extension or its first NAL unit,
+// or "" if it is not one
+func annexBFileCodec(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".h264", ".264", ".avc", ".h26l":
+		return config.CodecH264
+	case ".h265", ".265", ".hevc":
+		return config.CodecH265
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return ""
+	}
+	return sniffAnnexB(head)
+}
+
+// sniffAnnexB returns the codec of a byte stream from its first six bytes:
+// a start code and the NAL header of what streams begin with, an access
+// unit delimiter, SEI or SPS in H.264, or a VPS, delimiter or prefix SEI of
+// the base layer in H.265. It returns "" for anything else.
+func sniffAnnexB(head []byte) string {
+	switch {
+	case len(head) < 6 || head[0] != 0 || head[1] != 0:
+		return ""
+	case head[2] == 1:
+		head = head[3:] // three-byte start code
+	case head[2] == 0 && head[3] == 1:
+		head = head[4:]
+	default:
+		return ""
+	}
+	if head[0]&0x80 != 0 {
+		return ""
+	}
+
+	// Checked first, since 0x46 is also an H.264 SEI header
+	switch h265.Type(head) {
+	case h265.NALUVPS, h265.NALUAUD, h265.NALUSEI:
+		if head[0]&1 == 0 && head[1] == 1 {
+			return config.CodecH265
+		}
+	}
+	switch head[0] & 0x1F {
+	case h264.NALUAUD, h264.NALUSPS, h264.NALUSEI:
+		return config.CodecH264
+	}
+	return ""
+}
+
 // RTPClient represents an RTP client
 type RTPClient struct {
-	conn       *net.UDPConn
+	conn       *net.UDPConn  // nil when publishing over WHIP
+	transport  io.Writer     // where RTP packets are written, conn unless wrapped
+	feedback   io.ReadCloser // where RTCP arrives, conn or the WHIP publisher
 	remoteAddr *net.UDPAddr
+	multicast  multicast.SenderOptions // as last set, for newStream
 	seqNum     uint16
 	timestamp  uint32
 	ssrc       uint32
+	payloadPT  uint8 // of H.264, H.265, MPEG-TS or AAC in payloadTypes
+	hevc       bool  // video is H.265, packetized per RFC 7798
+
+	// Payload type of each codec, nil for the defaults
+	payloadTypes *config.PayloadTypes
+
+	// Header extension stamping each packet with its send time, for the
+	// receiver to measure latency: rtpext.AbsSendTimeID, NTP64ID or 0
+	sendTimeExt uint8
+
+	// Set by the RTCP reader when the receiver asks for a keyframe
+	keyframeRequested atomic.Bool
+	lastFIRSeq        int // -1 until the first FIR is received
+
+	// Set when no keyframe was left to skip to: the last one is re-sent
+	resendPending bool
+
+	// Congestion control, nil unless enabled
+	estimator    *bwe.Estimator
+	twccSeq      uint16
+	dropper      *framedrop.Dropper
+	droppingTail bool // between the first frame of a dropped GOP tail and the next IDR
+
+	// Counters for the summary log lines
+	packetsSent, bytesSent    uint64
+	payloadBytes              uint64 // for sender reports
+	framesSent, framesDropped uint64
+	tailFramesDropped         uint64        // of framesDropped, in GOP tails
+	layerFramesDropped        uint64        // of framesDropped, in temporal layers cut
+	redundantBytes            uint64        // redundant slices and filler left out of sent frames
+	statsInterval             time.Duration // 0 disables the summary
+	summary                   sendSnapshot
+}
+
+// sendSnapshot holds the client's counters at the previous summary line
+type sendSnapshot struct {
+	at                              time.Time
+	packets, bytes, frames, dropped uint64
 }
 
 // NewRTPClient creates a new RTP client
@@ -91,20 +782,111 @@ func NewRTPClient(remoteAddr string) (*RTPClient, error) {
 		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	// A socket connected to a group would drop unicast feedback from the
+	// receivers, so multicast uses an unconnected one
+	var conn *net.UDPConn
+	var transport io.Writer
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenUDP("udp", nil)
+		transport = &groupWriter{conn: conn, group: addr}
+	} else {
+		conn, err = net.DialUDP("udp", nil, addr)
+		transport = conn
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &RTPClient{
 		conn:       conn,
+		transport:  transport,
+		feedback:   conn,
 		remoteAddr: addr,
 		seqNum:     1,
 		timestamp:  0,
 		ssrc:       12345, // Random SSRC
+		payloadPT:  96,
+		lastFIRSeq: -1,
+	}, nil
+}
+
+// NewWHIPClient creates a client that publishes over WebRTC to a WHIP
+// endpoint instead of sending plain RTP
+func NewWHIPClient(endpoint string) (*RTPClient, error) {
+	pub, err := whip.Publish(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RTPClient{
+		transport:  pub,
+		feedback:   pub,
+		seqNum:     1,
+		ssrc:       pub.SSRC(), // the publisher rewrites it anyway
+		payloadPT:  96,
+		lastFIRSeq: -1,
 	}, nil
 }
 
+// groupWriter sends every write to a multicast group
+type groupWriter struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+func (w *groupWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteToUDP(p, w.group)
+}
+
+// IsMulticast reports whether the client sends to a multicast group
+func (c *RTPClient) IsMulticast() bool {
+	return c.remoteAddr != nil && c.remoteAddr.IP.IsMulticast()
+}
+
+// SetMulticastOptions sets the TTL, loopback and outgoing interface used
+// when sending to a multicast group
+func (c *RTPClient) SetMulticastOptions(opts multicast.SenderOptions) error {
+	c.multicast = opts
+	return multicast.ConfigureSender(c.conn, c.remoteAddr.IP, opts)
+}
+
+// newStream returns a client for another stream with the given SSRC to the
+// same destination, sent over the same socket if shared and otherwise over
+// a new one with the same multicast options. A shared stream reads no
+// feedback and must not be closed.
+func (c *RTPClient) newStream(ssrc uint32, shared bool) (*RTPClient, error) {
+	if shared {
+		return &RTPClient{
+			conn:         c.conn,
+			transport:    c.transport,
+			remoteAddr:   c.remoteAddr,
+			seqNum:       1,
+			ssrc:         ssrc,
+			payloadPT:    c.payloadPT,
+			payloadTypes: c.payloadTypes,
+			hevc:         c.hevc,
+			sendTimeExt:  c.sendTimeExt,
+			lastFIRSeq:   -1,
+		}, nil
+	}
+
+	stream, err := NewRTPClient(c.remoteAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	stream.ssrc = ssrc
+	stream.payloadPT, stream.payloadTypes = c.payloadPT, c.payloadTypes
+	stream.hevc = c.hevc
+	stream.sendTimeExt = c.sendTimeExt
+	if stream.IsMulticast() {
+		if err := stream.SetMulticastOptions(c.multicast); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
 // MarshalHeader marshals the RTP header into bytes
 func (h *RTPHeader) MarshalHeader() []byte {
 	buf := make([]byte, 12)
@@ -124,6 +906,15 @@ func (h *RTPHeader) MarshalHeader() []byte {
 	// SSRC
 	binary.BigEndian.PutUint32(buf[8:12], h.SSRC)
 
+	// Header extension: profile(16) length(16, in 32-bit words) data
+	if h.Extension {
+		ext := make([]byte, 4)
+		binary.BigEndian.PutUint16(ext[0:2], h.ExtensionProfile)
+		binary.BigEndian.PutUint16(ext[2:4], uint16(len(h.ExtensionData)/4))
+		buf = append(buf, ext...)
+		buf = append(buf, h.ExtensionData...)
+	}
+
 	return buf
 }
 
@@ -136,91 +927,1230 @@ func btou8(b bool) uint8 {
 }
 
 // SendPacket sends an RTP packet
-func (c *RTPClient) SendPacket(payload []byte) error {
+func (c *RTPClient) SendPacket(payload []byte, marker bool) error {
 	header := RTPHeader{
 		Version:        2,
 		Padding:        false,
 		Extension:      false,
 		CSRCCount:      0,
-		Marker:         false,
-		PayloadType:    96, // Dynamic type for H.264
+		Marker:         marker,
+		PayloadType:    c.payloadPT,
 		SequenceNumber: c.seqNum,
 		Timestamp:      c.timestamp,
 		SSRC:           c.ssrc,
 	}
 
+	var elements []rtpext.Element
+	if c.estimator != nil {
+		elements = append(elements, rtpext.TransportSequence(c.twccSeq))
+	}
+	switch c.sendTimeExt {
+	case rtpext.AbsSendTimeID:
+		elements = append(elements, rtpext.AbsSendTime(rtcp.NTPTime(time.Now())))
+	case rtpext.NTP64ID:
+		elements = append(elements, rtpext.NTP64(rtcp.NTPTime(time.Now())))
+	}
+	if len(elements) > 0 {
+		header.Extension = true
+		header.ExtensionProfile = rtpext.ProfileOneByte
+		header.ExtensionData = rtpext.Marshal(elements)
+	}
+
 	headerBytes := header.MarshalHeader()
 	packet := append(headerBytes, payload...)
 
-	_, err := c.conn.Write(packet)
+	_, err := c.transport.Write(packet)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Sent RTP packet: Seq=%d, TS=%d, Size=%d\n", c.seqNum, c.timestamp, len(payload))
+	if c.estimator != nil {
+		c.estimator.OnPacketSent(c.twccSeq, len(packet), time.Now())
+		c.twccSeq++
+	}
+
+	c.packetsSent++
+	c.bytesSent += uint64(len(packet))
+	c.payloadBytes += uint64(len(payload))
+	slog.Debug("Sent RTP packet", "seq", c.seqNum, "ts", c.timestamp, "marker", marker, "size", len(payload))
 
-	// Update sequence number and timestamp
+	// Update sequence number
 	c.seqNum++
-	c.timestamp += 3000 // Assuming 90kHz clock rate and ~33ms per frame
 
 	return nil
 }
 
-// Close closes the RTP client
-func (c *RTPClient) Close() error {
-	return c.conn.Close()
+// SetTransport replaces the writer RTP packets are sent through, e.g. with a
+// netsim.Conn wrapping the socket. RTCP feedback is still read from the socket.
+func (c *RTPClient) SetTransport(w io.Writer) {
+	c.transport = w
 }
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: client <server_address:port> <mp4_file>")
-		os.Exit(1)
+// SendRaw sends an already packetized RTP packet unchanged
+func (c *RTPClient) SendRaw(packet []byte) error {
+	if _, err := c.transport.Write(packet); err != nil {
+		return err
 	}
+	c.packetsSent++
+	c.bytesSent += uint64(len(packet))
+	return nil
+}
 
-	serverAddr := os.Args[1]
-	mp4File := os.Args[2]
-
-	// Create RTP client
-	client, err := NewRTPClient(serverAddr)
-	if err != nil {
-		fmt.Printf("Failed to create RTP client: %v\n", err)
-		os.Exit(1)
+// logStats logs a summary line once the stats interval has passed since the
+// previous one
+func (c *RTPClient) logStats(now time.Time) {
+	if c.statsInterval <= 0 {
+		return
+	}
+	prev := c.summary
+	if prev.at.IsZero() {
+		c.summary.at = now
+		return
+	}
+	if now.Sub(prev.at) < c.statsInterval {
+		return
 	}
-	defer client.Close()
 
-	// Open MP4 file
-	reader, err := NewMP4Reader(mp4File)
-	if err != nil {
-		fmt.Printf("Failed to open MP4 file: %v\n", err)
-		os.Exit(1)
+	elapsed := now.Sub(prev.at).Seconds()
+	args := []any{
+		"packets", c.packetsSent - prev.packets,
+		"kbps", math.Round(float64(c.bytesSent-prev.bytes) * 8 / elapsed / 1000),
+		"fps", math.Round(float64(c.framesSent-prev.frames)/elapsed*10) / 10,
+		"dropped", c.framesDropped - prev.dropped,
 	}
-	defer reader.Close()
+	if c.estimator != nil {
+		args = append(args, "target_kbps", c.estimator.TargetBitrate()/1000)
+	}
+	slog.Info("Send stats", args...)
 
-	fmt.Printf("Sending video stream to %s\n", serverAddr)
+	c.summary = sendSnapshot{at: now, packets: c.packetsSent, bytes: c.bytesSent, frames: c.framesSent, dropped: c.framesDropped}
+}
+
+// EnableCongestionControl adds the transport-wide sequence number extension
+// to every packet and runs a delay-based bandwidth estimator on the
+// transport-cc feedback; onTargetBitrate is called when the estimate changes.
+// Frames are only dropped from H.264, whose NAL units framedrop reads.
+func (c *RTPClient) EnableCongestionControl(onTargetBitrate func(bps int)) {
+	c.estimator = bwe.NewEstimator(initialBitrate, minBitrate, maxBitrate)
+	c.estimator.OnTargetBitrate = onTargetBitrate
+	if !c.hevc {
+		c.dropper = framedrop.New(time.Second)
+	}
+}
+
+// thin accounts for a frame about to be sent and returns the NAL units to
+// send of it while the bandwidth estimate is below the stream rate, and
+// whether the frame was dropped. A dropped frame still has its parameter
+// sets sent. The framedrop package decides what goes first.
+func (c *RTPClient) thin(frame *Frame) ([][]byte, bool) {
+	if c.dropper == nil {
+		return frame.NALUs, false
+	}
+
+	target := c.estimator.TargetBitrate()
+	dec := c.dropper.Decide(frame.NALUs, target, time.Now())
+	if dec.Resumed > 0 {
+		c.droppingTail = false
+		slog.Info("Resuming at keyframe", "ts", frame.Timestamp, "dropped", dec.Resumed, "target_kbps", target/1000)
+	}
+
+	switch dec.Reason {
+	case framedrop.Redundant:
+		c.redundantBytes += uint64(dec.Saved)
+		slog.Debug("Removed redundant slices", "ts", frame.Timestamp, "bytes", dec.Saved)
+	case framedrop.Disposable, framedrop.GOPTail, framedrop.TemporalLayer:
+		switch dec.Reason {
+		case framedrop.GOPTail:
+			if !c.droppingTail {
+				c.droppingTail = true
+				slog.Info("Dropping frames until the next keyframe", "ts", frame.Timestamp, "target_kbps", target/1000)
+			}
+			c.tailFramesDropped++
+		case framedrop.TemporalLayer:
+			c.layerFramesDropped++
+		}
+		c.framesDropped++
+		slog.Debug("Dropped frame", "ts", frame.Timestamp, "size", dec.Size, "class", dec.Class,
+			"slice_type", dec.SliceType, "nal_ref_idc", dec.RefIDC, "temporal_id", dec.TemporalID, "reason", dec.Reason)
+	}
+	return dec.NALUs, dec.Dropped()
+}
+
+// SendFrame packetizes an access unit and sends it with the marker bit set
+// on its last packet
+func (c *RTPClient) SendFrame(frame *Frame) error {
+	if err := c.sendNALUs(frame.Timestamp, frame.NALUs); err != nil {
+		return err
+	}
+	c.framesSent++
+	return nil
+}
+
+// sendNALUs packetizes NAL units with the given timestamp, setting the
+// marker bit on the last packet
+func (c *RTPClient) sendNALUs(timestamp uint32, nalus [][]byte) error {
+	c.timestamp = timestamp
+
+	payloads := c.packetize(nalus)
+	for i, payload := range payloads {
+		if err := c.SendPacket(payload, i == len(payloads)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packetize splits NAL units into RTP payloads for the video codec
+func (c *RTPClient) packetize(nalus [][]byte) [][]byte {
+	if c.hevc {
+		return rtph265.Packetize(nalus, maxPayloadSize)
+	}
+	return rtph264.Packetize(nalus, maxPayloadSize)
+}
 
-	// Send video frames
-	frameInterval := time.Second / 30 // 30 FPS
-	ticker := time.NewTicker(frameInterval)
-	defer ticker.Stop()
+// ReadFeedback reads RTCP feedback from the receiver until the connection is
+// closed, flagging keyframe requests for the send loop
+func (c *RTPClient) ReadFeedback() {
+	buffer := make([]byte, 1500)
 
 	for {
-		select {
-		case <-ticker.C:
-			// Read next frame/NAL unit
-			chunk, err := reader.ReadNextChunk()
-			if err == io.EOF {
-				fmt.Println("End of video stream")
-				return
-			} else if err != nil {
-				fmt.Printf("Error reading chunk: %v\n", err)
+		n, err := c.feedback.Read(buffer)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			// e.g. ICMP port unreachable while the server is not running
+			continue
+		}
+
+		if !rtcp.IsRTCP(buffer[:n]) {
+			continue
+		}
+
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			slog.Warn("Error parsing RTCP packet", "err", err)
+		}
+
+		for _, p := range packets {
+			c.handleFeedback(p)
+		}
+	}
+}
+
+// handleFeedback reacts to a single RTCP feedback message
+func (c *RTPClient) handleFeedback(p rtcp.Packet) {
+	switch p := p.(type) {
+	case *rtcp.PictureLossIndication:
+		if p.MediaSSRC == c.ssrc {
+			slog.Info("Received PLI", "from_ssrc", p.SenderSSRC)
+			c.keyframeRequested.Store(true)
+		}
+	case *rtcp.TransportCC:
+		if c.estimator != nil && p.MediaSSRC == c.ssrc {
+			c.estimator.OnFeedback(p, time.Now())
+		}
+	case *rtcp.FullIntraRequest:
+		for _, e := range p.Entries {
+			// Retransmitted FIRs carry the same sequence number and are ignored
+			if e.SSRC != c.ssrc || int(e.SequenceNumber) == c.lastFIRSeq {
+				continue
+			}
+			c.lastFIRSeq = int(e.SequenceNumber)
+			slog.Info("Received FIR", "from_ssrc", p.SenderSSRC, "fir_seq", e.SequenceNumber)
+			c.keyframeRequested.Store(true)
+		}
+	case *rtcp.Goodbye:
+		slog.Info("Receiver left", "reason", p.Reason)
+	}
+}
+
+// SendAudio sends an AAC frame as one RFC 3640 AAC-hbr packet: a single
+// 16-bit AU header of 13 bits size and 3 bits index
+func (c *RTPClient) SendAudio(frame *AudioFrame) error {
+	c.timestamp = frame.Timestamp
+
+	size := len(frame.Data)
+	payload := make([]byte, 4, 4+size)
+	payload[1] = 16 // AU-headers-length in bits
+	payload[2] = byte(size >> 5)
+	payload[3] = byte(size << 3)
+	payload = append(payload, frame.Data...)
+	if err := c.SendPacket(payload, true); err != nil {
+		return err
+	}
+	c.framesSent++
+	return nil
+}
+
+// senderReport reports the RTP timestamp of media time t for a stream with
+// the given clock rate, as sent at wallclock now
+func (c *RTPClient) senderReport(now time.Time, t time.Duration, clockRate uint32) *rtcp.SenderReport {
+	return &rtcp.SenderReport{
+		SSRC:        c.ssrc,
+		NTPTime:     rtcp.NTPTime(now),
+		RTPTime:     uint32(int64(t) * int64(clockRate) / int64(time.Second)),
+		PacketCount: uint32(c.packetsSent),
+		OctetCount:  uint32(c.payloadBytes),
+	}
+}
+
+// recoverKeyframe serves a pending keyframe request by jumping to the next
+// keyframe in the file. When no keyframe is left, the last IDR is re-sent
+// with its parameter sets in place of the next frame, see resendKeyframe.
+func (c *RTPClient) recoverKeyframe(reader FrameReader) {
+	if !c.keyframeRequested.Swap(false) {
+		return
+	}
+
+	if reader.SkipToNextKeyframe() {
+		slog.Info("Keyframe requested, skipping to next keyframe")
+		return
+	}
+	c.resendPending = true
+}
+
+// resendKeyframe returns the last keyframe of reader in place of frame if a
+// re-send is pending, with frame's timestamp and send time. The re-sent
+// picture thus gets its own timestamp, one frame after the previous one,
+// rather than merging into it at the receiver. The replaced frame is
+// dropped: its references are lost at the receiver anyway.
+func (c *RTPClient) resendKeyframe(reader FrameReader, frame *Frame) *Frame {
+	if !c.resendPending {
+		return frame
+	}
+	c.resendPending = false
+
+	last := reader.LastKeyframe()
+	if last == nil || frame.Keyframe {
+		return frame
+	}
+
+	slog.Info("Keyframe requested, re-sending last keyframe", "ts", frame.Timestamp)
+	resend := *last
+	resend.Timestamp, resend.SendTime = frame.Timestamp, frame.SendTime
+	return &resend
+}
+
+// SendBye tells the receiver that the client's stream, and the streams
+// sharing its socket, are over. WHIP has its own way of hanging up.
+func (c *RTPClient) SendBye(reason string, streams ...*RTPClient) error {
+	if c.conn == nil {
+		return nil
+	}
+	bye := &rtcp.Goodbye{SSRCs: []uint32{c.ssrc}, Reason: reason}
+	for _, stream := range streams {
+		bye.SSRCs = append(bye.SSRCs, stream.ssrc)
+	}
+	_, err := c.transport.Write(bye.Marshal())
+	return err
+}
+
+// Close closes the RTP client
+func (c *RTPClient) Close() error {
+	return c.feedback.Close()
+}
+
+// replayCapture sends the RTP packets of a pcap/pcapng/rtpdump file that pass
+// the filter, keeping their original spacing divided by speed (0 sends as
+// fast as possible), until ctx is done. RTCP is skipped since it belongs to
+// the old session.
+func replayCapture(ctx context.Context, client *RTPClient, filename string, filter capture.Filter, speed float64) error {
+	reader, err := capture.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var first time.Time
+	var start time.Time
+	var sent, skipped int
+
+	for ctx.Err() == nil {
+		p, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if !filter.Match(p) || rtcp.IsRTCP(p.Data) || len(p.Data) < 12 || p.Data[0]>>6 != 2 {
+			skipped++
+			continue
+		}
+
+		if first.IsZero() {
+			first = p.Time
+			start = time.Now()
+		}
+		if speed > 0 {
+			offset := time.Duration(float64(p.Time.Sub(first)) / speed)
+			if sleepUntil(ctx, start.Add(offset)) != nil {
+				break
+			}
+		}
+
+		if err := client.SendRaw(p.Data); err != nil {
+			slog.Error("Error sending RTP packet", "err", err)
+			continue
+		}
+		sent++
+
+		slog.Debug("Replayed RTP packet", "seq", binary.BigEndian.Uint16(p.Data[2:4]),
+			"ts", binary.BigEndian.Uint32(p.Data[4:8]), "ssrc", binary.BigEndian.Uint32(p.Data[8:12]), "size", len(p.Data))
+		client.logStats(time.Now())
+	}
+
+	slog.Info("End of capture", "replayed", sent, "skipped", skipped)
+	return nil
+}
+
+// sendTransportStream sends a transport stream as RTP with the payload type
+// of MPEG-TS (RFC 2250), seven TS packets per RTP packet. Packets are paced
+// by the PCR, divided by speed (0 sends as fast as possible, or as they
+// arrive from a pipe), and the RTP timestamp is the PCR on the 90 kHz clock.
+// It stops early when ctx is done.
+func sendTransportStream(ctx context.Context, client *RTPClient, f io.Reader, speed float64) error {
+	client.payloadPT = client.payloadTypes.Of(config.CodecMP2T)
+
+	var lastPCR, elapsed uint64 // 27 MHz
+	havePCR := false
+	start := time.Now()
+
+	buf := make([]byte, mpegts.PacketsPerRTP*mpegts.PacketSize)
+	for ctx.Err() == nil {
+		n, err := io.ReadFull(f, buf)
+		n -= n % mpegts.PacketSize
+		if n == 0 {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		payload := buf[:n]
+
+		for off := 0; off < n; off += mpegts.PacketSize {
+			pcr, ok := mpegts.PCR(payload[off:])
+			if !ok {
 				continue
 			}
+			if havePCR {
+				step, ok := pcrStep(lastPCR, pcr)
+				if !ok {
+					slog.Info("PCR discontinuity, re-anchoring the clock", "from", lastPCR/300, "to", pcr/300)
+				}
+				elapsed += step
+			}
+			lastPCR, havePCR = pcr, true
+			break
+		}
+
+		if speed > 0 {
+			offset := time.Duration(float64(elapsed) / 27e6 * float64(time.Second) / speed)
+			if sleepUntil(ctx, start.Add(offset)) != nil {
+				break
+			}
+		}
+
+		client.timestamp = uint32(lastPCR / 300)
+		if err := client.SendPacket(payload, false); err != nil {
+			slog.Error("Error sending RTP packet", "err", err)
+		}
+		client.logStats(time.Now())
+
+		if err != nil {
+			break // short read at the end of the file
+		}
+	}
+
+	slog.Info("End of transport stream", "packets", client.packetsSent, "bytes", client.bytesSent)
+	return nil
+}
+
+// pcrStep returns the time from one PCR to the next on the 27 MHz clock,
+// across the 2^33 wrap of the 90 kHz base. A step back or of more than
+// five seconds, as where a file was cut or looped, is a discontinuity: the
+// step is then 0 and ok false, so pacing carries on from the new PCR.
+func pcrStep(last, pcr uint64) (step uint64, ok bool) {
+	const pcrWrap = 1 << 33 * 300
+	const maxStep = 5 * 27000000
+	step = (pcr - last + pcrWrap) % pcrWrap
+	if step > maxStep {
+		return 0, false
+	}
+	return step, true
+}
+
+// loadFrame is an access unit packetized once and shared by all load
+// generator streams
+type loadFrame struct {
+	payloads  [][]byte
+	timestamp uint32
+	sendTime  time.Duration
+}
+
+// loadFile is an MP4 file read into memory for the load generator
+type loadFile struct {
+	frames  []loadFrame
+	length  time.Duration // of one loop
+	packets int           // per loop
+}
+
+// readLoadFile reads and packetizes the rest of a file for the client's
+// codec
+func (c *RTPClient) readLoadFile(reader FrameReader) (*loadFile, error) {
+	file := &loadFile{}
+	for {
+		frame, err := reader.ReadNextFrame()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		payloads := c.packetize(frame.NALUs)
+		file.frames = append(file.frames, loadFrame{payloads: payloads, timestamp: frame.Timestamp, sendTime: frame.SendTime})
+		file.packets += len(payloads)
+	}
+	if len(file.frames) == 0 {
+		return nil, errors.New("no frames to send")
+	}
+	file.length = reader.Length()
+	return file, nil
+}
+
+// loadOptions are the settings of a load test
+type loadOptions struct {
+	streams    int
+	sharedPort bool          // send all streams from the client's socket
+	stagger    time.Duration // between the starts of consecutive streams
+	loop       bool
+	limit      time.Duration // media time per stream, 0 for no limit
+	rate       float64       // playback speed factor, 0 for as fast as possible
+}
+
+// loadStats are the counters of a load test, updated by all streams
+type loadStats struct {
+	packets, bytes, errors atomic.Uint64
+	active                 atomic.Int64
+	streamTime             atomic.Int64 // total time the streams ran, in ns
+}
+
+// sendLoad sends the file as one load generator stream, with the same
+// timing rules as a single stream: loops keep the timestamps increasing. It
+// stops early when ctx is done.
+func (c *RTPClient) sendLoad(ctx context.Context, file *loadFile, opts loadOptions, stats *loadStats) {
+	loopTicks := uint32(uint64(file.length) * 90000 / uint64(time.Second))
+	warned := false
+	start := time.Now()
+
+	for loop := 0; ; loop++ {
+		offset := time.Duration(loop) * file.length
+		for i := range file.frames {
+			frame := &file.frames[i]
+			sendTime := offset + frame.sendTime
+			if opts.limit > 0 && sendTime >= opts.limit {
+				return
+			}
+			if pace(ctx, start, sendTime, opts.rate) != nil {
+				return
+			}
+
+			c.timestamp = frame.timestamp + uint32(loop)*loopTicks
+			for j, payload := range frame.payloads {
+				bytesBefore := c.bytesSent
+				if err := c.SendPacket(payload, j == len(frame.payloads)-1); err != nil {
+					stats.errors.Add(1)
+					if !warned {
+						slog.Warn("Error sending RTP packet", "ssrc", c.ssrc, "err", err)
+						warned = true
+					}
+					continue
+				}
+				stats.packets.Add(1)
+				stats.bytes.Add(c.bytesSent - bytesBefore)
+			}
+			c.framesSent++
+		}
+		if !opts.loop {
+			return
+		}
+	}
+}
+
+// runLoad sends the file as opts.streams concurrent streams with SSRCs
+// counting up from the client's. It logs the aggregate send rate every
+// statsInterval and at the end compares the packet rate achieved with the
+// one the file's timing asks for. When ctx is done, the streams stop and say
+// goodbye.
+func runLoad(ctx context.Context, client *RTPClient, file *loadFile, opts loadOptions, statsInterval time.Duration) error {
+	streams := []*RTPClient{client}
+	for i := 1; i < opts.streams; i++ {
+		stream, err := client.newStream(client.ssrc+uint32(i), opts.sharedPort)
+		if err != nil {
+			return err
+		}
+		if !opts.sharedPort {
+			defer stream.Close()
+		}
+		streams = append(streams, stream)
+	}
+
+	// Packets per second of one stream, 0 when not paced
+	var streamRate float64
+	if opts.rate > 0 && file.length > 0 {
+		streamRate = float64(file.packets) / file.length.Seconds() * opts.rate
+	}
+
+	stats := &loadStats{}
+	var wg sync.WaitGroup
+	begin := time.Now()
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(i int, stream *RTPClient) {
+			defer wg.Done()
+			if sleepUntil(ctx, begin.Add(time.Duration(i)*opts.stagger)) != nil {
+				return
+			}
+
+			stats.active.Add(1)
+			started := time.Now()
+			stream.sendLoad(ctx, file, opts, stats)
+			stats.streamTime.Add(int64(time.Since(started)))
+			stats.active.Add(-1)
+			if err := stream.SendBye(byeReason(ctx)); err != nil {
+				slog.Warn("Error sending RTCP BYE", "ssrc", stream.ssrc, "err", err)
+			}
+		}(i, stream)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var tick <-chan time.Time
+	if statsInterval > 0 {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last, lastPackets, lastBytes := begin, uint64(0), uint64(0)
+	for running := true; running; {
+		select {
+		case now := <-tick:
+			packets, bytes := stats.packets.Load(), stats.bytes.Load()
+			elapsed := now.Sub(last).Seconds()
+			active := stats.active.Load()
+			slog.Info("Load stats",
+				"streams", active,
+				"pps", math.Round(float64(packets-lastPackets)/elapsed),
+				"target_pps", math.Round(float64(active)*streamRate),
+				"kbps", math.Round(float64(bytes-lastBytes)*8/elapsed/1000),
+				"errors", stats.errors.Load())
+			last, lastPackets, lastBytes = now, packets, bytes
+		case <-done:
+			running = false
+		}
+	}
+
+	elapsed := time.Since(begin).Seconds()
+	packets := stats.packets.Load()
+	args := []any{
+		"streams", len(streams),
+		"packets", packets,
+		"errors", stats.errors.Load(),
+		"seconds", math.Round(elapsed*10) / 10,
+		"pps", math.Round(float64(packets) / elapsed),
+		"kbps", math.Round(float64(stats.bytes.Load()) * 8 / elapsed / 1000),
+	}
+	if streamRate > 0 {
+		// What the streams should have sent in the time they ran
+		target := streamRate * time.Duration(stats.streamTime.Load()).Seconds() / elapsed
+		args = append(args, "target_pps", math.Round(target), "achieved_percent", math.Round(float64(packets)/elapsed/target*1000)/10)
+	}
+	slog.Info("Load test finished", args...)
+	return nil
+}
+
+// senderReportInterval is how often sender reports go out, RFC 3550 leaves
+// it to the bandwidth but a second keeps the receiver's mapping fresh
+const senderReportInterval = time.Second
+
+// senderReports sends the RTCP that maps the streams' RTP timestamps to a
+// common wallclock: a sender report per stream and their shared CNAME. With
+// it the receiver can time frames and, for an MP4 with an AAC track, whose
+// AudioSpecificConfig goes along, line up the audio and video.
+type senderReports struct {
+	video, audio *RTPClient // audio is nil unless an AAC track is sent
+	reader       *MP4Reader
+	config       *mp4.AudioConfig
+	cname        string
+	next         time.Time
+}
+
+// newSenderReports reports on the video stream
+func newSenderReports(video *RTPClient) *senderReports {
+	host, _ := os.Hostname()
+	return &senderReports{
+		video: video,
+		cname: fmt.Sprintf("client-%d@%s", os.Getpid(), host),
+	}
+}
+
+// addAudio pairs the video stream with the audio stream of the reader's
+// AAC track
+func (r *senderReports) addAudio(audio *RTPClient, reader *MP4Reader, config *mp4.AudioConfig) {
+	r.audio, r.reader, r.config = audio, reader, config
+}
 
-			// Send RTP packet
-			err = client.SendPacket(chunk)
+// sendAudio sends the audio frames due before media time limit, each paced
+// to its own time, until ctx is done
+func (r *senderReports) sendAudio(ctx context.Context, start time.Time, limit time.Duration, rate float64) {
+	if r.audio == nil {
+		return
+	}
+	for {
+		frame, err := r.reader.ReadAudioFrame(limit)
+		if err != nil {
+			slog.Error("Error reading audio frame", "err", err)
+		}
+		if frame == nil {
+			return
+		}
+		if pace(ctx, start, frame.SendTime, rate) != nil {
+			return
+		}
+		if err := r.audio.SendAudio(frame); err != nil {
+			slog.Error("Error sending RTP packet", "err", err)
+		}
+	}
+}
+
+// send sends the reports once the interval has passed since the previous
+// ones, t being the media time at wallclock now
+func (r *senderReports) send(now time.Time, t time.Duration) error {
+	if now.Before(r.next) {
+		return nil
+	}
+	r.next = now.Add(senderReportInterval)
+
+	packets := []rtcp.Packet{r.video.senderReport(now, t, 90000)}
+	sdes := &rtcp.SourceDescription{Chunks: []rtcp.SDESChunk{{SSRC: r.video.ssrc, CNAME: r.cname}}}
+	if r.audio != nil {
+		packets = append(packets, r.audio.senderReport(now, t, r.config.SampleRate))
+		sdes.Chunks = append(sdes.Chunks, rtcp.SDESChunk{SSRC: r.audio.ssrc, CNAME: r.cname})
+	}
+	packets = append(packets, sdes)
+	if r.audio != nil {
+		packets = append(packets, &rtcp.ApplicationDefined{SSRC: r.audio.ssrc, Name: rtcp.AudioConfigName, Data: r.config.Config})
+	}
+
+	var compound []byte
+	for _, p := range packets {
+		compound = append(compound, p.Marshal()...)
+	}
+	_, err := r.video.transport.Write(compound)
+	return err
+}
+
+// openVideoFile opens an MP4 file, or an H.264 or H.265 elementary stream
+// timed at fps frames per second
+func openVideoFile(filename string, fps float64) (FrameReader, error) {
+	codec := annexBFileCodec(filename)
+	if codec == "" {
+		reader, err := NewMP4Reader(filename)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewAnnexBReader(f, codec, fps)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rate, source := reader.FrameRate()
+	slog.Info("Reading elementary stream", "codec", codecName(codec), "fps", rate, "fps_from", source)
+	if source == "default" {
+		slog.Warn("No frame rate in the SPS, assuming the default; set -fps", "fps", rate)
+	}
+	return reader, nil
+}
+
+// watchConfig reloads the config file on every SIGHUP, applying the changed
+// settings that are reloadable and then calling apply
+func watchConfig(loader *config.Loader, reloadable []string, apply func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			applied, restart, err := loader.Reload(reloadable...)
 			if err != nil {
-				fmt.Printf("Error sending RTP packet: %v\n", err)
+				slog.Error("Config reload failed, keeping the current settings", "err", err)
+				continue
+			}
+			if err := apply(); err != nil {
+				slog.Error("Error applying reloaded config", "err", err)
+			}
+			slog.Info("Reloaded config", "changed", applied)
+			if len(restart) > 0 {
+				slog.Warn("Changed settings take effect after a restart", "settings", restart)
+			}
+		}
+	}()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run runs the client and returns its exit status: 0 when the input was sent
+// or the client was stopped by a signal, 1 on error. Deferred cleanup runs
+// before the exit.
+func run() int {
+	congestionControl := flag.Bool("cc", true, "use transport-cc feedback to estimate bandwidth and drop non-reference frames when short")
+	netsimSpec := flag.String("netsim", "", "impair outgoing packets, e.g. loss=0.02,ge=0.01:0.3:0:0.5,delay=40ms,jitter=10ms,reorder=0.01,dup=0.01,rate=2m,queue=200ms,seed=1")
+	port := flag.Uint("port", 0, "when replaying a capture, only send UDP packets from or to this port")
+	ssrc := flag.Uint("ssrc", 0, "when replaying a capture, only send packets with this SSRC")
+	rate := flag.Float64("rate", 1, "playback speed factor, e.g. 2 for twice real time (0 = as fast as possible)")
+	speed := flag.Float64("speed", 1, "deprecated alias of -rate")
+	loop := flag.Bool("loop", false, "restart an MP4, H.264 or H.265 file at the end, continuing sequence numbers and timestamps")
+	seek := flag.Duration("ss", 0, "start an MP4, H.264 or H.265 file at this time, from the keyframe at or before it")
+	limit := flag.Duration("t", 0, "stop an MP4, H.264 or H.265 file after this much media time (0 = no limit)")
+	fps := flag.Float64("fps", 0, "frame rate of an H.264 or H.265 elementary stream (0 = from the SPS, else 25)")
+	streams := flag.Int("streams", 1, "load test: send an MP4, H.264 or H.265 file as this many concurrent streams with consecutive SSRCs")
+	sharedPort := flag.Bool("shared-port", false, "load test: send all streams from one source port instead of one port each")
+	stagger := flag.Duration("stagger", 10*time.Millisecond, "load test: delay between the starts of consecutive streams")
+	ttl := flag.Int("ttl", 1, "multicast TTL / hop limit")
+	loopback := flag.Bool("loopback", true, "deliver multicast packets to receivers on this host too")
+	iface := flag.String("iface", "", "network interface to send multicast on")
+	latencyExt := flag.String("latency-ext", "", "stamp packets with their send time for the receiver to measure latency: abs-send-time or ntp-64")
+	sendAudio := flag.Bool("audio", true, "also send the AAC track of an MP4 file, synchronized with RTCP sender reports")
+	publishWHIP := flag.Bool("whip", false, "publish over WebRTC to the WHIP endpoint URL given instead of the server address")
+	payloadTypes := &config.PayloadTypes{}
+	flag.Var(payloadTypes, "payload-types", "RTP payload type of each codec as codec=type pairs, of h264, h265, aac and mp2t; WHIP negotiates its own")
+	configFile := flag.String("config", "", "read settings from a JSON file of flag names and values, overridden by the command line; SIGHUP reloads -v and -log-format")
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Println("Usage: client [flags] <server_address:port> <mp4_file|h264_file|h265_file|ts_file|pcap|pcapng|rtpdump>")
+		fmt.Println("       client -whip [flags] <whip_url> <mp4_file|h264_file>")
+		fmt.Println("       producer | client [flags] <server_address:port> -")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	var loader *config.Loader
+	if *configFile != "" {
+		var err error
+		if loader, err = config.NewLoader(flag.CommandLine, *configFile); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		args = loader.Args()
+	}
+	if len(args) < 2 {
+		flag.Usage()
+		return 1
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "speed" {
+			*rate = *speed
+		}
+	})
+	if *rate < 0 {
+		fmt.Println("-rate must not be negative")
+		return 1
+	}
+	if *streams < 1 {
+		fmt.Println("-streams must be at least 1")
+		return 1
+	}
+	if *streams > 1 && (*publishWHIP || *netsimSpec != "") {
+		fmt.Println("-streams cannot be combined with -whip or -netsim")
+		return 1
+	}
+	if *publishWHIP && annexBFileCodec(args[1]) == config.CodecH265 {
+		fmt.Println("-whip only publishes H.264")
+		return 1
+	}
+	if err := logOpts.Setup(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if loader != nil {
+		watchConfig(loader, []string{"v", "log-format"}, logOpts.Setup)
+	}
+
+	// SIGINT or SIGTERM stops sending, and the receiver is told with an
+	// RTCP BYE
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer func() {
+		if ctx.Err() != nil {
+			slog.Info("Stopped on signal")
+		}
+	}()
+
+	serverAddr := args[0]
+	mp4File := args[1]
+
+	// Create RTP client
+	var client *RTPClient
+	var err error
+	if *publishWHIP {
+		client, err = NewWHIPClient(serverAddr)
+	} else {
+		client, err = NewRTPClient(serverAddr)
+	}
+	if err != nil {
+		slog.Error("Failed to create RTP client", "err", err)
+		return 1
+	}
+	defer client.Close()
+	client.statsInterval = logOpts.Interval
+	if !*publishWHIP {
+		client.payloadTypes = payloadTypes
+		client.payloadPT = payloadTypes.Of(config.CodecH264)
+	}
+
+	switch *latencyExt {
+	case "":
+	case "abs-send-time":
+		client.sendTimeExt = rtpext.AbsSendTimeID
+	case "ntp-64":
+		client.sendTimeExt = rtpext.NTP64ID
+	default:
+		slog.Error("Invalid -latency-ext, expected abs-send-time or ntp-64", "value", *latencyExt)
+		return 1
+	}
+
+	if client.IsMulticast() {
+		ifi, err := multicast.Interface(*iface)
+		if err == nil {
+			err = client.SetMulticastOptions(multicast.SenderOptions{TTL: *ttl, Loopback: *loopback, Interface: ifi})
+		}
+		if err != nil {
+			slog.Error("Failed to configure multicast", "err", err)
+			return 1
+		}
+		slog.Info("Sending to multicast group", "group", serverAddr, "ttl", *ttl)
+	}
+
+	// Optionally route packets through the network impairment simulator
+	if *netsimSpec != "" {
+		cfg, err := netsim.ParseConfig(*netsimSpec)
+		if err != nil {
+			slog.Error("Invalid -netsim", "err", err)
+			return 1
+		}
+
+		sim := netsim.NewConn(client.transport, cfg)
+		client.SetTransport(sim)
+		defer func() {
+			sim.Flush()
+			slog.Info("Network simulator", "stats", fmt.Sprintf("%+v", sim.Stats()))
+		}()
+	}
+
+	// Live input from a pipe is sent as it arrives: a transport stream as it
+	// is, an elementary stream timed on arrival unless -fps is given
+	var reader FrameReader
+	if mp4File == "-" {
+		if *loop || *seek > 0 || *streams > 1 {
+			slog.Error("-loop, -ss and -streams need a file, not stdin")
+			return 1
+		}
+
+		input := bufio.NewReaderSize(os.Stdin, 64<<10)
+		if head, err := input.Peek(1); err == nil && head[0] == 0x47 { // TS sync byte
+			slog.Info("Relaying transport stream from stdin", "to", serverAddr)
+			return sendTS(ctx, client, input, 0)
+		}
+
+		codec := config.CodecH264
+		if head, err := input.Peek(6); err == nil && sniffAnnexB(head) == config.CodecH265 {
+			codec = config.CodecH265
+		}
+		live, err := NewAnnexBReader(io.NopCloser(input), codec, *fps)
+		if err != nil {
+			slog.Error("Failed to read elementary stream from stdin", "err", err)
+			return 1
+		}
+		timing := "fps"
+		if *fps == 0 {
+			live.TimeOnArrival()
+			timing = "arrival"
+		}
+		slog.Info("Reading elementary stream from stdin", "codec", codecName(codec), "timing", timing)
+		reader = live
+	}
+
+	if *streams > 1 && (capture.IsCaptureFile(mp4File) || mpegts.IsTransportStream(mp4File)) {
+		slog.Error("-streams needs an MP4 file", "file", mp4File)
+		return 1
+	}
+
+	// Replay captures packet by packet instead of packetizing an MP4
+	if capture.IsCaptureFile(mp4File) {
+		slog.Info("Replaying capture", "file", mp4File, "to", serverAddr)
+
+		filter := capture.Filter{Port: uint16(*port), SSRC: uint32(*ssrc)}
+		if err := replayCapture(ctx, client, mp4File, filter, *rate); err != nil {
+			slog.Error("Error replaying capture", "err", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Transport streams are sent as they are, without depacketizing
+	if mpegts.IsTransportStream(mp4File) {
+		slog.Info("Sending transport stream", "file", mp4File, "to", serverAddr)
+
+		f, err := os.Open(mp4File)
+		if err != nil {
+			slog.Error("Failed to open transport stream", "err", err)
+			return 1
+		}
+		defer f.Close()
+
+		return sendTS(ctx, client, f, *rate)
+	}
+
+	// Open MP4 file
+	if reader == nil {
+		reader, err = openVideoFile(mp4File, *fps)
+		if err != nil {
+			slog.Error("Failed to open video file", "err", err)
+			return 1
+		}
+	}
+	defer reader.Close()
+
+	// H.265 goes with its own payload type; WHIP only negotiates H.264,
+	// which files were checked for before connecting
+	if r, ok := reader.(*AnnexBReader); ok && r.Codec() == config.CodecH265 {
+		if *publishWHIP {
+			slog.Error("-whip only publishes H.264, got H.265 from stdin")
+			return 1
+		}
+		client.hevc = true
+		client.payloadPT = payloadTypes.Of(config.CodecH265)
+	}
+
+	if *seek > 0 {
+		at, err := reader.Seek(*seek)
+		if err != nil {
+			slog.Error("Failed to seek", "err", err)
+			return 1
+		}
+		slog.Info("Starting at keyframe", "requested", *seek, "at", at)
+	}
+
+	// Load tests share one packetized copy of the file between the streams
+	if *streams > 1 {
+		file, err := client.readLoadFile(reader)
+		if err != nil {
+			slog.Error("Failed to read video file", "err", err)
+			return 1
+		}
+		slog.Info("Starting load test", "file", mp4File, "to", serverAddr, "streams", *streams,
+			"frames", len(file.frames), "packets_per_loop", file.packets)
+
+		opts := loadOptions{streams: *streams, sharedPort: *sharedPort, stagger: *stagger, loop: *loop, limit: *limit, rate: *rate}
+		if err := runLoad(ctx, client, file, opts, logOpts.Interval); err != nil {
+			slog.Error("Load test failed", "err", err)
+			return 1
+		}
+		return 0
+	}
+
+	if *congestionControl {
+		client.EnableCongestionControl(func(bps int) {
+			slog.Debug("Target bitrate changed", "kbps", bps/1000)
+		})
+	}
+
+	// Sender reports go out with the packets, and the AAC track of an MP4
+	// as a second stream from the same socket. WHIP has its own RTCP and
+	// only negotiates video.
+	var reports *senderReports
+	if !*publishWHIP {
+		reports = newSenderReports(client)
+	}
+	if r, ok := reader.(*MP4Reader); ok && *sendAudio && reports != nil {
+		audioConfig, err := r.EnableAudio()
+		if err == nil {
+			audio, _ := client.newStream(client.ssrc+1, true)
+			audio.payloadPT = client.payloadTypes.Of(config.CodecAAC)
+			reports.addAudio(audio, r, audioConfig)
+			slog.Info("Sending audio stream", "ssrc", audio.ssrc, "sample_rate", audioConfig.SampleRate, "channels", audioConfig.Channels)
+		} else if err != mp4.ErrNoAudioTrack {
+			slog.Warn("Not sending audio", "err", err)
+		}
+	}
+
+	slog.Info("Sending video stream", "file", mp4File, "to", serverAddr)
+
+	go client.ReadFeedback()
+
+	err = client.Run(ctx, reader, reports, streamOptions{loop: *loop, limit: *limit, rate: *rate})
+	var audio []*RTPClient
+	if reports != nil && reports.audio != nil {
+		audio = append(audio, reports.audio)
+	}
+	if err := client.SendBye(byeReason(ctx), audio...); err != nil {
+		slog.Warn("Error sending RTCP BYE", "err", err)
+	}
+
+	end := []any{"packets", client.packetsSent, "frames", client.framesSent, "dropped", client.framesDropped}
+	if client.dropper != nil {
+		end = append(end,
+			"dropped_non_reference", client.framesDropped-client.tailFramesDropped-client.layerFramesDropped,
+			"dropped_temporal_layer", client.layerFramesDropped,
+			"dropped_gop_tail", client.tailFramesDropped,
+			"redundant_bytes", client.redundantBytes)
+	}
+	slog.Info("End of video stream", end...)
+	if len(audio) > 0 {
+		slog.Info("End of audio stream", "packets", audio[0].packetsSent, "frames", audio[0].framesSent)
+	}
+	if err != nil {
+		slog.Error("Error sending video stream", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// sendTS sends a transport stream and says goodbye, returning the exit
+// status
+func sendTS(ctx context.Context, client *RTPClient, f io.Reader, speed float64) int {
+	err := sendTransportStream(ctx, client, f, speed)
+	if err := client.SendBye(byeReason(ctx)); err != nil {
+		slog.Warn("Error sending RTCP BYE", "err", err)
+	}
+	if err != nil {
+		slog.Error("Error sending transport stream", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// streamOptions are the playback settings of a single stream
+type streamOptions struct {
+	loop  bool
+	limit time.Duration // media time, 0 for no limit
+	rate  float64       // playback speed factor, 0 for as fast as possible
+}
+
+// Run sends the frames of reader, paced by their decode timestamps divided
+// by the rate, along with the audio and sender reports if reports is not
+// nil. It returns at the end of the input or when ctx is done, and an error
+// only if the input cannot be read any further.
+func (c *RTPClient) Run(ctx context.Context, reader FrameReader, reports *senderReports, opts streamOptions) error {
+	start := time.Now()
+
+	for ctx.Err() == nil {
+		c.recoverKeyframe(reader)
+
+		// Read next frame/access unit
+		frame, err := reader.ReadNextFrame()
+		if err == io.EOF && opts.loop {
+			slog.Debug("Looping to the start", "frames", c.framesSent)
+			if err := reader.Rewind(); err != nil {
+				return fmt.Errorf("looping: %w", err)
 			}
+			continue
+		} else if err == io.EOF {
+			// Audio may run past the last video frame
+			if reports != nil {
+				reports.sendAudio(ctx, start, math.MaxInt64, opts.rate)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading frame: %w", err)
+		}
+		if opts.limit > 0 && frame.SendTime >= opts.limit {
+			return nil
 		}
+		frame = c.resendKeyframe(reader, frame)
+
+		// Audio due before the frame goes first
+		if reports != nil {
+			reports.sendAudio(ctx, start, frame.SendTime, opts.rate)
+		}
+
+		if pace(ctx, start, frame.SendTime, opts.rate) != nil {
+			return nil
+		}
+
+		if reports != nil {
+			// Without pacing, the media time is as far as the file got
+			now, t := time.Now(), frame.SendTime
+			if opts.rate > 0 {
+				t = time.Duration(float64(now.Sub(start)) * opts.rate)
+			}
+			if err := reports.send(now, t); err != nil {
+				slog.Error("Error sending RTCP packet", "err", err)
+			}
+		}
+
+		nalus, dropped := c.thin(frame)
+		if dropped {
+			if len(nalus) > 0 {
+				if err := c.sendNALUs(frame.Timestamp, nalus); err != nil {
+					slog.Error("Error sending RTP packet", "err", err)
+				}
+			}
+			continue
+		}
+
+		// Send RTP packets, less any redundant slices removed
+		sent := *frame
+		sent.NALUs = nalus
+		if err := c.SendFrame(&sent); err != nil {
+			slog.Error("Error sending RTP packet", "err", err)
+		}
+		c.logStats(time.Now())
+	}
+	return nil
+}
+
+// pace sleeps until media time t, divided by the rate, after start. It
+// returns ctx's error if ctx is done first.
+func pace(ctx context.Context, start time.Time, t time.Duration, rate float64) error {
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	return sleepUntil(ctx, start.Add(time.Duration(float64(t)/rate)))
+}
+
+// sleepUntil sleeps until t, or returns ctx's error if ctx is done first
+func sleepUntil(ctx context.Context, t time.Time) error {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// byeReason is the reason given in the RTCP BYE at the end of a stream
+func byeReason(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "interrupted"
 	}
+	return "end of file"
 }
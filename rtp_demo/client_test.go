@@ -0,0 +1,83 @@
+package main
+
+// client.go and server.go are separate programs: run with
+// go test client.go client_test.go
+
+import (
+	"testing"
+	"time"
+)
+
+// endOfGOP is a FrameReader with no keyframe left to skip to
+type endOfGOP struct {
+	last *Frame
+}
+
+func (r *endOfGOP) ReadNextFrame() (*Frame, error)              { return nil, nil }
+func (r *endOfGOP) Seek(t time.Duration) (time.Duration, error) { return t, nil }
+func (r *endOfGOP) Rewind() error                               { return nil }
+func (r *endOfGOP) Length() time.Duration                       { return 0 }
+func (r *endOfGOP) SkipToNextKeyframe() bool                    { return false }
+func (r *endOfGOP) LastKeyframe() *Frame                        { return r.last }
+func (r *endOfGOP) ParameterSets() [][]byte                     { return nil }
+func (r *endOfGOP) Close() error                                { return nil }
+
+func TestResendKeyframe(t *testing.T) {
+	idr := &Frame{NALUs: [][]byte{{0x67}, {0x68}, {0x65}}, Timestamp: 0, Keyframe: true}
+	reader := &endOfGOP{last: idr}
+	c := &RTPClient{}
+
+	// The previous frame went out at 27000, the request comes after it
+	c.timestamp = 27000
+	c.keyframeRequested.Store(true)
+	c.recoverKeyframe(reader)
+
+	next := &Frame{NALUs: [][]byte{{0x41}}, Timestamp: 30000, SendTime: time.Second}
+	got := c.resendKeyframe(reader, next)
+	if len(got.NALUs) != 3 || !got.Keyframe {
+		t.Fatalf("Expected the last keyframe in place of the next frame, got %d NAL units", len(got.NALUs))
+	}
+	if got.Timestamp != 30000 || got.SendTime != time.Second {
+		t.Errorf("Expected the re-sent keyframe at timestamp 30000 and 1s, got %d and %v", got.Timestamp, got.SendTime)
+	}
+	if idr.Timestamp != 0 {
+		t.Errorf("Expected the reader's keyframe unchanged, got timestamp %d", idr.Timestamp)
+	}
+
+	// Served once
+	following := &Frame{NALUs: [][]byte{{0x41}}, Timestamp: 33000}
+	if got := c.resendKeyframe(reader, following); got != following {
+		t.Error("Expected the following frame sent as read")
+	}
+
+	// A keyframe read next serves the request itself
+	c.keyframeRequested.Store(true)
+	c.recoverKeyframe(reader)
+	key := &Frame{NALUs: [][]byte{{0x65}}, Timestamp: 36000, Keyframe: true}
+	if got := c.resendKeyframe(reader, key); got != key {
+		t.Error("Expected a keyframe read next sent as read")
+	}
+}
+
+func TestPCRStep(t *testing.T) {
+	const second = 27000000
+	const wrap = 1 << 33 * 300
+	for _, tc := range []struct {
+		name      string
+		last, pcr uint64
+		want      uint64
+		ok        bool
+	}{
+		{"forward", 10 * second, 10*second + second/25, second / 25, true},
+		{"same", second, second, 0, true},
+		{"across the wrap", wrap - second/10, second / 10, second / 5, true},
+		{"backward", 60 * second, 2 * second, 0, false},
+		{"jump ahead", 2 * second, 60 * second, 0, false},
+		{"just back across the wrap", second / 10, wrap - second/10, 0, false},
+	} {
+		step, ok := pcrStep(tc.last, tc.pcr)
+		if step != tc.want || ok != tc.ok {
+			t.Errorf("%s: expected %d, %v, got %d, %v", tc.name, tc.want, tc.ok, step, ok)
+		}
+	}
+}
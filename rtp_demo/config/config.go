@@ -0,0 +1,438 @@
+// Package config reads the settings of the client and the server from a
+// JSON file. Its keys are the names of their command line flags, with
+// nested objects joined to their keys by a dash, so that
+//
+//	{"hls": true, "log": {"format": "json"}}
+//
+// sets -hls and -log-format. The "args" key holds the positional arguments.
+// An object set for a keyed flag such as -payload-types becomes its
+// key=value pairs instead:
+//
+//	{"payload-types": {"h264": 100, "aac": 101}}
+//
+// sets -payload-types aac=101,h264=100. Flags given on the command line
+// override the file, and a reload applies only the settings that can change
+// while running.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgsKey is the key of the positional arguments
+const ArgsKey = "args"
+
+// File is a parsed config file
+type File struct {
+	Path     string
+	Args     []string
+	settings map[string]setting
+}
+
+// setting is one flag value and where in the file it was set
+type setting struct {
+	value  string
+	pos    string // file:line:column
+	offset int64  // in the file, to order settings by position
+}
+
+// Load reads and parses a config file
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return Parse(path, data)
+}
+
+// Parse parses the contents of a config file named path
+func Parse(path string, data []byte) (*File, error) {
+	p := &parser{
+		file: &File{Path: path, settings: make(map[string]setting)},
+		data: data,
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+	}
+	p.dec.UseNumber()
+
+	if tok, err := p.dec.Token(); err != nil {
+		return nil, p.syntaxError(err)
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("config: %s: expected a JSON object", p.position(0))
+	}
+	if err := p.object(""); err != nil {
+		return nil, err
+	}
+	end := p.dec.InputOffset()
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("config: %s: unexpected data after the object", p.position(end))
+	}
+	return p.file, nil
+}
+
+// parser walks the JSON tokens, keeping track of positions for errors
+type parser struct {
+	file *File
+	data []byte
+	dec  *json.Decoder
+}
+
+// object reads the members of an object up to its closing brace, with keys
+// prefixed by those of the enclosing objects
+func (p *parser) object(prefix string) error {
+	for p.dec.More() {
+		offset := p.dec.InputOffset()
+		pos := p.position(offset)
+		tok, err := p.dec.Token()
+		if err != nil {
+			return p.syntaxError(err)
+		}
+		key := prefix + tok.(string)
+
+		tok, err = p.dec.Token()
+		if err != nil {
+			return p.syntaxError(err)
+		}
+		if tok == json.Delim('{') {
+			if err := p.object(key + "-"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var value string
+		if tok == json.Delim('[') {
+			list, err := p.array(pos, key)
+			if err != nil {
+				return err
+			}
+			if key == ArgsKey {
+				p.file.Args = list
+				continue
+			}
+			value = strings.Join(list, ",") // like -source a,b
+		} else if value, err = scalar(tok); err != nil {
+			return fmt.Errorf("config: %s: %q: %v", pos, key, err)
+		}
+		if key == ArgsKey {
+			return fmt.Errorf("config: %s: %q must be a list of strings", pos, key)
+		}
+		if previous, ok := p.file.settings[key]; ok {
+			return fmt.Errorf("config: %s: %q already set at %s", pos, key, previous.pos)
+		}
+		p.file.settings[key] = setting{value: value, pos: pos, offset: offset}
+	}
+	_, err := p.dec.Token()
+	return p.syntaxError(err)
+}
+
+// array reads a list of values up to its closing bracket
+func (p *parser) array(pos, key string) ([]string, error) {
+	var list []string
+	for p.dec.More() {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return nil, p.syntaxError(err)
+		}
+		value, err := scalar(tok)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %q: %v in a list", pos, key, err)
+		}
+		list = append(list, value)
+	}
+	_, err := p.dec.Token()
+	return list, p.syntaxError(err)
+}
+
+// scalar returns a JSON string, number or boolean as a flag value
+func scalar(tok json.Token) (string, error) {
+	switch v := tok.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", errors.New("null is not a value")
+	default:
+		return "", errors.New("nested lists are not supported")
+	}
+}
+
+// syntaxError adds the position to a JSON syntax error
+func (p *parser) syntaxError(err error) error {
+	var syntax *json.SyntaxError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &syntax):
+		// The offset is past the offending character
+		return fmt.Errorf("config: %s: %v", p.position(max(syntax.Offset-1, 0)), err)
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("config: %s: unexpected end of file", p.position(int64(len(p.data))))
+	default:
+		return fmt.Errorf("config: %s: %v", p.file.Path, err)
+	}
+}
+
+// position returns the file, line and column of the first token at or after
+// offset, skipping the separators the decoder has not consumed yet
+func (p *parser) position(offset int64) string {
+	i := int(offset)
+	for i < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[i]) >= 0 {
+		i++
+	}
+	line, column := 1, 1
+	for _, c := range p.data[:min(i, len(p.data))] {
+		if c == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return fmt.Sprintf("%s:%d:%d", p.file.Path, line, column)
+}
+
+// Value returns the value of a setting, as it would be given on the command
+// line
+func (f *File) Value(name string) (string, bool) {
+	s, ok := f.settings[name]
+	return s.value, ok
+}
+
+// names returns the names of the settings in order
+func (f *File) names() []string {
+	names := make([]string, 0, len(f.settings))
+	for name := range f.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keyedValue is a flag whose value is a list of key=value pairs, set in a
+// file as an object
+type keyedValue interface {
+	flag.Value
+	keyed()
+}
+
+// checker is a flag of this package that validates a value without setting
+// it
+type checker interface {
+	check(value string) error
+}
+
+// Check reports every setting that is not a flag of fs or whose value the
+// flag would reject. The members of objects set for keyed flags are joined
+// into the flag's value first.
+func (f *File) Check(fs *flag.FlagSet) error {
+	errs := f.joinKeyed(fs)
+	for _, name := range f.names() {
+		s := f.settings[name]
+		fl := fs.Lookup(name)
+		switch {
+		case fl == nil:
+			errs = append(errs, fmt.Errorf("config: %s: unknown setting %q", s.pos, name))
+		case name == "config":
+			errs = append(errs, fmt.Errorf("config: %s: %q cannot be set in a config file", s.pos, name))
+		default:
+			if err := checkValue(fl, s.value); err != nil {
+				errs = append(errs, fmt.Errorf("config: %s: %q: invalid value %q: %v", s.pos, name, s.value, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// joinKeyed replaces the settings made from the members of an object for a
+// keyed flag, e.g. payload-types-h264 and payload-types-aac, with one
+// setting of the flag, aac=…,h264=…, at the position of the first member
+func (f *File) joinKeyed(fs *flag.FlagSet) []error {
+	pairs := make(map[string][]string)
+	first := make(map[string]setting)
+	for _, name := range f.names() {
+		if fs.Lookup(name) != nil {
+			continue
+		}
+		for i := strings.LastIndexByte(name, '-'); i > 0; i = strings.LastIndexByte(name[:i], '-') {
+			fl := fs.Lookup(name[:i])
+			if fl == nil {
+				continue
+			}
+			if _, ok := fl.Value.(keyedValue); ok {
+				s := f.settings[name]
+				pairs[fl.Name] = append(pairs[fl.Name], name[i+1:]+"="+s.value)
+				if prev, ok := first[fl.Name]; !ok || s.offset < prev.offset {
+					first[fl.Name] = s
+				}
+				delete(f.settings, name)
+			}
+			break
+		}
+	}
+
+	names := make([]string, 0, len(pairs))
+	for name := range pairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		list := pairs[name]
+		if previous, ok := f.settings[name]; ok {
+			errs = append(errs, fmt.Errorf("config: %s: %q already set at %s", first[name].pos, name, previous.pos))
+			continue
+		}
+		f.settings[name] = setting{value: strings.Join(list, ","), pos: first[name].pos, offset: first[name].offset}
+	}
+	return errs
+}
+
+// checkValue parses a value the way the flag would without setting it, so
+// that a file is either applied whole or not at all
+func checkValue(fl *flag.Flag, value string) error {
+	if c, ok := fl.Value.(checker); ok {
+		return c.check(value)
+	}
+	getter, ok := fl.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case int, int64:
+		_, err = strconv.ParseInt(value, 0, 64)
+	case uint, uint64:
+		_, err = strconv.ParseUint(value, 0, 64)
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	}
+	if numErr, ok := err.(*strconv.NumError); ok {
+		err = numErr.Err
+	}
+	return err
+}
+
+// Loader applies a config file to a flag set parsed from the command line,
+// whose flags take precedence
+type Loader struct {
+	fs       *flag.FlagSet
+	explicit map[string]bool
+	file     *File
+}
+
+// NewLoader loads the file at path and sets the flags of fs the command
+// line did not set. fs must have been parsed.
+func NewLoader(fs *flag.FlagSet, path string) (*Loader, error) {
+	l := &Loader{fs: fs, explicit: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) { l.explicit[f.Name] = true })
+
+	file, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Check(fs); err != nil {
+		return nil, err
+	}
+	for _, name := range file.names() {
+		if !l.explicit[name] {
+			fs.Set(name, file.settings[name].value)
+		}
+	}
+	l.file = file
+	return l, nil
+}
+
+// Args returns the positional arguments of the command line, or those of
+// the file if there are none
+func (l *Loader) Args() []string {
+	if l.fs.NArg() > 0 {
+		return l.fs.Args()
+	}
+	return l.file.Args
+}
+
+// Reload reads the file again and applies the changed settings that are
+// reloadable, returning their names. Changed settings that are not, which
+// take a restart, are returned too and left alone. A removed setting goes
+// back to its default. On error nothing changes.
+func (l *Loader) Reload(reloadable ...string) (applied, restart []string, err error) {
+	file, err := Load(l.file.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := file.Check(l.fs); err != nil {
+		return nil, nil, err
+	}
+
+	can := make(map[string]bool)
+	for _, name := range reloadable {
+		can[name] = true
+	}
+	for _, name := range changed(l.file, file) {
+		if l.explicit[name] {
+			continue
+		}
+		if !can[name] {
+			restart = append(restart, name)
+			continue
+		}
+		value, ok := file.Value(name)
+		if !ok {
+			value = l.fs.Lookup(name).DefValue
+		}
+		l.fs.Set(name, value)
+		applied = append(applied, name)
+	}
+	if l.fs.NArg() == 0 && strings.Join(file.Args, "\x00") != strings.Join(l.file.Args, "\x00") {
+		restart = append(restart, ArgsKey)
+	}
+
+	// Settings left alone keep their old values, so that they show up as
+	// changes again on the next reload
+	for _, name := range restart {
+		if name == ArgsKey {
+			file.Args = l.file.Args
+		} else if s, ok := l.file.settings[name]; ok {
+			file.settings[name] = s
+		} else {
+			delete(file.settings, name)
+		}
+	}
+	l.file = file
+	return applied, restart, nil
+}
+
+// changed returns the names of the settings that differ between two files,
+// in order
+func changed(old, new *File) []string {
+	var names []string
+	for _, name := range new.names() {
+		if s, ok := old.settings[name]; !ok || s.value != new.settings[name].value {
+			names = append(names, name)
+		}
+	}
+	for _, name := range old.names() {
+		if _, ok := new.settings[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
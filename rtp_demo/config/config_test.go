@@ -0,0 +1,257 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags returns a flag set like the server's
+func testFlags() (*flag.FlagSet, map[string]any) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := map[string]any{
+		"hls":         fs.Bool("hls", false, ""),
+		"hls-segment": fs.Duration("hls-segment", 2*time.Second, ""),
+		"hls-window":  fs.Int("hls-window", 6, ""),
+		"source":      fs.String("source", "", ""),
+		"log-format":  fs.String("log-format", "text", ""),
+		"stats":       fs.Duration("stats", 5*time.Second, ""),
+		"rate":        fs.Float64("rate", 1, ""),
+	}
+	payloadTypes := &PayloadTypes{}
+	fs.Var(payloadTypes, "payload-types", "")
+	flags["payload-types"] = payloadTypes
+	fs.String("config", "", "")
+	return fs, flags
+}
+
+func writeConfig(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "server.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	f, err := Parse("test.json", []byte(`{
+		"args": [":5004"],
+		"hls": {"segment": "4s", "window": 10},
+		"source": ["10.0.0.1", "10.0.0.2"],
+		"log": {"format": "json"},
+		"rate": 0.5
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(f.Args) != 1 || f.Args[0] != ":5004" {
+		t.Errorf("Expected args [:5004], got %v", f.Args)
+	}
+	want := map[string]string{"hls-segment": "4s", "hls-window": "10", "source": "10.0.0.1,10.0.0.2", "log-format": "json", "rate": "0.5"}
+	for name, value := range want {
+		if got, ok := f.Value(name); !ok || got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+	if len(f.settings) != len(want) {
+		t.Errorf("Expected %d settings, got %v", len(want), f.names())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"syntax", "{\n  \"hls\": true,\n  \"stats\" \"1s\"\n}", "test.json:3:11: invalid character"},
+		{"end", "{\n  \"hls\": true,", "test.json:2:15: unexpected end"},
+		{"not an object", "[1]", "test.json:1:1: expected a JSON object"},
+		{"trailing", "{} {}", "test.json:1:4: unexpected data after the object"},
+		{"null", "{\n  \"hls\": null\n}", `test.json:2:3: "hls": null is not a value`},
+		{"twice", "{\"hls-window\": 1,\n \"hls\": {\"window\": 2}}", `test.json:2:10: "hls-window" already set at test.json:1:2`},
+		{"args", `{"args": ":5004"}`, `"args" must be a list of strings`},
+	}
+	for _, tt := range tests {
+		_, err := Parse("test.json", []byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fs, _ := testFlags()
+	f, err := Parse("test.json", []byte(`{
+  "hls-windw": 3,
+  "hls": {"segment": "2x", "window": 1.5},
+  "config": "other.json",
+  "rate": "fast"
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = f.Check(fs)
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+	for _, want := range []string{
+		`test.json:2:3: unknown setting "hls-windw"`,
+		`test.json:3:11: "hls-segment": invalid value "2x"`,
+		`test.json:3:28: "hls-window": invalid value "1.5": invalid syntax`,
+		`test.json:4:3: "config" cannot be set in a config file`,
+		`test.json:5:3: "rate": invalid value "fast"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoaderPrecedence(t *testing.T) {
+	fs, flags := testFlags()
+	path := writeConfig(t, t.TempDir(), `{"args": [":5004"], "hls": {"window": 10, "segment": "4s"}, "stats": "1s"}`)
+	if err := fs.Parse([]string{"-hls-window", "3", "-config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLoader(fs, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := *flags["hls-window"].(*int); got != 3 {
+		t.Errorf("Expected the command line's window 3, got %d", got)
+	}
+	if got := *flags["hls-segment"].(*time.Duration); got != 4*time.Second {
+		t.Errorf("Expected the file's segment 4s, got %v", got)
+	}
+	if args := l.Args(); len(args) != 1 || args[0] != ":5004" {
+		t.Errorf("Expected the file's args, got %v", args)
+	}
+
+	fs, _ = testFlags()
+	fs.Parse([]string{"127.0.0.1:6000"})
+	l, _ = NewLoader(fs, path)
+	if args := l.Args(); len(args) != 1 || args[0] != "127.0.0.1:6000" {
+		t.Errorf("Expected the command line's args, got %v", args)
+	}
+}
+
+func TestLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+	fs, flags := testFlags()
+	path := writeConfig(t, dir, `{"args": [":5004"], "hls": true, "stats": "1s", "log-format": "json"}`)
+	fs.Parse([]string{"-log-format", "text"})
+	l, err := NewLoader(fs, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// An invalid file changes nothing
+	writeConfig(t, dir, `{"args": [":5004"], "hls": true, "stats": "soon"}`)
+	if _, _, err := l.Reload("stats"); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+	if got := *flags["stats"].(*time.Duration); got != time.Second {
+		t.Errorf("Expected stats to stay 1s, got %v", got)
+	}
+
+	writeConfig(t, dir, `{"args": [":5006"], "hls": false, "stats": "10s", "log-format": "json", "rate": 2}`)
+	applied, restart, err := l.Reload("stats", "rate", "log-format")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Join(applied, ",") != "rate,stats" {
+		t.Errorf("Expected rate and stats applied, got %v", applied)
+	}
+	if strings.Join(restart, ",") != "hls,args" {
+		t.Errorf("Expected hls and args to need a restart, got %v", restart)
+	}
+	if got := *flags["stats"].(*time.Duration); got != 10*time.Second {
+		t.Errorf("Expected stats 10s, got %v", got)
+	}
+	if *flags["hls"].(*bool) != true || *flags["log-format"].(*string) != "text" {
+		t.Error("Expected hls and the command line's log format to be left alone")
+	}
+
+	// A removed setting goes back to its default
+	writeConfig(t, dir, `{"args": [":5006"], "hls": false, "stats": "10s", "log-format": "json"}`)
+	applied, restart, _ = l.Reload("stats", "rate")
+	if strings.Join(applied, ",") != "rate" || *flags["rate"].(*float64) != 1 {
+		t.Errorf("Expected rate reset to 1, got %v applied and %v", applied, *flags["rate"].(*float64))
+	}
+	if strings.Join(restart, ",") != "hls,args" {
+		t.Errorf("Expected hls and args to still need a restart, got %v", restart)
+	}
+}
+
+func TestPayloadTypes(t *testing.T) {
+	var defaults *PayloadTypes
+	if defaults.Of(CodecH264) != 96 || defaults.Codec(111) != CodecOpus || defaults.Codec(100) != "" {
+		t.Errorf("Unexpected defaults %v", defaults)
+	}
+
+	p := &PayloadTypes{}
+	if err := p.Set("h264=100,aac=101"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p.Codec(100) != CodecH264 || p.Codec(96) != "" || p.Of(CodecMP2T) != 33 {
+		t.Errorf("Expected H.264 moved to 100 and the rest kept, got %v", p)
+	}
+	if p.String() != "h264=100,h265=98,aac=101,opus=111,mp2t=33" {
+		t.Errorf("Unexpected string %q", p.String())
+	}
+
+	for value, want := range map[string]string{
+		"vp8=99":          `unknown codec "vp8"`,
+		"h264":            "expected codec=type",
+		"h264=128":        "not a number from 0 to 127",
+		"aac=72":          "conflicts with RTCP",
+		"h264=97":         "payload type 97 given to both h264 and aac",
+		"aac=96,h264=111": "payload type 111 given to both h264 and opus",
+	} {
+		if err := p.Set(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", value, want, err)
+		}
+	}
+	if p.Of(CodecH264) != 100 {
+		t.Error("Expected a rejected value to change nothing")
+	}
+}
+
+func TestKeyedObject(t *testing.T) {
+	fs, flags := testFlags()
+	path := writeConfig(t, t.TempDir(), `{"payload-types": {"h264": 100, "opus": 120}}`)
+	fs.Parse(nil)
+	if _, err := NewLoader(fs, path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	p := flags["payload-types"].(*PayloadTypes)
+	if p.Of(CodecH264) != 100 || p.Of(CodecOpus) != 120 || p.Of(CodecAAC) != 97 {
+		t.Errorf("Expected the file's payload types, got %v", p)
+	}
+
+	fs, _ = testFlags()
+	f, err := Parse("test.json", []byte(`{
+  "payload-types": {"h264": 100, "aac": 72},
+  "hls": {"segmnt": "4s"}
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = f.Check(fs)
+	for _, want := range []string{
+		`test.json:2:21: "payload-types": invalid value "aac=72,h264=100": aac: payload type 72 conflicts with RTCP`,
+		`test.json:3:11: unknown setting "hls-segmnt"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in:\n%v", want, err)
+		}
+	}
+
+	f, _ = Parse("test.json", []byte(`{"payload-types": "h264=100", "payload": {"types": {"aac": 101}}}`))
+	if err := f.Check(fs); err == nil || !strings.Contains(err.Error(), `"payload-types" already set`) {
+		t.Errorf("Expected the object and the value to clash, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codecs a payload type map assigns payload types to
+const (
+	CodecH264 = "h264" // RFC 6184, packetization mode 1
+	CodecH265 = "h265" // RFC 7798
+	CodecAAC  = "aac"  // RFC 3640 AAC-hbr
+	CodecOpus = "opus" // RFC 7587
+	CodecMP2T = "mp2t" // RFC 2250 MPEG transport stream
+)
+
+// codecs in the order they are printed
+var codecs = []string{CodecH264, CodecH265, CodecAAC, CodecOpus, CodecMP2T}
+
+// defaultPayloadTypes are those of the demo client and of WHIP publishers,
+// with the static type of MPEG-TS
+var defaultPayloadTypes = map[string]uint8{CodecH264: 96, CodecH265: 98, CodecAAC: 97, CodecOpus: 111, CodecMP2T: 33}
+
+// PayloadTypes maps codecs to RTP payload types. As a flag it takes
+// codec=type pairs, e.g. -payload-types h264=100,aac=101, and in a file an
+// object, e.g. {"payload-types": {"h264": 100}}. Codecs left out keep their
+// default types. A nil *PayloadTypes has the defaults.
+type PayloadTypes struct {
+	types map[string]uint8
+}
+
+// Of returns the payload type of a codec
+func (p *PayloadTypes) Of(codec string) uint8 {
+	if p == nil || p.types == nil {
+		return defaultPayloadTypes[codec]
+	}
+	return p.types[codec]
+}
+
+// Codec returns the codec of a payload type, or "" if it has none
+func (p *PayloadTypes) Codec(pt uint8) string {
+	for _, codec := range codecs {
+		if p.Of(codec) == pt {
+			return codec
+		}
+	}
+	return ""
+}
+
+// String implements flag.Value
+func (p *PayloadTypes) String() string {
+	pairs := make([]string, len(codecs))
+	for i, codec := range codecs {
+		pairs[i] = fmt.Sprintf("%s=%d", codec, p.Of(codec))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value, starting over from the defaults
+func (p *PayloadTypes) Set(value string) error {
+	types, err := parsePayloadTypes(value)
+	if err != nil {
+		return err
+	}
+	p.types = types
+	return nil
+}
+
+// check implements checker
+func (p *PayloadTypes) check(value string) error {
+	_, err := parsePayloadTypes(value)
+	return err
+}
+
+// keyed implements keyedValue
+func (p *PayloadTypes) keyed() {}
+
+// parsePayloadTypes parses codec=type pairs over the defaults
+func parsePayloadTypes(value string) (map[string]uint8, error) {
+	types := make(map[string]uint8, len(defaultPayloadTypes))
+	for codec, pt := range defaultPayloadTypes {
+		types[codec] = pt
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		codec, number, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected codec=type, got %q", pair)
+		}
+		if _, known := defaultPayloadTypes[codec]; !known {
+			return nil, fmt.Errorf("unknown codec %q, expected one of %s", codec, strings.Join(codecs, ", "))
+		}
+		pt, err := strconv.ParseUint(number, 10, 7)
+		if err != nil {
+			return nil, fmt.Errorf("%s: payload type %q is not a number from 0 to 127", codec, number)
+		}
+		// With RTCP on the same port, these would read as SR, RR, SDES,
+		// BYE and APP packets (RFC 5761 section 4)
+		if pt >= 72 && pt <= 76 {
+			return nil, fmt.Errorf("%s: payload type %d conflicts with RTCP", codec, pt)
+		}
+		types[codec] = uint8(pt)
+	}
+
+	for i, a := range codecs {
+		for _, b := range codecs[i+1:] {
+			if types[a] == types[b] {
+				return nil, fmt.Errorf("payload type %d given to both %s and %s", types[a], a, b)
+			}
+		}
+	}
+	return types, nil
+}
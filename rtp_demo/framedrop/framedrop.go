@@ -0,0 +1,298 @@
+// Package framedrop chooses the H.264 frames a sender leaves out while its
+// bandwidth estimate is below the stream's bitrate. Frames are classified by
+// the nal_ref_idc and slice headers of their slices, and dropped in order of
+// how little the rest of the stream depends on them: redundant coded
+// pictures and filler data first, then non-reference frames, then the
+// highest temporal layers of streams that have them and, when the reference
+// frames of the base layer alone are too much, every frame up to the next
+// IDR. Parameter sets are always sent.
+//
+// Temporal layers are read from the temporal_id of SVC prefix and slice
+// extension NAL units, as sent by encoders with temporal scalability. Frames
+// of a layer only predict from that layer and the ones below, so the top
+// layers can go without breaking the rest.
+package framedrop
+
+import (
+	"time"
+
+	"rtp_demo/bwe"
+	"rtp_demo/h264"
+)
+
+// Class is how much of the stream depends on a frame
+type Class int
+
+const (
+	Keyframe     Class = iota // an IDR, where decoding can start
+	Reference                 // later frames may predict from it
+	NonReference              // nal_ref_idc 0 on every slice, nothing predicts from it
+)
+
+func (c Class) String() string {
+	switch c {
+	case Keyframe:
+		return "keyframe"
+	case Reference:
+		return "reference"
+	default:
+		return "non-reference"
+	}
+}
+
+// Reason is what was left out of a frame
+type Reason int
+
+const (
+	None          Reason = iota
+	Redundant            // redundant slices and filler data were removed, the frame was sent
+	Disposable           // a non-reference frame was dropped
+	GOPTail              // the frame was dropped with the rest of its GOP
+	TemporalLayer        // the frame was dropped with the rest of its temporal layer
+)
+
+func (r Reason) String() string {
+	switch r {
+	case Redundant:
+		return "redundant"
+	case Disposable:
+		return "non-reference"
+	case GOPTail:
+		return "gop-tail"
+	case TemporalLayer:
+		return "temporal-layer"
+	default:
+		return "none"
+	}
+}
+
+// Info describes a frame
+type Info struct {
+	Class     Class
+	SliceType string // of the first slice, "" if it cannot be parsed
+	RefIDC    uint8  // highest nal_ref_idc of the slices
+	Slices    int
+	Size      int // bytes in all NAL units
+
+	// Highest temporal_id of the slices, 0 without SVC or MVC NAL unit
+	// headers
+	TemporalID uint8
+}
+
+// Decision is what to send of a frame
+type Decision struct {
+	Info
+	Reason Reason
+	NALUs  [][]byte // to send: the frame, the frame without its redundant parts, or just its parameter sets
+	Saved  int      // bytes left out
+
+	// At the IDR ending a dropped GOP tail, the number of frames dropped
+	// in it
+	Resumed int
+}
+
+// Dropped reports whether the frame's pictures were left out
+func (d Decision) Dropped() bool {
+	return d.Reason == Disposable || d.Reason == GOPTail || d.Reason == TemporalLayer
+}
+
+// Dropper tracks the parameter sets and bitrates of a stream and decides
+// what to send of each frame
+type Dropper struct {
+	window time.Duration
+	sps    map[uint32]*h264.SPS
+	pps    map[uint32]*h264.PPS
+	stream *bwe.RateWindow // all frames, including dropped ones
+
+	// Keyframes and reference frames by temporal_id, one window for every
+	// layer seen
+	reference []*bwe.RateWindow
+
+	layers       int  // highest temporal layer sent, -1 if not even the base layer fits
+	layerDropped bool // a frame above layers was dropped since the last base layer frame
+
+	skipping bool // dropping until the next IDR
+	skipped  int  // frames dropped since skipping started
+}
+
+// New creates a dropper measuring bitrates over window
+func New(window time.Duration) *Dropper {
+	return &Dropper{
+		window:    window,
+		sps:       make(map[uint32]*h264.SPS),
+		pps:       make(map[uint32]*h264.PPS),
+		stream:    bwe.NewRateWindow(window),
+		reference: []*bwe.RateWindow{bwe.NewRateWindow(window)},
+	}
+}
+
+// Classify notes the parameter sets of a frame and describes it
+func (d *Dropper) Classify(nalus [][]byte) Info {
+	info := Info{Class: NonReference}
+	for _, nalu := range nalus {
+		info.Size += len(nalu)
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case h264.NALUSPS:
+			if sps, err := h264.ParseSPS(nalu); err == nil {
+				d.sps[sps.ID] = sps
+			}
+		case h264.NALUPPS:
+			if pps, err := h264.ParsePPS(nalu); err == nil {
+				d.pps[pps.ID] = pps
+			}
+		case h264.NALUIDR, h264.NALUNonIDR:
+			refIDC := nalu[0] >> 5 & 0x03
+			if info.Slices == 0 {
+				info.SliceType = h264.SliceType(nalu)
+			}
+			info.Slices++
+			info.RefIDC = max(info.RefIDC, refIDC)
+			if nalu[0]&0x1F == h264.NALUIDR {
+				info.Class = Keyframe
+			} else if refIDC != 0 && info.Class == NonReference {
+				info.Class = Reference
+			}
+		case h264.NALUPrefix, h264.NALUSliceExtension:
+			if id, ok := h264.TemporalID(nalu); ok {
+				info.TemporalID = max(info.TemporalID, id)
+			}
+		}
+	}
+	return info
+}
+
+// Decide classifies a frame about to be sent and returns what to send of
+// it, given the target bitrate of the bandwidth estimate
+func (d *Dropper) Decide(nalus [][]byte, targetBitrate int, now time.Time) Decision {
+	dec := Decision{Info: d.Classify(nalus), NALUs: nalus}
+	d.stream.Add(dec.Size, now)
+	for int(dec.TemporalID) >= len(d.reference) {
+		d.reference = append(d.reference, bwe.NewRateWindow(d.window))
+	}
+	if dec.Class != NonReference {
+		d.reference[dec.TemporalID].Add(dec.Size, now)
+	}
+	short := targetBitrate < d.stream.Rate(now)
+
+	// Frames without pictures only carry parameter sets and SEI
+	if dec.Slices == 0 {
+		return dec
+	}
+	d.chooseLayers(dec.TemporalID, targetBitrate, now)
+
+	if dec.Class == Keyframe {
+		if d.skipping {
+			dec.Resumed = d.skipped
+			d.skipping, d.skipped = false, 0
+		}
+		if short {
+			d.stripRedundant(&dec)
+		}
+		return dec
+	}
+
+	if !d.skipping {
+		if d.layers >= 0 && int(dec.TemporalID) > d.layers {
+			d.layerDropped = true
+			return d.drop(dec, TemporalLayer)
+		}
+		if !short {
+			return dec
+		}
+		d.stripRedundant(&dec)
+		if dec.Class == NonReference {
+			return d.drop(dec, Disposable)
+		}
+		if d.layers >= 0 {
+			return dec
+		}
+		// Dropping a reference frame breaks every frame after it until
+		// the next IDR, so those go too
+		d.skipping = true
+	}
+	d.skipped++
+	return d.drop(dec, GOPTail)
+}
+
+// chooseLayers sets the highest temporal layer whose reference frames fit in
+// the target bitrate together with the layers below. Layers are cut at once
+// but only restored at a base layer frame, or while none of their frames was
+// dropped, since a frame may predict from earlier frames of its own layer.
+func (d *Dropper) chooseLayers(temporalID uint8, targetBitrate int, now time.Time) {
+	fit, rate := -1, 0
+	for layer, window := range d.reference {
+		rate += window.Rate(now)
+		if rate > targetBitrate {
+			break
+		}
+		fit = layer
+	}
+
+	if temporalID == 0 {
+		d.layerDropped = false
+	}
+	if fit < d.layers || !d.layerDropped {
+		d.layers = fit
+	}
+}
+
+// drop leaves out everything of a frame but its parameter sets
+func (d *Dropper) drop(dec Decision, reason Reason) Decision {
+	var kept [][]byte
+	for _, nalu := range dec.NALUs {
+		if len(nalu) == 0 {
+			continue
+		}
+		if t := nalu[0] & 0x1F; t == h264.NALUSPS || t == h264.NALUPPS {
+			kept = append(kept, nalu)
+		} else {
+			dec.Saved += len(nalu)
+		}
+	}
+	dec.NALUs, dec.Reason = kept, reason
+	return dec
+}
+
+// stripRedundant removes the redundant coded slices and filler data of a
+// frame, which decoders only need when the primary picture is lost
+func (d *Dropper) stripRedundant(dec *Decision) {
+	var kept [][]byte
+	for _, nalu := range dec.NALUs {
+		if d.isRedundant(nalu) {
+			dec.Saved += len(nalu)
+			continue
+		}
+		kept = append(kept, nalu)
+	}
+	if dec.Saved > 0 {
+		dec.NALUs, dec.Reason = kept, Redundant
+	}
+}
+
+// isRedundant reports whether a NAL unit is filler data or a slice of a
+// redundant coded picture
+func (d *Dropper) isRedundant(nalu []byte) bool {
+	if len(nalu) == 0 {
+		return true
+	}
+	switch nalu[0] & 0x1F {
+	case h264.NALUFiller:
+		return true
+	case h264.NALUNonIDR, h264.NALUIDR:
+		h, err := h264.ParseSliceHeader(nalu, d.lookup)
+		return err == nil && h.RedundantPicCnt > 0
+	}
+	return false
+}
+
+// lookup returns a PPS and its SPS by ID
+func (d *Dropper) lookup(ppsID uint32) (*h264.PPS, *h264.SPS) {
+	pps := d.pps[ppsID]
+	if pps == nil {
+		return nil, nil
+	}
+	return pps, d.sps[pps.SPSID]
+}
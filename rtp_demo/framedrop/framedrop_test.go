@@ -0,0 +1,170 @@
+package framedrop
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"rtp_demo/internal/h264test"
+)
+
+// slice pads a coded slice to size bytes
+func slice(header byte, sliceType, redundantPicCnt uint32, size int) []byte {
+	nalu := h264test.Slice(header, sliceType, 0, redundantPicCnt)
+	return append(nalu, bytes.Repeat([]byte{0x55}, size-len(nalu))...)
+}
+
+func idr(size int) [][]byte        { return [][]byte{slice(0x65, 7, 0, size)} }
+func reference(size int) [][]byte  { return [][]byte{slice(0x41, 5, 0, size)} }
+func disposable(size int) [][]byte { return [][]byte{slice(0x01, 6, 0, size)} }
+
+// layered is a reference frame of temporal layer id behind an SVC prefix NAL
+// unit, size bytes in all
+func layered(id uint8, size int) [][]byte {
+	prefix := []byte{0x6E, 0x80, 0x00, id<<5 | 0x07}
+	return [][]byte{prefix, slice(0x41, 5, 0, size-len(prefix))}
+}
+
+func TestClassify(t *testing.T) {
+	d := New(time.Second)
+	cases := []struct {
+		frame     [][]byte
+		class     Class
+		sliceType string
+	}{
+		{append([][]byte{h264test.BaselineSPS(), h264test.PPS()}, idr(100)...), Keyframe, "I"},
+		{reference(100), Reference, "P"},
+		{disposable(100), NonReference, "B"},
+		{append(disposable(50), reference(50)...), Reference, "B"},
+	}
+	for i, c := range cases {
+		info := d.Classify(c.frame)
+		if info.Class != c.class || info.SliceType != c.sliceType {
+			t.Errorf("Frame %d: expected %s %s, got %s %s", i, c.class, c.sliceType, info.Class, info.SliceType)
+		}
+	}
+}
+
+func TestDropNonReference(t *testing.T) {
+	d := New(time.Second)
+	now := time.Now()
+
+	// Reference frames of 500 bytes take 20 kbps in the window, all
+	// frames 60 kbps
+	for i := 0; i < 10; i++ {
+		frame, class := reference(500), Reference
+		if i%2 == 1 {
+			frame, class = disposable(1000), NonReference
+		}
+		dec := d.Decide(frame, 30000, now.Add(time.Duration(i)*10*time.Millisecond))
+		short := i >= 5
+		switch {
+		case class == Reference && dec.Dropped():
+			t.Errorf("Frame %d: reference frame dropped for %s", i, dec.Reason)
+		case class == NonReference && short && dec.Reason != Disposable:
+			t.Errorf("Frame %d: expected the non-reference frame dropped, got %s", i, dec.Reason)
+		case class == NonReference && !short && dec.Dropped():
+			t.Errorf("Frame %d: dropped with bandwidth to spare", i)
+		}
+	}
+
+	if dec := d.Decide(disposable(1000), 1e9, now.Add(200*time.Millisecond)); dec.Dropped() {
+		t.Error("Expected no drop with plenty of bandwidth")
+	}
+}
+
+func TestDropGOPTail(t *testing.T) {
+	d := New(time.Second)
+	now := time.Now()
+	step := func(i int) time.Time { return now.Add(time.Duration(i) * 33 * time.Millisecond) }
+
+	if dec := d.Decide(append([][]byte{h264test.BaselineSPS(), h264test.PPS()}, idr(1000)...), 10000, step(0)); dec.Dropped() {
+		t.Fatalf("Expected the first keyframe sent, got %s", dec.Reason)
+	}
+	if dec := d.Decide(reference(1000), 10000, step(1)); dec.Reason != GOPTail {
+		t.Errorf("Expected the reference frame dropped with its GOP, got %s", dec.Reason)
+	}
+
+	// Parameter sets in a dropped frame are still sent
+	sps, pps := h264test.BaselineSPS(), h264test.PPS()
+	dec := d.Decide(append([][]byte{sps, pps}, disposable(1000)...), 1e9, step(2))
+	if dec.Reason != GOPTail || len(dec.NALUs) != 2 || !bytes.Equal(dec.NALUs[0], sps) || !bytes.Equal(dec.NALUs[1], pps) {
+		t.Errorf("Expected only the parameter sets sent, got %s with %d NAL units", dec.Reason, len(dec.NALUs))
+	}
+	if dec.Saved != 1000 {
+		t.Errorf("Expected 1000 bytes saved, got %d", dec.Saved)
+	}
+
+	// Empty NAL units in a dropped frame are skipped
+	dec = d.Decide(append([][]byte{{}}, reference(1000)...), 1e9, step(3))
+	if dec.Reason != GOPTail || len(dec.NALUs) != 0 || dec.Saved != 1000 {
+		t.Errorf("Expected the frame with an empty NAL unit dropped, got %s with %d NAL units", dec.Reason, len(dec.NALUs))
+	}
+
+	dec = d.Decide(idr(1000), 1e9, step(4))
+	if dec.Dropped() || dec.Resumed != 3 {
+		t.Errorf("Expected the keyframe sent after 3 dropped frames, got %s after %d", dec.Reason, dec.Resumed)
+	}
+	if dec := d.Decide(reference(1000), 1e9, step(5)); dec.Dropped() {
+		t.Errorf("Expected the GOP after the keyframe sent, got %s", dec.Reason)
+	}
+}
+
+func TestStripRedundant(t *testing.T) {
+	d := New(time.Second)
+	primary := slice(0x65, 7, 0, 300)
+	redundant := slice(0x65, 7, 1, 200)
+	filler := append([]byte{0x0C}, bytes.Repeat([]byte{0xFF}, 99)...)
+	frame := [][]byte{h264test.BaselineSPS(), h264test.PPS(), primary, redundant, filler}
+
+	dec := d.Decide(frame, 1000, time.Now())
+	if dec.Reason != Redundant || dec.Saved != 300 {
+		t.Errorf("Expected 300 redundant bytes removed, got %s with %d", dec.Reason, dec.Saved)
+	}
+	if len(dec.NALUs) != 3 || !bytes.Equal(dec.NALUs[2], primary) {
+		t.Errorf("Expected the parameter sets and primary slice, got %d NAL units", len(dec.NALUs))
+	}
+
+	d = New(time.Second)
+	if dec := d.Decide(frame, 1e9, time.Now()); dec.Reason != None || len(dec.NALUs) != len(frame) {
+		t.Errorf("Expected the whole frame with plenty of bandwidth, got %s", dec.Reason)
+	}
+}
+
+func TestDropTemporalLayers(t *testing.T) {
+	d := New(time.Second)
+	now := time.Now()
+	step := func(i int) time.Time { return now.Add(time.Duration(i) * 10 * time.Millisecond) }
+
+	// Frames of 500 bytes alternate between layers 0 and 1. From frame 7
+	// both layers exceed 30 kbps, the base layer alone does not.
+	for i := 0; i < 10; i++ {
+		dec := d.Decide(layered(uint8(i%2), 500), 30000, step(i))
+		if dec.TemporalID != uint8(i%2) {
+			t.Errorf("Frame %d: expected temporal layer %d, got %d", i, i%2, dec.TemporalID)
+		}
+		want := None
+		if i >= 7 && i%2 == 1 {
+			want = TemporalLayer
+		}
+		if dec.Reason != want {
+			t.Errorf("Frame %d: expected %s, got %s", i, want, dec.Reason)
+		}
+	}
+
+	// With bandwidth back, layer 1 returns at the next base layer frame
+	if dec := d.Decide(layered(1, 500), 1e9, step(10)); dec.Reason != TemporalLayer {
+		t.Errorf("Expected layer 1 dropped until a base layer frame, got %s", dec.Reason)
+	}
+	if dec := d.Decide(layered(0, 500), 1e9, step(11)); dec.Dropped() {
+		t.Errorf("Expected the base layer frame sent, got %s", dec.Reason)
+	}
+	if dec := d.Decide(layered(1, 500), 1e9, step(12)); dec.Dropped() {
+		t.Errorf("Expected layer 1 sent again, got %s", dec.Reason)
+	}
+
+	// When the base layer does not fit either, the GOP tail goes
+	if dec := d.Decide(layered(0, 500), 1000, step(13)); dec.Reason != GOPTail {
+		t.Errorf("Expected the GOP tail dropped, got %s", dec.Reason)
+	}
+}
@@ -0,0 +1,159 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+)
+
+// SplitAnnexB splits a byte stream (Annex B) into NAL units without their
+// start codes. Trailing zero bytes before a start code belong to it.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = appendTrimmed(nalus, data[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nalus = appendTrimmed(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendTrimmed appends a NAL unit without the zeros that precede the next
+// start code, skipping empty ones
+func appendTrimmed(nalus [][]byte, nalu []byte) [][]byte {
+	if nalu = trimZeros(nalu); len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+func trimZeros(nalu []byte) []byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	return nalu
+}
+
+// AppendAnnexB appends NAL units to buf, each with a four-byte start code
+func AppendAnnexB(buf []byte, nalus [][]byte) []byte {
+	for _, nalu := range nalus {
+		buf = append(buf, 0, 0, 0, 1)
+		buf = append(buf, nalu...)
+	}
+	return buf
+}
+
+// startCode is the three-byte start code prefix; a four-byte one is a
+// zero byte followed by it
+var startCode = []byte{0, 0, 1}
+
+// NALUReader reads NAL units from an Annex B byte stream as it arrives, e.g.
+// from a pipe. A NAL unit is returned once the start code after it has been
+// read, or at the end of the stream.
+type NALUReader struct {
+	r       io.Reader
+	buf     []byte // unread data, starting after a start code once one is found
+	found   bool   // a start code has been seen
+	scanned int    // bytes of buf already searched for a start code
+	err     error  // from r, returned once buf is used up
+}
+
+// NewNALUReader creates a reader for the byte stream r. Data before the
+// first start code is skipped.
+func NewNALUReader(r io.Reader) *NALUReader {
+	return &NALUReader{r: r}
+}
+
+// Next returns the next NAL unit without its start code. The data stays
+// valid after later calls.
+func (r *NALUReader) Next() ([]byte, error) {
+	for {
+		if i := bytes.Index(r.buf[r.scanned:], startCode); i >= 0 {
+			i += r.scanned
+			nalu := trimZeros(r.buf[:i:i])
+			found := r.found
+			r.buf, r.found, r.scanned = r.buf[i+3:], true, 0
+			if found && len(nalu) > 0 {
+				return nalu, nil
+			}
+			continue
+		}
+		// A start code may straddle the next read
+		if r.scanned = len(r.buf) - 2; r.scanned < 0 {
+			r.scanned = 0
+		}
+
+		if r.err != nil {
+			nalu := trimZeros(r.buf)
+			r.buf, r.scanned = nil, 0
+			if r.found && len(nalu) > 0 {
+				return nalu, nil
+			}
+			return nil, r.err
+		}
+
+		// Appending never overwrites returned NAL units, which all end
+		// before len(r.buf)
+		if cap(r.buf)-len(r.buf) < 4096 {
+			grown := make([]byte, len(r.buf), 2*cap(r.buf)+64<<10)
+			copy(grown, r.buf)
+			r.buf = grown
+		}
+		n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		r.err = err
+	}
+}
+
+// AccessUnitBuilder groups NAL units in decoding order into access units
+// (section 7.4.1.2.3): a new one starts at an access unit delimiter, SEI,
+// SPS or PPS after a slice, or at a slice with first_mb_in_slice zero
+// after a slice. Arbitrary slice order is not supported.
+type AccessUnitBuilder struct {
+	nalus  [][]byte
+	hasVCL bool
+}
+
+// Push adds a NAL unit and returns the previous access unit if the NAL
+// unit starts a new one, otherwise nil
+func (b *AccessUnitBuilder) Push(nalu []byte) [][]byte {
+	if len(nalu) == 0 {
+		return nil
+	}
+	nalType := nalu[0] & 0x1F
+	isVCL := nalType >= NALUNonIDR && nalType <= NALUIDR
+
+	var au [][]byte
+	if b.hasVCL {
+		starts := false
+		switch {
+		case isVCL:
+			first, ok := FirstMBInSlice(nalu)
+			starts = ok && first == 0
+		case nalType >= NALUSEI && nalType <= NALUAUD, nalType >= 14 && nalType <= 18:
+			starts = true
+		}
+		if starts {
+			au = b.Flush()
+		}
+	}
+
+	b.nalus = append(b.nalus, nalu)
+	b.hasVCL = b.hasVCL || isVCL
+	return au
+}
+
+// Flush returns the access unit being collected, at the end of the stream
+func (b *AccessUnitBuilder) Flush() [][]byte {
+	au := b.nalus
+	b.nalus, b.hasVCL = nil, false
+	return au
+}
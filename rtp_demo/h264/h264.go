@@ -0,0 +1,507 @@
+// Package h264 parses the H.264 syntax elements the RTP tools need:
+// sequence and picture parameter sets, slice headers and SEI messages.
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// NAL unit types
+const (
+	NALUNonIDR = 1
+	NALUIDR    = 5
+	NALUSEI    = 6
+	NALUSPS    = 7
+	NALUPPS    = 8
+	NALUAUD    = 9
+	NALUFiller = 12
+
+	// SVC and MVC (Annex G and H): a prefix NAL unit carries the extension
+	// header of the AVC slices after it, a slice extension its own
+	NALUPrefix         = 14
+	NALUSliceExtension = 20
+)
+
+// SPS holds the fields of a sequence parameter set that describe the video
+type SPS struct {
+	ProfileIDC      uint8
+	ConstraintFlags uint8 // constraint_set0..5 flags, as in the second SPS byte
+	LevelIDC        uint8
+	ID              uint32
+	ChromaFormatIDC uint32
+	BitDepth        uint32 // luma bit depth
+	Log2MaxFrameNum uint32
+	POCType         uint32
+	MaxNumRefFrames uint32
+	FrameMBSOnly    bool
+	Width           int
+	Height          int
+
+	// Needed to parse slice headers
+	SeparateColourPlane     bool
+	Log2MaxPOCLsb           uint32 // for POC type 0
+	DeltaPicOrderAlwaysZero bool   // for POC type 1
+
+	// From the VUI, zero when absent
+	SARWidth, SARHeight uint32
+	FrameRate           float64
+
+	// From the VUI's HRD parameters, needed to parse picture timing SEI
+	CPBDPBDelaysPresent   bool
+	CPBRemovalDelayLength uint32 // in bits
+	DPBOutputDelayLength  uint32
+	TimeOffsetLength      uint32
+	PicStructPresent      bool
+}
+
+// highProfiles carry chroma format and bit depth in the SPS
+var highProfiles = map[uint8]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// ParseSPS parses a sequence parameter set NAL unit, including its one-byte
+// NAL header
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || nalu[0]&0x1F != NALUSPS {
+		return nil, errors.New("h264: not an SPS NAL unit")
+	}
+
+	br := newBitReader(unescapeRBSP(nalu[1:]))
+	sps := &SPS{
+		ProfileIDC:      uint8(br.bits(8)),
+		ConstraintFlags: uint8(br.bits(8)),
+		LevelIDC:        uint8(br.bits(8)),
+		ID:              br.ue(),
+		ChromaFormatIDC: 1,
+		BitDepth:        8,
+	}
+
+	if highProfiles[sps.ProfileIDC] {
+		sps.ChromaFormatIDC = br.ue()
+		if sps.ChromaFormatIDC == 3 {
+			sps.SeparateColourPlane = br.flag()
+		}
+		sps.BitDepth = br.ue() + 8
+		br.ue() // bit_depth_chroma_minus8
+		br.flag()
+		if br.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if sps.ChromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if br.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(br, size)
+				}
+			}
+		}
+	}
+
+	sps.Log2MaxFrameNum = br.ue() + 4
+	sps.POCType = br.ue()
+	switch sps.POCType {
+	case 0:
+		sps.Log2MaxPOCLsb = br.ue() + 4
+	case 1:
+		sps.DeltaPicOrderAlwaysZero = br.flag()
+		br.se()
+		br.se()
+		n := br.ue()
+		if n > 255 {
+			return nil, errors.New("h264: invalid num_ref_frames_in_pic_order_cnt_cycle")
+		}
+		for i := uint32(0); i < n; i++ {
+			br.se()
+		}
+	}
+
+	sps.MaxNumRefFrames = br.ue()
+	br.flag() // gaps_in_frame_num_value_allowed_flag
+	widthMBs := int(br.ue()) + 1
+	heightMapUnits := int(br.ue()) + 1
+	sps.FrameMBSOnly = br.flag()
+	if !sps.FrameMBSOnly {
+		br.flag() // mb_adaptive_frame_field_flag
+	}
+	br.flag() // direct_8x8_inference_flag
+
+	frameHeightFactor := 1
+	if !sps.FrameMBSOnly {
+		frameHeightFactor = 2
+	}
+	sps.Width = widthMBs * 16
+	sps.Height = heightMapUnits * 16 * frameHeightFactor
+
+	if br.flag() { // frame_cropping_flag
+		left, right, top, bottom := int(br.ue()), int(br.ue()), int(br.ue()), int(br.ue())
+
+		cropX, cropY := 1, frameHeightFactor
+		if sps.ChromaFormatIDC != 0 && !sps.SeparateColourPlane {
+			subWidth, subHeight := 2, 2 // 4:2:0
+			switch sps.ChromaFormatIDC {
+			case 2:
+				subHeight = 1
+			case 3:
+				subWidth, subHeight = 1, 1
+			}
+			cropX, cropY = subWidth, subHeight*frameHeightFactor
+		}
+		sps.Width -= (left + right) * cropX
+		sps.Height -= (top + bottom) * cropY
+	}
+
+	if br.err == nil && br.flag() { // vui_parameters_present_flag
+		parseVUI(br, sps)
+	}
+
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid SPS: %w", br.err)
+	}
+	return sps, nil
+}
+
+// skipScalingList skips a scaling_list() structure
+func skipScalingList(br *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			next = (last + br.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseVUI reads the VUI fields up to pic_struct_present_flag. A truncated
+// VUI leaves the remaining fields zero rather than failing the SPS.
+func parseVUI(br *bitReader, sps *SPS) {
+	if br.flag() { // aspect_ratio_info_present_flag
+		idc := br.bits(8)
+		if idc == 255 { // Extended_SAR
+			sps.SARWidth, sps.SARHeight = br.bits(16), br.bits(16)
+		} else if int(idc) < len(sarTable) {
+			sps.SARWidth, sps.SARHeight = sarTable[idc][0], sarTable[idc][1]
+		}
+	}
+	if br.flag() { // overscan_info_present_flag
+		br.flag()
+	}
+	if br.flag() { // video_signal_type_present_flag
+		br.bits(4)
+		if br.flag() { // colour_description_present_flag
+			br.bits(24)
+		}
+	}
+	if br.flag() { // chroma_loc_info_present_flag
+		br.ue()
+		br.ue()
+	}
+	if br.flag() { // timing_info_present_flag
+		unitsInTick := br.bits(32)
+		timeScale := br.bits(32)
+		if br.err == nil && unitsInTick > 0 {
+			sps.FrameRate = float64(timeScale) / float64(2*unitsInTick)
+		}
+		br.flag() // fixed_frame_rate_flag
+	}
+	nalHRD := br.flag() && parseHRD(br, sps)
+	vclHRD := br.flag() && parseHRD(br, sps)
+	if nalHRD || vclHRD {
+		sps.CPBDPBDelaysPresent = true
+		br.flag() // low_delay_hrd_flag
+	}
+	sps.PicStructPresent = br.flag()
+	if br.err != nil {
+		sps.CPBDPBDelaysPresent, sps.PicStructPresent = false, false
+	}
+	br.err = nil
+}
+
+// parseHRD reads the field lengths of hrd_parameters() and reports whether
+// it was present
+func parseHRD(br *bitReader, sps *SPS) bool {
+	cpbCount := br.ue() + 1
+	if cpbCount > 32 {
+		br.err = errors.New("h264: invalid cpb_cnt_minus1")
+		return false
+	}
+	br.bits(8) // bit_rate_scale, cpb_size_scale
+	for i := uint32(0); i < cpbCount; i++ {
+		br.ue() // bit_rate_value_minus1
+		br.ue() // cpb_size_value_minus1
+		br.flag()
+	}
+	br.bits(5) // initial_cpb_removal_delay_length_minus1
+	sps.CPBRemovalDelayLength = br.bits(5) + 1
+	sps.DPBOutputDelayLength = br.bits(5) + 1
+	sps.TimeOffsetLength = br.bits(5)
+	return true
+}
+
+// sarTable holds the sample aspect ratios of Table E-1
+var sarTable = [][2]uint32{
+	{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11},
+	{32, 11}, {80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// ProfileName returns the name of the profile, e.g. "High"
+func (s *SPS) ProfileName() string {
+	switch s.ProfileIDC {
+	case 66:
+		if s.ConstraintFlags&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	default:
+		return fmt.Sprintf("Profile %d", s.ProfileIDC)
+	}
+}
+
+// Level returns the level as a string, e.g. "3.1"
+func (s *SPS) Level() string {
+	// Level 1b is signalled as 11 with constraint_set3 in Baseline/Main
+	if s.LevelIDC == 11 && s.ConstraintFlags&0x10 != 0 && (s.ProfileIDC == 66 || s.ProfileIDC == 77) {
+		return "1b"
+	}
+	return fmt.Sprintf("%d.%d", s.LevelIDC/10, s.LevelIDC%10)
+}
+
+// Codec returns the RFC 6381 codecs parameter, e.g. "avc1.64001F"
+func (s *SPS) Codec() string {
+	return fmt.Sprintf("avc1.%02X%02X%02X", s.ProfileIDC, s.ConstraintFlags, s.LevelIDC)
+}
+
+// PPS holds the fields of a picture parameter set needed to identify it and
+// to parse slice headers
+type PPS struct {
+	ID           uint32
+	SPSID        uint32
+	EntropyCABAC bool
+
+	// Zero when the PPS is cut short after the fields above
+	BottomFieldPicOrderInFramePresent bool
+	NumSliceGroups                    uint32
+	RedundantPicCntPresent            bool
+}
+
+// ParsePPS parses a picture parameter set NAL unit, including its one-byte
+// NAL header, up to redundant_pic_cnt_present_flag
+func ParsePPS(nalu []byte) (*PPS, error) {
+	if len(nalu) < 2 || nalu[0]&0x1F != NALUPPS {
+		return nil, errors.New("h264: not a PPS NAL unit")
+	}
+
+	br := newBitReader(unescapeRBSP(nalu[1:]))
+	pps := &PPS{
+		ID:           br.ue(),
+		SPSID:        br.ue(),
+		EntropyCABAC: br.flag(),
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid PPS: %w", br.err)
+	}
+
+	pps.BottomFieldPicOrderInFramePresent = br.flag()
+	pps.NumSliceGroups = br.ue() + 1
+	if pps.NumSliceGroups > 8 {
+		return nil, errors.New("h264: invalid num_slice_groups_minus1")
+	}
+	if pps.NumSliceGroups > 1 {
+		skipSliceGroups(br, pps.NumSliceGroups)
+	}
+	br.ue()    // num_ref_idx_l0_default_active_minus1
+	br.ue()    // num_ref_idx_l1_default_active_minus1
+	br.bits(3) // weighted_pred_flag, weighted_bipred_idc
+	br.se()    // pic_init_qp_minus26
+	br.se()    // pic_init_qs_minus26
+	br.se()    // chroma_qp_index_offset
+	br.bits(2) // deblocking_filter_control_present_flag, constrained_intra_pred_flag
+	pps.RedundantPicCntPresent = br.flag()
+	if br.err != nil {
+		pps.BottomFieldPicOrderInFramePresent, pps.NumSliceGroups, pps.RedundantPicCntPresent = false, 0, false
+	}
+	return pps, nil
+}
+
+// skipSliceGroups skips the slice group map of a PPS
+func skipSliceGroups(br *bitReader, groups uint32) {
+	switch br.ue() { // slice_group_map_type
+	case 0:
+		for i := uint32(0); i < groups; i++ {
+			br.ue() // run_length_minus1
+		}
+	case 2:
+		for i := uint32(1); i < groups; i++ {
+			br.ue() // top_left
+			br.ue() // bottom_right
+		}
+	case 3, 4, 5:
+		br.flag() // slice_group_change_direction_flag
+		br.ue()   // slice_group_change_rate_minus1
+	case 6:
+		units := br.ue() + 1
+		idBits := bits.Len32(groups - 1)
+		for i := uint32(0); i < units && br.err == nil; i++ {
+			br.bits(idBits) // slice_group_id
+		}
+	}
+}
+
+// TemporalID returns temporal_id from the extension header of a prefix or
+// slice extension NAL unit, SVC or MVC, and false for other NAL units
+func TemporalID(nalu []byte) (uint8, bool) {
+	if len(nalu) < 4 {
+		return 0, false
+	}
+	if t := nalu[0] & 0x1F; t != NALUPrefix && t != NALUSliceExtension {
+		return 0, false
+	}
+	if nalu[1]&0x80 != 0 {
+		// svc_extension_flag: priority, dependency and quality IDs first
+		return nalu[3] >> 5, true
+	}
+	// MVC: view_id ends two bits into the last byte
+	return nalu[3] >> 3 & 0x07, true
+}
+
+// SliceType returns the slice type ("P", "B", "I", "SP" or "SI") from the
+// header of a coded slice NAL unit, or "" if it cannot be parsed. Only the
+// start of the NAL unit is needed.
+func SliceType(nalu []byte) string {
+	if len(nalu) < 2 {
+		return ""
+	}
+
+	// The slice header starts right after the one-byte NAL header
+	end := len(nalu)
+	if end > 32 {
+		end = 32
+	}
+	br := newBitReader(unescapeRBSP(nalu[1:end]))
+
+	br.ue() // first_mb_in_slice
+	sliceType := br.ue()
+	if br.err != nil {
+		return ""
+	}
+
+	switch sliceType % 5 {
+	case 0:
+		return "P"
+	case 1:
+		return "B"
+	case 2:
+		return "I"
+	case 3:
+		return "SP"
+	default:
+		return "SI"
+	}
+}
+
+// FirstMBInSlice returns first_mb_in_slice from the header of a coded slice
+// NAL unit, zero for the first slice of a picture
+func FirstMBInSlice(nalu []byte) (uint32, bool) {
+	if len(nalu) < 2 {
+		return 0, false
+	}
+	end := len(nalu)
+	if end > 16 {
+		end = 16
+	}
+	br := newBitReader(unescapeRBSP(nalu[1:end]))
+	first := br.ue()
+	return first, br.err == nil
+}
+
+// SliceHeader holds the start of a slice header, up to redundant_pic_cnt
+type SliceHeader struct {
+	NALRefIDC       uint8
+	IDR             bool
+	FirstMB         uint32
+	SliceType       string // as returned by SliceType
+	PPSID           uint32
+	FrameNum        uint32
+	RedundantPicCnt uint32 // nonzero for a redundant coded picture
+}
+
+// ParseSliceHeader parses the header of a coded slice NAL unit, including
+// its one-byte NAL header. lookup returns the PPS with the given ID and its
+// SPS, which give the field lengths.
+func ParseSliceHeader(nalu []byte, lookup func(ppsID uint32) (*PPS, *SPS)) (*SliceHeader, error) {
+	if len(nalu) < 2 || nalu[0]&0x1F != NALUNonIDR && nalu[0]&0x1F != NALUIDR {
+		return nil, errors.New("h264: not a coded slice NAL unit")
+	}
+	nalType := nalu[0] & 0x1F
+
+	// The fields parsed here fit in the first few dozen bytes
+	br := newBitReader(unescapeRBSP(nalu[1:min(len(nalu), 64)]))
+	h := &SliceHeader{
+		NALRefIDC: nalu[0] >> 5 & 0x03,
+		IDR:       nalType == NALUIDR,
+		FirstMB:   br.ue(),
+		SliceType: SliceType(nalu),
+	}
+	br.ue() // slice_type
+	h.PPSID = br.ue()
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid slice header: %w", br.err)
+	}
+	pps, sps := lookup(h.PPSID)
+	if pps == nil || sps == nil {
+		return nil, fmt.Errorf("h264: slice refers to unknown PPS %d", h.PPSID)
+	}
+
+	if sps.SeparateColourPlane {
+		br.bits(2) // colour_plane_id
+	}
+	h.FrameNum = br.bits(int(sps.Log2MaxFrameNum))
+	fieldPic := false
+	if !sps.FrameMBSOnly {
+		if fieldPic = br.flag(); fieldPic {
+			br.flag() // bottom_field_flag
+		}
+	}
+	if h.IDR {
+		br.ue() // idr_pic_id
+	}
+	switch {
+	case sps.POCType == 0:
+		br.bits(int(sps.Log2MaxPOCLsb))
+		if pps.BottomFieldPicOrderInFramePresent && !fieldPic {
+			br.se() // delta_pic_order_cnt_bottom
+		}
+	case sps.POCType == 1 && !sps.DeltaPicOrderAlwaysZero:
+		br.se()
+		if pps.BottomFieldPicOrderInFramePresent && !fieldPic {
+			br.se()
+		}
+	}
+	if pps.RedundantPicCntPresent {
+		h.RedundantPicCnt = br.ue()
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid slice header: %w", br.err)
+	}
+	return h, nil
+}
@@ -0,0 +1,424 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"rtp_demo/internal/h264test"
+)
+
+func TestParseSPS(t *testing.T) {
+	sps, err := ParseSPS(h264test.SPS())
+	if err != nil {
+		t.Fatalf("ParseSPS failed: %v", err)
+	}
+
+	if sps.Width != 1920 || sps.Height != 1080 {
+		t.Errorf("Expected 1920x1080, got %dx%d", sps.Width, sps.Height)
+	}
+	if sps.ProfileName() != "High" || sps.Level() != "4.0" || sps.Codec() != "avc1.640028" {
+		t.Errorf("Unexpected profile %s, level %s, codec %s", sps.ProfileName(), sps.Level(), sps.Codec())
+	}
+	if sps.FrameRate != 25 || sps.SARWidth != 1 || sps.MaxNumRefFrames != 4 {
+		t.Errorf("Unexpected VUI fields %+v", sps)
+	}
+}
+
+func TestParseSPSBaseline(t *testing.T) {
+	sps, err := ParseSPS(h264test.BaselineSPS())
+	if err != nil {
+		t.Fatalf("ParseSPS failed: %v", err)
+	}
+	if sps.Width != 320 || sps.Height != 240 || sps.ProfileName() != "Constrained Baseline" || sps.Level() != "1.3" || sps.FrameRate != 0 {
+		t.Errorf("Unexpected SPS %+v", sps)
+	}
+
+	if _, err := ParseSPS([]byte{0x67, 0x42, 0x00}); err == nil {
+		t.Error("Expected an error for a truncated SPS")
+	}
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	got := unescapeRBSP([]byte{0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x00, 0x03})
+	want := []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x03}
+	if string(got) != string(want) {
+		t.Errorf("Expected % X, got % X", want, got)
+	}
+}
+
+func TestParsePPS(t *testing.T) {
+	w := &h264test.BitWriter{}
+	w.UE(2)
+	w.UE(1)
+	w.Flag(true)
+	pps, err := ParsePPS(w.NALU(0x68))
+	if err != nil {
+		t.Fatalf("ParsePPS failed: %v", err)
+	}
+	if pps.ID != 2 || pps.SPSID != 1 || !pps.EntropyCABAC {
+		t.Errorf("Unexpected PPS %+v", pps)
+	}
+}
+
+func TestParsePPSFull(t *testing.T) {
+	pps, err := ParsePPS(h264test.PPS())
+	if err != nil {
+		t.Fatalf("ParsePPS failed: %v", err)
+	}
+	if !pps.BottomFieldPicOrderInFramePresent || pps.NumSliceGroups != 2 || !pps.RedundantPicCntPresent {
+		t.Errorf("Unexpected PPS %+v", pps)
+	}
+}
+
+func TestParseSliceHeader(t *testing.T) {
+	sps, err := ParseSPS(h264test.SPS())
+	if err != nil {
+		t.Fatalf("ParseSPS failed: %v", err)
+	}
+	pps, err := ParsePPS(h264test.PPS())
+	if err != nil {
+		t.Fatalf("ParsePPS failed: %v", err)
+	}
+	lookup := func(id uint32) (*PPS, *SPS) {
+		if id != 0 {
+			return nil, nil
+		}
+		return pps, sps
+	}
+
+	// A redundant IDR slice, then a primary P slice
+	h, err := ParseSliceHeader(h264test.Slice(0x65, 7, 0, 1), lookup)
+	if err != nil {
+		t.Fatalf("ParseSliceHeader failed: %v", err)
+	}
+	if !h.IDR || h.NALRefIDC != 3 || h.SliceType != "I" || h.RedundantPicCnt != 1 {
+		t.Errorf("Unexpected IDR slice header %+v", h)
+	}
+
+	h, err = ParseSliceHeader(h264test.Slice(0x01, 5, 9, 0), lookup)
+	if err != nil {
+		t.Fatalf("ParseSliceHeader failed: %v", err)
+	}
+	if h.IDR || h.NALRefIDC != 0 || h.SliceType != "P" || h.FrameNum != 9 || h.RedundantPicCnt != 0 {
+		t.Errorf("Unexpected P slice header %+v", h)
+	}
+
+	w := &h264test.BitWriter{}
+	w.UE(0)
+	w.UE(5)
+	w.UE(4) // unknown PPS
+	if _, err := ParseSliceHeader(w.NALU(0x41), lookup); err == nil {
+		t.Error("Expected an error for an unknown PPS")
+	}
+}
+
+func TestSliceType(t *testing.T) {
+	cases := map[uint32]string{0: "P", 1: "B", 2: "I", 3: "SP", 4: "SI", 5: "P", 6: "B", 7: "I"}
+	for sliceType, want := range cases {
+		w := &h264test.BitWriter{}
+		w.UE(0)
+		w.UE(sliceType)
+		nalu := w.NALU(0x41)
+		if got := SliceType(nalu); got != want {
+			t.Errorf("slice_type %d: expected %s, got %s", sliceType, want, got)
+		}
+	}
+	if got := SliceType([]byte{0x41}); got != "" {
+		t.Errorf("Expected empty slice type for truncated NAL, got %s", got)
+	}
+}
+
+func TestTemporalID(t *testing.T) {
+	cases := []struct {
+		nalu []byte
+		id   uint8
+		ok   bool
+	}{
+		{[]byte{0x6E, 0x80, 0x00, 2<<5 | 0x07}, 2, true},        // SVC prefix
+		{[]byte{0x74, 0x80, 0x10, 1<<5 | 0x07, 0x88}, 1, true},  // SVC slice extension
+		{[]byte{0x6E, 0x40, 0x00, 0x80 | 3<<3 | 0x01}, 3, true}, // MVC prefix, view 2
+		{[]byte{0x6E, 0x80, 0x00}, 0, false},
+		{[]byte{0x41, 0x9A, 0xFF, 0xFF}, 0, false},
+	}
+	for i, c := range cases {
+		if id, ok := TemporalID(c.nalu); id != c.id || ok != c.ok {
+			t.Errorf("Case %d: expected %d, %v, got %d, %v", i, c.id, c.ok, id, ok)
+		}
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	nalus := [][]byte{{0x09, 0xF0}, {0x67, 0x42, 0x00, 0x1E}, {0x65, 0x88, 0x00, 0x00, 0x03, 0x01}}
+	data := AppendAnnexB(nil, nalus)
+
+	// Three-byte start codes and trailing zeros are accepted too
+	data = append(data, 0, 0, 0, 0, 1, 0x41, 0x9A, 0, 0, 1, 0x06, 0x05)
+	nalus = append(nalus, []byte{0x41, 0x9A}, []byte{0x06, 0x05})
+
+	got := SplitAnnexB(data)
+	if len(got) != len(nalus) {
+		t.Fatalf("Expected %d NAL units, got %d", len(nalus), len(got))
+	}
+	for i := range nalus {
+		if !bytes.Equal(got[i], nalus[i]) {
+			t.Errorf("NAL unit %d: expected % X, got % X", i, nalus[i], got[i])
+		}
+	}
+}
+
+// testSlice builds a slice NAL unit header with first_mb_in_slice
+func testSlice(header byte, firstMB uint32) []byte {
+	w := &h264test.BitWriter{}
+	w.UE(firstMB)
+	w.UE(7) // slice_type I
+	return w.NALU(header)
+}
+
+func TestNALUReader(t *testing.T) {
+	nalus := [][]byte{{0x09, 0xF0}, {0x67, 0x42, 0x00, 0x1E}, {0x65, 0x88, 0x00, 0x00, 0x03, 0x01}, {0x41, 0x9A}}
+	data := append([]byte{0xFF, 0x00}, AppendAnnexB(nil, nalus[:3])...) // leading garbage
+	data = append(data, 0, 0, 1, 0x41, 0x9A, 0, 0)
+
+	// One byte at a time, so start codes straddle reads
+	r := NewNALUReader(iotest.OneByteReader(bytes.NewReader(data)))
+	var got [][]byte
+	for {
+		nalu, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, nalu)
+	}
+	if len(got) != len(nalus) {
+		t.Fatalf("Expected %d NAL units, got %d", len(nalus), len(got))
+	}
+	for i := range nalus {
+		if !bytes.Equal(got[i], nalus[i]) {
+			t.Errorf("NAL unit %d: expected % X, got % X", i, nalus[i], got[i])
+		}
+	}
+}
+
+func TestAccessUnitBuilder(t *testing.T) {
+	sps, pps, sei := []byte{0x67, 0x42}, []byte{0x68, 0xCE}, []byte{0x06, 0x05}
+	stream := [][]byte{
+		sps, pps, testSlice(0x65, 0), testSlice(0x65, 40), // IDR in two slices
+		testSlice(0x41, 0),      // next picture, no delimiter
+		sei, testSlice(0x41, 0), // SEI starts the third
+		{0x09, 0xF0}, testSlice(0x41, 0),
+	}
+	b := &AccessUnitBuilder{}
+	var sizes []int
+	for _, nalu := range stream {
+		if au := b.Push(nalu); au != nil {
+			sizes = append(sizes, len(au))
+		}
+	}
+	sizes = append(sizes, len(b.Flush()))
+
+	want := []int{4, 1, 2, 2}
+	if len(sizes) != len(want) {
+		t.Fatalf("Expected access units of %v NAL units, got %v", want, sizes)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Errorf("Expected access units of %v NAL units, got %v", want, sizes)
+			break
+		}
+	}
+	if first, ok := FirstMBInSlice(testSlice(0x65, 40)); !ok || first != 40 {
+		t.Errorf("Expected first_mb_in_slice 40, got %d (%v)", first, ok)
+	}
+}
+
+// timingSPS builds a Baseline SPS whose VUI has NAL HRD parameters and
+// pic_struct_present_flag, with 24-bit delays and a 24-bit time offset
+func timingSPS() *SPS {
+	w := &h264test.BitWriter{}
+	w.Bits(66, 8)
+	w.Bits(0xC0, 8)
+	w.Bits(30, 8)
+	w.UE(0)
+	w.UE(0)
+	w.UE(0)
+	w.UE(0)
+	w.UE(1)
+	w.Flag(false)
+	w.UE(19)
+	w.UE(14)
+	w.Flag(true)
+	w.Flag(true)
+	w.Flag(false)
+	w.Flag(true) // vui_parameters_present_flag
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(true) // timing_info_present_flag
+	w.Bits(1001, 32)
+	w.Bits(60000, 32)
+	w.Flag(true)
+	w.Flag(true) // nal_hrd_parameters_present_flag
+	w.UE(0)      // cpb_cnt_minus1
+	w.Bits(0, 8)
+	w.UE(1000)
+	w.UE(1000)
+	w.Flag(false)
+	w.Bits(23, 5)
+	w.Bits(23, 5) // cpb_removal_delay_length_minus1
+	w.Bits(23, 5) // dpb_output_delay_length_minus1
+	w.Bits(24, 5) // time_offset_length
+	w.Flag(false) // vcl_hrd_parameters_present_flag
+	w.Flag(false) // low_delay_hrd_flag
+	w.Flag(true)  // pic_struct_present_flag
+	w.Flag(false) // bitstream_restriction_flag
+	sps, err := ParseSPS(w.NALU(0x67))
+	if err != nil {
+		panic(err)
+	}
+	return sps
+}
+
+func TestParseSPSTiming(t *testing.T) {
+	sps := timingSPS()
+	if !sps.CPBDPBDelaysPresent || !sps.PicStructPresent || sps.CPBRemovalDelayLength != 24 ||
+		sps.DPBOutputDelayLength != 24 || sps.TimeOffsetLength != 24 {
+		t.Errorf("Unexpected HRD fields %+v", sps)
+	}
+	if sps.FrameRate < 29.97 || sps.FrameRate > 29.98 {
+		t.Errorf("Expected 29.97 fps, got %v", sps.FrameRate)
+	}
+
+	// No HRD in the 25 fps SPS, and the VUI after the timing is cut short
+	if sps, _ := ParseSPS(h264test.SPS()); sps.CPBDPBDelaysPresent || sps.PicStructPresent {
+		t.Errorf("Expected no HRD fields, got %+v", sps)
+	}
+}
+
+func TestParseSEI(t *testing.T) {
+	// Picture timing for a frame at 01:02:03;04, drop frame, with a time
+	// offset of -2
+	w := &h264test.BitWriter{}
+	w.Bits(10, 24) // cpb_removal_delay
+	w.Bits(4, 24)  // dpb_output_delay
+	w.Bits(0, 4)   // pic_struct: frame
+	w.Flag(true)   // clock_timestamp_flag
+	w.Bits(0, 2)
+	w.Flag(false)
+	w.Bits(4, 5)  // counting_type
+	w.Flag(true)  // full_timestamp_flag
+	w.Flag(false) // discontinuity_flag
+	w.Flag(false)
+	w.Bits(4, 8)
+	w.Bits(3, 6)
+	w.Bits(2, 6)
+	w.Bits(1, 5)
+	w.Bits(0xFFFFFE, 24)
+	timing := w.Trailing()
+
+	recovery := &h264test.BitWriter{}
+	recovery.UE(0)
+	recovery.Flag(true)
+	recovery.Flag(false)
+	recovery.Bits(0, 2)
+
+	x264 := append([]byte{0xDC, 0x45, 0xE9, 0xBD, 0xE6, 0xD9, 0x48, 0xB7, 0x96, 0x2C, 0xD8, 0x20, 0xD9, 0x23, 0xEE, 0xEF}, "x264 - core 164\x00"...)
+
+	nalu := []byte{0x06, SEIPicTiming, byte(len(timing))}
+	nalu = append(nalu, timing...)
+	nalu = append(nalu, SEIRecoveryPoint, byte(len(recovery.Trailing())))
+	nalu = append(nalu, recovery.Data...)
+	nalu = append(nalu, SEIUserDataUnregistered, byte(len(x264)))
+	nalu = append(nalu, x264...)
+	nalu = append(nalu, 0x80)
+
+	messages, err := ParseSEI(nalu)
+	if err != nil {
+		t.Fatalf("ParseSEI failed: %v", err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+
+	pt, err := ParsePicTiming(messages[0].Payload, timingSPS())
+	if err != nil {
+		t.Fatalf("ParsePicTiming failed: %v", err)
+	}
+	if pt.CPBRemovalDelay != 10 || pt.DPBOutputDelay != 4 || len(pt.Timecodes) != 1 {
+		t.Fatalf("Unexpected picture timing %+v", pt)
+	}
+	if tc := pt.Timecodes[0]; tc.String() != "01:02:03;04" || tc.Offset != -2 {
+		t.Errorf("Expected 01:02:03;04 offset -2, got %v offset %d", tc, tc.Offset)
+	}
+
+	rp, err := ParseRecoveryPoint(messages[1].Payload)
+	if err != nil || rp.FrameCount != 0 || !rp.ExactMatch || rp.BrokenLink {
+		t.Errorf("Unexpected recovery point %+v (%v)", rp, err)
+	}
+
+	u, err := ParseUserDataUnregistered(messages[2].Payload)
+	if err != nil {
+		t.Fatalf("ParseUserDataUnregistered failed: %v", err)
+	}
+	if u.UUIDString() != "dc45e9bd-e6d9-48b7-962c-d820d923eeef" || u.Text() != "x264 - core 164" {
+		t.Errorf("Unexpected user data %s %q", u.UUIDString(), u.Text())
+	}
+	if (&UserDataUnregistered{Data: []byte{0x01, 0xFF}}).Text() != "" {
+		t.Error("Expected no text for binary data")
+	}
+
+	if _, err := ParseSEI([]byte{0x06, SEIPicTiming, 20, 0x00}); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+func TestTimecodeFill(t *testing.T) {
+	sps := &SPS{PicStructPresent: true}
+	w := &h264test.BitWriter{}
+	w.Bits(0, 4)
+	w.Flag(true)
+	w.Bits(0, 8)
+	w.Flag(false) // full_timestamp_flag
+	w.Flag(false)
+	w.Flag(false)
+	w.Bits(7, 8)
+	w.Flag(true) // seconds_flag
+	w.Bits(30, 6)
+	w.Flag(false) // minutes_flag
+	pt, err := ParsePicTiming(w.Trailing(), sps)
+	if err != nil || len(pt.Timecodes) != 1 {
+		t.Fatalf("Unexpected picture timing %+v (%v)", pt, err)
+	}
+	tc := pt.Timecodes[0].Fill(Timecode{Hours: 10, Minutes: 20, Seconds: 29})
+	if tc.String() != "10:20:30:07" {
+		t.Errorf("Expected 10:20:30:07, got %v", tc)
+	}
+}
+
+func TestParseCaptions(t *testing.T) {
+	payload := []byte{0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03,
+		0xC3, 0xFF, // process_cc_data_flag, 3 triplets
+		0xFC, 0x94, 0x20, // field 1
+		0xF9, 0x80, 0x80, // field 2, not valid
+		0xFF, 0x02, 0x21, // DTVCC start
+		0xFF}
+	cc, err := ParseCaptions(payload)
+	if err != nil {
+		t.Fatalf("ParseCaptions failed: %v", err)
+	}
+	want := []CCData{{Type: CC608Field1, Data: [2]byte{0x94, 0x20}}, {Type: DTVCCStart, Data: [2]byte{0x02, 0x21}}}
+	if len(cc) != len(want) || cc[0] != want[0] || cc[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, cc)
+	}
+
+	if cc, err := ParseCaptions([]byte{0xB5, 0x00, 0x2F, 0x03}); cc != nil || err != nil {
+		t.Errorf("Expected nothing for other user data, got %v (%v)", cc, err)
+	}
+	if _, err := ParseCaptions(payload[:12]); err == nil {
+		t.Error("Expected an error for truncated cc_data")
+	}
+}
@@ -0,0 +1,285 @@
+package h264
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// SEI payload types (H.264 Annex D)
+const (
+	SEIBufferingPeriod      = 0
+	SEIPicTiming            = 1
+	SEIUserDataRegistered   = 4
+	SEIUserDataUnregistered = 5
+	SEIRecoveryPoint        = 6
+)
+
+// SEIMessage is one sei_message() of an SEI NAL unit
+type SEIMessage struct {
+	Type    int
+	Payload []byte // without emulation prevention bytes
+}
+
+// ParseSEI splits an SEI NAL unit, including its one-byte NAL header, into
+// its messages
+func ParseSEI(nalu []byte) ([]SEIMessage, error) {
+	if len(nalu) < 2 || nalu[0]&0x1F != NALUSEI {
+		return nil, errors.New("h264: not an SEI NAL unit")
+	}
+
+	data := unescapeRBSP(nalu[1:])
+	var messages []SEIMessage
+	for len(data) > 0 && !isTrailing(data) {
+		typ, n := seiValue(data)
+		data = data[n:]
+		size, n := seiValue(data)
+		data = data[n:]
+		if n == 0 || size > len(data) {
+			return messages, fmt.Errorf("h264: SEI message of type %d runs past the NAL unit", typ)
+		}
+		messages = append(messages, SEIMessage{Type: typ, Payload: data[:size]})
+		data = data[size:]
+	}
+	return messages, nil
+}
+
+// seiValue reads a payload type or size, coded as 0xFF bytes each adding 255
+// and a last byte, returning it and the bytes read, 0 if data ends first
+func seiValue(data []byte) (int, int) {
+	v := 0
+	for i, b := range data {
+		v += int(b)
+		if b != 0xFF {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// isTrailing reports whether data is just rbsp_trailing_bits
+func isTrailing(data []byte) bool {
+	return data[0] == 0x80 && len(bytes.Trim(data[1:], "\x00")) == 0
+}
+
+// numClockTS is the number of clock timestamps for each pic_struct (Table D-1)
+var numClockTS = [...]int{1, 1, 1, 2, 2, 3, 3, 2, 3}
+
+// PicTiming is a picture timing SEI message
+type PicTiming struct {
+	CPBRemovalDelay uint32
+	DPBOutputDelay  uint32
+	PicStruct       uint8 // 0 for a frame, absent without pic_struct_present_flag
+	Timecodes       []Timecode
+}
+
+// Timecode is a clock timestamp of a picture timing SEI message. Fields a
+// partial timestamp leaves out are zero, see Fill.
+type Timecode struct {
+	Hours, Minutes, Seconds, Frames int
+	CountingType                    uint8 // 4 for drop frame counting
+	Discontinuity                   bool
+	Offset                          int32 // time_offset, in clock ticks
+
+	set uint8 // which of seconds, minutes and hours were present
+}
+
+const (
+	tcSeconds = 1 << iota
+	tcMinutes
+	tcHours
+	tcFull = tcSeconds | tcMinutes | tcHours
+)
+
+// ParsePicTiming parses a picture timing SEI payload. The SPS of the
+// picture gives the field lengths.
+func ParsePicTiming(payload []byte, sps *SPS) (*PicTiming, error) {
+	br := newBitReader(payload)
+	pt := &PicTiming{}
+	if sps.CPBDPBDelaysPresent {
+		pt.CPBRemovalDelay = br.bits(int(sps.CPBRemovalDelayLength))
+		pt.DPBOutputDelay = br.bits(int(sps.DPBOutputDelayLength))
+	}
+	if sps.PicStructPresent {
+		pt.PicStruct = uint8(br.bits(4))
+		if int(pt.PicStruct) >= len(numClockTS) {
+			return nil, fmt.Errorf("h264: invalid pic_struct %d", pt.PicStruct)
+		}
+		for i := 0; i < numClockTS[pt.PicStruct]; i++ {
+			if !br.flag() { // clock_timestamp_flag
+				continue
+			}
+			pt.Timecodes = append(pt.Timecodes, parseClockTimestamp(br, sps))
+		}
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid picture timing SEI: %w", br.err)
+	}
+	return pt, nil
+}
+
+// parseClockTimestamp reads the fields following a set clock_timestamp_flag
+func parseClockTimestamp(br *bitReader, sps *SPS) Timecode {
+	var tc Timecode
+	br.bits(2) // ct_type
+	br.flag()  // nuit_field_based_flag
+	tc.CountingType = uint8(br.bits(5))
+	full := br.flag()
+	tc.Discontinuity = br.flag()
+	br.flag() // cnt_dropped_flag
+	tc.Frames = int(br.bits(8))
+	if full {
+		tc.Seconds, tc.Minutes, tc.Hours = int(br.bits(6)), int(br.bits(6)), int(br.bits(5))
+		tc.set = tcFull
+	} else if br.flag() {
+		tc.Seconds, tc.set = int(br.bits(6)), tcSeconds
+		if br.flag() {
+			tc.Minutes, tc.set = int(br.bits(6)), tc.set|tcMinutes
+			if br.flag() {
+				tc.Hours, tc.set = int(br.bits(5)), tc.set|tcHours
+			}
+		}
+	}
+	if n := int(sps.TimeOffsetLength); n > 0 {
+		// Two's complement of n bits
+		tc.Offset = int32(br.bits(n)<<(32-n)) >> (32 - n)
+	}
+	return tc
+}
+
+// Fill takes the fields a partial timestamp left out from the previous
+// one, as D.2.3 says they are inferred
+func (tc Timecode) Fill(prev Timecode) Timecode {
+	if tc.set&tcSeconds == 0 {
+		tc.Seconds = prev.Seconds
+	}
+	if tc.set&tcMinutes == 0 {
+		tc.Minutes = prev.Minutes
+	}
+	if tc.set&tcHours == 0 {
+		tc.Hours = prev.Hours
+	}
+	tc.set = tcFull
+	return tc
+}
+
+// String formats the timecode as HH:MM:SS:FF, with a semicolon before the
+// frames for drop frame counting
+func (tc Timecode) String() string {
+	sep := ':'
+	if tc.CountingType == 4 {
+		sep = ';'
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%c%02d", tc.Hours, tc.Minutes, tc.Seconds, sep, tc.Frames)
+}
+
+// RecoveryPoint is a recovery point SEI message, marking where decoding
+// can start without an IDR
+type RecoveryPoint struct {
+	FrameCount            uint32 // frames until the output is correct
+	ExactMatch            bool
+	BrokenLink            bool
+	ChangingSliceGroupIDC uint8
+}
+
+// ParseRecoveryPoint parses a recovery point SEI payload
+func ParseRecoveryPoint(payload []byte) (*RecoveryPoint, error) {
+	br := newBitReader(payload)
+	rp := &RecoveryPoint{
+		FrameCount:            br.ue(),
+		ExactMatch:            br.flag(),
+		BrokenLink:            br.flag(),
+		ChangingSliceGroupIDC: uint8(br.bits(2)),
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("h264: invalid recovery point SEI: %w", br.err)
+	}
+	return rp, nil
+}
+
+// UserDataUnregistered is a user_data_unregistered SEI message, data
+// identified by a UUID, such as the settings x264 writes
+type UserDataUnregistered struct {
+	UUID [16]byte
+	Data []byte
+}
+
+// ParseUserDataUnregistered parses a user_data_unregistered SEI payload
+func ParseUserDataUnregistered(payload []byte) (*UserDataUnregistered, error) {
+	if len(payload) < 16 {
+		return nil, errors.New("h264: user_data_unregistered SEI shorter than its UUID")
+	}
+	u := &UserDataUnregistered{Data: payload[16:]}
+	copy(u.UUID[:], payload)
+	return u, nil
+}
+
+// UUIDString formats the UUID as 8-4-4-4-12 hex digits
+func (u *UserDataUnregistered) UUIDString() string {
+	b := u.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Text returns the data as text if it is printable, up to a terminating
+// NUL, or "" if it is binary
+func (u *UserDataUnregistered) Text() string {
+	text, _, _ := bytes.Cut(u.Data, []byte{0})
+	if len(text) == 0 {
+		return ""
+	}
+	for _, r := range string(text) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return ""
+		}
+	}
+	return string(text)
+}
+
+// Caption data types of cc_data() (CEA-708 4.4)
+const (
+	CC608Field1 = 0
+	CC608Field2 = 1
+	DTVCCData   = 2 // CEA-708 caption channel packet data
+	DTVCCStart  = 3 // CEA-708 caption channel packet start
+)
+
+// CCData is one valid cc_data_1/cc_data_2 pair of closed caption data. The
+// CEA-608 bytes keep their parity bit.
+type CCData struct {
+	Type uint8
+	Data [2]byte
+}
+
+// ParseCaptions returns the closed captions in a user_data_registered_itu_t_t35
+// SEI payload carrying ATSC A/53 caption data, or nil for other registered
+// user data
+func ParseCaptions(payload []byte) ([]CCData, error) {
+	// United States, ATSC, "GA94", cc_data()
+	header := []byte{0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03}
+	if !bytes.HasPrefix(payload, header) {
+		return nil, nil
+	}
+	data := payload[len(header):]
+	if len(data) < 2 {
+		return nil, errors.New("h264: truncated cc_data")
+	}
+	if data[0]&0x40 == 0 { // process_cc_data_flag
+		return nil, nil
+	}
+	count := int(data[0] & 0x1F)
+	data = data[2:] // flags and em_data
+	if len(data) < count*3 {
+		return nil, fmt.Errorf("h264: cc_data announces %d triplets in %d bytes", count, len(data))
+	}
+
+	var captions []CCData
+	for i := 0; i < count; i++ {
+		t := data[i*3:]
+		if t[0]&0x04 == 0 { // cc_valid
+			continue
+		}
+		captions = append(captions, CCData{Type: t[0] & 0x03, Data: [2]byte{t[1], t[2]}})
+	}
+	return captions, nil
+}
@@ -0,0 +1,48 @@
+package h265
+
+// AccessUnitBuilder groups NAL units in decoding order into access units
+// (section 7.4.2.4.4): a new one starts at an access unit delimiter,
+// parameter set, prefix SEI or reserved prefix type after a slice segment,
+// or at a slice segment with first_slice_segment_in_pic_flag set after one.
+// Byte streams come from h264.NALUReader, since Annex B is the same in both
+// codecs.
+type AccessUnitBuilder struct {
+	nalus  [][]byte
+	hasVCL bool
+}
+
+// Push adds a NAL unit and returns the previous access unit if the NAL
+// unit starts a new one, otherwise nil
+func (b *AccessUnitBuilder) Push(nalu []byte) [][]byte {
+	if len(nalu) < 2 {
+		return nil
+	}
+	nalType := Type(nalu)
+	isVCL := IsVCL(nalType)
+
+	var au [][]byte
+	if b.hasVCL {
+		starts := false
+		switch {
+		case isVCL:
+			starts = FirstSliceSegment(nalu)
+		case nalType >= NALUVPS && nalType <= NALUAUD, nalType == NALUSEI,
+			nalType >= 41 && nalType <= 44, nalType >= 48 && nalType <= 55:
+			starts = true
+		}
+		if starts {
+			au = b.Flush()
+		}
+	}
+
+	b.nalus = append(b.nalus, nalu)
+	b.hasVCL = b.hasVCL || isVCL
+	return au
+}
+
+// Flush returns the access unit being collected, at the end of the stream
+func (b *AccessUnitBuilder) Flush() [][]byte {
+	au := b.nalus
+	b.nalus, b.hasVCL = nil, false
+	return au
+}
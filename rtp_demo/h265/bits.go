@@ -0,0 +1,82 @@
+package h265
+
+import "errors"
+
+// errShort is returned when a NAL unit ends before a field is complete
+var errShort = errors.New("h265: NAL unit too short")
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03)
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads fixed-width and Exp-Golomb coded fields. The first read
+// past the end sets err, and later reads return zero.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func newBitReader(rbsp []byte) *bitReader {
+	return &bitReader{data: rbsp}
+}
+
+// bit reads one bit
+func (br *bitReader) bit() uint32 {
+	if br.err != nil {
+		return 0
+	}
+	if br.pos >= len(br.data)*8 {
+		br.err = errShort
+		return 0
+	}
+	bit := uint32(br.data[br.pos/8]>>(7-br.pos%8)) & 1
+	br.pos++
+	return bit
+}
+
+// flag reads one bit as a bool
+func (br *bitReader) flag() bool {
+	return br.bit() == 1
+}
+
+// bits reads an n-bit unsigned value, n <= 32
+func (br *bitReader) bits(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		v = v<<1 | br.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb value. Signed values are skipped with it
+// too, since they have the same length.
+func (br *bitReader) ue() uint32 {
+	zeros := 0
+	for br.bit() == 0 {
+		if br.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			br.err = errors.New("h265: invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return (1 << zeros) - 1 + br.bits(zeros)
+}
@@ -0,0 +1,293 @@
+// Package h265 parses the H.265 (HEVC) syntax elements the RTP tools need
+// to send elementary streams: NAL unit headers, the picture size and frame
+// rate of sequence parameter sets, and access unit boundaries.
+package h265
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NAL unit types
+const (
+	NALUBLAWLP   = 16 // first of the IRAP types, up to 23
+	NALUIDRWRADL = 19
+	NALUIDRNLP   = 20
+	NALUCRA      = 21
+	NALUVPS      = 32
+	NALUSPS      = 33
+	NALUPPS      = 34
+	NALUAUD      = 35
+	NALUEOS      = 36
+	NALUEOB      = 37
+	NALUFiller   = 38
+	NALUSEI      = 39 // prefix SEI
+	NALUSuffix   = 40 // suffix SEI
+)
+
+// Type returns the NAL unit type from the two-byte NAL header
+func Type(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] >> 1 & 0x3F
+}
+
+// IsVCL reports whether a NAL unit type is a coded slice segment
+func IsVCL(nalType uint8) bool {
+	return nalType < 32
+}
+
+// IsIRAP reports whether a NAL unit type is a slice segment of an intra
+// random access point picture (BLA, IDR or CRA), where decoding can start
+func IsIRAP(nalType uint8) bool {
+	return nalType >= NALUBLAWLP && nalType <= 23
+}
+
+// FirstSliceSegment reports whether a coded slice segment NAL unit starts
+// a picture (first_slice_segment_in_pic_flag)
+func FirstSliceSegment(nalu []byte) bool {
+	return len(nalu) > 2 && nalu[2]&0x80 != 0
+}
+
+// SPS holds the fields of a sequence parameter set that describe the video
+type SPS struct {
+	ProfileIDC      uint8
+	TierFlag        bool
+	LevelIDC        uint8 // 30 times the level
+	ID              uint32
+	ChromaFormatIDC uint32
+	BitDepth        uint32 // luma bit depth
+	Width           int    // after the conformance window
+	Height          int
+
+	// From the VUI, zero when absent
+	FrameRate float64
+}
+
+// ParseSPS parses a sequence parameter set NAL unit, including its two-byte
+// NAL header, up to the timing information of its VUI
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || Type(nalu) != NALUSPS {
+		return nil, errors.New("h265: not an SPS NAL unit")
+	}
+
+	br := newBitReader(unescapeRBSP(nalu[2:]))
+	br.bits(4) // sps_video_parameter_set_id
+	maxSubLayers := int(br.bits(3)) + 1
+	br.flag() // sps_temporal_id_nesting_flag
+
+	sps := &SPS{}
+	parseProfileTierLevel(br, sps, maxSubLayers)
+
+	sps.ID = br.ue()
+	sps.ChromaFormatIDC = br.ue()
+	separateColourPlane := false
+	if sps.ChromaFormatIDC == 3 {
+		separateColourPlane = br.flag()
+	}
+	sps.Width = int(br.ue())
+	sps.Height = int(br.ue())
+	if br.flag() { // conformance_window_flag
+		left, right, top, bottom := int(br.ue()), int(br.ue()), int(br.ue()), int(br.ue())
+
+		subWidth, subHeight := 1, 1
+		if !separateColourPlane {
+			switch sps.ChromaFormatIDC {
+			case 1:
+				subWidth, subHeight = 2, 2
+			case 2:
+				subWidth = 2
+			}
+		}
+		sps.Width -= (left + right) * subWidth
+		sps.Height -= (top + bottom) * subHeight
+	}
+	sps.BitDepth = br.ue() + 8
+	br.ue() // bit_depth_chroma_minus8
+	log2MaxPOCLsb := int(br.ue()) + 4
+
+	first := maxSubLayers - 1
+	if br.flag() { // sps_sub_layer_ordering_info_present_flag
+		first = 0
+	}
+	for i := first; i < maxSubLayers; i++ {
+		br.ue() // sps_max_dec_pic_buffering_minus1
+		br.ue() // sps_max_num_reorder_pics
+		br.ue() // sps_max_latency_increase_plus1
+	}
+
+	// Coding block and transform sizes
+	for i := 0; i < 6; i++ {
+		br.ue()
+	}
+	if br.flag() && br.flag() { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		skipScalingListData(br)
+	}
+	br.flag()      // amp_enabled_flag
+	br.flag()      // sample_adaptive_offset_enabled_flag
+	if br.flag() { // pcm_enabled_flag
+		br.bits(8) // PCM sample bit depths
+		br.ue()
+		br.ue()
+		br.flag() // pcm_loop_filter_disabled_flag
+	}
+
+	if err := skipShortTermRefPicSets(br); err != nil {
+		return nil, err
+	}
+	if br.flag() { // long_term_ref_pics_present_flag
+		n := br.ue()
+		if n > 32 {
+			return nil, errors.New("h265: invalid num_long_term_ref_pics_sps")
+		}
+		for i := uint32(0); i < n; i++ {
+			br.bits(log2MaxPOCLsb) // lt_ref_pic_poc_lsb_sps
+			br.flag()              // used_by_curr_pic_lt_sps_flag
+		}
+	}
+	br.flag() // sps_temporal_mvp_enabled_flag
+	br.flag() // strong_intra_smoothing_enabled_flag
+
+	if br.err == nil && br.flag() { // vui_parameters_present_flag
+		parseVUI(br, sps)
+	}
+
+	if br.err != nil {
+		return nil, fmt.Errorf("h265: invalid SPS: %w", br.err)
+	}
+	return sps, nil
+}
+
+// parseProfileTierLevel reads the general profile, tier and level of a
+// profile_tier_level() structure and skips those of the sub-layers
+func parseProfileTierLevel(br *bitReader, sps *SPS, maxSubLayers int) {
+	br.bits(2) // general_profile_space
+	sps.TierFlag = br.flag()
+	sps.ProfileIDC = uint8(br.bits(5))
+	br.bits(32) // general_profile_compatibility_flags
+	br.bits(32) // source and constraint flags
+	br.bits(16)
+	sps.LevelIDC = uint8(br.bits(8))
+
+	profilePresent := make([]bool, maxSubLayers-1)
+	levelPresent := make([]bool, maxSubLayers-1)
+	for i := range profilePresent {
+		profilePresent[i] = br.flag()
+		levelPresent[i] = br.flag()
+	}
+	if maxSubLayers > 1 {
+		for i := maxSubLayers - 1; i < 8; i++ {
+			br.bits(2) // reserved_zero_2bits
+		}
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			br.bits(32) // sub_layer profile space, tier, profile and flags
+			br.bits(32)
+			br.bits(24)
+		}
+		if levelPresent[i] {
+			br.bits(8) // sub_layer_level_idc
+		}
+	}
+}
+
+// skipScalingListData skips a scaling_list_data() structure
+func skipScalingListData(br *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !br.flag() { // scaling_list_pred_mode_flag
+				br.ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			coefs := 1 << (4 + sizeID*2)
+			if coefs > 64 {
+				coefs = 64
+			}
+			if sizeID > 1 {
+				br.ue() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefs; i++ {
+				br.ue() // scaling_list_delta_coef
+			}
+		}
+	}
+}
+
+// skipShortTermRefPicSets skips num_short_term_ref_pic_sets and the
+// st_ref_pic_set() structures of an SPS. A set predicted from the one
+// before it lists a flag for each picture of that set.
+func skipShortTermRefPicSets(br *bitReader) error {
+	n := br.ue()
+	if n > 64 {
+		return errors.New("h265: invalid num_short_term_ref_pic_sets")
+	}
+
+	deltaPOCs := make([]uint32, n) // NumDeltaPocs of each set
+	for i := uint32(0); i < n; i++ {
+		if i > 0 && br.flag() { // inter_ref_pic_set_prediction_flag
+			br.flag() // delta_rps_sign
+			br.ue()   // abs_delta_rps_minus1
+			for j := uint32(0); j <= deltaPOCs[i-1]; j++ {
+				used := br.flag()
+				if used || br.flag() { // use_delta_flag
+					deltaPOCs[i]++
+				}
+			}
+			continue
+		}
+
+		negative, positive := br.ue(), br.ue()
+		if negative > 16 || positive > 16 {
+			return errors.New("h265: invalid st_ref_pic_set")
+		}
+		for j := uint32(0); j < negative+positive; j++ {
+			br.ue()   // delta_poc_s0_minus1 or delta_poc_s1_minus1
+			br.flag() // used_by_curr_pic_s0_flag or used_by_curr_pic_s1_flag
+		}
+		deltaPOCs[i] = negative + positive
+	}
+	return nil
+}
+
+// parseVUI reads the VUI fields up to the timing information. A truncated
+// VUI leaves the frame rate zero rather than failing the SPS.
+func parseVUI(br *bitReader, sps *SPS) {
+	if br.flag() { // aspect_ratio_info_present_flag
+		if br.bits(8) == 255 { // Extended_SAR
+			br.bits(32)
+		}
+	}
+	if br.flag() { // overscan_info_present_flag
+		br.flag()
+	}
+	if br.flag() { // video_signal_type_present_flag
+		br.bits(4)
+		if br.flag() { // colour_description_present_flag
+			br.bits(24)
+		}
+	}
+	if br.flag() { // chroma_loc_info_present_flag
+		br.ue()
+		br.ue()
+	}
+	br.bits(3)     // neutral_chroma_indication, field_seq and frame_field_info_present flags
+	if br.flag() { // default_display_window_flag
+		for i := 0; i < 4; i++ {
+			br.ue()
+		}
+	}
+	if br.flag() { // vui_timing_info_present_flag
+		unitsInTick := br.bits(32)
+		timeScale := br.bits(32)
+		if br.err == nil && unitsInTick > 0 {
+			sps.FrameRate = float64(timeScale) / float64(unitsInTick)
+		}
+	}
+	br.err = nil
+}
@@ -0,0 +1,208 @@
+package h265
+
+import (
+	"math"
+	"testing"
+
+	"rtp_demo/internal/h264test"
+)
+
+// header returns a two-byte NAL header of layer 0 and temporal ID 0
+func header(nalType uint8) []byte {
+	return []byte{nalType << 1, 1}
+}
+
+// buildSPS builds a Main profile 1920x1080 SPS (1088 coded lines, cropped)
+// with two sub-layers, a predicted short-term reference picture set, a
+// long-term one and VUI timing for 59.94 fps
+func buildSPS() []byte {
+	w := &h264test.BitWriter{}
+	w.Bits(0, 4) // sps_video_parameter_set_id
+	w.Bits(1, 3) // sps_max_sub_layers_minus1
+	w.Flag(true) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	w.Bits(0, 2) // general_profile_space
+	w.Flag(false)
+	w.Bits(1, 5) // general_profile_idc: Main
+	w.Bits(0x60000000, 32)
+	w.Bits(0x9000, 16)
+	w.Bits(0, 32)
+	w.Bits(120, 8) // general_level_idc: 4
+	w.Flag(true)   // sub_layer_profile_present_flag
+	w.Flag(true)   // sub_layer_level_present_flag
+	for i := 1; i < 8; i++ {
+		w.Bits(0, 2)
+	}
+	w.Bits(0, 32)
+	w.Bits(0, 32)
+	w.Bits(0, 24)
+	w.Bits(90, 8)
+
+	w.UE(0)    // sps_seq_parameter_set_id
+	w.UE(1)    // chroma_format_idc
+	w.UE(1920) // pic_width_in_luma_samples
+	w.UE(1088)
+	w.Flag(true) // conformance_window_flag
+	w.UE(0)
+	w.UE(0)
+	w.UE(0)
+	w.UE(4)      // bottom offset: 4 * 2 lines
+	w.UE(0)      // bit_depth_luma_minus8
+	w.UE(0)      // bit_depth_chroma_minus8
+	w.UE(4)      // log2_max_pic_order_cnt_lsb_minus4
+	w.Flag(true) // sps_sub_layer_ordering_info_present_flag
+	for i := 0; i < 2; i++ {
+		w.UE(4)
+		w.UE(2)
+		w.UE(0)
+	}
+	w.UE(0) // log2_min_luma_coding_block_size_minus3
+	w.UE(3)
+	w.UE(0)
+	w.UE(3)
+	w.UE(0)
+	w.UE(0)
+	w.Flag(true) // scaling_list_enabled_flag
+	w.Flag(true) // sps_scaling_list_data_present_flag
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if sizeID == 2 && matrixID == 0 {
+				w.Flag(true) // explicit: DC and 64 deltas
+				w.UE(7)
+				for i := 0; i < 64; i++ {
+					w.UE(0)
+				}
+				continue
+			}
+			w.Flag(false)
+			w.UE(0)
+		}
+	}
+	w.Flag(false) // amp_enabled_flag
+	w.Flag(true)  // sample_adaptive_offset_enabled_flag
+	w.Flag(false) // pcm_enabled_flag
+
+	w.UE(2) // num_short_term_ref_pic_sets
+	w.UE(2) // num_negative_pics
+	w.UE(1) // num_positive_pics
+	for i := 0; i < 3; i++ {
+		w.UE(0)
+		w.Flag(true)
+	}
+	w.Flag(true)  // inter_ref_pic_set_prediction_flag
+	w.Flag(false) // delta_rps_sign
+	w.UE(0)       // abs_delta_rps_minus1
+	// One flag more than the pictures of set 0
+	for j := 0; j <= 3; j++ {
+		w.Flag(j == 0) // used_by_curr_pic_flag
+		if j > 0 {
+			w.Flag(j == 1) // use_delta_flag
+		}
+	}
+	w.Flag(true) // long_term_ref_pics_present_flag
+	w.UE(1)
+	w.Bits(5, 8) // lt_ref_pic_poc_lsb_sps
+	w.Flag(true)
+	w.Flag(true)  // sps_temporal_mvp_enabled_flag
+	w.Flag(true)  // strong_intra_smoothing_enabled_flag
+	w.Flag(true)  // vui_parameters_present_flag
+	w.Flag(true)  // aspect_ratio_info_present_flag
+	w.Bits(1, 8)  // 1:1
+	w.Flag(false) // overscan_info_present_flag
+	w.Flag(true)  // video_signal_type_present_flag
+	w.Bits(5, 4)
+	w.Flag(true)
+	w.Bits(0x010101, 24)
+	w.Flag(false) // chroma_loc_info_present_flag
+	w.Bits(0, 3)
+	w.Flag(false) // default_display_window_flag
+	w.Flag(true)  // vui_timing_info_present_flag
+	w.Bits(1001, 32)
+	w.Bits(60000, 32)
+	w.Flag(false)
+	return append(header(NALUSPS), w.Trailing()...)
+}
+
+func TestParseSPS(t *testing.T) {
+	sps, err := ParseSPS(buildSPS())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sps.ProfileIDC != 1 || sps.LevelIDC != 120 || sps.TierFlag {
+		t.Errorf("Expected Main profile, main tier, level 120, got %d, %v, %d", sps.ProfileIDC, sps.TierFlag, sps.LevelIDC)
+	}
+	if sps.Width != 1920 || sps.Height != 1080 {
+		t.Errorf("Expected 1920x1080, got %dx%d", sps.Width, sps.Height)
+	}
+	if sps.ChromaFormatIDC != 1 || sps.BitDepth != 8 {
+		t.Errorf("Expected 8-bit 4:2:0, got chroma_format_idc %d, bit depth %d", sps.ChromaFormatIDC, sps.BitDepth)
+	}
+	if math.Abs(sps.FrameRate-59.94) > 0.01 {
+		t.Errorf("Expected 59.94 fps, got %f", sps.FrameRate)
+	}
+
+	// Truncated in the reference picture sets
+	if _, err := ParseSPS(buildSPS()[:40]); err == nil {
+		t.Error("Expected an error for a truncated SPS")
+	}
+	if _, err := ParseSPS(append(header(NALUPPS), 1, 2, 3)); err == nil {
+		t.Error("Expected an error for a PPS")
+	}
+}
+
+func TestIsIRAP(t *testing.T) {
+	for nalType, want := range map[uint8]bool{
+		1: false, 9: false, NALUBLAWLP: true, NALUIDRWRADL: true, NALUCRA: true, 23: true, 24: false, NALUVPS: false,
+	} {
+		if got := IsIRAP(nalType); got != want {
+			t.Errorf("IsIRAP(%d): expected %v, got %v", nalType, want, got)
+		}
+	}
+}
+
+func TestAccessUnitBuilder(t *testing.T) {
+	// slice returns a slice segment NAL unit, the first of its picture or not
+	slice := func(nalType uint8, first bool) []byte {
+		b := append(header(nalType), 0x10, 0xAA)
+		if first {
+			b[2] |= 0x80
+		}
+		return b
+	}
+	aud, vps, sps, pps := header(NALUAUD), header(NALUVPS), header(NALUSPS), header(NALUPPS)
+	prefix, suffix := header(NALUSEI), header(NALUSuffix)
+
+	stream := [][]byte{
+		aud, vps, sps, pps, prefix, slice(NALUIDRWRADL, true), slice(NALUIDRWRADL, false), suffix,
+		aud, slice(1, true), slice(1, false),
+		slice(1, true), // no delimiter: the flag starts the picture
+		prefix, slice(0, true),
+		vps, sps, pps, slice(NALUCRA, true), header(NALUEOS),
+	}
+	var aus [][][]byte
+	b := &AccessUnitBuilder{}
+	for _, nalu := range stream {
+		if au := b.Push(nalu); au != nil {
+			aus = append(aus, au)
+		}
+	}
+	aus = append(aus, b.Flush())
+
+	wantSizes := []int{8, 3, 1, 2, 5}
+	if len(aus) != len(wantSizes) {
+		t.Fatalf("Expected %d access units, got %d", len(wantSizes), len(aus))
+	}
+	for i, au := range aus {
+		if len(au) != wantSizes[i] {
+			t.Errorf("Access unit %d: expected %d NAL units, got %d", i, wantSizes[i], len(au))
+		}
+	}
+	if b.Flush() != nil {
+		t.Error("Expected nothing left after Flush")
+	}
+}
@@ -0,0 +1,340 @@
+// Package hls republishes fragmented MP4 from the mp4 muxer as live HLS
+// (RFC 8216) with fMP4 segments. Segments start at keyframes where the GOP
+// allows, are kept in memory for a rolling window and served with their
+// playlist over HTTP.
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtp_demo/mp4"
+)
+
+// Defaults for Options
+const (
+	DefaultTargetDuration = 2 * time.Second
+	DefaultWindow         = 6
+)
+
+// PlayerURL is the hls.js build the player pages load when the server has
+// no copy of its own, pinned so that the page does not change under it
+const PlayerURL = "https://cdn.jsdelivr.net/npm/hls.js@1.5.17/dist/hls.min.js"
+
+// Options controls segmenting
+type Options struct {
+	// TargetDuration is the shortest segment; segments are cut at the first
+	// keyframe after it. The playlist's EXT-X-TARGETDURATION is this or the
+	// first segment, if the first GOP is longer, and does not change after.
+	TargetDuration time.Duration
+
+	// Window is the number of segments in the live playlist
+	Window int
+
+	// Player is a copy of hls.min.js, served at /hls.min.js for the player
+	// pages. Without it they load PlayerURL.
+	Player []byte
+}
+
+// segment is one media segment: a run of fragments, starting at a keyframe
+// unless a GOP was longer than the target duration
+type segment struct {
+	sequence    int
+	data        []byte
+	duration    time.Duration
+	independent bool // starts with a keyframe
+}
+
+// Stream is one live playlist with its segments
+type Stream struct {
+	opts Options
+
+	mu       sync.Mutex
+	init     []byte
+	segments []*segment // completed segments, the window and as many before it
+	current  *segment   // being filled
+	next     int        // sequence number of the next segment
+	target   int        // EXT-X-TARGETDURATION in seconds, 0 until the first segment
+	ended    bool
+}
+
+// ErrSegmentTooLong is returned by Write for a fragment longer than the
+// target duration, which makes a segment the playlist cannot announce. The
+// muxer's MaxFragment should be below MaxFragment.
+var ErrSegmentTooLong = errors.New("hls: fragment longer than the target duration")
+
+// NewStream creates an empty stream
+func NewStream(opts Options) *Stream {
+	if opts.TargetDuration <= 0 {
+		opts.TargetDuration = DefaultTargetDuration
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultWindow
+	}
+	return &Stream{opts: opts}
+}
+
+// Write adds muxer output to the stream. It has the signature of the
+// mp4.NewMuxer callback.
+func (st *Stream) Write(seg mp4.Segment) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if seg.Init {
+		st.init = append([]byte(nil), seg.Data...)
+		return nil
+	}
+	if st.init == nil {
+		return nil
+	}
+
+	// Cut before a keyframe once the segment is long enough, or before any
+	// fragment that would take it past the target duration; other fragments
+	// are appended to the current segment
+	if st.current != nil {
+		long := seg.Keyframe && st.current.duration >= st.opts.TargetDuration
+		if long || st.target > 0 && st.rounded(st.current.duration+seg.Duration) > st.target {
+			st.finish()
+		}
+	}
+	if st.current == nil {
+		if !seg.Keyframe && st.next == 0 {
+			return nil
+		}
+		st.current = &segment{sequence: st.next, independent: seg.Keyframe}
+		st.next++
+	}
+
+	st.current.data = append(st.current.data, seg.Data...)
+	st.current.duration += seg.Duration
+	if st.target > 0 && st.rounded(st.current.duration) > st.target {
+		return fmt.Errorf("%w: segment %d is %v, the target %ds", ErrSegmentTooLong, st.current.sequence, st.current.duration, st.target)
+	}
+	return nil
+}
+
+// rounded returns a duration in whole seconds, rounded the way EXTINF
+// durations are compared with the target duration (RFC 8216 4.3.3.1)
+func (st *Stream) rounded(d time.Duration) int {
+	return int(math.Round(d.Seconds()))
+}
+
+// MaxFragment returns the longest muxer fragment that leaves room to cut
+// segments within the target duration
+func (st *Stream) MaxFragment() time.Duration {
+	return st.opts.TargetDuration / 2
+}
+
+// End completes the last segment and marks the playlist as finished
+func (st *Stream) End() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.current != nil {
+		st.finish()
+	}
+	st.ended = true
+}
+
+// finish moves the current segment into the window
+func (st *Stream) finish() {
+	st.segments = append(st.segments, st.current)
+	if st.target == 0 {
+		// The first segment fixes the target duration, which must not
+		// change during the stream
+		st.target = int(math.Ceil(max(st.current.duration, st.opts.TargetDuration).Seconds()))
+	}
+	st.current = nil
+
+	// Segments that just left the playlist stay available for clients
+	// still working through an older copy of it
+	if len(st.segments) > 2*st.opts.Window {
+		st.segments = st.segments[len(st.segments)-2*st.opts.Window:]
+	}
+}
+
+// Playlist returns the media playlist, or false while there is no segment
+func (st *Stream) Playlist() (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if len(st.segments) == 0 {
+		return "", false
+	}
+	window := st.segments
+	if len(window) > st.opts.Window {
+		window = window[len(window)-st.opts.Window:]
+	}
+
+	independent := true
+	for _, seg := range window {
+		independent = independent && seg.independent
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	if independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", st.target)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", window[0].sequence)
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for _, seg := range window {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.m4s\n", seg.duration.Seconds(), seg.sequence)
+	}
+	if st.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String(), true
+}
+
+// file returns the init segment or a media segment by name
+func (st *Stream) file(name string) ([]byte, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if name == "init.mp4" {
+		return st.init, st.init != nil
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, ".m4s"))
+	if err != nil || !strings.HasSuffix(name, ".m4s") {
+		return nil, false
+	}
+	for _, seg := range st.segments {
+		if seg.sequence == seq {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// Server serves the playlists and segments of named streams
+type Server struct {
+	opts Options
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+}
+
+// NewServer creates a server whose streams use opts
+func NewServer(opts Options) *Server {
+	return &Server{opts: opts, streams: make(map[string]*Stream)}
+}
+
+// Stream returns the named stream, creating it on first use
+func (s *Server) Stream(name string) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		st = NewStream(s.opts)
+		s.streams[name] = st
+	}
+	return st
+}
+
+// ServeHTTP serves, relative to where the server is mounted:
+//
+//	/                      list of streams
+//	/hls.min.js            hls.js, if Options.Player is set
+//	/<name>/               player page
+//	/<name>/index.m3u8     live playlist
+//	/<name>/init.mp4       initialization segment
+//	/<name>/<n>.m4s        media segments
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		s.serveIndex(w)
+		return
+	}
+	if path == "hls.min.js" && s.opts.Player != nil {
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Write(s.opts.Player)
+		return
+	}
+
+	name, file, ok := strings.Cut(path, "/")
+	if !ok {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	s.mu.Lock()
+	st, found := s.streams[name]
+	s.mu.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch file {
+	case "":
+		player := PlayerURL
+		if s.opts.Player != nil {
+			player = "../hls.min.js"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, playerPage, html.EscapeString(name), player)
+	case "index.m3u8":
+		playlist, ok := st.Playlist()
+		if !ok {
+			http.Error(w, "no segments yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+	default:
+		data, ok := st.file(file)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(data)
+	}
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.streams))
+	for name := range s.streams {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<!DOCTYPE html>\n<title>Streams</title>\n<ul>\n")
+	for _, name := range names {
+		n := html.EscapeString(name)
+		fmt.Fprintf(w, "<li><a href=\"%s/\">%s</a> (<a href=\"%s/index.m3u8\">playlist</a>)</li>\n", n, n, n)
+	}
+	fmt.Fprint(w, "</ul>\n")
+}
+
+// playerPage plays the playlist natively (Safari) or with hls.js
+const playerPage = `<!DOCTYPE html>
+<title>%s</title>
+<video id="video" controls autoplay muted playsinline style="max-width: 100%%"></video>
+<script>
+const video = document.getElementById("video");
+if (video.canPlayType("application/vnd.apple.mpegurl")) {
+  video.src = "index.m3u8";
+} else {
+  const script = document.createElement("script");
+  script.src = "%s";
+  script.onload = () => { const hls = new Hls(); hls.loadSource("index.m3u8"); hls.attachMedia(video); };
+  document.head.appendChild(script);
+}
+</script>
+`
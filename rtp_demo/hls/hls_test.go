@@ -0,0 +1,186 @@
+package hls
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rtp_demo/mp4"
+)
+
+// feed writes an init segment and one-second fragments, keyframes every
+// gop fragments
+func feed(st *Stream, fragments, gop int) {
+	st.Write(mp4.Segment{Init: true, Data: []byte("init")})
+	for i := 0; i < fragments; i++ {
+		st.Write(mp4.Segment{Data: []byte{byte(i)}, Duration: time.Second, Keyframe: i%gop == 0})
+	}
+}
+
+func TestSegmenting(t *testing.T) {
+	st := NewStream(Options{TargetDuration: 2 * time.Second, Window: 3})
+
+	if _, ok := st.Playlist(); ok {
+		t.Error("Expected no playlist before the first segment")
+	}
+
+	// Keyframes every 3s with a 2s target: 3s segments
+	feed(st, 20, 3)
+	playlist, ok := st.Playlist()
+	if !ok {
+		t.Fatal("Expected a playlist")
+	}
+
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-TARGETDURATION:3
+#EXT-X-MEDIA-SEQUENCE:3
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:3.000,
+3.m4s
+#EXTINF:3.000,
+4.m4s
+#EXTINF:3.000,
+5.m4s
+`
+	if playlist != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, playlist)
+	}
+
+	// Segment 6 holds fragments 18 and 19 until End
+	st.End()
+	playlist, _ = st.Playlist()
+	if !strings.HasSuffix(playlist, "#EXTINF:2.000,\n6.m4s\n#EXT-X-ENDLIST\n") {
+		t.Errorf("Expected the last segment and ENDLIST, got:\n%s", playlist)
+	}
+
+	if data, ok := st.file("4.m4s"); !ok || string(data) != "\x0c\x0d\x0e" {
+		t.Errorf("Expected segment 4 to hold fragments 12-14, got %v", data)
+	}
+	if _, ok := st.file("1.m4s"); !ok {
+		t.Error("Expected a segment just out of the window to stay available")
+	}
+	if _, ok := st.file("0.m4s"); ok {
+		t.Error("Expected old segments to be dropped")
+	}
+}
+
+func TestFixedTargetDuration(t *testing.T) {
+	st := NewStream(Options{TargetDuration: 2 * time.Second, Window: 3})
+	st.Write(mp4.Segment{Init: true, Data: []byte("init")})
+	write := func(d time.Duration, keyframe bool) error {
+		return st.Write(mp4.Segment{Data: []byte{0}, Duration: d, Keyframe: keyframe})
+	}
+
+	// The first GOP of 3s sets the target
+	for i := 0; i < 3; i++ {
+		write(time.Second, i == 0)
+	}
+
+	// An 8s GOP is cut into segments of at most 3s without raising it
+	for i := 0; i < 8; i++ {
+		if err := write(time.Second, i == 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	write(time.Second, true)
+
+	playlist, _ := st.Playlist()
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:3
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:3.000,
+1.m4s
+#EXTINF:3.000,
+2.m4s
+#EXTINF:2.000,
+3.m4s
+`
+	if playlist != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, playlist)
+	}
+
+	// Once the window only has segments starting at keyframes, they are
+	// independent again
+	for i := 1; i < 12; i++ {
+		write(time.Second, i%3 == 0)
+	}
+	playlist, _ = st.Playlist()
+	if !strings.Contains(playlist, "#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-TARGETDURATION:3\n") {
+		t.Errorf("Expected independent segments with the same target, got:\n%s", playlist)
+	}
+
+	// A fragment longer than the target cannot be cut
+	if err := write(5*time.Second, true); !errors.Is(err, ErrSegmentTooLong) {
+		t.Errorf("Expected ErrSegmentTooLong, got %v", err)
+	}
+}
+
+func TestWaitsForKeyframe(t *testing.T) {
+	st := NewStream(Options{TargetDuration: time.Second, Window: 5})
+	st.Write(mp4.Segment{Init: true, Data: []byte("init")})
+	st.Write(mp4.Segment{Data: []byte{1}, Duration: time.Second})
+	st.Write(mp4.Segment{Data: []byte{2}, Duration: time.Second, Keyframe: true})
+	st.Write(mp4.Segment{Data: []byte{3}, Duration: time.Second, Keyframe: true})
+
+	if data, ok := st.file("0.m4s"); !ok || string(data) != "\x02" {
+		t.Errorf("Expected the first segment to start at the keyframe, got %v", data)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer(Options{Window: 3})
+	feed(srv.Stream("12345"), 10, 2)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := get("/12345/index.m3u8"); rec.Code != 200 || rec.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Errorf("Unexpected playlist response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/12345/init.mp4"); rec.Body.String() != "init" {
+		t.Errorf("Unexpected init segment %q", rec.Body.String())
+	}
+	if rec := get("/12345/3.m4s"); rec.Code != 200 || rec.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("Unexpected segment response %d", rec.Code)
+	}
+	if rec := get("/"); !strings.Contains(rec.Body.String(), `href="12345/"`) {
+		t.Errorf("Expected the stream in the index, got:\n%s", rec.Body.String())
+	}
+	if rec := get("/12345"); rec.Code != 301 {
+		t.Errorf("Expected a redirect to the player page, got %d", rec.Code)
+	}
+	for _, path := range []string{"/other/index.m3u8", "/12345/99.m4s", "/12345/x.ts"} {
+		if rec := get(path); rec.Code != 404 {
+			t.Errorf("%s: expected 404, got %d", path, rec.Code)
+		}
+	}
+	if rec := get("/12345/"); !strings.Contains(rec.Body.String(), PlayerURL) {
+		t.Errorf("Expected the player page to load %s, got:\n%s", PlayerURL, rec.Body.String())
+	}
+}
+
+func TestServerPlayer(t *testing.T) {
+	srv := NewServer(Options{Window: 3, Player: []byte("var Hls;")})
+	feed(srv.Stream("12345"), 10, 2)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/12345/", nil))
+	if page := rec.Body.String(); !strings.Contains(page, `"../hls.min.js"`) || strings.Contains(page, "jsdelivr") {
+		t.Errorf("Expected the player page to load the served copy, got:\n%s", page)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/hls.min.js", nil))
+	if rec.Code != 200 || rec.Body.String() != "var Hls;" || rec.Header().Get("Content-Type") != "text/javascript" {
+		t.Errorf("Unexpected hls.js response %d %q", rec.Code, rec.Body.String())
+	}
+}
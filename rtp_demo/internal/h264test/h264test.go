@@ -0,0 +1,157 @@
+// Package h264test builds H.264 NAL units for tests: a bit writer for RBSP
+// data and parameter sets and slices that parse with each other
+package h264test
+
+// BitWriter builds RBSP data
+type BitWriter struct {
+	Data []byte
+	n    int // bits written
+}
+
+// Bits writes the low n bits of v
+func (w *BitWriter) Bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.Data = append(w.Data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.Data[len(w.Data)-1] |= 0x80 >> uint(w.n%8)
+		}
+		w.n++
+	}
+}
+
+// Flag writes one bit
+func (w *BitWriter) Flag(b bool) {
+	if b {
+		w.Bits(1, 1)
+	} else {
+		w.Bits(0, 1)
+	}
+}
+
+// UE writes an Exp-Golomb coded unsigned value
+func (w *BitWriter) UE(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.Bits(0, n)
+	w.Bits(v, n+1)
+}
+
+// Trailing adds rbsp_trailing_bits and returns the RBSP
+func (w *BitWriter) Trailing() []byte {
+	w.Bits(1, 1)
+	for w.n%8 != 0 {
+		w.Bits(0, 1)
+	}
+	return w.Data
+}
+
+// NALU adds rbsp_trailing_bits and returns the RBSP behind a NAL header
+func (w *BitWriter) NALU(header byte) []byte {
+	return append([]byte{header}, w.Trailing()...)
+}
+
+// SPS builds a High profile 1920x1080 SPS (1088 coded lines, cropped) with
+// VUI timing for 25 fps
+func SPS() []byte {
+	w := &BitWriter{}
+	w.Bits(100, 8) // profile_idc
+	w.Bits(0, 8)   // constraint flags
+	w.Bits(40, 8)  // level_idc
+	w.UE(0)        // seq_parameter_set_id
+	w.UE(1)        // chroma_format_idc
+	w.UE(0)        // bit_depth_luma_minus8
+	w.UE(0)        // bit_depth_chroma_minus8
+	w.Flag(false)  // qpprime_y_zero_transform_bypass_flag
+	w.Flag(false)  // seq_scaling_matrix_present_flag
+	w.UE(0)        // log2_max_frame_num_minus4
+	w.UE(0)        // pic_order_cnt_type
+	w.UE(2)        // log2_max_pic_order_cnt_lsb_minus4
+	w.UE(4)        // max_num_ref_frames
+	w.Flag(false)  // gaps_in_frame_num_value_allowed_flag
+	w.UE(119)      // pic_width_in_mbs_minus1
+	w.UE(67)       // pic_height_in_map_units_minus1
+	w.Flag(true)   // frame_mbs_only_flag
+	w.Flag(true)   // direct_8x8_inference_flag
+	w.Flag(true)   // frame_cropping_flag
+	w.UE(0)
+	w.UE(0)
+	w.UE(0)
+	w.UE(4)      // bottom offset: 4 * 2 lines
+	w.Flag(true) // vui_parameters_present_flag
+	w.Flag(true) // aspect_ratio_info_present_flag
+	w.Bits(1, 8) // 1:1
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(true) // timing_info_present_flag
+	w.Bits(1, 32)
+	w.Bits(50, 32)
+	w.Flag(true)
+	return w.NALU(0x67)
+}
+
+// BaselineSPS builds a Constrained Baseline 320x240 SPS without VUI, with
+// the same frame_num and pic_order_cnt_lsb lengths as SPS
+func BaselineSPS() []byte {
+	w := &BitWriter{}
+	w.Bits(66, 8)
+	w.Bits(0xC0, 8)
+	w.Bits(13, 8)
+	w.UE(0) // seq_parameter_set_id
+	w.UE(0) // log2_max_frame_num_minus4
+	w.UE(0) // pic_order_cnt_type
+	w.UE(2) // log2_max_pic_order_cnt_lsb_minus4
+	w.UE(1) // max_num_ref_frames
+	w.Flag(false)
+	w.UE(19)
+	w.UE(14)
+	w.Flag(true)  // frame_mbs_only_flag
+	w.Flag(true)  // direct_8x8_inference_flag
+	w.Flag(false) // frame_cropping_flag
+	w.Flag(false) // vui_parameters_present_flag
+	return w.NALU(0x67)
+}
+
+// PPS builds a CAVLC PPS for SPS 0, with redundant_pic_cnt_present_flag set
+func PPS() []byte {
+	w := &BitWriter{}
+	w.UE(0)       // pic_parameter_set_id
+	w.UE(0)       // seq_parameter_set_id
+	w.Flag(false) // entropy_coding_mode_flag
+	w.Flag(true)  // bottom_field_pic_order_in_frame_present_flag
+	w.UE(1)       // num_slice_groups_minus1
+	w.UE(0)       // slice_group_map_type
+	w.UE(10)      // run_length_minus1
+	w.UE(20)
+	w.UE(0)      // num_ref_idx_l0_default_active_minus1
+	w.UE(0)      // num_ref_idx_l1_default_active_minus1
+	w.Bits(0, 3) // weighted prediction
+	w.UE(0)      // pic_init_qp_minus26
+	w.UE(0)      // pic_init_qs_minus26
+	w.UE(0)      // chroma_qp_index_offset
+	w.Bits(0, 2)
+	w.Flag(true) // redundant_pic_cnt_present_flag
+	return w.NALU(0x68)
+}
+
+// Slice builds a slice NAL unit whose header parses to its end with PPS and
+// either SPS
+func Slice(header byte, sliceType, frameNum, redundantPicCnt uint32) []byte {
+	w := &BitWriter{}
+	w.UE(0)             // first_mb_in_slice
+	w.UE(sliceType)     // slice_type
+	w.UE(0)             // pic_parameter_set_id
+	w.Bits(frameNum, 4) // frame_num
+	if header&0x1F == 5 {
+		w.UE(3) // idr_pic_id
+	}
+	w.Bits(7, 6)          // pic_order_cnt_lsb
+	w.UE(0)               // delta_pic_order_cnt_bottom
+	w.UE(redundantPicCnt) // redundant_pic_cnt
+	return w.NALU(header)
+}
@@ -0,0 +1,91 @@
+// Package latency measures the one-way delay of a stream from the send or
+// capture times the sender stamps on it, and the drift between the sender's
+// clock and the receiver's. Absolute delays are only as good as the
+// agreement between the two clocks, e.g. both synchronized with NTP; the
+// drift and the variation in delay do not depend on it.
+package latency
+
+import (
+	"math"
+	"time"
+)
+
+// MinDriftSpan is how much sender time the samples must cover before the
+// drift is estimated, since queuing noise swamps it over short spans
+const MinDriftSpan = 10 * time.Second
+
+// Tracker accumulates the delay samples of one stream
+type Tracker struct {
+	samples        uint64
+	last, min, max time.Duration
+	average        float64 // seconds, exponentially weighted
+
+	// Least squares fit of delay against send time, in seconds since the
+	// first sample, whose slope is the drift
+	first            time.Time
+	span             time.Duration
+	sx, sy, sxx, sxy float64
+}
+
+// Stats summarizes the samples
+type Stats struct {
+	Samples  uint64
+	Last     time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Average  time.Duration // weighted 1/16 per sample, like RFC 3550 jitter
+	Span     time.Duration // between the first and latest send times
+	Drift    bool          // whether DriftPPM is known, see MinDriftSpan
+	DriftPPM float64       // how much faster the receiver's clock runs, in parts per million
+}
+
+// Add records a packet or frame sent at sent, by the sender's clock, that
+// arrived at arrived, by the receiver's
+func (t *Tracker) Add(sent, arrived time.Time) {
+	delay := arrived.Sub(sent)
+
+	if t.samples == 0 {
+		t.first = sent
+		t.min, t.max = delay, delay
+		t.average = delay.Seconds()
+	}
+	t.samples++
+	t.last = delay
+	if delay < t.min {
+		t.min = delay
+	}
+	if delay > t.max {
+		t.max = delay
+	}
+	t.average += (delay.Seconds() - t.average) / 16
+
+	x, y := sent.Sub(t.first).Seconds(), delay.Seconds()
+	t.sx += x
+	t.sy += y
+	t.sxx += x * x
+	t.sxy += x * y
+	if d := sent.Sub(t.first); d > t.span {
+		t.span = d
+	}
+}
+
+// Stats returns the summary of the samples so far
+func (t *Tracker) Stats() Stats {
+	stats := Stats{
+		Samples: t.samples,
+		Last:    t.last,
+		Min:     t.min,
+		Max:     t.max,
+		Average: time.Duration(t.average * float64(time.Second)),
+		Span:    t.span,
+	}
+
+	n := float64(t.samples)
+	denominator := n*t.sxx - t.sx*t.sx
+	if t.span >= MinDriftSpan && denominator > 0 {
+		slope := (n*t.sxy - t.sx*t.sy) / denominator
+		stats.Drift = true
+		stats.DriftPPM = math.Round(slope*1e6*100) / 100
+	}
+	return stats
+}
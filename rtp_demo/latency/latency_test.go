@@ -0,0 +1,60 @@
+package latency
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTrackerStats(t *testing.T) {
+	var tracker Tracker
+	start := time.Unix(1000, 0)
+
+	delays := []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 25 * time.Millisecond}
+	for i, d := range delays {
+		sent := start.Add(time.Duration(i) * 10 * time.Millisecond)
+		tracker.Add(sent, sent.Add(d))
+	}
+
+	stats := tracker.Stats()
+	if stats.Samples != 3 {
+		t.Errorf("Expected 3 samples, got %d", stats.Samples)
+	}
+	if stats.Last != 25*time.Millisecond {
+		t.Errorf("Expected last 25ms, got %v", stats.Last)
+	}
+	if stats.Min != 20*time.Millisecond || stats.Max != 30*time.Millisecond {
+		t.Errorf("Expected min 20ms and max 30ms, got %v and %v", stats.Min, stats.Max)
+	}
+	if stats.Average <= 20*time.Millisecond || stats.Average >= 25*time.Millisecond {
+		t.Errorf("Expected an average weighted towards the first sample, got %v", stats.Average)
+	}
+	if stats.Drift {
+		t.Errorf("Expected no drift over %v, got %v ppm", stats.Span, stats.DriftPPM)
+	}
+}
+
+func TestTrackerDrift(t *testing.T) {
+	var tracker Tracker
+	start := time.Unix(1000, 0)
+
+	// The receiver's clock runs 50 ppm fast, under ±2ms of queuing noise
+	for i := 0; i < 3000; i++ {
+		elapsed := time.Duration(i) * 20 * time.Millisecond
+		sent := start.Add(elapsed)
+		noise := time.Duration(i%5-2) * time.Millisecond
+		arrived := sent.Add(40*time.Millisecond + elapsed*50/1e6 + noise)
+		tracker.Add(sent, arrived)
+	}
+
+	stats := tracker.Stats()
+	if !stats.Drift {
+		t.Fatalf("Expected the drift to be known after %v", stats.Span)
+	}
+	if math.Abs(stats.DriftPPM-50) > 1 {
+		t.Errorf("Expected a drift of about 50 ppm, got %v", stats.DriftPPM)
+	}
+	if stats.Min < 38*time.Millisecond || stats.Max > 45*time.Millisecond {
+		t.Errorf("Expected delays between 38ms and 45ms, got %v to %v", stats.Min, stats.Max)
+	}
+}
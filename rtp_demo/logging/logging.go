@@ -0,0 +1,76 @@
+// Package logging sets up the log/slog logger shared by the client and the
+// server. Per-packet and per-NAL detail is logged at debug level and only
+// shown with -v; periodic summaries and session events are logged at info.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// DefaultInterval is how often summary lines are logged
+const DefaultInterval = 5 * time.Second
+
+// Options holds the logging command line flags
+type Options struct {
+	Verbose  bool
+	Format   string
+	Interval time.Duration // between summary lines, 0 disables them
+}
+
+// RegisterFlags adds -v, -log-format and -stats to fs
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.BoolVar(&o.Verbose, "v", false, "log every packet and NAL unit (debug level)")
+	fs.StringVar(&o.Format, "log-format", FormatText, "log format: text or json")
+	fs.DurationVar(&o.Interval, "stats", DefaultInterval, "interval between summary log lines, 0 to disable")
+	return o
+}
+
+// New creates a logger writing to w in the given format
+func New(w io.Writer, verbose bool, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if verbose {
+		opts.Level = slog.LevelDebug
+	}
+
+	switch format {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+}
+
+// Setup installs a logger on stderr for the options as the slog default
+func (o *Options) Setup() error {
+	logger, err := New(os.Stderr, o.Verbose, o.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Discard installs a logger that drops everything as the slog default
+func Discard() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1})))
+}
+
+// Fatal logs an error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, false, FormatText)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	logger.Debug("RTP packet", "seq", 1)
+	logger.Info("stream", "ssrc", 12345)
+
+	if strings.Contains(buf.String(), "RTP packet") {
+		t.Errorf("Expected debug lines to be hidden without -v, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "msg=stream ssrc=12345") {
+		t.Errorf("Expected the info line, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	logger, _ = New(&buf, true, FormatText)
+	logger.Debug("RTP packet", "seq", 1)
+	if !strings.Contains(buf.String(), "level=DEBUG") {
+		t.Errorf("Expected debug lines with -v, got:\n%s", buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, false, FormatJSON)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger.Info("stream", "ssrc", 12345, "lost", 2)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if line["msg"] != "stream" || line["ssrc"] != 12345.0 || line["lost"] != 2.0 {
+		t.Errorf("Unexpected JSON line %v", line)
+	}
+
+	if _, err := New(&buf, false, "xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-v", "-log-format", "json", "-stats", "1s"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !opts.Verbose || opts.Format != FormatJSON || opts.Interval != time.Second {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+}
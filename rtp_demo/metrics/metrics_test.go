@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	packets := NewCounter("rtp_packets_received_total", "RTP packets received.")
+	packets.Add(42, Label{"ssrc", "12345"})
+	packets.Add(7, Label{"ssrc", "6789"}, Label{"name", "a \"quoted\"\nvalue\\"})
+
+	jitter := NewGauge("rtp_jitter_seconds", "Interarrival jitter.\nSee RFC 3550.")
+	jitter.Add(0.00125)
+	jitter.Add(math.Inf(1))
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf, []*Family{packets, jitter}); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	want := `# HELP rtp_packets_received_total RTP packets received.
+# TYPE rtp_packets_received_total counter
+rtp_packets_received_total{ssrc="12345"} 42
+rtp_packets_received_total{ssrc="6789",name="a \"quoted\"\nvalue\\"} 7
+# HELP rtp_jitter_seconds Interarrival jitter.\nSee RFC 3550.
+# TYPE rtp_jitter_seconds gauge
+rtp_jitter_seconds 0.00125
+rtp_jitter_seconds +Inf
+`
+	if buf.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	calls := 0
+	h := Handler(func() []*Family {
+		calls++
+		g := NewGauge("up", "Up.")
+		g.Add(float64(calls))
+		return []*Family{g}
+	})
+
+	for i := 1; i <= 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		if !strings.Contains(rec.Body.String(), "up "+string(rune('0'+i))+"\n") {
+			t.Errorf("Expected value collected on scrape %d, got:\n%s", i, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"rtp_demo/h264"
+)
+
+// Track IDs and timescales used by the Muxer. Video keeps the 90 kHz RTP
+// clock so RTP timestamps need no conversion.
+const (
+	videoTrackID   = 1
+	audioTrackID   = 2
+	videoTimescale = 90000
+)
+
+// DefaultMaxFragment bounds how much video a fragment holds when keyframes
+// are far apart, which is also the most a crash can lose
+const DefaultMaxFragment = 5 * time.Second
+
+// ErrAudioTooLate is returned by SetAudio once the init segment is written
+var ErrAudioTooLate = errors.New("mp4: audio must be configured before the first keyframe")
+
+// AudioConfig describes an AAC track
+type AudioConfig struct {
+	Config     []byte // AudioSpecificConfig
+	SampleRate uint32 // also the RTP clock rate and the track timescale
+	Channels   uint16
+}
+
+// Segment is a piece of Muxer output: the init segment or one fragment
+type Segment struct {
+	Data     []byte
+	Init     bool
+	Start    time.Duration // decode time of the first video sample
+	Duration time.Duration // of the video samples
+	Keyframe bool          // the fragment starts with an IDR
+}
+
+// Muxer builds a fragmented MP4 from H.264 access units, and optionally AAC
+// frames, timestamped with their RTP clock. The init segment is emitted at
+// the first keyframe once an SPS and PPS have been seen, and a fragment
+// before every keyframe, so each one is independently decodable.
+type Muxer struct {
+	write func(Segment) error
+
+	// MaxFragment forces a fragment without a keyframe after this much video
+	MaxFragment time.Duration
+
+	sps, pps []byte
+	audio    *AudioConfig
+	started  bool
+	sequence uint32
+
+	video      videoTimeline
+	videoStart uint32 // RTP timestamp of the first video frame
+	audioTime  timeline
+
+	// Set by SyncAudio: a video and an audio timestamp of the same instant,
+	// and the decode time of the first audio frame derived from them
+	synced               bool
+	syncVideo, syncAudio uint32
+	audioOffset          uint64
+
+	// Samples of the fragment being built; the last sample of each track
+	// waits for the next timestamp to learn its duration
+	videoSamples  []FragmentSample
+	videoBase     uint64
+	pendingVideo  *FragmentSample
+	pendingDTS    uint64
+	audioSamples  []FragmentSample
+	audioBase     uint64
+	pendingAudio  *FragmentSample
+	pendingAudioT uint64
+}
+
+// NewMuxer creates a muxer that passes its output to write
+func NewMuxer(write func(Segment) error) *Muxer {
+	return &Muxer{write: write, MaxFragment: DefaultMaxFragment}
+}
+
+// SetAudio adds an AAC track. It must be called before the first keyframe.
+// Both tracks start at decode time zero with their first sample, so audio
+// should start together with the first keyframe.
+func (m *Muxer) SetAudio(cfg AudioConfig) error {
+	if m.started {
+		return ErrAudioTooLate
+	}
+	m.audio = &cfg
+	return nil
+}
+
+// SyncAudio places the audio track relative to the video: the two RTP
+// timestamps were sampled at the same instant, as worked out from RTCP
+// sender reports. Without it both tracks start at their first sample. It
+// must be called before the first audio frame.
+func (m *Muxer) SyncAudio(videoTimestamp, audioTimestamp uint32) {
+	m.synced = true
+	m.syncVideo, m.syncAudio = videoTimestamp, audioTimestamp
+}
+
+// WriteVideo adds an access unit with its 90 kHz RTP timestamp. Frames
+// before the first keyframe are dropped.
+func (m *Muxer) WriteVideo(timestamp uint32, nalus [][]byte) error {
+	keyframe := false
+	var sample []byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case h264.NALUSPS:
+			m.sps = append(m.sps[:0], nalu...)
+		case h264.NALUPPS:
+			m.pps = append(m.pps[:0], nalu...)
+		case h264.NALUIDR:
+			keyframe = true
+		case h264.NALUAUD:
+			continue // not carried in MP4
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	if len(sample) == 0 {
+		return nil
+	}
+
+	if !m.started {
+		if !keyframe || m.sps == nil || m.pps == nil {
+			return nil
+		}
+		if err := m.writeInit(); err != nil {
+			return err
+		}
+		m.videoStart = timestamp
+	}
+
+	dts, cto := m.video.add(timestamp)
+
+	if m.pendingVideo != nil {
+		m.pendingVideo.Duration = uint32(dts - m.pendingDTS)
+		if len(m.videoSamples) == 0 {
+			m.videoBase = m.pendingDTS
+		}
+		m.videoSamples = append(m.videoSamples, *m.pendingVideo)
+
+		full := time.Duration(dts-m.videoBase) * time.Second / videoTimescale
+		if keyframe || (m.MaxFragment > 0 && full >= m.MaxFragment) {
+			if err := m.writeFragment(); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.pendingVideo = &FragmentSample{Data: sample, CompositionOffset: cto, Keyframe: keyframe}
+	m.pendingDTS = dts
+	return nil
+}
+
+// WriteAudio adds an AAC frame with its RTP timestamp, in sample rate units.
+// Frames are dropped until the video has started, at its first keyframe.
+// Once SyncAudio has placed the audio, frames timed before the first video
+// frame are dropped too; without it, the first frame written starts at the
+// beginning of the video.
+func (m *Muxer) WriteAudio(timestamp uint32, frame []byte) error {
+	if m.audio == nil || !m.started {
+		return nil
+	}
+
+	// Frames from before the first video frame are dropped
+	if !m.audioTime.started && m.synced {
+		rate := int64(m.audio.SampleRate)
+		offset := int64(int32(m.syncVideo-m.videoStart))*rate/videoTimescale + int64(int32(timestamp-m.syncAudio))
+		if offset < 0 {
+			return nil
+		}
+		m.audioOffset = uint64(offset)
+	}
+
+	t := m.audioOffset + m.audioTime.unwrap(timestamp)
+	if m.pendingAudio != nil {
+		m.pendingAudio.Duration = uint32(t - m.pendingAudioT)
+		if len(m.audioSamples) == 0 {
+			m.audioBase = m.pendingAudioT
+		}
+		m.audioSamples = append(m.audioSamples, *m.pendingAudio)
+	}
+
+	m.pendingAudio = &FragmentSample{Data: append([]byte(nil), frame...), Keyframe: true}
+	m.pendingAudioT = t
+	return nil
+}
+
+// Flush writes the buffered samples as a final fragment, guessing the
+// duration of the last one from the one before
+func (m *Muxer) Flush() error {
+	if m.pendingVideo != nil {
+		m.pendingVideo.Duration = m.video.frameInterval()
+		if len(m.videoSamples) == 0 {
+			m.videoBase = m.pendingDTS
+		}
+		m.videoSamples = append(m.videoSamples, *m.pendingVideo)
+		m.pendingVideo = nil
+	}
+	if m.pendingAudio != nil {
+		m.pendingAudio.Duration = 1024 // samples per AAC frame
+		if len(m.audioSamples) == 0 {
+			m.audioBase = m.pendingAudioT
+		}
+		m.audioSamples = append(m.audioSamples, *m.pendingAudio)
+		m.pendingAudio = nil
+	}
+	if len(m.videoSamples) == 0 && len(m.audioSamples) == 0 {
+		return nil
+	}
+	return m.writeFragment()
+}
+
+func (m *Muxer) writeInit() error {
+	tracks := []TrackInfo{{
+		ID:        videoTrackID,
+		Handler:   "vide",
+		Timescale: videoTimescale,
+		SPS:       [][]byte{m.sps},
+		PPS:       [][]byte{m.pps},
+	}}
+	if sps, err := h264.ParseSPS(m.sps); err == nil {
+		tracks[0].Width, tracks[0].Height = uint16(sps.Width), uint16(sps.Height)
+		if sps.FrameRate > 0 {
+			m.video.interval = uint32(videoTimescale / sps.FrameRate)
+		}
+	}
+	if m.audio != nil {
+		tracks = append(tracks, TrackInfo{
+			ID:          audioTrackID,
+			Handler:     "soun",
+			Timescale:   m.audio.SampleRate,
+			AudioConfig: m.audio.Config,
+			SampleRate:  m.audio.SampleRate,
+			Channels:    m.audio.Channels,
+		})
+	}
+
+	init, err := InitSegment(tracks)
+	if err != nil {
+		return err
+	}
+	m.started = true
+	return m.write(Segment{Data: init, Init: true})
+}
+
+func (m *Muxer) writeFragment() error {
+	var tracks []TrackFragment
+	var duration uint64
+	if len(m.videoSamples) > 0 {
+		tracks = append(tracks, TrackFragment{TrackID: videoTrackID, BaseDecodeTime: m.videoBase, Samples: m.videoSamples})
+		for _, s := range m.videoSamples {
+			duration += uint64(s.Duration)
+		}
+	}
+	if len(m.audioSamples) > 0 {
+		tracks = append(tracks, TrackFragment{TrackID: audioTrackID, BaseDecodeTime: m.audioBase, Samples: m.audioSamples})
+	}
+
+	m.sequence++
+	segment := Segment{
+		Data:     Fragment(m.sequence, tracks),
+		Start:    time.Duration(m.videoBase) * time.Second / videoTimescale,
+		Duration: time.Duration(duration) * time.Second / videoTimescale,
+		Keyframe: len(m.videoSamples) > 0 && m.videoSamples[0].Keyframe,
+	}
+
+	m.videoSamples = nil
+	m.audioSamples = nil
+	return m.write(segment)
+}
+
+// timeline extends 32-bit RTP timestamps to 64 bits, starting at zero
+type timeline struct {
+	started bool
+	last    uint32
+	now     uint64
+}
+
+func (t *timeline) unwrap(ts uint32) uint64 {
+	if !t.started {
+		t.started = true
+		t.last = ts
+		return 0
+	}
+	// Timestamps may go back slightly with B-frames; clamp at the start
+	delta := int64(int32(ts - t.last))
+	t.last = ts
+	if delta < 0 && uint64(-delta) > t.now {
+		t.now = 0
+	} else {
+		t.now = uint64(int64(t.now) + delta)
+	}
+	return t.now
+}
+
+// videoTimeline derives decode times from presentation timestamps. Frames
+// arrive in decode order: while presentation times only grow the two are
+// equal. Once a frame goes back in time (B-frames), decode times advance by
+// the frame interval instead, and the rest becomes the composition offset.
+// The interval is the shortest distance between presentation times seen,
+// or the SPS's, so it is not known before the second frame.
+type videoTimeline struct {
+	pts       timeline
+	lastPTS   uint64
+	lastDTS   uint64
+	reordered bool
+	interval  uint32 // shortest frame distance seen, 90 kHz units, 0 until one is
+	frames    int
+}
+
+// frameInterval returns the frame interval, assuming 30 fps until one is
+// known
+func (v *videoTimeline) frameInterval() uint32 {
+	if v.interval == 0 {
+		return videoTimescale / 30
+	}
+	return v.interval
+}
+
+// add returns the decode time and composition offset of the next frame
+func (v *videoTimeline) add(timestamp uint32) (dts uint64, cto int32) {
+	pts := v.pts.unwrap(timestamp)
+	v.frames++
+
+	if v.frames == 1 {
+		v.lastPTS, v.lastDTS = pts, 0
+		return 0, int32(pts)
+	}
+
+	if pts > v.lastPTS {
+		if d := uint32(pts - v.lastPTS); v.interval == 0 || d < v.interval {
+			v.interval = d
+		}
+	} else {
+		v.reordered = true
+	}
+	v.lastPTS = pts
+
+	if v.reordered {
+		dts = v.lastDTS + uint64(v.frameInterval())
+	} else {
+		dts = pts
+		if dts <= v.lastDTS {
+			dts = v.lastDTS + 1
+		}
+	}
+	v.lastDTS = dts
+	return dts, int32(int64(pts) - int64(dts))
+}
@@ -0,0 +1,895 @@
+// Package mp4 implements a small ISO BMFF (MP4) demuxer that extracts
+// H.264 samples from progressive and fragmented MP4 files, and a muxer that
+// writes fragmented MP4.
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNoVideoTrack is returned when the file has no H.264 video track
+var ErrNoVideoTrack = errors.New("mp4: no H.264 video track found")
+
+// ErrNoAudioTrack is returned when the file has no AAC audio track
+var ErrNoAudioTrack = errors.New("mp4: no AAC audio track found")
+
+// Sample describes one access unit stored in the file
+type Sample struct {
+	Offset            int64  // byte offset of the sample in the file
+	Size              uint32 // sample size in bytes
+	DecodeTime        uint64 // decode timestamp in track timescale units
+	CompositionOffset int32  // presentation time minus decode time
+	Duration          uint32 // sample duration in track timescale units
+	Keyframe          bool   // sync sample (IDR for H.264)
+}
+
+// PresentationTime returns the presentation timestamp of the sample
+func (s *Sample) PresentationTime() uint64 {
+	return uint64(int64(s.DecodeTime) + int64(s.CompositionOffset))
+}
+
+// Track holds the parsed description and sample table of a track
+type Track struct {
+	ID        uint32
+	Handler   string // "vide", "soun", ...
+	Codec     string // sample entry type, e.g. "avc1"
+	Timescale uint32
+	Duration  uint64
+	Width     uint16
+	Height    uint16
+
+	// H.264 decoder configuration (avcC)
+	SPS            [][]byte
+	PPS            [][]byte
+	NALULengthSize int
+
+	// AAC decoder configuration (esds), nil for other tracks
+	Audio *AudioConfig
+
+	Samples []Sample
+}
+
+// Reader reads samples from an MP4 file
+type Reader struct {
+	file   *os.File
+	Tracks []*Track
+
+	// Fragmented files: per-track trex defaults
+	fragmented bool
+	defaults   map[uint32]trackDefaults
+}
+
+// Open opens an MP4 file and parses its moov box
+func Open(filename string) (*Reader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{file: file}
+	if err := r.parse(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// VideoTrack returns the first H.264 video track
+func (r *Reader) VideoTrack() (*Track, error) {
+	for _, t := range r.Tracks {
+		if t.Handler == "vide" && (t.Codec == "avc1" || t.Codec == "avc3") {
+			return t, nil
+		}
+	}
+	return nil, ErrNoVideoTrack
+}
+
+// AudioTrack returns the first AAC audio track
+func (r *Reader) AudioTrack() (*Track, error) {
+	for _, t := range r.Tracks {
+		if t.Handler == "soun" && t.Codec == "mp4a" && t.Audio != nil {
+			return t, nil
+		}
+	}
+	return nil, ErrNoAudioTrack
+}
+
+// ReadSample reads the raw bytes of a sample
+func (r *Reader) ReadSample(s *Sample) ([]byte, error) {
+	data := make([]byte, s.Size)
+	if _, err := r.file.ReadAt(data, s.Offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the MP4 file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// SplitNALUs splits a length-prefixed (AVCC) sample into NAL units
+func SplitNALUs(data []byte, lengthSize int) ([][]byte, error) {
+	var nalus [][]byte
+
+	for offset := 0; offset < len(data); {
+		if offset+lengthSize > len(data) {
+			return nalus, fmt.Errorf("mp4: truncated NAL length at offset %d", offset)
+		}
+
+		var n int
+		for i := 0; i < lengthSize; i++ {
+			n = n<<8 | int(data[offset+i])
+		}
+		offset += lengthSize
+
+		if n > len(data)-offset {
+			return nalus, fmt.Errorf("mp4: NAL unit of %d bytes exceeds sample", n)
+		}
+
+		nalus = append(nalus, data[offset:offset+n])
+		offset += n
+	}
+
+	return nalus, nil
+}
+
+// box is a parsed box header
+type box struct {
+	typ        string
+	size       int64 // total size including header
+	headerSize int64
+}
+
+// readBoxHeader reads a box header at the given offset
+func readBoxHeader(ra io.ReaderAt, offset, limit int64) (box, error) {
+	var hdr [16]byte
+	if _, err := ra.ReadAt(hdr[:8], offset); err != nil {
+		return box{}, err
+	}
+
+	b := box{
+		typ:        string(hdr[4:8]),
+		size:       int64(binary.BigEndian.Uint32(hdr[0:4])),
+		headerSize: 8,
+	}
+
+	switch b.size {
+	case 0: // box extends to the end of the enclosing container
+		b.size = limit - offset
+	case 1: // 64-bit largesize follows the type
+		if _, err := ra.ReadAt(hdr[8:16], offset+8); err != nil {
+			return box{}, err
+		}
+		b.size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		b.headerSize = 16
+	}
+
+	if b.size < b.headerSize || offset+b.size > limit {
+		return box{}, fmt.Errorf("mp4: invalid size %d for box %q", b.size, b.typ)
+	}
+
+	return b, nil
+}
+
+// parse walks the top-level boxes and parses moov, and the moof boxes of a
+// fragmented file
+func (r *Reader) parse() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	haveMoov := false
+	for offset := int64(0); offset+8 <= end; {
+		b, err := readBoxHeader(r.file, offset, end)
+		if err != nil {
+			// A fragmented recording cut off mid-fragment is still usable
+			if haveMoov && r.fragmented {
+				break
+			}
+			return err
+		}
+
+		if b.typ == "moov" || (b.typ == "moof" && haveMoov) {
+			data := make([]byte, b.size-b.headerSize)
+			if _, err := r.file.ReadAt(data, offset+b.headerSize); err != nil {
+				return err
+			}
+			if b.typ == "moov" {
+				err = r.parseMoov(data, end)
+				haveMoov = true
+			} else {
+				err = r.parseMoof(data, offset, end)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += b.size
+	}
+
+	if !haveMoov {
+		return fmt.Errorf("mp4: moov box not found")
+	}
+	return nil
+}
+
+// children iterates over the boxes contained in data
+func children(data []byte, fn func(typ string, body []byte) error) error {
+	for offset := 0; offset+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		typ := string(data[offset+4 : offset+8])
+		header := 8
+
+		switch size {
+		case 0:
+			size = len(data) - offset
+		case 1:
+			if offset+16 > len(data) {
+				return fmt.Errorf("mp4: truncated largesize for box %q", typ)
+			}
+			size = int(binary.BigEndian.Uint64(data[offset+8 : offset+16]))
+			header = 16
+		}
+
+		if size < header || offset+size > len(data) {
+			return fmt.Errorf("mp4: invalid size %d for box %q", size, typ)
+		}
+
+		if err := fn(typ, data[offset+header:offset+size]); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// parseMoov parses the tracks of the movie box of a file of end bytes
+func (r *Reader) parseMoov(data []byte, end int64) error {
+	return children(data, func(typ string, body []byte) error {
+		if typ == "mvex" {
+			return r.parseMvex(body)
+		}
+		if typ != "trak" {
+			return nil
+		}
+
+		t := &Track{}
+		tables := &sampleTables{}
+		if err := parseTrak(t, tables, body); err != nil {
+			return err
+		}
+		if err := tables.build(t, end); err != nil {
+			return err
+		}
+
+		r.Tracks = append(r.Tracks, t)
+		return nil
+	})
+}
+
+// trackDefaults holds the per-track sample defaults of trex/tfhd
+type trackDefaults struct {
+	duration, size, flags uint32
+}
+
+// sample_flags bit marking a sample that is not a sync sample
+const sampleIsNonSync = 0x00010000
+
+// parseMvex reads the trex defaults of a fragmented file
+func (r *Reader) parseMvex(data []byte) error {
+	r.fragmented = true
+	r.defaults = make(map[uint32]trackDefaults)
+
+	return children(data, func(typ string, body []byte) error {
+		if typ != "trex" {
+			return nil
+		}
+		if len(body) < 24 {
+			return fmt.Errorf("mp4: trex box too short")
+		}
+		r.defaults[be32(body[4:])] = trackDefaults{duration: be32(body[12:]), size: be32(body[16:]), flags: be32(body[20:])}
+		return nil
+	})
+}
+
+// parseMoof appends the samples of a movie fragment to their tracks.
+// moofOffset is the file offset of the moof box, end the file size.
+func (r *Reader) parseMoof(data []byte, moofOffset, end int64) error {
+	return children(data, func(typ string, body []byte) error {
+		if typ == "traf" {
+			return r.parseTraf(body, moofOffset, end)
+		}
+		return nil
+	})
+}
+
+func (r *Reader) parseTraf(data []byte, moofOffset, end int64) error {
+	var track *Track
+	var defaults trackDefaults
+	base := moofOffset
+	next := int64(-1) // offset after the previous trun's data
+	var decodeTime uint64
+	haveDecodeTime := false
+
+	return children(data, func(typ string, body []byte) error {
+		switch typ {
+		case "tfhd":
+			if len(body) < 8 {
+				return fmt.Errorf("mp4: tfhd box too short")
+			}
+			flags := be32(body) & 0xFFFFFF
+			id := be32(body[4:])
+			for _, t := range r.Tracks {
+				if t.ID == id {
+					track = t
+				}
+			}
+			if track == nil {
+				return fmt.Errorf("mp4: fragment for unknown track %d", id)
+			}
+			defaults = r.defaults[id]
+
+			// Optional fields follow in flag order
+			fields := body[8:]
+			for _, f := range []struct {
+				present uint32
+				size    int
+			}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}, {0x20, 4}} {
+				if flags&f.present == 0 {
+					continue
+				}
+				if len(fields) < f.size {
+					return fmt.Errorf("mp4: tfhd box too short")
+				}
+				switch f.present {
+				case 0x01: // base-data-offset
+					base = int64(binary.BigEndian.Uint64(fields))
+				case 0x08:
+					defaults.duration = be32(fields)
+				case 0x10:
+					defaults.size = be32(fields)
+				case 0x20:
+					defaults.flags = be32(fields)
+				}
+				fields = fields[f.size:]
+			}
+
+		case "tfdt":
+			if len(body) < 8 {
+				return fmt.Errorf("mp4: tfdt box too short")
+			}
+			if body[0] == 1 {
+				if len(body) < 12 {
+					return fmt.Errorf("mp4: tfdt box too short")
+				}
+				decodeTime = binary.BigEndian.Uint64(body[4:])
+			} else {
+				decodeTime = uint64(be32(body[4:]))
+			}
+			haveDecodeTime = true
+
+		case "trun":
+			if track == nil {
+				return fmt.Errorf("mp4: trun before tfhd")
+			}
+			if !haveDecodeTime {
+				// Continue after the track's last sample
+				if n := len(track.Samples); n > 0 {
+					last := track.Samples[n-1]
+					decodeTime = last.DecodeTime + uint64(last.Duration)
+				}
+				haveDecodeTime = true
+			}
+			var err error
+			next, decodeTime, err = parseTrun(track, body, base, next, decodeTime, defaults, end)
+			return err
+		}
+		return nil
+	})
+}
+
+// parseTrun appends the samples of a track run, returning the offset and
+// decode time following them
+func parseTrun(t *Track, body []byte, base, next int64, decodeTime uint64, defaults trackDefaults, end int64) (int64, uint64, error) {
+	if len(body) < 8 {
+		return 0, 0, fmt.Errorf("mp4: trun box too short")
+	}
+	flags := be32(body) & 0xFFFFFF
+	count := int(be32(body[4:]))
+	pos := 8
+
+	offset := next
+	if flags&0x01 != 0 {
+		if len(body) < pos+4 {
+			return 0, 0, fmt.Errorf("mp4: trun box too short")
+		}
+		offset = base + int64(int32(be32(body[pos:])))
+		pos += 4
+	} else if offset < 0 {
+		offset = base
+	}
+
+	firstFlags, haveFirstFlags := uint32(0), false
+	if flags&0x04 != 0 {
+		if len(body) < pos+4 {
+			return 0, 0, fmt.Errorf("mp4: trun box too short")
+		}
+		firstFlags, haveFirstFlags = be32(body[pos:]), true
+		pos += 4
+	}
+
+	entrySize := 0
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			entrySize += 4
+		}
+	}
+	if entrySize > 0 && count > (len(body)-pos)/entrySize {
+		return 0, 0, fmt.Errorf("mp4: trun with %d entries exceeds box", count)
+	}
+
+	for i := 0; i < count; i++ {
+		s := Sample{Offset: offset, DecodeTime: decodeTime, Duration: defaults.duration, Size: defaults.size}
+		sampleFlags := defaults.flags
+		if i == 0 && haveFirstFlags {
+			sampleFlags = firstFlags
+		}
+
+		if flags&0x100 != 0 {
+			s.Duration = be32(body[pos:])
+			pos += 4
+		}
+		if flags&0x200 != 0 {
+			s.Size = be32(body[pos:])
+			pos += 4
+		}
+		if flags&0x400 != 0 {
+			sampleFlags = be32(body[pos:])
+			pos += 4
+		}
+		if flags&0x800 != 0 {
+			// Signed in version 1; version 0 writers use it that way too
+			s.CompositionOffset = int32(be32(body[pos:]))
+			pos += 4
+		}
+		s.Keyframe = sampleFlags&sampleIsNonSync == 0
+
+		// Samples past the end of a truncated file are dropped
+		if s.Offset+int64(s.Size) > end {
+			break
+		}
+		t.Samples = append(t.Samples, s)
+		offset += int64(s.Size)
+		decodeTime += uint64(s.Duration)
+	}
+
+	return offset, decodeTime, nil
+}
+
+// sampleTables collects the raw stbl entries of a track
+type sampleTables struct {
+	stts    [][2]uint32 // sample count, delta
+	ctts    [][2]uint32 // sample count, offset
+	stss    []uint32    // 1-based sync sample numbers
+	hasStss bool
+	stsc    [][3]uint32 // first chunk, samples per chunk, description index
+	sizes   []uint32    // nil when every sample has sampleSize bytes
+	chunks  []int64
+
+	// A constant sample size is kept as the size and count, which come
+	// straight from the file, rather than expanded
+	sampleSize  uint32
+	sampleCount uint32
+}
+
+func parseTrak(t *Track, st *sampleTables, data []byte) error {
+	return children(data, func(typ string, body []byte) error {
+		switch typ {
+		case "tkhd":
+			return parseTkhd(t, body)
+		case "mdia", "minf", "stbl":
+			return parseTrak(t, st, body)
+		case "mdhd":
+			return parseMdhd(t, body)
+		case "hdlr":
+			if len(body) < 12 {
+				return fmt.Errorf("mp4: hdlr box too short")
+			}
+			t.Handler = string(body[8:12])
+		case "stsd":
+			return parseStsd(t, body)
+		case "stts":
+			return parseTable(body, 8, func(e []byte) {
+				st.stts = append(st.stts, [2]uint32{be32(e[0:]), be32(e[4:])})
+			})
+		case "ctts":
+			return parseTable(body, 8, func(e []byte) {
+				st.ctts = append(st.ctts, [2]uint32{be32(e[0:]), be32(e[4:])})
+			})
+		case "stss":
+			st.hasStss = true
+			return parseTable(body, 4, func(e []byte) {
+				st.stss = append(st.stss, be32(e))
+			})
+		case "stsc":
+			return parseTable(body, 12, func(e []byte) {
+				st.stsc = append(st.stsc, [3]uint32{be32(e[0:]), be32(e[4:]), be32(e[8:])})
+			})
+		case "stsz":
+			return parseStsz(st, body)
+		case "stco":
+			return parseTable(body, 4, func(e []byte) {
+				st.chunks = append(st.chunks, int64(be32(e)))
+			})
+		case "co64":
+			return parseTable(body, 8, func(e []byte) {
+				st.chunks = append(st.chunks, int64(binary.BigEndian.Uint64(e)))
+			})
+		}
+		return nil
+	})
+}
+
+func be32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+// parseTable parses a full box holding an entry count and fixed-size entries
+func parseTable(body []byte, entrySize int, fn func(entry []byte)) error {
+	if len(body) < 8 {
+		return fmt.Errorf("mp4: table box too short")
+	}
+
+	count := int(be32(body[4:8]))
+	if count > (len(body)-8)/entrySize {
+		return fmt.Errorf("mp4: table with %d entries exceeds box", count)
+	}
+
+	for i := 0; i < count; i++ {
+		offset := 8 + i*entrySize
+		fn(body[offset : offset+entrySize])
+	}
+	return nil
+}
+
+func parseTkhd(t *Track, body []byte) error {
+	if len(body) < 1 {
+		return fmt.Errorf("mp4: tkhd box too short")
+	}
+
+	// version 1 uses 64-bit creation/modification times and duration
+	idOffset, sizeOffset := 12, 76
+	if body[0] == 1 {
+		idOffset, sizeOffset = 20, 88
+	}
+	if len(body) < sizeOffset+8 {
+		return fmt.Errorf("mp4: tkhd box too short")
+	}
+
+	t.ID = be32(body[idOffset:])
+	// width and height are 16.16 fixed point
+	t.Width = uint16(be32(body[sizeOffset:]) >> 16)
+	t.Height = uint16(be32(body[sizeOffset+4:]) >> 16)
+	return nil
+}
+
+func parseMdhd(t *Track, body []byte) error {
+	if len(body) < 1 {
+		return fmt.Errorf("mp4: mdhd box too short")
+	}
+
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return fmt.Errorf("mp4: mdhd box too short")
+		}
+		t.Timescale = be32(body[20:])
+		t.Duration = binary.BigEndian.Uint64(body[24:])
+		return nil
+	}
+
+	if len(body) < 20 {
+		return fmt.Errorf("mp4: mdhd box too short")
+	}
+	t.Timescale = be32(body[12:])
+	t.Duration = uint64(be32(body[16:]))
+	return nil
+}
+
+func parseStsd(t *Track, body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("mp4: stsd box too short")
+	}
+
+	// Only the first sample entry is used
+	return children(body[8:], func(typ string, entry []byte) error {
+		if t.Codec != "" {
+			return nil
+		}
+		t.Codec = typ
+
+		if typ == "mp4a" {
+			return parseMp4a(t, entry)
+		}
+		if typ != "avc1" && typ != "avc3" {
+			return nil
+		}
+
+		// VisualSampleEntry: 6 reserved + 2 data_reference_index + 16 predefined/reserved,
+		// then width/height and another 50 bytes before the child boxes
+		if len(entry) < 78 {
+			return fmt.Errorf("mp4: %s sample entry too short", typ)
+		}
+		t.Width = binary.BigEndian.Uint16(entry[24:26])
+		t.Height = binary.BigEndian.Uint16(entry[26:28])
+
+		return children(entry[78:], func(typ string, body []byte) error {
+			if typ == "avcC" {
+				return parseAvcC(t, body)
+			}
+			return nil
+		})
+	})
+}
+
+// parseAvcC parses the AVCDecoderConfigurationRecord
+func parseAvcC(t *Track, body []byte) error {
+	if len(body) < 6 {
+		return fmt.Errorf("mp4: avcC box too short")
+	}
+
+	t.NALULengthSize = int(body[4]&0x03) + 1
+
+	offset := 6
+	readSets := func(count int) ([][]byte, error) {
+		var sets [][]byte
+		for i := 0; i < count; i++ {
+			if offset+2 > len(body) {
+				return nil, fmt.Errorf("mp4: truncated avcC parameter set")
+			}
+			n := int(binary.BigEndian.Uint16(body[offset:]))
+			offset += 2
+			if offset+n > len(body) {
+				return nil, fmt.Errorf("mp4: truncated avcC parameter set")
+			}
+			sets = append(sets, append([]byte(nil), body[offset:offset+n]...))
+			offset += n
+		}
+		return sets, nil
+	}
+
+	var err error
+	if t.SPS, err = readSets(int(body[5] & 0x1F)); err != nil {
+		return err
+	}
+
+	if offset >= len(body) {
+		return fmt.Errorf("mp4: avcC missing PPS count")
+	}
+	count := int(body[offset])
+	offset++
+	t.PPS, err = readSets(count)
+	return err
+}
+
+// parseMp4a parses an AudioSampleEntry for the AudioSpecificConfig in its
+// esds box
+func parseMp4a(t *Track, entry []byte) error {
+	// 6 reserved + 2 data_reference_index + 8 reserved, channelcount,
+	// samplesize, 4 more bytes and the 16.16 samplerate
+	if len(entry) < 28 {
+		return fmt.Errorf("mp4: mp4a sample entry too short")
+	}
+	return children(entry[28:], func(typ string, body []byte) error {
+		if typ != "esds" || len(body) < 4 {
+			return nil
+		}
+		asc := findDescriptor(body[4:], []byte{0x03, 0x04, 0x05})
+		if asc == nil {
+			return fmt.Errorf("mp4: esds without a decoder specific info")
+		}
+		cfg, err := ParseAudioConfig(asc)
+		if err != nil {
+			return err
+		}
+		t.Audio = cfg
+		return nil
+	})
+}
+
+// findDescriptor follows a path of nested MPEG-4 descriptor tags (ISO
+// 14496-1) and returns the body of the last one, or nil
+func findDescriptor(data []byte, path []byte) []byte {
+	for len(data) >= 2 {
+		tag := data[0]
+		n, offset := 0, 1
+		for ; offset < len(data) && offset <= 4; offset++ { // expandable size
+			n = n<<7 | int(data[offset]&0x7F)
+			if data[offset]&0x80 == 0 {
+				offset++
+				break
+			}
+		}
+		if n > len(data)-offset {
+			return nil
+		}
+		body := data[offset : offset+n]
+		data = data[offset+n:]
+		if tag != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return body
+		}
+
+		// Skip the fixed fields before the nested descriptors
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if len(body) < 3 {
+				return nil
+			}
+			flags, skip := body[2], 3
+			if flags&0x80 != 0 { // streamDependenceFlag
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip { // URL_Flag
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 { // OCRstreamFlag
+				skip += 2
+			}
+			if skip > len(body) {
+				return nil
+			}
+			body = body[skip:]
+		case 0x04: // DecoderConfigDescriptor
+			if len(body) < 13 {
+				return nil
+			}
+			body = body[13:]
+		}
+		return findDescriptor(body, path[1:])
+	}
+	return nil
+}
+
+// aacSampleRates maps the samplingFrequencyIndex to a rate in Hz
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseAudioConfig reads the sample rate and channel count from an AAC
+// AudioSpecificConfig (ISO 14496-3 section 1.6.2.1)
+func ParseAudioConfig(asc []byte) (*AudioConfig, error) {
+	if len(asc) < 2 {
+		return nil, fmt.Errorf("mp4: AudioSpecificConfig too short")
+	}
+	cfg := &AudioConfig{Config: append([]byte(nil), asc...)}
+
+	index := asc[0]&0x07<<1 | asc[1]>>7
+	channels := asc[1] >> 3 & 0x0F
+	if asc[0]>>3 == 31 {
+		return nil, fmt.Errorf("mp4: extended audio object types are not supported")
+	}
+	switch {
+	case int(index) < len(aacSampleRates):
+		cfg.SampleRate = aacSampleRates[index]
+	case index == 15 && len(asc) >= 5: // explicit 24-bit rate
+		cfg.SampleRate = uint32(asc[1]&0x7F)<<17 | uint32(asc[2])<<9 | uint32(asc[3])<<1 | uint32(asc[4]>>7)
+		channels = asc[4] >> 3 & 0x0F
+	default:
+		return nil, fmt.Errorf("mp4: invalid AAC sampling frequency index %d", index)
+	}
+	cfg.Channels = uint16(channels)
+	return cfg, nil
+}
+
+func parseStsz(st *sampleTables, body []byte) error {
+	if len(body) < 12 {
+		return fmt.Errorf("mp4: stsz box too short")
+	}
+
+	sampleSize := be32(body[4:8])
+	count := int(be32(body[8:12]))
+
+	if sampleSize != 0 {
+		st.sampleSize, st.sampleCount = sampleSize, uint32(count)
+		return nil
+	}
+
+	if count > (len(body)-12)/4 {
+		return fmt.Errorf("mp4: stsz with %d entries exceeds box", count)
+	}
+	st.sizes = make([]uint32, count)
+	for i := range st.sizes {
+		st.sizes[i] = be32(body[12+i*4:])
+	}
+	return nil
+}
+
+// build expands the compact sample tables into one Sample per entry. The
+// samples of a file of fileSize bytes are capped at the number stts gives
+// durations to and, with a constant sample size, at the number that fit in
+// the file, so a corrupt count cannot exhaust memory.
+func (st *sampleTables) build(t *Track, fileSize int64) error {
+	count := len(st.sizes)
+	if st.sampleSize != 0 {
+		count = int(min(int64(st.sampleCount), fileSize/int64(st.sampleSize)))
+	}
+	var timed int64
+	for _, run := range st.stts {
+		timed += int64(run[0])
+	}
+	count = int(min(int64(count), timed))
+	t.Samples = make([]Sample, count)
+
+	// Sample offsets from chunk offsets and sample-to-chunk runs
+	sample := 0
+	for i, run := range st.stsc {
+		if run[0] == 0 {
+			return fmt.Errorf("mp4: invalid stsc first chunk 0")
+		}
+		lastChunk := uint32(len(st.chunks))
+		if i+1 < len(st.stsc) {
+			lastChunk = st.stsc[i+1][0] - 1
+		}
+
+		for chunk := run[0]; chunk <= lastChunk && int(chunk) <= len(st.chunks); chunk++ {
+			offset := st.chunks[chunk-1]
+			for j := uint32(0); j < run[1] && sample < len(t.Samples); j++ {
+				t.Samples[sample].Offset = offset
+				size := st.sampleSize
+				if st.sizes != nil {
+					size = st.sizes[sample]
+				}
+				t.Samples[sample].Size = size
+				offset += int64(size)
+				sample++
+			}
+		}
+	}
+	if sample != len(t.Samples) {
+		return fmt.Errorf("mp4: chunk tables cover %d of %d samples", sample, len(t.Samples))
+	}
+
+	// Decode times
+	sample = 0
+	var dts uint64
+	for _, run := range st.stts {
+		for j := uint32(0); j < run[0] && sample < len(t.Samples); j++ {
+			t.Samples[sample].DecodeTime = dts
+			t.Samples[sample].Duration = run[1]
+			dts += uint64(run[1])
+			sample++
+		}
+	}
+
+	// Composition offsets (signed in version 1, but version 0 writers use them that way too)
+	sample = 0
+	for _, run := range st.ctts {
+		for j := uint32(0); j < run[0] && sample < len(t.Samples); j++ {
+			t.Samples[sample].CompositionOffset = int32(run[1])
+			sample++
+		}
+	}
+
+	// Without stss every sample is a sync sample
+	if !st.hasStss {
+		for i := range t.Samples {
+			t.Samples[i].Keyframe = true
+		}
+	}
+	for _, n := range st.stss {
+		if n >= 1 && int(n) <= len(t.Samples) {
+			t.Samples[n-1].Keyframe = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,381 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFile writes an MP4 with one H.264 track holding the given samples
+// (AVCC, 4-byte lengths) in a single chunk; keyframes are 1-based sample numbers
+func writeTestFile(t *testing.T, samples [][]byte, keyframes []uint32) string {
+	t.Helper()
+
+	sps := []byte{0x67, 0x42, 0xC0, 0x1E}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+
+	avcC := []byte{1, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0, byte(len(sps))}
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1, 0, byte(len(pps)))
+	avcC = append(avcC, pps...)
+
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[24:], 320)
+	binary.BigEndian.PutUint16(entry[26:], 240)
+
+	sizes := []uint32{0, 0, uint32(len(samples))}
+	for _, s := range samples {
+		sizes = append(sizes, uint32(len(s)))
+	}
+
+	ftyp := mkbox("ftyp", []byte("isom"), u32(0x200), []byte("isomavc1"))
+	mdat := mkbox("mdat", samples...)
+	chunkOffset := uint32(len(ftyp) + 8)
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	binary.BigEndian.PutUint32(tkhd[76:], 320<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 240<<16)
+
+	stbl := mkbox("stbl",
+		mkbox("stsd", u32(0, 1), mkbox("avc1", entry, mkbox("avcC", avcC))),
+		mkbox("stts", u32(0, 1, uint32(len(samples)), 3000)),
+		mkbox("stss", u32(0, uint32(len(keyframes))), u32(keyframes...)),
+		mkbox("stsc", u32(0, 1, 1, uint32(len(samples)), 1)),
+		mkbox("stsz", u32(sizes...)),
+		mkbox("stco", u32(0, 1, chunkOffset)),
+	)
+	moov := mkbox("moov", mkbox("trak",
+		mkbox("tkhd", tkhd),
+		mkbox("mdia",
+			mkbox("mdhd", u32(0, 0, 0, 90000, uint32(3000*len(samples)), 0)),
+			mkbox("hdlr", u32(0, 0), []byte("vide"), u32(0, 0, 0), []byte{0}),
+			mkbox("minf", stbl),
+		),
+	))
+
+	name := filepath.Join(t.TempDir(), "test.mp4")
+	if err := os.WriteFile(name, bytes.Join([][]byte{ftyp, mdat, moov}, nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func avcc(nalus ...[]byte) []byte {
+	var buf []byte
+	for _, n := range nalus {
+		buf = append(buf, u32(uint32(len(n)))...)
+		buf = append(buf, n...)
+	}
+	return buf
+}
+
+func TestReaderSamples(t *testing.T) {
+	samples := [][]byte{
+		avcc([]byte{0x65, 1, 2, 3}),
+		avcc([]byte{0x41, 4, 5}, []byte{0x41, 6}),
+		avcc([]byte{0x65, 7}),
+	}
+	name := writeTestFile(t, samples, []uint32{1, 3})
+
+	r, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	track, err := r.VideoTrack()
+	if err != nil {
+		t.Fatalf("VideoTrack failed: %v", err)
+	}
+
+	if track.Width != 320 || track.Height != 240 {
+		t.Errorf("Expected 320x240, got %dx%d", track.Width, track.Height)
+	}
+	if track.Timescale != 90000 || track.NALULengthSize != 4 {
+		t.Errorf("Unexpected timescale %d or NAL length size %d", track.Timescale, track.NALULengthSize)
+	}
+	if len(track.SPS) != 1 || len(track.PPS) != 1 {
+		t.Fatalf("Expected one SPS and one PPS, got %d and %d", len(track.SPS), len(track.PPS))
+	}
+	if len(track.Samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(track.Samples))
+	}
+
+	for i, s := range track.Samples {
+		if s.DecodeTime != uint64(3000*i) {
+			t.Errorf("Sample %d: expected decode time %d, got %d", i, 3000*i, s.DecodeTime)
+		}
+		if s.Keyframe != (i != 1) {
+			t.Errorf("Sample %d: unexpected keyframe flag %v", i, s.Keyframe)
+		}
+
+		data, err := r.ReadSample(&track.Samples[i])
+		if err != nil {
+			t.Fatalf("ReadSample %d failed: %v", i, err)
+		}
+		if !bytes.Equal(data, samples[i]) {
+			t.Errorf("Sample %d: data mismatch", i)
+		}
+	}
+
+	nalus, err := SplitNALUs(samples[1], 4)
+	if err != nil || len(nalus) != 2 || nalus[1][1] != 6 {
+		t.Errorf("SplitNALUs returned %v, %v", nalus, err)
+	}
+}
+
+func TestConstantSampleSizeCapped(t *testing.T) {
+	// A constant-size stsz announcing 2^32-1 samples
+	st := &sampleTables{
+		stts:   [][2]uint32{{0xFFFFFFFF, 3000}},
+		stsc:   [][3]uint32{{1, 0xFFFFFFFF, 1}},
+		chunks: []int64{0},
+	}
+	if err := parseStsz(st, u32(0, 4, 0xFFFFFFFF)); err != nil {
+		t.Fatalf("parseStsz failed: %v", err)
+	}
+
+	track := &Track{}
+	if err := st.build(track, 1000); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if len(track.Samples) != 250 || track.Samples[249].Offset != 996 {
+		t.Errorf("Expected the 250 samples fitting in the file, got %d", len(track.Samples))
+	}
+
+	st.stts = [][2]uint32{{10, 3000}}
+	if err := st.build(track, 1000); err != nil || len(track.Samples) != 10 {
+		t.Errorf("Expected the 10 samples with durations, got %d, %v", len(track.Samples), err)
+	}
+}
+
+func TestSplitNALUsTruncated(t *testing.T) {
+	if _, err := SplitNALUs([]byte{0, 0, 0, 5, 1}, 4); err == nil {
+		t.Error("Expected error for truncated NAL unit")
+	}
+}
+
+// muxTestStream muxes two GOPs of five frames at 30 fps into a fragmented
+// MP4 and returns the file contents and the number of fragments written
+func muxTestStream(t *testing.T, audio bool) ([]byte, int) {
+	t.Helper()
+
+	var out bytes.Buffer
+	fragments := 0
+	m := NewMuxer(func(s Segment) error {
+		if !s.Init {
+			fragments++
+			if !s.Keyframe {
+				t.Errorf("Fragment %d does not start with a keyframe", fragments)
+			}
+		}
+		out.Write(s.Data)
+		return nil
+	})
+	if audio {
+		if err := m.SetAudio(AudioConfig{Config: []byte{0x12, 0x10}, SampleRate: 48000, Channels: 2}); err != nil {
+			t.Fatalf("SetAudio failed: %v", err)
+		}
+	}
+
+	// A P-frame before the first keyframe is dropped
+	m.WriteVideo(1000, [][]byte{{0x41, 0x9A}})
+
+	ts := uint32(0xFFFFF000) // wraps during the stream
+	for i := 0; i < 10; i++ {
+		nalus := [][]byte{{0x09, 0xF0}, {0x41, 0x9A, byte(i)}}
+		if i%5 == 0 {
+			nalus = [][]byte{{0x67, 0x42, 0xC0, 0x1E}, {0x68, 0xCE, 0x3C, 0x80}, {0x65, 0x88, byte(i)}}
+		}
+		if err := m.WriteVideo(ts, nalus); err != nil {
+			t.Fatalf("WriteVideo failed: %v", err)
+		}
+		if audio {
+			m.WriteAudio(uint32(i)*1600, []byte{0x21, byte(i)})
+		}
+		ts += 3000
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	return out.Bytes(), fragments
+}
+
+func openBytes(t *testing.T, data []byte) *Reader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mp4")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	data, fragments := muxTestStream(t, false)
+	if fragments != 2 {
+		t.Errorf("Expected a fragment per GOP, got %d", fragments)
+	}
+
+	r := openBytes(t, data)
+	track, err := r.VideoTrack()
+	if err != nil {
+		t.Fatalf("VideoTrack failed: %v", err)
+	}
+	if track.Timescale != 90000 || len(track.SPS) != 1 || len(track.PPS) != 1 || track.NALULengthSize != 4 {
+		t.Errorf("Unexpected track %+v", track)
+	}
+
+	if len(track.Samples) != 10 {
+		t.Fatalf("Expected 10 samples, got %d", len(track.Samples))
+	}
+	for i, s := range track.Samples {
+		if s.DecodeTime != uint64(i)*3000 || s.Duration != 3000 || s.Keyframe != (i%5 == 0) {
+			t.Errorf("Sample %d: unexpected %+v", i, s)
+		}
+	}
+
+	sample, err := r.ReadSample(&track.Samples[5])
+	if err != nil {
+		t.Fatalf("ReadSample failed: %v", err)
+	}
+	nalus, err := SplitNALUs(sample, 4)
+	if err != nil || len(nalus) != 3 || nalus[2][0] != 0x65 || nalus[2][2] != 5 {
+		t.Errorf("Unexpected keyframe NAL units %x (%v)", nalus, err)
+	}
+
+	sample, _ = r.ReadSample(&track.Samples[1])
+	if nalus, _ := SplitNALUs(sample, 4); len(nalus) != 1 || nalus[0][0] != 0x41 {
+		t.Errorf("Expected the AUD to be dropped, got %x", nalus)
+	}
+}
+
+func TestMuxerTruncated(t *testing.T) {
+	data, _ := muxTestStream(t, false)
+
+	// Killed while writing the last fragment: the first GOP and the samples
+	// of the second that made it to disk survive
+	r := openBytes(t, data[:len(data)-10])
+	track, err := r.VideoTrack()
+	if err != nil {
+		t.Fatalf("VideoTrack failed: %v", err)
+	}
+	if len(track.Samples) < 5 || len(track.Samples) >= 10 {
+		t.Errorf("Expected between 5 and 9 samples, got %d", len(track.Samples))
+	}
+}
+
+func TestMuxerAudio(t *testing.T) {
+	data, _ := muxTestStream(t, true)
+	r := openBytes(t, data)
+
+	if len(r.Tracks) != 2 || r.Tracks[1].Handler != "soun" || r.Tracks[1].Codec != "mp4a" || r.Tracks[1].Timescale != 48000 {
+		t.Fatalf("Unexpected tracks %+v", r.Tracks)
+	}
+	audio := r.Tracks[1].Samples
+	if len(audio) != 10 || audio[1].DecodeTime != 1600 || audio[9].Duration != 1024 {
+		t.Errorf("Unexpected audio samples %+v", audio)
+	}
+}
+
+func TestMuxerAudioSync(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMuxer(func(s Segment) error {
+		out.Write(s.Data)
+		return nil
+	})
+	m.SetAudio(AudioConfig{Config: []byte{0x11, 0x90}, SampleRate: 48000, Channels: 2})
+
+	// Audio timestamp 500 was sampled 100ms after the first video frame,
+	// so audio 500-4800 lines up with the start of the video
+	m.SyncAudio(1000+9000, 500)
+	for i := 0; i < 6; i++ {
+		if err := m.WriteVideo(1000+uint32(i)*3000, [][]byte{{0x67, 0x42, 0xC0, 0x1E}, {0x68, 0xCE, 0x3C, 0x80}, {0x65, 0x88, byte(i)}}); err != nil {
+			t.Fatalf("WriteVideo failed: %v", err)
+		}
+	}
+	audioTS := uint32(500)
+	audioTS -= 6 * 1024 // wraps
+	for i := 0; i < 8; i++ {
+		m.WriteAudio(audioTS, []byte{0x21, byte(i)})
+		audioTS += 1024
+	}
+	m.Flush()
+
+	r := openBytes(t, out.Bytes())
+	track, err := r.AudioTrack()
+	if err != nil {
+		t.Fatalf("AudioTrack failed: %v", err)
+	}
+	if track.Audio.SampleRate != 48000 || track.Audio.Channels != 2 || !bytes.Equal(track.Audio.Config, []byte{0x11, 0x90}) {
+		t.Errorf("Unexpected audio config %+v", track.Audio)
+	}
+
+	// The two frames that start before the video are dropped
+	if len(track.Samples) != 6 || track.Samples[0].DecodeTime != 4800-4*1024 {
+		t.Errorf("Expected 6 samples from %d, got %+v", 4800-4*1024, track.Samples)
+	}
+}
+
+func TestParseAudioConfig(t *testing.T) {
+	cfg, err := ParseAudioConfig([]byte{0x12, 0x10})
+	if err != nil || cfg.SampleRate != 44100 || cfg.Channels != 2 {
+		t.Errorf("Expected 44100 Hz stereo, got %+v (%v)", cfg, err)
+	}
+	if _, err := ParseAudioConfig([]byte{0x17, 0x90}); err == nil {
+		t.Error("Expected an error for a reserved sampling frequency index")
+	}
+}
+
+func TestVideoTimelineReorder(t *testing.T) {
+	// I0 P3 B1 B2 P6 B4 B5 in decode order
+	var v videoTimeline
+	lastDTS := int64(-1)
+	for _, frame := range []uint32{0, 3, 1, 2, 6, 4, 5} {
+		pts := frame * 3000
+		dts, cto := v.add(pts)
+		if int64(dts) <= lastDTS {
+			t.Errorf("Decode time %d not increasing after %d", dts, lastDTS)
+		}
+		if int64(dts)+int64(cto) != int64(pts) {
+			t.Errorf("Frame %d: dts %d + cto %d != pts %d", frame, dts, cto, pts)
+		}
+		lastDTS = int64(dts)
+	}
+	if v.interval != 3000 {
+		t.Errorf("Expected a 3000 tick frame interval, got %d", v.interval)
+	}
+}
+
+func TestVideoTimelineReorder25(t *testing.T) {
+	// 25 fps without VUI timing: I0, then P3 B1 B2, P6 B4 B5, ... in
+	// decode order, for 10000 frames
+	var v videoTimeline
+	v.add(0)
+	lastDTS := uint64(0)
+	var cto int32
+	for k := uint32(0); k < 3333; k++ {
+		for i, frame := range []uint32{3*k + 3, 3*k + 1, 3*k + 2} {
+			var dts uint64
+			dts, cto = v.add(frame * 3600)
+			if k > 1 && dts-lastDTS != 3600 {
+				t.Fatalf("Frame %d: expected a 3600 tick duration, got %d", 3*k+uint32(i)+1, dts-lastDTS)
+			}
+			lastDTS = dts
+		}
+	}
+	if v.interval != 3600 {
+		t.Errorf("Expected a 3600 tick frame interval, got %d", v.interval)
+	}
+	if cto < -5*3600 || cto > 5*3600 {
+		t.Errorf("Expected the composition offset to stay within a few frames, got %d", cto)
+	}
+}
@@ -0,0 +1,280 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"rtp_demo/h264"
+)
+
+// TrackInfo describes a track of a fragmented MP4 for the init segment
+type TrackInfo struct {
+	ID        uint32
+	Handler   string // "vide" or "soun"
+	Timescale uint32
+
+	// Video: H.264 parameter sets (NAL units with header) and picture size
+	SPS, PPS      [][]byte
+	Width, Height uint16
+
+	// Audio: AAC AudioSpecificConfig
+	AudioConfig []byte
+	SampleRate  uint32
+	Channels    uint16
+}
+
+// FragmentSample is one sample of a track fragment
+type FragmentSample struct {
+	Data              []byte // AVCC with 4-byte lengths for video, a raw frame for AAC
+	Duration          uint32
+	CompositionOffset int32
+	Keyframe          bool
+}
+
+// TrackFragment holds the samples of one track in a fragment
+type TrackFragment struct {
+	TrackID        uint32
+	BaseDecodeTime uint64
+	Samples        []FragmentSample
+}
+
+// errNoParameterSets is returned for a video track without SPS/PPS
+var errNoParameterSets = errors.New("mp4: video track needs an SPS and a PPS")
+
+// sample_flags of trun: sample_depends_on and sample_is_non_sync_sample
+const (
+	syncSampleFlags    = 0x02000000
+	nonSyncSampleFlags = 0x01010000
+)
+
+// InitSegment returns the ftyp and moov boxes of a fragmented MP4. The moov
+// has empty sample tables; the samples follow in moof/mdat pairs.
+func InitSegment(tracks []TrackInfo) ([]byte, error) {
+	ftyp := mkbox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso5iso6avc1mp41"))
+
+	var traks [][]byte
+	var trexs [][]byte
+	nextID := uint32(1)
+	for _, t := range tracks {
+		trak, err := buildTrak(t)
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak)
+		trexs = append(trexs, mkfull("trex", 0, 0, u32(t.ID, 1, 0, 0, 0)))
+		if t.ID >= nextID {
+			nextID = t.ID + 1
+		}
+	}
+
+	mvhd := mkfull("mvhd", 0, 0,
+		u32(0, 0, 1000, 0),                         // creation, modification, timescale, duration
+		u32(0x00010000), u16(0x0100, 0), u32(0, 0), // rate, volume, reserved
+		unityMatrix, make([]byte, 24), u32(nextID))
+
+	moov := mkbox("moov", append([][]byte{mvhd}, append(traks, mkbox("mvex", trexs...))...)...)
+	return append(ftyp, moov...), nil
+}
+
+// unityMatrix is the identity transformation of tkhd and mvhd
+var unityMatrix = u32(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+
+func buildTrak(t TrackInfo) ([]byte, error) {
+	var entry, mediaHeader []byte
+	var volume uint16
+	name := "VideoHandler"
+
+	switch t.Handler {
+	case "vide":
+		if len(t.SPS) == 0 || len(t.PPS) == 0 {
+			return nil, errNoParameterSets
+		}
+		entry = avc1Entry(t)
+		mediaHeader = mkfull("vmhd", 0, 1, make([]byte, 8))
+	case "soun":
+		entry = mp4aEntry(t)
+		mediaHeader = mkfull("smhd", 0, 0, make([]byte, 4))
+		volume = 0x0100
+		name = "SoundHandler"
+	default:
+		return nil, errors.New("mp4: unsupported handler " + t.Handler)
+	}
+
+	tkhd := mkfull("tkhd", 0, 3, // enabled, in movie
+		u32(0, 0, t.ID, 0, 0), make([]byte, 8), // times, track ID, reserved, duration, reserved
+		u16(0, 0, volume, 0), unityMatrix,
+		u32(uint32(t.Width)<<16, uint32(t.Height)<<16))
+
+	mdhd := mkfull("mdhd", 0, 0, u32(0, 0, t.Timescale, 0), u16(0x55C4, 0)) // language "und"
+	hdlr := mkfull("hdlr", 0, 0, u32(0), []byte(t.Handler), make([]byte, 12), []byte(name+"\x00"))
+
+	dref := mkfull("dref", 0, 0, u32(1), mkfull("url ", 0, 1))
+	stbl := mkbox("stbl",
+		mkfull("stsd", 0, 0, u32(1), entry),
+		mkfull("stts", 0, 0, u32(0)),
+		mkfull("stsc", 0, 0, u32(0)),
+		mkfull("stsz", 0, 0, u32(0, 0)),
+		mkfull("stco", 0, 0, u32(0)))
+	minf := mkbox("minf", mediaHeader, mkbox("dinf", dref), stbl)
+
+	return mkbox("trak", tkhd, mkbox("mdia", mdhd, hdlr, minf)), nil
+}
+
+// avc1Entry builds the visual sample entry with its avcC
+func avc1Entry(t TrackInfo) []byte {
+	sps := t.SPS[0]
+	record := []byte{1, 0, 0, 0, 0xFF, 0xE0 | byte(len(t.SPS))}
+	if len(sps) >= 4 {
+		copy(record[1:4], sps[1:4]) // profile, constraint flags, level
+	}
+	for _, s := range t.SPS {
+		record = append(record, u16(uint16(len(s)))...)
+		record = append(record, s...)
+	}
+	record = append(record, byte(len(t.PPS)))
+	for _, p := range t.PPS {
+		record = append(record, u16(uint16(len(p)))...)
+		record = append(record, p...)
+	}
+
+	// High profiles add chroma format and bit depths
+	if info, err := h264.ParseSPS(sps); err == nil && highProfile(info.ProfileIDC) {
+		depth := byte(info.BitDepth-8) & 0x07
+		record = append(record, 0xFC|byte(info.ChromaFormatIDC), 0xF8|depth, 0xF8|depth, 0)
+	}
+
+	return mkbox("avc1",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16), u16(t.Width, t.Height),
+		u32(0x00480000, 0x00480000, 0), u16(1), // 72 dpi, reserved, frame_count
+		make([]byte, 32), u16(0x0018, 0xFFFF), // compressorname, depth, pre_defined
+		mkbox("avcC", record))
+}
+
+func highProfile(profile uint8) bool {
+	return profile == 100 || profile == 110 || profile == 122 || profile == 144
+}
+
+// mp4aEntry builds the audio sample entry with its esds
+func mp4aEntry(t TrackInfo) []byte {
+	decoderConfig := descriptor(0x04,
+		[]byte{0x40, 0x15, 0, 0, 0}, // AAC, audio stream, bufferSizeDB
+		u32(0, 0),                   // max and average bitrate unknown
+		descriptor(0x05, t.AudioConfig))
+	es := descriptor(0x03, u16(0), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02}))
+
+	return mkbox("mp4a",
+		make([]byte, 6), u16(1),
+		make([]byte, 8), u16(t.Channels, 16, 0, 0),
+		u32(t.SampleRate<<16),
+		mkfull("esds", 0, 0, es))
+}
+
+// descriptor builds an MPEG-4 descriptor with a 4-byte expandable size
+func descriptor(tag byte, parts ...[]byte) []byte {
+	body := concat(parts)
+	n := len(body)
+	buf := []byte{tag, 0x80 | byte(n>>21&0x7F), 0x80 | byte(n>>14&0x7F), 0x80 | byte(n>>7&0x7F), byte(n & 0x7F)}
+	return append(buf, body...)
+}
+
+// Fragment returns a moof box and its mdat for the given track fragments
+func Fragment(sequence uint32, tracks []TrackFragment) []byte {
+	// The data offsets depend on the moof size, which does not depend on
+	// the offsets, so build it twice
+	moof := buildMoof(sequence, tracks, 0)
+	moof = buildMoof(sequence, tracks, len(moof)+8)
+
+	var data [][]byte
+	size := 8
+	for _, t := range tracks {
+		for _, s := range t.Samples {
+			data = append(data, s.Data)
+			size += len(s.Data)
+		}
+	}
+
+	mdat := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(mdat, uint32(size))
+	copy(mdat[4:], "mdat")
+	for _, d := range data {
+		mdat = append(mdat, d...)
+	}
+	return append(moof, mdat...)
+}
+
+// buildMoof builds the moof box; dataStart is the offset of the first sample
+// from the start of the moof
+func buildMoof(sequence uint32, tracks []TrackFragment, dataStart int) []byte {
+	trafs := [][]byte{mkfull("mfhd", 0, 0, u32(sequence))}
+
+	offset := dataStart
+	for _, t := range tracks {
+		// data offset, duration, size, flags and composition offset per sample
+		entries := make([]byte, 0, 16*len(t.Samples))
+		for _, s := range t.Samples {
+			flags := uint32(nonSyncSampleFlags)
+			if s.Keyframe {
+				flags = syncSampleFlags
+			}
+			entries = append(entries, u32(s.Duration, uint32(len(s.Data)), flags, uint32(s.CompositionOffset))...)
+		}
+		trun := mkfull("trun", 1, 0x000F01, u32(uint32(len(t.Samples)), uint32(offset)), entries)
+
+		trafs = append(trafs, mkbox("traf",
+			mkfull("tfhd", 0, 0x020000, u32(t.TrackID)), // default-base-is-moof
+			mkfull("tfdt", 1, 0, u64(t.BaseDecodeTime)),
+			trun))
+
+		for _, s := range t.Samples {
+			offset += len(s.Data)
+		}
+	}
+
+	return mkbox("moof", trafs...)
+}
+
+// mkbox builds a box from its type and body parts
+func mkbox(typ string, parts ...[]byte) []byte {
+	body := concat(parts)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	copy(buf[4:], typ)
+	return append(buf, body...)
+}
+
+// mkfull builds a full box with a version and 24-bit flags
+func mkfull(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xFFFFFF)
+	return mkbox(typ, append([][]byte{header}, parts...)...)
+}
+
+func concat(parts [][]byte) []byte {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func u16(vals ...uint16) []byte {
+	buf := make([]byte, 2*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint16(buf[2*i:], v)
+	}
+	return buf
+}
+
+func u32(vals ...uint32) []byte {
+	buf := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint32(buf[4*i:], v)
+	}
+	return buf
+}
+
+func u64(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
@@ -0,0 +1,67 @@
+package mpegts
+
+import "errors"
+
+// adtsSampleRates maps the sampling_frequency_index to a rate in Hz
+var adtsSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ADTSFrame is an AAC frame with the fields of its ADTS header
+type ADTSFrame struct {
+	ObjectType      uint8 // MPEG-4 audio object type, 2 for AAC-LC
+	SampleRateIndex uint8
+	Channels        uint8
+	Data            []byte // raw frame without the header
+}
+
+// SampleRate returns the sample rate in Hz, or 0 for a reserved index
+func (f *ADTSFrame) SampleRate() uint32 {
+	if int(f.SampleRateIndex) < len(adtsSampleRates) {
+		return adtsSampleRates[f.SampleRateIndex]
+	}
+	return 0
+}
+
+// AudioSpecificConfig returns the two-byte decoder configuration for MP4
+func (f *ADTSFrame) AudioSpecificConfig() []byte {
+	return []byte{f.ObjectType<<3 | f.SampleRateIndex>>1, f.SampleRateIndex<<7 | f.Channels<<3}
+}
+
+// SplitADTS splits the payload of an AAC PES packet into frames
+func SplitADTS(data []byte) ([]ADTSFrame, error) {
+	var frames []ADTSFrame
+	for len(data) > 0 {
+		if len(data) < 7 || data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+			return frames, errors.New("mpegts: invalid ADTS header")
+		}
+		headerSize := 7
+		if data[1]&0x01 == 0 {
+			headerSize = 9 // with CRC
+		}
+		frameSize := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if frameSize < headerSize || frameSize > len(data) {
+			return frames, errors.New("mpegts: truncated ADTS frame")
+		}
+
+		frames = append(frames, ADTSFrame{
+			ObjectType:      data[2]>>6 + 1,
+			SampleRateIndex: data[2] >> 2 & 0x0F,
+			Channels:        data[2]&0x01<<2 | data[3]>>6,
+			Data:            data[headerSize:frameSize],
+		})
+		data = data[frameSize:]
+	}
+	return frames, nil
+}
+
+// AppendADTS appends a raw AAC frame with an ADTS header built from f,
+// whose Data is ignored
+func AppendADTS(buf []byte, f ADTSFrame, frame []byte) []byte {
+	size := 7 + len(frame)
+	return append(append(buf,
+		0xFF, 0xF1, // MPEG-4, no CRC
+		(f.ObjectType-1)<<6|f.SampleRateIndex<<2|f.Channels>>2,
+		f.Channels<<6|byte(size>>11),
+		byte(size>>3),
+		byte(size<<5)|0x1F,
+		0xFC), frame...)
+}
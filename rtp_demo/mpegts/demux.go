@@ -0,0 +1,252 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PES is a reassembled elementary stream packet
+type PES struct {
+	PID        uint16
+	StreamType uint8
+	PTS, DTS   uint64 // 90 kHz; DTS equals PTS when the packet has none
+	HasPTS     bool
+	Data       []byte
+}
+
+// Demuxer extracts the elementary streams of the first program listed in
+// the PAT. Packets are checked against their continuity counters; a gap
+// drops the PES packet being collected on that PID.
+type Demuxer struct {
+	onPES func(*PES)
+
+	// OnContinuityError, if set, is called for every continuity counter gap;
+	// streamType is 0 for the PAT and PMT
+	OnContinuityError func(pid uint16, streamType, expected, got uint8)
+
+	// ContinuityErrors counts the gaps on all PIDs
+	ContinuityErrors uint64
+
+	pmtPID uint16 // 0 until the PAT is seen
+	pids   map[uint16]*pidState
+}
+
+// pidState is the continuity counter and PES buffer of one PID
+type pidState struct {
+	streamType uint8 // 0 for PSI
+	haveCC     bool
+	cc         uint8
+	collecting bool // a PES packet start was seen since the last gap
+	buf        []byte
+}
+
+// NewDemuxer creates a demuxer that passes complete PES packets to onPES.
+// The PES data is only valid during the call.
+func NewDemuxer(onPES func(*PES)) *Demuxer {
+	return &Demuxer{
+		onPES: onPES,
+		pids:  map[uint16]*pidState{patPID: {}},
+	}
+}
+
+// Write demultiplexes whole transport stream packets
+func (d *Demuxer) Write(data []byte) error {
+	if len(data)%PacketSize != 0 {
+		return errors.New("mpegts: data is not a whole number of packets")
+	}
+	for ; len(data) > 0; data = data[PacketSize:] {
+		p, err := parsePacket(data)
+		if err != nil {
+			return err
+		}
+		d.handlePacket(p)
+	}
+	return nil
+}
+
+// Flush passes on PES packets of unspecified length still being collected,
+// at the end of the stream
+func (d *Demuxer) Flush() {
+	for pid, st := range d.pids {
+		if st.streamType != 0 && st.collecting {
+			d.emit(pid, st)
+		}
+	}
+}
+
+func (d *Demuxer) handlePacket(p packet) {
+	st, ok := d.pids[p.pid]
+	if !ok {
+		return // null packets and PIDs of other programs
+	}
+	if !d.checkContinuity(p, st) {
+		return
+	}
+	if !p.hasPayload {
+		return
+	}
+
+	switch {
+	case st.streamType != 0:
+		d.handlePES(p, st)
+	case p.pid == patPID:
+		d.parsePAT(p)
+	case p.pid == d.pmtPID:
+		d.parsePMT(p)
+	}
+}
+
+// checkContinuity reports whether the packet should be processed: false for
+// a repeated packet. A gap is counted and discards the partial PES packet.
+func (d *Demuxer) checkContinuity(p packet, st *pidState) bool {
+	if !st.haveCC || p.discontinuity {
+		st.haveCC = true
+		st.cc = p.cc
+		return true
+	}
+	if !p.hasPayload {
+		return true // the counter only advances with payload
+	}
+
+	expected := (st.cc + 1) & 0x0F
+	if p.cc == st.cc {
+		return false // duplicate
+	}
+	st.cc = p.cc
+	if p.cc == expected {
+		return true
+	}
+
+	d.ContinuityErrors++
+	if d.OnContinuityError != nil {
+		d.OnContinuityError(p.pid, st.streamType, expected, p.cc)
+	}
+	st.collecting = false
+	st.buf = st.buf[:0]
+	return true
+}
+
+func (d *Demuxer) handlePES(p packet, st *pidState) {
+	if p.unitStart {
+		if st.collecting {
+			d.emit(p.pid, st)
+		}
+		st.collecting = true
+		st.buf = st.buf[:0]
+	}
+	if !st.collecting {
+		return // waiting for the start of a PES packet after a gap
+	}
+	st.buf = append(st.buf, p.payload...)
+
+	// Emit as soon as a PES packet of known length is complete
+	if len(st.buf) >= 6 {
+		if length := int(binary.BigEndian.Uint16(st.buf[4:6])); length > 0 && len(st.buf) >= 6+length {
+			st.buf = st.buf[:6+length]
+			d.emit(p.pid, st)
+		}
+	}
+}
+
+// emit parses the collected PES packet and passes it on
+func (d *Demuxer) emit(pid uint16, st *pidState) {
+	st.collecting = false
+	buf := st.buf
+	st.buf = st.buf[:0]
+
+	// start code prefix, stream_id, length, flags, header length
+	if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return
+	}
+	headerEnd := 9 + int(buf[8])
+	if headerEnd > len(buf) {
+		return
+	}
+
+	pes := &PES{PID: pid, StreamType: st.streamType, Data: buf[headerEnd:]}
+	switch buf[7] >> 6 {
+	case 2:
+		if headerEnd >= 14 {
+			pes.PTS = parseTimestamp(buf[9:14])
+			pes.DTS, pes.HasPTS = pes.PTS, true
+		}
+	case 3:
+		if headerEnd >= 19 {
+			pes.PTS = parseTimestamp(buf[9:14])
+			pes.DTS = parseTimestamp(buf[14:19])
+			pes.HasPTS = true
+		}
+	}
+	d.onPES(pes)
+}
+
+// parseTimestamp decodes a 33-bit PTS or DTS with its marker bits
+func parseTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// section returns the PSI section starting in a packet, with its CRC checked.
+// Sections are assumed to fit in one packet, as PATs and PMTs with a few
+// streams do.
+func section(p packet) ([]byte, bool) {
+	if !p.unitStart || len(p.payload) < 1 {
+		return nil, false
+	}
+	start := 1 + int(p.payload[0]) // pointer_field
+	if start+3 > len(p.payload) {
+		return nil, false
+	}
+	data := p.payload[start:]
+	length := int(binary.BigEndian.Uint16(data[1:3]) & 0x0FFF)
+	if length < 9 || 3+length > len(data) {
+		return nil, false
+	}
+	data = data[:3+length]
+	if crc32(data) != 0 { // the CRC over data and CRC is zero
+		return nil, false
+	}
+	return data[:len(data)-4], true
+}
+
+// parsePAT picks the PMT of the first program
+func (d *Demuxer) parsePAT(p packet) {
+	data, ok := section(p)
+	if !ok || data[0] != 0x00 {
+		return
+	}
+	for i := 8; i+4 <= len(data); i += 4 {
+		program := binary.BigEndian.Uint16(data[i:])
+		pid := binary.BigEndian.Uint16(data[i+2:]) & 0x1FFF
+		if program == 0 {
+			continue // network PID
+		}
+		if pid != d.pmtPID {
+			if d.pmtPID != 0 {
+				delete(d.pids, d.pmtPID)
+			}
+			d.pmtPID = pid
+			d.pids[pid] = &pidState{}
+		}
+		return
+	}
+}
+
+// parsePMT registers the elementary stream PIDs of the program
+func (d *Demuxer) parsePMT(p packet) {
+	data, ok := section(p)
+	if !ok || data[0] != 0x02 || len(data) < 12 {
+		return
+	}
+	infoLength := int(binary.BigEndian.Uint16(data[10:]) & 0x0FFF)
+	for i := 12 + infoLength; i+5 <= len(data); {
+		streamType := data[i]
+		pid := binary.BigEndian.Uint16(data[i+1:]) & 0x1FFF
+		esInfoLength := int(binary.BigEndian.Uint16(data[i+3:]) & 0x0FFF)
+		i += 5 + esInfoLength
+
+		if st, ok := d.pids[pid]; ok && st.streamType == streamType {
+			continue
+		}
+		d.pids[pid] = &pidState{streamType: streamType}
+	}
+}
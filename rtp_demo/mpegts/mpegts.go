@@ -0,0 +1,148 @@
+// Package mpegts reads and writes MPEG transport streams (ISO/IEC 13818-1)
+// carrying H.264 and AAC, the format sent over RTP with payload type 33
+// (RFC 2250).
+package mpegts
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// PacketSize is the size of a transport stream packet
+const PacketSize = 188
+
+// PacketsPerRTP is the usual number of TS packets in an RTP payload; seven
+// packets (1316 bytes) fit an Ethernet MTU with the IP, UDP and RTP headers
+const PacketsPerRTP = 7
+
+// Stream types of the PMT
+const (
+	StreamTypeAAC  = 0x0F // ADTS
+	StreamTypeH264 = 0x1B
+)
+
+const (
+	syncByte = 0x47
+	patPID   = 0x0000
+	nullPID  = 0x1FFF
+)
+
+// ErrSync is returned for data that does not start with the sync byte at
+// every packet boundary
+var ErrSync = errors.New("mpegts: lost sync")
+
+// packet is a parsed transport stream packet
+type packet struct {
+	pid           uint16
+	unitStart     bool // payload_unit_start_indicator
+	cc            uint8
+	hasPayload    bool
+	discontinuity bool
+	randomAccess  bool
+	pcr           uint64
+	hasPCR        bool
+	payload       []byte
+}
+
+// parsePacket parses the header and adaptation field of one packet
+func parsePacket(data []byte) (packet, error) {
+	if len(data) < PacketSize || data[0] != syncByte {
+		return packet{}, ErrSync
+	}
+
+	p := packet{
+		pid:        uint16(data[1]&0x1F)<<8 | uint16(data[2]),
+		unitStart:  data[1]&0x40 != 0,
+		cc:         data[3] & 0x0F,
+		hasPayload: data[3]&0x10 != 0,
+	}
+
+	offset := 4
+	if data[3]&0x20 != 0 {
+		length := int(data[4])
+		offset = 5 + length
+		if offset > PacketSize {
+			return packet{}, errors.New("mpegts: adaptation field too long")
+		}
+		if length > 0 {
+			flags := data[5]
+			p.discontinuity = flags&0x80 != 0
+			p.randomAccess = flags&0x40 != 0
+			if flags&0x10 != 0 && length >= 7 {
+				b := data[6:12]
+				base := uint64(b[0])<<25 | uint64(b[1])<<17 | uint64(b[2])<<9 | uint64(b[3])<<1 | uint64(b[4])>>7
+				ext := uint64(b[4]&0x01)<<8 | uint64(b[5])
+				p.pcr = base*300 + ext
+				p.hasPCR = true
+			}
+		}
+	}
+	if p.hasPayload {
+		p.payload = data[offset:PacketSize]
+	}
+	return p, nil
+}
+
+// PCR returns the program clock reference of a packet, in 27 MHz units
+func PCR(data []byte) (uint64, bool) {
+	p, err := parsePacket(data)
+	if err != nil {
+		return 0, false
+	}
+	return p.pcr, p.hasPCR
+}
+
+// RandomAccess reports whether any of the packets in data has the
+// random_access_indicator set, which encoders use to mark the start of a
+// keyframe
+func RandomAccess(data []byte) bool {
+	for ; len(data) >= PacketSize; data = data[PacketSize:] {
+		if p, err := parsePacket(data); err == nil && p.randomAccess {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTransportStream reports whether a file starts with transport stream
+// packets, judged by the sync bytes of the first three
+func IsTransportStream(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, 3*PacketSize)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return buf[0] == syncByte && buf[PacketSize] == syncByte && buf[2*PacketSize] == syncByte
+}
+
+// crcTable is the CRC-32/MPEG-2 table for polynomial 0x04C11DB7
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32 computes the CRC of a PSI section
+func crc32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
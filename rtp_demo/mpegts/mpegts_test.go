@@ -0,0 +1,162 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+// writeTestStream writes frames of video, each a keyframe every 3 frames
+// and followed by an audio PES, and returns the stream
+func writeTestStream(t *testing.T, frames int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, true)
+
+	aac := ADTSFrame{ObjectType: 2, SampleRateIndex: 3, Channels: 2}
+	for i := 0; i < frames; i++ {
+		// Large enough to span several packets
+		au := append([]byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{byte(i + 1)}, 500)...)
+		pts := uint64(i*3000 + 6000)
+		if err := w.WriteVideo(pts, pts-3000, au, i%3 == 0); err != nil {
+			t.Fatalf("WriteVideo failed: %v", err)
+		}
+		adts := AppendADTS(nil, aac, bytes.Repeat([]byte{0xA0 + byte(i)}, 100))
+		if err := w.WriteAudio(pts, adts); err != nil {
+			t.Fatalf("WriteAudio failed: %v", err)
+		}
+	}
+	if buf.Len()%PacketSize != 0 {
+		t.Fatalf("Stream is not a whole number of packets: %d bytes", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+type collected struct {
+	video, audio []PES
+}
+
+func demux(t *testing.T, data []byte) (*Demuxer, *collected) {
+	t.Helper()
+	c := &collected{}
+	d := NewDemuxer(func(p *PES) {
+		p.Data = append([]byte(nil), p.Data...)
+		switch p.StreamType {
+		case StreamTypeH264:
+			c.video = append(c.video, *p)
+		case StreamTypeAAC:
+			c.audio = append(c.audio, *p)
+		}
+	})
+	// Feed in RTP-sized chunks
+	for len(data) > 0 {
+		n := PacketsPerRTP * PacketSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := d.Write(data[:n]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		data = data[n:]
+	}
+	d.Flush()
+	return d, c
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := writeTestStream(t, 6)
+	d, c := demux(t, data)
+
+	if d.ContinuityErrors != 0 {
+		t.Errorf("Expected no continuity errors, got %d", d.ContinuityErrors)
+	}
+	if len(c.video) != 6 || len(c.audio) != 6 {
+		t.Fatalf("Expected 6 video and 6 audio PES packets, got %d and %d", len(c.video), len(c.audio))
+	}
+	for i, p := range c.video {
+		if !p.HasPTS || p.PTS != uint64(i*3000+6000) || p.DTS != uint64(i*3000+3000) {
+			t.Errorf("Video %d: unexpected PTS %d DTS %d", i, p.PTS, p.DTS)
+		}
+		if len(p.Data) != 511 || p.Data[len(p.Data)-1] != byte(i+1) {
+			t.Errorf("Video %d: unexpected data of %d bytes", i, len(p.Data))
+		}
+	}
+
+	frames, err := SplitADTS(c.audio[2].Data)
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("Expected one ADTS frame, got %d (%v)", len(frames), err)
+	}
+	f := frames[0]
+	if f.SampleRate() != 48000 || f.Channels != 2 || f.ObjectType != 2 || len(f.Data) != 100 || f.Data[0] != 0xA2 {
+		t.Errorf("Unexpected ADTS frame %+v", f)
+	}
+	if asc := f.AudioSpecificConfig(); !bytes.Equal(asc, []byte{0x11, 0x90}) {
+		t.Errorf("Expected AudioSpecificConfig 11 90, got % X", asc)
+	}
+
+	pcr, ok := PCR(data[2*PacketSize:]) // after the PAT and PMT
+	if !ok || pcr != 3000*300 {
+		t.Errorf("Expected PCR %d, got %d (%v)", 3000*300, pcr, ok)
+	}
+	if !RandomAccess(data[:3*PacketSize]) {
+		t.Error("Expected the keyframe to be marked for random access")
+	}
+}
+
+func TestContinuityError(t *testing.T) {
+	data := writeTestStream(t, 6)
+
+	// Find the second packet of the fourth video PES (a keyframe) and drop it
+	var lossy []byte
+	starts := 0
+	dropped := false
+	for off := 0; off < len(data); off += PacketSize {
+		p, _ := parsePacket(data[off:])
+		if p.pid == VideoPID && p.unitStart {
+			starts++
+		}
+		if !dropped && starts == 4 && p.pid == VideoPID && !p.unitStart {
+			dropped = true
+			continue
+		}
+		lossy = append(lossy, data[off:off+PacketSize]...)
+		if p.pid == AudioPID {
+			lossy = append(lossy, data[off:off+PacketSize]...) // duplicates are ignored
+		}
+	}
+
+	var reported []uint16
+	c := &collected{}
+	d := NewDemuxer(func(p *PES) {
+		if p.StreamType == StreamTypeH264 {
+			c.video = append(c.video, *p)
+		} else {
+			c.audio = append(c.audio, *p)
+		}
+	})
+	d.OnContinuityError = func(pid uint16, streamType, expected, got uint8) {
+		reported = append(reported, pid)
+	}
+	if err := d.Write(lossy); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	d.Flush()
+
+	if d.ContinuityErrors != 1 || len(reported) != 1 || reported[0] != VideoPID {
+		t.Errorf("Expected one continuity error on the video PID, got %d %v", d.ContinuityErrors, reported)
+	}
+	if len(c.video) != 5 || len(c.audio) != 6 {
+		t.Errorf("Expected the damaged PES to be dropped: %d video, %d audio", len(c.video), len(c.audio))
+	}
+}
+
+func TestSync(t *testing.T) {
+	data := writeTestStream(t, 1)
+	data[PacketSize] = 0
+	d := NewDemuxer(func(*PES) {})
+	if err := d.Write(data); err != ErrSync {
+		t.Errorf("Expected ErrSync, got %v", err)
+	}
+	if err := d.Write(data[:100]); err == nil {
+		t.Error("Expected an error for a partial packet")
+	}
+}
@@ -0,0 +1,179 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// PIDs used by the Writer
+const (
+	PMTPID   = 0x1000
+	VideoPID = 0x0100
+	AudioPID = 0x0101
+)
+
+// Writer multiplexes H.264 and optionally AAC into a transport stream with
+// a single program. The PAT and PMT are repeated before every keyframe and
+// the PCR is carried on the video PID.
+type Writer struct {
+	w     io.Writer
+	audio bool
+	cc    map[uint16]uint8
+	buf   [PacketSize]byte
+}
+
+// NewWriter creates a writer; audio adds an AAC stream to the PMT
+func NewWriter(w io.Writer, audio bool) *Writer {
+	return &Writer{w: w, audio: audio, cc: make(map[uint16]uint8)}
+}
+
+// WriteVideo writes an access unit in Annex B format with its 90 kHz
+// presentation and decode times
+func (w *Writer) WriteVideo(pts, dts uint64, annexB []byte, keyframe bool) error {
+	if keyframe {
+		if err := w.writeTables(); err != nil {
+			return err
+		}
+	}
+	header := pesHeader(0xE0, pts, dts, 0) // unbounded length for video
+	pcr := dts * 300
+	return w.writePES(VideoPID, append(header, annexB...), &pcr, keyframe)
+}
+
+// WriteAudio writes ADTS frames with the presentation time of the first
+func (w *Writer) WriteAudio(pts uint64, adts []byte) error {
+	header := pesHeader(0xC0, pts, pts, len(adts))
+	return w.writePES(AudioPID, append(header, adts...), nil, true)
+}
+
+// pesHeader builds a PES header with a PTS, and a DTS when it differs
+func pesHeader(streamID byte, pts, dts uint64, payloadSize int) []byte {
+	flags, fields := byte(0x80), timestamp(0x20, pts)
+	if dts != pts {
+		flags = 0xC0
+		fields = append(timestamp(0x30, pts), timestamp(0x10, dts)...)
+	}
+
+	length := 0
+	if payloadSize > 0 {
+		length = 3 + len(fields) + payloadSize
+		if length > 0xFFFF {
+			length = 0
+		}
+	}
+
+	header := []byte{0, 0, 1, streamID, byte(length >> 8), byte(length), 0x80, flags, byte(len(fields))}
+	return append(header, fields...)
+}
+
+// timestamp encodes a 33-bit PTS or DTS with its marker bits
+func timestamp(prefix byte, t uint64) []byte {
+	return []byte{
+		prefix | byte(t>>29)&0x0E | 1,
+		byte(t >> 22),
+		byte(t>>14) | 1,
+		byte(t >> 7),
+		byte(t<<1) | 1,
+	}
+}
+
+// writeTables writes the PAT and PMT
+func (w *Writer) writeTables() error {
+	pat := []byte{0x00, 0xB0, 0, 0x00, 0x01, 0xC1, 0, 0, 0x00, 0x01, 0xE0 | PMTPID>>8, PMTPID & 0xFF}
+	if err := w.writeSection(patPID, pat); err != nil {
+		return err
+	}
+
+	pmt := []byte{0x02, 0xB0, 0, 0x00, 0x01, 0xC1, 0, 0, 0xE0 | VideoPID>>8, VideoPID & 0xFF, 0xF0, 0}
+	pmt = append(pmt, StreamTypeH264, 0xE0|VideoPID>>8, VideoPID&0xFF, 0xF0, 0)
+	if w.audio {
+		pmt = append(pmt, StreamTypeAAC, 0xE0|AudioPID>>8, AudioPID&0xFF, 0xF0, 0)
+	}
+	return w.writeSection(PMTPID, pmt)
+}
+
+// writeSection fills in the section length and CRC and writes the section
+// in one packet
+func (w *Writer) writeSection(pid uint16, section []byte) error {
+	length := len(section) - 3 + 4
+	section[1] = section[1]&0xF0 | byte(length>>8)
+	section[2] = byte(length)
+	section = binary.BigEndian.AppendUint32(section, crc32(section))
+
+	payload := append([]byte{0}, section...) // pointer_field
+	_, err := w.writePacket(pid, true, payload, nil, false)
+	return err
+}
+
+// writePES splits a PES packet into transport stream packets. The first
+// carries the PCR and random access indicator, if any.
+func (w *Writer) writePES(pid uint16, pes []byte, pcr *uint64, randomAccess bool) error {
+	for unitStart := true; len(pes) > 0; unitStart = false {
+		n, err := w.writePacket(pid, unitStart, pes, pcr, randomAccess)
+		if err != nil {
+			return err
+		}
+		pes = pes[n:]
+		pcr, randomAccess = nil, false
+	}
+	return nil
+}
+
+// writePacket writes one packet with as much of payload as fits and returns
+// how much that was. A short payload is padded with stuffing bytes in the
+// adaptation field.
+func (w *Writer) writePacket(pid uint16, unitStart bool, payload []byte, pcr *uint64, randomAccess bool) (int, error) {
+	p := w.buf[:]
+	p[0] = syncByte
+	p[1] = byte(pid>>8) & 0x1F
+	if unitStart {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	cc := w.cc[pid]
+	w.cc[pid] = (cc + 1) & 0x0F
+	p[3] = 0x10 | cc
+
+	// Adaptation field flags with the PCR, if any
+	var adaptation []byte
+	if pcr != nil || randomAccess {
+		flags := byte(0)
+		if randomAccess {
+			flags |= 0x40
+		}
+		adaptation = []byte{flags}
+		if pcr != nil {
+			adaptation[0] |= 0x10
+			base, ext := *pcr/300, *pcr%300
+			adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+				byte(base<<7)|0x7E|byte(ext>>8), byte(ext))
+		}
+	}
+
+	if adaptation == nil && len(payload) >= PacketSize-4 {
+		copy(p[4:], payload)
+		_, err := w.w.Write(p)
+		return PacketSize - 4, err
+	}
+
+	space := PacketSize - 5 - len(adaptation)
+	n := min(len(payload), space)
+	if n < space {
+		if len(adaptation) == 0 {
+			adaptation = append(adaptation, 0) // no flags
+		}
+		for 5+len(adaptation)+n < PacketSize {
+			adaptation = append(adaptation, 0xFF)
+		}
+	}
+
+	p[3] |= 0x20
+	p[4] = byte(len(adaptation))
+	copy(p[5:], adaptation)
+	copy(p[5+len(adaptation):], payload[:n])
+
+	if _, err := w.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
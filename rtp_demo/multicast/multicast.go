@@ -0,0 +1,136 @@
+// Package multicast sets up UDP sockets for sending to and receiving from
+// IPv4/IPv6 multicast groups, including source-specific multicast (SSM).
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IsMulticast reports whether addr ("host:port") names a multicast group
+func IsMulticast(addr string) bool {
+	ap, err := netip.ParseAddrPort(addr)
+	return err == nil && ap.Addr().IsMulticast()
+}
+
+// Interface looks up a network interface by name, or returns nil (the
+// system default) for an empty name
+func Interface(name string) (*net.Interface, error) {
+	if name == "" {
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("multicast: %w", err)
+	}
+	return ifi, nil
+}
+
+// Listen opens a socket on the group's port and joins the group on ifi (nil
+// for the default interface). With sources, only traffic from those senders
+// is received (SSM, RFC 4607). The socket allows address reuse so that
+// several receivers on one host can join the same group.
+func Listen(group *net.UDPAddr, ifi *net.Interface, sources []net.IP) (*net.UDPConn, error) {
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("multicast: %s is not a multicast address", group.IP)
+	}
+
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	lc := net.ListenConfig{Control: reuseAddr}
+	pc, err := lc.ListenPacket(context.Background(), network, bindAddress(group))
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+
+	if err := join(conn, group, ifi, sources); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// join joins the group, or each (source, group) channel for SSM
+func join(conn *net.UDPConn, group *net.UDPAddr, ifi *net.Interface, sources []net.IP) error {
+	groupAddr := &net.UDPAddr{IP: group.IP}
+
+	if group.IP.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if len(sources) == 0 {
+			if err := p.JoinGroup(ifi, groupAddr); err != nil {
+				return fmt.Errorf("multicast: join %s: %w", group.IP, err)
+			}
+			return nil
+		}
+		for _, src := range sources {
+			if err := p.JoinSourceSpecificGroup(ifi, groupAddr, &net.UDPAddr{IP: src}); err != nil {
+				return fmt.Errorf("multicast: join (%s, %s): %w", src, group.IP, err)
+			}
+		}
+		return nil
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if len(sources) == 0 {
+		if err := p.JoinGroup(ifi, groupAddr); err != nil {
+			return fmt.Errorf("multicast: join %s: %w", group.IP, err)
+		}
+		return nil
+	}
+	for _, src := range sources {
+		if err := p.JoinSourceSpecificGroup(ifi, groupAddr, &net.UDPAddr{IP: src}); err != nil {
+			return fmt.Errorf("multicast: join (%s, %s): %w", src, group.IP, err)
+		}
+	}
+	return nil
+}
+
+// SenderOptions control how packets are sent to a group
+type SenderOptions struct {
+	TTL       int            // IPv4 TTL or IPv6 hop limit; 1 keeps packets on the local network
+	Loopback  bool           // also deliver to receivers on the sending host
+	Interface *net.Interface // outgoing interface, nil for the routing table's choice
+}
+
+// ConfigureSender applies the options to a socket connected or sending to
+// a multicast group
+func ConfigureSender(conn *net.UDPConn, group net.IP, opts SenderOptions) error {
+	if group.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if err := p.SetMulticastTTL(opts.TTL); err != nil {
+			return fmt.Errorf("multicast: set TTL: %w", err)
+		}
+		if err := p.SetMulticastLoopback(opts.Loopback); err != nil {
+			return fmt.Errorf("multicast: set loopback: %w", err)
+		}
+		if opts.Interface != nil {
+			if err := p.SetMulticastInterface(opts.Interface); err != nil {
+				return fmt.Errorf("multicast: set interface: %w", err)
+			}
+		}
+		return nil
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if err := p.SetMulticastHopLimit(opts.TTL); err != nil {
+		return fmt.Errorf("multicast: set hop limit: %w", err)
+	}
+	if err := p.SetMulticastLoopback(opts.Loopback); err != nil {
+		return fmt.Errorf("multicast: set loopback: %w", err)
+	}
+	if opts.Interface != nil {
+		if err := p.SetMulticastInterface(opts.Interface); err != nil {
+			return fmt.Errorf("multicast: set interface: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package multicast
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsMulticast(t *testing.T) {
+	cases := map[string]bool{
+		"239.1.2.3:5004":   true,
+		"[ff3e::1]:5004":   true,
+		"127.0.0.1:5004":   false,
+		":5004":            false,
+		"example.com:5004": false,
+	}
+	for addr, want := range cases {
+		if got := IsMulticast(addr); got != want {
+			t.Errorf("IsMulticast(%q): expected %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestListenRejectsUnicast(t *testing.T) {
+	if _, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5004}, nil, nil); err == nil {
+		t.Error("Expected an error for a unicast address")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 42, 99), Port: 45678}
+
+	// Two receivers on the same group and port
+	var receivers []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		conn, err := Listen(group, nil, nil)
+		if err != nil {
+			t.Skipf("Multicast not available: %v", err)
+		}
+		defer conn.Close()
+		receivers = append(receivers, conn)
+	}
+
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	if err := ConfigureSender(sender, group.IP, SenderOptions{TTL: 1, Loopback: true}); err != nil {
+		t.Fatalf("ConfigureSender failed: %v", err)
+	}
+	if _, err := sender.WriteToUDP([]byte("hello"), group); err != nil {
+		t.Skipf("No multicast route: %v", err)
+	}
+
+	for i, conn := range receivers {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 16)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Errorf("Receiver %d: %v", i, err)
+			continue
+		}
+		if string(buf[:n]) != "hello" {
+			t.Errorf("Receiver %d: expected hello, got %q", i, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package multicast
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// reuseAddr lets several sockets bind the same group and port
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// bindAddress binds to the group itself so that only its traffic arrives
+func bindAddress(group *net.UDPAddr) string {
+	return net.JoinHostPort(group.IP.String(), fmt.Sprint(group.Port))
+}
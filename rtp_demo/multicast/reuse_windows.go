@@ -0,0 +1,27 @@
+//go:build windows
+
+package multicast
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// reuseAddr lets several sockets bind the same group and port
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// bindAddress binds to the wildcard address, since Windows cannot bind to
+// a multicast address
+func bindAddress(group *net.UDPAddr) string {
+	return fmt.Sprintf(":%d", group.Port)
+}
@@ -0,0 +1,319 @@
+// Package netsim simulates network impairments (loss, delay, jitter,
+// reordering, duplication and bandwidth limits) on packets written to a
+// transport, so RTP receivers can be tested against reproducible bad networks.
+package netsim
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GilbertElliott describes a two-state bursty loss model. The channel moves
+// between a good and a bad state once per packet and each state has its own
+// loss probability.
+type GilbertElliott struct {
+	PGoodToBad float64 // probability of entering the bad state (p)
+	PBadToGood float64 // probability of leaving the bad state (r)
+	LossGood   float64 // loss probability in the good state (1-k)
+	LossBad    float64 // loss probability in the bad state (1-h)
+}
+
+// Config describes the impairments applied to each packet
+type Config struct {
+	Loss         float64         // independent random loss probability
+	Burst        *GilbertElliott // bursty loss model, applied in addition to Loss
+	Delay        time.Duration   // fixed one-way delay
+	Jitter       time.Duration   // delay varies uniformly within ±Jitter
+	Reorder      float64         // probability a packet is held back by ReorderDelay
+	ReorderDelay time.Duration
+	Duplicate    float64       // probability a packet is delivered twice
+	Bandwidth    int           // bottleneck rate in bits per second, 0 for unlimited
+	QueueLimit   time.Duration // max queuing delay at the bottleneck before tail drop
+	Seed         int64
+}
+
+// Stats counts what happened to packets passing through the simulator
+type Stats struct {
+	Packets    int // packets offered
+	Lost       int // dropped by random or burst loss
+	QueueDrops int // dropped by the bandwidth queue
+	Reordered  int // held back so later packets overtake them
+	Duplicated int
+}
+
+// Delivery is a packet scheduled to leave the simulator
+type Delivery struct {
+	Data []byte
+	At   time.Time
+}
+
+// Impairer decides the fate of each packet. Given the same seed and the same
+// sequence of send times it always produces the same deliveries, which keeps
+// tests deterministic.
+type Impairer struct {
+	cfg      Config
+	rng      *rand.Rand
+	bad      bool      // Gilbert-Elliott state
+	linkFree time.Time // when the bottleneck finishes sending queued data
+	stats    Stats
+}
+
+// NewImpairer creates an impairer for the given configuration
+func NewImpairer(cfg Config) *Impairer {
+	return &Impairer{
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+// Stats returns the counters accumulated so far
+func (im *Impairer) Stats() Stats {
+	return im.stats
+}
+
+// Process applies the impairments to a packet sent at now and returns zero,
+// one or two deliveries
+func (im *Impairer) Process(data []byte, now time.Time) []Delivery {
+	im.stats.Packets++
+
+	if im.lost() {
+		im.stats.Lost++
+		return nil
+	}
+
+	// Serialize through the bottleneck link
+	at := now
+	if im.cfg.Bandwidth > 0 {
+		if im.linkFree.Before(now) {
+			im.linkFree = now
+		}
+		if im.cfg.QueueLimit > 0 && im.linkFree.Sub(now) > im.cfg.QueueLimit {
+			im.stats.QueueDrops++
+			return nil
+		}
+		im.linkFree = im.linkFree.Add(time.Duration(len(data)) * 8 * time.Second / time.Duration(im.cfg.Bandwidth))
+		at = im.linkFree
+	}
+
+	deliveries := []Delivery{{Data: data, At: at.Add(im.delay())}}
+
+	if im.cfg.Reorder > 0 && im.rng.Float64() < im.cfg.Reorder {
+		im.stats.Reordered++
+		deliveries[0].At = deliveries[0].At.Add(im.cfg.ReorderDelay)
+	}
+
+	if im.cfg.Duplicate > 0 && im.rng.Float64() < im.cfg.Duplicate {
+		im.stats.Duplicated++
+		deliveries = append(deliveries, Delivery{Data: data, At: at.Add(im.delay())})
+	}
+
+	return deliveries
+}
+
+// lost runs the loss models for one packet
+func (im *Impairer) lost() bool {
+	lost := im.cfg.Loss > 0 && im.rng.Float64() < im.cfg.Loss
+
+	if ge := im.cfg.Burst; ge != nil {
+		if im.bad {
+			if im.rng.Float64() < ge.PBadToGood {
+				im.bad = false
+			}
+		} else if im.rng.Float64() < ge.PGoodToBad {
+			im.bad = true
+		}
+
+		p := ge.LossGood
+		if im.bad {
+			p = ge.LossBad
+		}
+		if im.rng.Float64() < p {
+			lost = true
+		}
+	}
+
+	return lost
+}
+
+// delay returns the fixed delay plus a random jitter component
+func (im *Impairer) delay() time.Duration {
+	d := im.cfg.Delay
+	if im.cfg.Jitter > 0 {
+		d += time.Duration(im.rng.Int63n(int64(2*im.cfg.Jitter)+1)) - im.cfg.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Conn wraps a transport and impairs every packet written to it. Delayed
+// packets are written from timer goroutines.
+type Conn struct {
+	w  io.Writer
+	mu sync.Mutex
+	im *Impairer
+	wg sync.WaitGroup
+}
+
+// NewConn wraps w with the impairments described by cfg
+func NewConn(w io.Writer, cfg Config) *Conn {
+	return &Conn{
+		w:  w,
+		im: NewImpairer(cfg),
+	}
+}
+
+// Write impairs and forwards one packet. It always reports success, like a
+// UDP socket whose datagram is lost somewhere on the path.
+func (c *Conn) Write(p []byte) (int, error) {
+	data := append([]byte(nil), p...)
+	now := time.Now()
+
+	c.mu.Lock()
+	deliveries := c.im.Process(data, now)
+	c.mu.Unlock()
+
+	for _, d := range deliveries {
+		wait := d.At.Sub(now)
+		if wait <= 0 {
+			c.send(d.Data)
+			continue
+		}
+
+		c.wg.Add(1)
+		time.AfterFunc(wait, func(data []byte) func() {
+			return func() {
+				defer c.wg.Done()
+				c.send(data)
+			}
+		}(d.Data))
+	}
+
+	return len(p), nil
+}
+
+func (c *Conn) send(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write(data)
+}
+
+// Flush waits until all delayed packets have been written
+func (c *Conn) Flush() {
+	c.wg.Wait()
+}
+
+// Stats returns the impairment counters
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.im.Stats()
+}
+
+// ParseConfig parses a comma-separated impairment spec such as
+// "loss=0.02,delay=40ms,jitter=10ms,rate=2m,seed=7". Supported keys are
+// loss, ge (p:r:lossGood:lossBad), delay, jitter, reorder, reorder-delay,
+// dup, rate (bits/s with optional k/m suffix), queue and seed.
+func ParseConfig(spec string) (Config, error) {
+	cfg := Config{ReorderDelay: 20 * time.Millisecond, Seed: 1}
+	if spec == "" {
+		return cfg, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return cfg, fmt.Errorf("netsim: expected key=value, got %q", item)
+		}
+
+		var err error
+		switch key {
+		case "loss":
+			cfg.Loss, err = parseProbability(value)
+		case "ge":
+			cfg.Burst, err = parseGilbertElliott(value)
+		case "delay":
+			cfg.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			cfg.Jitter, err = time.ParseDuration(value)
+		case "reorder":
+			cfg.Reorder, err = parseProbability(value)
+		case "reorder-delay":
+			cfg.ReorderDelay, err = time.ParseDuration(value)
+		case "dup":
+			cfg.Duplicate, err = parseProbability(value)
+		case "rate":
+			cfg.Bandwidth, err = parseRate(value)
+		case "queue":
+			cfg.QueueLimit, err = time.ParseDuration(value)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("netsim: invalid %s=%q: %v", key, value, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability out of range [0,1]")
+	}
+	return p, nil
+}
+
+func parseGilbertElliott(s string) (*GilbertElliott, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("expected p:r:lossGood:lossBad")
+	}
+
+	var vals [4]float64
+	for i, part := range parts {
+		p, err := parseProbability(part)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = p
+	}
+
+	return &GilbertElliott{
+		PGoodToBad: vals[0],
+		PBadToGood: vals[1],
+		LossGood:   vals[2],
+		LossBad:    vals[3],
+	}, nil
+}
+
+func parseRate(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1000, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult, s = 1000000, strings.TrimSuffix(s, "m")
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("rate must not be negative")
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,159 @@
+package netsim
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// run sends n packets spaced by interval and returns the deliveries
+func run(cfg Config, n int, interval time.Duration) ([]Delivery, Stats) {
+	im := NewImpairer(cfg)
+	start := time.Unix(0, 0)
+
+	var out []Delivery
+	for i := 0; i < n; i++ {
+		out = append(out, im.Process([]byte{byte(i >> 8), byte(i)}, start.Add(time.Duration(i)*interval))...)
+	}
+	return out, im.Stats()
+}
+
+func TestDeterministic(t *testing.T) {
+	cfg := Config{Loss: 0.1, Jitter: 5 * time.Millisecond, Reorder: 0.05, ReorderDelay: 10 * time.Millisecond, Duplicate: 0.05, Seed: 42}
+
+	a, statsA := run(cfg, 500, time.Millisecond)
+	b, statsB := run(cfg, 500, time.Millisecond)
+	if !reflect.DeepEqual(a, b) || statsA != statsB {
+		t.Error("Expected identical results for the same seed")
+	}
+
+	cfg.Seed = 43
+	c, _ := run(cfg, 500, time.Millisecond)
+	if reflect.DeepEqual(a, c) {
+		t.Error("Expected different results for a different seed")
+	}
+}
+
+func TestRandomLoss(t *testing.T) {
+	_, stats := run(Config{Loss: 0.2, Seed: 1}, 10000, time.Millisecond)
+
+	rate := float64(stats.Lost) / float64(stats.Packets)
+	if rate < 0.18 || rate > 0.22 {
+		t.Errorf("Expected ~20%% loss, got %.3f", rate)
+	}
+}
+
+func TestGilbertElliottBursts(t *testing.T) {
+	// Always lose in the bad state, never in the good one; mean burst is 1/r = 4
+	cfg := Config{Burst: &GilbertElliott{PGoodToBad: 0.02, PBadToGood: 0.25, LossBad: 1}, Seed: 7}
+	out, stats := run(cfg, 20000, time.Millisecond)
+
+	received := make(map[int]bool)
+	for _, d := range out {
+		received[int(d.Data[0])<<8|int(d.Data[1])] = true
+	}
+
+	bursts, burstLen := 0, 0
+	for i := 0; i < stats.Packets; i++ {
+		if !received[i] {
+			burstLen++
+			continue
+		}
+		if burstLen > 0 {
+			bursts++
+		}
+		burstLen = 0
+	}
+
+	mean := float64(stats.Lost) / float64(bursts)
+	if mean < 3 || mean > 5 {
+		t.Errorf("Expected mean burst length ~4, got %.2f over %d bursts", mean, bursts)
+	}
+}
+
+func TestBandwidthAndQueue(t *testing.T) {
+	// 1000-byte packets at 80 kbit/s take 100 ms each on the wire
+	cfg := Config{Bandwidth: 80000, QueueLimit: 250 * time.Millisecond}
+	im := NewImpairer(cfg)
+	start := time.Unix(0, 0)
+	packet := make([]byte, 1000)
+
+	var delivered []time.Duration
+	for i := 0; i < 5; i++ {
+		for _, d := range im.Process(packet, start) {
+			delivered = append(delivered, d.At.Sub(start))
+		}
+	}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	if !reflect.DeepEqual(delivered, want) {
+		t.Errorf("Expected deliveries at %v, got %v", want, delivered)
+	}
+	if im.Stats().QueueDrops != 2 {
+		t.Errorf("Expected 2 queue drops, got %d", im.Stats().QueueDrops)
+	}
+}
+
+func TestReorderAndDuplicate(t *testing.T) {
+	out, stats := run(Config{Reorder: 0.1, ReorderDelay: 5 * time.Millisecond, Duplicate: 0.1, Seed: 3}, 1000, time.Millisecond)
+
+	if stats.Reordered == 0 || stats.Duplicated == 0 {
+		t.Fatalf("Expected reordering and duplication, got %+v", stats)
+	}
+	if len(out) != stats.Packets+stats.Duplicated {
+		t.Errorf("Expected %d deliveries, got %d", stats.Packets+stats.Duplicated, len(out))
+	}
+
+	overtaken := 0
+	for i := 1; i < len(out); i++ {
+		if out[i].At.Before(out[i-1].At) {
+			overtaken++
+		}
+	}
+	if overtaken == 0 {
+		t.Error("Expected later packets to overtake held-back ones")
+	}
+}
+
+func TestConnWritesThrough(t *testing.T) {
+	var buf bytes.Buffer
+	conn := NewConn(&buf, Config{Delay: time.Millisecond})
+
+	conn.Write([]byte("ab"))
+	conn.Write([]byte("cd"))
+	conn.Flush()
+
+	if buf.Len() != 4 || conn.Stats().Packets != 2 {
+		t.Errorf("Expected 2 delivered packets, got %q", buf.String())
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("loss=0.05,ge=0.01:0.3:0:0.5,delay=40ms,jitter=5ms,reorder=0.01,dup=0.02,rate=2m,queue=200ms,seed=9")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	want := Config{
+		Loss:         0.05,
+		Burst:        &GilbertElliott{PGoodToBad: 0.01, PBadToGood: 0.3, LossGood: 0, LossBad: 0.5},
+		Delay:        40 * time.Millisecond,
+		Jitter:       5 * time.Millisecond,
+		Reorder:      0.01,
+		ReorderDelay: 20 * time.Millisecond,
+		Duplicate:    0.02,
+		Bandwidth:    2000000,
+		QueueLimit:   200 * time.Millisecond,
+		Seed:         9,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Expected %+v, got %+v", want, cfg)
+	}
+
+	for _, spec := range []string{"loss=2", "bogus=1", "delay", "ge=0.1:0.2"} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Handler serves the control API:
+//
+//	GET    /subscribers              list subscribers as JSON
+//	POST   /subscribers?addr=h:port  add a subscriber
+//	DELETE /subscribers?addr=h:port  remove a subscriber
+//
+// POST also accepts a JSON body {"addr": "host:port"}.
+func Handler(r *Relay) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribers", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, r.Subscribers())
+
+		case http.MethodPost, http.MethodDelete:
+			addr, err := requestAddr(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if req.Method == http.MethodPost {
+				err = r.Add(addr)
+			} else {
+				err = r.Remove(addr)
+			}
+
+			switch {
+			case errors.Is(err, ErrExists):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, ErrNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case req.Method == http.MethodPost:
+				writeJSON(w, http.StatusCreated, r.Subscribers())
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// requestAddr reads the subscriber address from the query or a JSON body
+func requestAddr(req *http.Request) (*net.UDPAddr, error) {
+	addr := req.URL.Query().Get("addr")
+	if addr == "" && req.Body != nil {
+		var body struct {
+			Addr string `json:"addr"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err == nil {
+			addr = body.Addr
+		}
+	}
+	if addr == "" {
+		return nil, errors.New("relay: missing subscriber address")
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,349 @@
+// Package relay forwards one upstream RTP stream to a changing set of
+// subscribers. Each subscriber gets its own SSRC, sequence numbers and
+// timestamps, which stay continuous when the upstream source changes, and
+// joins at the next keyframe.
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default settings
+const (
+	DefaultSourceTimeout = time.Second
+	DefaultKeyframeRetry = time.Second
+	DefaultClockRate     = 90000
+)
+
+const (
+	minPacketSize = 12   // RTP fixed header
+	frameTicks    = 3000 // timestamp step used when the gap is unknown, 1/30s
+	maxGap        = 10 * time.Second
+)
+
+// ErrExists is returned when adding a subscriber twice
+var ErrExists = errors.New("relay: subscriber already exists")
+
+// ErrNotFound is returned when removing an unknown subscriber
+var ErrNotFound = errors.New("relay: no such subscriber")
+
+// SendFunc writes a packet to a subscriber
+type SendFunc func(packet []byte, addr *net.UDPAddr) error
+
+// Packet describes an upstream RTP packet after parsing
+type Packet struct {
+	Data      []byte // the whole RTP packet, not modified by the relay
+	SSRC      uint32
+	Sequence  uint16
+	Timestamp uint32
+	Arrival   time.Time
+
+	// Keyframe is set on the packets of a frame that decoders can start
+	// from, from the first one that shows it, e.g. by carrying an SPS or the
+	// start of an IDR slice. Waiting subscribers start at the first packet
+	// of that frame.
+	Keyframe bool
+}
+
+// Relay forwards packets to subscribers. It is safe for concurrent use, so
+// the control API can run alongside the packet loop.
+type Relay struct {
+	SourceTimeout time.Duration // silence after which another SSRC may take over
+	KeyframeRetry time.Duration // how often to repeat keyframe requests
+	ClockRate     int
+
+	send SendFunc
+
+	mu            sync.Mutex
+	subscribers   map[string]*subscriber
+	source        uint32 // current upstream SSRC, 0 before the first packet
+	lastSource    time.Time
+	lastRequest   time.Time
+	forceKeyframe bool
+	rng           *rand.Rand
+
+	// Packets of the current frame, kept while a subscriber waits for a
+	// keyframe that may only show in a later packet, e.g. after an AUD
+	frame []Packet
+}
+
+// subscriber holds the rewrite state for one receiver
+type subscriber struct {
+	addr *net.UDPAddr
+	ssrc uint32
+
+	active  bool // false while waiting for a keyframe
+	started bool // has received packets before
+
+	seqOffset uint16
+	tsOffset  uint32
+
+	lastSeq     uint16 // highest sequence number sent
+	lastTS      uint32
+	lastArrival time.Time
+
+	packets int
+	bytes   int
+}
+
+// Subscriber is a snapshot of a subscriber's state
+type Subscriber struct {
+	Addr    string `json:"addr"`
+	SSRC    uint32 `json:"ssrc"`
+	Active  bool   `json:"active"`
+	Packets int    `json:"packets"`
+	Bytes   int    `json:"bytes"`
+}
+
+// New creates a relay that sends packets with send
+func New(send SendFunc) *Relay {
+	return &Relay{
+		SourceTimeout: DefaultSourceTimeout,
+		KeyframeRetry: DefaultKeyframeRetry,
+		ClockRate:     DefaultClockRate,
+		send:          send,
+		subscribers:   make(map[string]*subscriber),
+		rng:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add adds a subscriber, which starts receiving at the next keyframe
+func (r *Relay) Add(addr *net.UDPAddr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := addr.String()
+	if _, ok := r.subscribers[key]; ok {
+		return ErrExists
+	}
+
+	r.subscribers[key] = &subscriber{
+		addr:      addr,
+		ssrc:      r.newSSRC(),
+		seqOffset: uint16(r.rng.Uint32()),
+		tsOffset:  r.rng.Uint32(),
+	}
+	r.forceKeyframe = true
+	return nil
+}
+
+// newSSRC picks a random SSRC not used by another subscriber
+func (r *Relay) newSSRC() uint32 {
+	for {
+		ssrc := r.rng.Uint32()
+		if ssrc == 0 {
+			continue
+		}
+		used := false
+		for _, s := range r.subscribers {
+			used = used || s.ssrc == ssrc
+		}
+		if !used {
+			return ssrc
+		}
+	}
+}
+
+// Remove removes a subscriber
+func (r *Relay) Remove(addr *net.UDPAddr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := addr.String()
+	if _, ok := r.subscribers[key]; !ok {
+		return ErrNotFound
+	}
+	delete(r.subscribers, key)
+	return nil
+}
+
+// Subscribers returns the subscribers sorted by address
+func (r *Relay) Subscribers() []Subscriber {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]Subscriber, 0, len(r.subscribers))
+	for _, s := range r.subscribers {
+		list = append(list, Subscriber{
+			Addr:    s.addr.String(),
+			SSRC:    s.ssrc,
+			Active:  s.active,
+			Packets: s.packets,
+			Bytes:   s.bytes,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// IsSubscriber reports whether addr is a subscriber, e.g. to route its RTCP
+func (r *Relay) IsSubscriber(addr *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.subscribers[addr.String()]
+	return ok
+}
+
+// Source returns the SSRC currently being forwarded, or 0
+func (r *Relay) Source() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.source
+}
+
+// RequestKeyframe asks for a keyframe from the source, e.g. when a
+// subscriber sent a PLI
+func (r *Relay) RequestKeyframe() {
+	r.mu.Lock()
+	r.forceKeyframe = true
+	r.mu.Unlock()
+}
+
+// TakeKeyframeRequest reports whether the source should be asked for a
+// keyframe now: right after a subscriber joined or asked for one, and then
+// every KeyframeRetry while a subscriber is still waiting
+func (r *Relay) TakeKeyframeRequest(now time.Time) (ssrc uint32, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.source == 0 {
+		return 0, false
+	}
+
+	waiting := false
+	for _, s := range r.subscribers {
+		waiting = waiting || !s.active
+	}
+
+	if r.forceKeyframe || (waiting && now.Sub(r.lastRequest) >= r.KeyframeRetry) {
+		r.forceKeyframe = false
+		r.lastRequest = now
+		return r.source, true
+	}
+	return 0, false
+}
+
+// Forward sends an upstream packet to every subscriber that can use it and
+// reports whether it came from the current source
+func (r *Relay) Forward(p Packet) bool {
+	if len(p.Data) < minPacketSize {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p.SSRC != r.source {
+		// Another sender only takes over once the current one went quiet
+		if r.source != 0 && p.Arrival.Sub(r.lastSource) < r.SourceTimeout {
+			return false
+		}
+		r.switchSource(p)
+	}
+	r.lastSource = p.Arrival
+	if len(r.frame) > 0 && r.frame[0].Timestamp != p.Timestamp {
+		r.frame = r.frame[:0]
+	}
+
+	waiting := false
+	for _, s := range r.subscribers {
+		if !s.active {
+			if !p.Keyframe {
+				waiting = true
+				continue
+			}
+			first := p
+			if len(r.frame) > 0 {
+				first = r.frame[0]
+			}
+			r.activate(s, first)
+			for _, q := range r.frame {
+				r.deliver(s, q)
+			}
+		}
+		r.deliver(s, p)
+	}
+
+	if waiting {
+		p.Data = append([]byte(nil), p.Data...)
+		r.frame = append(r.frame, p)
+	} else {
+		r.frame = r.frame[:0]
+	}
+	return true
+}
+
+// deliver sends a packet to an active subscriber
+func (r *Relay) deliver(s *subscriber, p Packet) {
+	out := r.rewrite(s, p)
+	if err := r.send(out, s.addr); err != nil {
+		return
+	}
+	s.packets++
+	s.bytes += len(out)
+}
+
+// switchSource makes p's SSRC the source; every subscriber waits for its
+// first keyframe
+func (r *Relay) switchSource(p Packet) {
+	r.source = p.SSRC
+	r.frame = r.frame[:0]
+	for _, s := range r.subscribers {
+		s.active = false
+	}
+	r.forceKeyframe = true
+}
+
+// activate starts a subscriber at p. A subscriber that already received
+// packets continues its numbering: the next sequence number, and a
+// timestamp advanced by the time since its last packet.
+func (r *Relay) activate(s *subscriber, p Packet) {
+	s.active = true
+
+	if !s.started {
+		s.started = true
+		s.lastSeq = p.Sequence + s.seqOffset - 1
+		s.lastTS = p.Timestamp + s.tsOffset
+		s.lastArrival = p.Arrival
+		return
+	}
+
+	gap := p.Arrival.Sub(s.lastArrival)
+	ticks := uint32(frameTicks)
+	if gap > 0 && gap < maxGap {
+		ticks = uint32(gap.Seconds() * float64(r.ClockRate))
+		if ticks == 0 {
+			ticks = 1
+		}
+	}
+
+	s.seqOffset = s.lastSeq + 1 - p.Sequence
+	s.tsOffset = s.lastTS + ticks - p.Timestamp
+}
+
+// rewrite copies the packet with the subscriber's SSRC, sequence number and
+// timestamp
+func (r *Relay) rewrite(s *subscriber, p Packet) []byte {
+	out := append([]byte(nil), p.Data...)
+
+	seq := p.Sequence + s.seqOffset
+	ts := p.Timestamp + s.tsOffset
+	binary.BigEndian.PutUint16(out[2:4], seq)
+	binary.BigEndian.PutUint32(out[4:8], ts)
+	binary.BigEndian.PutUint32(out[8:12], s.ssrc)
+
+	// Track the newest packet; reordered ones keep their mapping
+	if diff := seq - s.lastSeq; diff != 0 && diff < 0x8000 {
+		s.lastSeq = seq
+		s.lastTS = ts
+		s.lastArrival = p.Arrival
+	}
+	return out
+}
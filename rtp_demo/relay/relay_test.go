@@ -0,0 +1,193 @@
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1700000000, 0)
+
+type sent struct {
+	addr string
+	seq  uint16
+	ts   uint32
+	ssrc uint32
+}
+
+// newTestRelay returns a relay that records what it sends
+func newTestRelay() (*Relay, *[]sent) {
+	var out []sent
+	r := New(func(packet []byte, addr *net.UDPAddr) error {
+		out = append(out, sent{
+			addr: addr.String(),
+			seq:  binary.BigEndian.Uint16(packet[2:4]),
+			ts:   binary.BigEndian.Uint32(packet[4:8]),
+			ssrc: binary.BigEndian.Uint32(packet[8:12]),
+		})
+		return nil
+	})
+	return r, &out
+}
+
+func packet(ssrc uint32, seq uint16, ts uint32, at time.Duration, keyframe bool) Packet {
+	data := make([]byte, 20)
+	data[0] = 0x80
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[4:8], ts)
+	binary.BigEndian.PutUint32(data[8:12], ssrc)
+	return Packet{Data: data, SSRC: ssrc, Sequence: seq, Timestamp: ts, Arrival: start.Add(at), Keyframe: keyframe}
+}
+
+func addr(s string) *net.UDPAddr {
+	a, _ := net.ResolveUDPAddr("udp", s)
+	return a
+}
+
+func TestStartsAtKeyframe(t *testing.T) {
+	r, out := newTestRelay()
+	r.Add(addr("127.0.0.1:6000"))
+
+	r.Forward(packet(1, 10, 0, 0, false))
+	if len(*out) != 0 {
+		t.Fatalf("Expected nothing before a keyframe, got %d packets", len(*out))
+	}
+	if _, ok := r.TakeKeyframeRequest(start); !ok {
+		t.Error("Expected a keyframe request for the waiting subscriber")
+	}
+
+	r.Forward(packet(1, 11, 3000, 33*time.Millisecond, true))
+	r.Forward(packet(1, 12, 3000, 34*time.Millisecond, false))
+	r.Forward(packet(1, 13, 6000, 66*time.Millisecond, false))
+
+	if len(*out) != 3 {
+		t.Fatalf("Expected 3 packets from the keyframe on, got %d", len(*out))
+	}
+	p := *out
+	if p[1].seq != p[0].seq+1 || p[2].seq != p[0].seq+2 || p[2].ts-p[0].ts != 3000 || p[0].ssrc == 1 {
+		t.Errorf("Unexpected rewritten packets %+v", p)
+	}
+}
+
+func TestStartsAtKeyframeFrame(t *testing.T) {
+	r, out := newTestRelay()
+	r.Add(addr("127.0.0.1:6000"))
+
+	// A P frame, then AUD, SPS, PPS and IDR packets of one access unit:
+	// the keyframe shows from the SPS, and the AUD goes out first
+	r.Forward(packet(1, 10, 0, 0, false))
+	r.Forward(packet(1, 11, 3000, 33*time.Millisecond, false))
+	r.Forward(packet(1, 12, 3000, 33*time.Millisecond, true))
+	r.Forward(packet(1, 13, 3000, 33*time.Millisecond, true))
+	r.Forward(packet(1, 14, 3000, 34*time.Millisecond, true))
+	r.Forward(packet(1, 15, 6000, 66*time.Millisecond, false))
+
+	if len(*out) != 5 {
+		t.Fatalf("Expected 5 packets from the AUD on, got %d", len(*out))
+	}
+	p := *out
+	for i := range p[1:] {
+		if p[i+1].seq != p[0].seq+uint16(i+1) {
+			t.Errorf("Packet %d: expected sequence number %d, got %d", i+1, p[0].seq+uint16(i+1), p[i+1].seq)
+		}
+	}
+	if p[3].ts != p[0].ts || p[4].ts-p[0].ts != 3000 {
+		t.Errorf("Unexpected timestamps %+v", p)
+	}
+	if subs := r.Subscribers(); !subs[0].Active || subs[0].Packets != 5 {
+		t.Errorf("Expected an active subscriber with 5 packets, got %+v", subs[0])
+	}
+}
+
+func TestContinuousAcrossSourceSwitch(t *testing.T) {
+	r, out := newTestRelay()
+	r.Add(addr("127.0.0.1:6000"))
+
+	r.Forward(packet(1, 100, 90000, 0, true))
+	r.Forward(packet(1, 101, 93000, 33*time.Millisecond, false))
+
+	// A second sender is ignored while the first is active
+	if r.Forward(packet(2, 5000, 0, 50*time.Millisecond, true)) {
+		t.Error("Expected the second source to be ignored")
+	}
+
+	// It takes over after the first went quiet, at its next keyframe
+	r.Forward(packet(2, 5001, 3000, 2*time.Second, false))
+	r.Forward(packet(2, 5002, 6000, 2*time.Second+33*time.Millisecond, true))
+
+	if r.Source() != 2 {
+		t.Errorf("Expected source 2, got %d", r.Source())
+	}
+	p := *out
+	if len(p) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(p))
+	}
+	if p[2].seq != p[1].seq+1 {
+		t.Errorf("Expected sequence %d after the switch, got %d", p[1].seq+1, p[2].seq)
+	}
+	if gap := p[2].ts - p[1].ts; gap < 179000 || gap > 181000 {
+		t.Errorf("Expected the timestamp to advance by about 2s, got %d", gap)
+	}
+	if p[2].ssrc != p[0].ssrc {
+		t.Errorf("Expected the subscriber SSRC to stay %d, got %d", p[0].ssrc, p[2].ssrc)
+	}
+}
+
+func TestPerSubscriberRewrite(t *testing.T) {
+	r, out := newTestRelay()
+	r.Add(addr("127.0.0.1:6000"))
+	r.Add(addr("127.0.0.1:6001"))
+
+	if err := r.Add(addr("127.0.0.1:6000")); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+
+	r.Forward(packet(1, 1, 0, 0, true))
+
+	p := *out
+	if len(p) != 2 || p[0].ssrc == p[1].ssrc {
+		t.Errorf("Expected distinct SSRCs per subscriber, got %+v", p)
+	}
+
+	r.Remove(addr("127.0.0.1:6000"))
+	r.Forward(packet(1, 2, 0, time.Millisecond, false))
+	if len(*out) != 3 || (*out)[2].addr != "127.0.0.1:6001" {
+		t.Errorf("Expected only the remaining subscriber, got %+v", *out)
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	r, _ := newTestRelay()
+	srv := httptest.NewServer(Handler(r))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/subscribers", "application/json", strings.NewReader(`{"addr":"127.0.0.1:7000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	resp, _ = http.Post(srv.URL+"/subscribers?addr=127.0.0.1:7000", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate, got %d", resp.StatusCode)
+	}
+
+	if subs := r.Subscribers(); len(subs) != 1 || subs[0].Addr != "127.0.0.1:7000" {
+		t.Errorf("Unexpected subscribers %+v", subs)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/subscribers?addr=127.0.0.1:7000", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(r.Subscribers()) != 0 {
+		t.Errorf("Expected 204 and no subscribers, got %d and %+v", resp.StatusCode, r.Subscribers())
+	}
+}
@@ -0,0 +1,216 @@
+package rtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// SDES item type carrying the canonical name
+const sdesCNAME = 1
+
+// AudioConfigName is the name of the APP packets in which the demo client
+// sends the AudioSpecificConfig of an AAC stream, since there is no SDP to
+// carry it
+const AudioConfigName = "AACC"
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970
+const ntpEpochOffset = 2208988800
+
+// NTPTime converts a time to the 64-bit NTP format: seconds since 1900 in
+// the upper 32 bits and the fraction in the lower
+func NTPTime(t time.Time) uint64 {
+	nanos := uint64(t.UnixNano()) + ntpEpochOffset*uint64(time.Second)
+	seconds := nanos / uint64(time.Second)
+	fraction := (nanos % uint64(time.Second)) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// NTPToTime converts a 64-bit NTP timestamp to a time
+func NTPToTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+// SenderReport ties a sender's RTP timestamps to its wallclock and counts
+// what it sent (RFC 3550 section 6.4.1). Reception report blocks are
+// neither written nor parsed.
+type SenderReport struct {
+	SSRC        uint32
+	NTPTime     uint64 // wallclock when the report was sent, see NTPTime
+	RTPTime     uint32 // RTP timestamp of the same instant
+	PacketCount uint32
+	OctetCount  uint32 // payload bytes
+}
+
+// Marshal marshals the sender report into bytes
+func (p *SenderReport) Marshal() []byte {
+	buf := make([]byte, 28)
+	marshalHeader(buf, 0, TypeSR)
+	binary.BigEndian.PutUint32(buf[4:8], p.SSRC)
+	binary.BigEndian.PutUint64(buf[8:16], p.NTPTime)
+	binary.BigEndian.PutUint32(buf[16:20], p.RTPTime)
+	binary.BigEndian.PutUint32(buf[20:24], p.PacketCount)
+	binary.BigEndian.PutUint32(buf[24:28], p.OctetCount)
+	return buf
+}
+
+// Unmarshal unmarshals the sender report from bytes
+func (p *SenderReport) Unmarshal(data []byte) error {
+	if len(data) < 28 {
+		return errPacketTooShort
+	}
+	p.SSRC = binary.BigEndian.Uint32(data[4:8])
+	p.NTPTime = binary.BigEndian.Uint64(data[8:16])
+	p.RTPTime = binary.BigEndian.Uint32(data[16:20])
+	p.PacketCount = binary.BigEndian.Uint32(data[20:24])
+	p.OctetCount = binary.BigEndian.Uint32(data[24:28])
+	return nil
+}
+
+// SDESChunk is the canonical name of one source
+type SDESChunk struct {
+	SSRC  uint32
+	CNAME string
+}
+
+// SourceDescription names sources (RFC 3550 section 6.5). Streams from one
+// sender share a CNAME, which is how a receiver knows to synchronize them.
+// Only CNAME items are written and parsed.
+type SourceDescription struct {
+	Chunks []SDESChunk
+}
+
+// Marshal marshals the source description into bytes
+func (p *SourceDescription) Marshal() []byte {
+	buf := make([]byte, 4)
+	for _, c := range p.Chunks {
+		buf = binary.BigEndian.AppendUint32(buf, c.SSRC)
+		buf = append(buf, sdesCNAME, byte(len(c.CNAME)))
+		buf = append(buf, c.CNAME...)
+		// The item list ends with a zero byte, padded to a 32-bit boundary
+		buf = append(buf, 0)
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+	marshalHeader(buf, uint8(len(p.Chunks)), TypeSDES)
+	return buf
+}
+
+// Unmarshal unmarshals the source description from bytes
+func (p *SourceDescription) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return errPacketTooShort
+	}
+	count := int(data[0] & 0x1F)
+
+	p.Chunks = nil
+	offset := 4
+	for i := 0; i < count; i++ {
+		if offset+4 > len(data) {
+			return errPacketTooShort
+		}
+		chunk := SDESChunk{SSRC: binary.BigEndian.Uint32(data[offset:])}
+		offset += 4
+
+		// Items up to the terminating zero byte
+		for offset < len(data) && data[offset] != 0 {
+			if offset+2 > len(data) || offset+2+int(data[offset+1]) > len(data) {
+				return errPacketTooShort
+			}
+			typ, n := data[offset], int(data[offset+1])
+			if typ == sdesCNAME {
+				chunk.CNAME = string(data[offset+2 : offset+2+n])
+			}
+			offset += 2 + n
+		}
+		offset = (offset + 4) &^ 3 // past the zero byte and padding
+		p.Chunks = append(p.Chunks, chunk)
+	}
+	return nil
+}
+
+// ApplicationDefined is an APP packet (RFC 3550 section 6.7)
+type ApplicationDefined struct {
+	SubType uint8
+	SSRC    uint32
+	Name    string // four ASCII characters
+	Data    []byte // padded to a multiple of four bytes
+}
+
+// Marshal marshals the APP packet into bytes
+func (p *ApplicationDefined) Marshal() []byte {
+	buf := make([]byte, 12, 12+len(p.Data)+3)
+	binary.BigEndian.PutUint32(buf[4:8], p.SSRC)
+	copy(buf[8:12], p.Name)
+	buf = append(buf, p.Data...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	marshalHeader(buf, p.SubType, TypeAPP)
+	return buf
+}
+
+// Unmarshal unmarshals the APP packet from bytes
+func (p *ApplicationDefined) Unmarshal(data []byte) error {
+	if len(data) < 12 {
+		return errPacketTooShort
+	}
+	if data[0]&0x20 != 0 {
+		return errors.New("rtcp: padded APP packets are not supported")
+	}
+	p.SubType = data[0] & 0x1F
+	p.SSRC = binary.BigEndian.Uint32(data[4:8])
+	p.Name = string(data[8:12])
+	p.Data = append([]byte(nil), data[12:]...)
+	return nil
+}
+
+// Goodbye is a BYE packet (RFC 3550 section 6.6), sent by a participant
+// leaving the session
+type Goodbye struct {
+	SSRCs  []uint32
+	Reason string // optional, at most 255 bytes
+}
+
+// Marshal marshals the BYE packet into bytes
+func (p *Goodbye) Marshal() []byte {
+	buf := make([]byte, 4+4*len(p.SSRCs), 4+4*len(p.SSRCs)+len(p.Reason)+4)
+	for i, ssrc := range p.SSRCs {
+		binary.BigEndian.PutUint32(buf[4+4*i:], ssrc)
+	}
+	if reason := p.Reason; reason != "" {
+		if len(reason) > 255 {
+			reason = reason[:255]
+		}
+		buf = append(buf, byte(len(reason)))
+		buf = append(buf, reason...)
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+	marshalHeader(buf, uint8(len(p.SSRCs)), TypeBYE)
+	return buf
+}
+
+// Unmarshal unmarshals the BYE packet from bytes
+func (p *Goodbye) Unmarshal(data []byte) error {
+	count := int(data[0] & 0x1F)
+	if len(data) < 4+4*count {
+		return errPacketTooShort
+	}
+	p.SSRCs = make([]uint32, count)
+	for i := range p.SSRCs {
+		p.SSRCs[i] = binary.BigEndian.Uint32(data[4+4*i:])
+	}
+	p.Reason = ""
+	if rest := data[4+4*count:]; len(rest) > 0 {
+		if int(rest[0]) >= len(rest) {
+			return errPacketTooShort
+		}
+		p.Reason = string(rest[1 : 1+rest[0]])
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Package rtcp implements marshalling and parsing of the RTCP packets used by
+// the RTP demo (RFC 3550, RFC 4585, RFC 5104 and transport-wide congestion
+// control feedback).
+package rtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// RTCP packet types
+const (
+	TypeSR    = 200 // Sender report
+	TypeRR    = 201 // Receiver report
+	TypeSDES  = 202 // Source description
+	TypeBYE   = 203 // Goodbye
+	TypeAPP   = 204 // Application-defined
+	TypeRTPFB = 205 // Transport layer feedback (RFC 4585)
+	TypePSFB  = 206 // Payload-specific feedback (RFC 4585)
+)
+
+// Feedback message types (FMT field)
+const (
+	FormatPLI = 1 // Picture Loss Indication (PSFB)
+	FormatFIR = 4 // Full Intra Request (PSFB, RFC 5104)
+)
+
+var errPacketTooShort = errors.New("rtcp: packet too short")
+
+// Header is the common RTCP header
+type Header struct {
+	Padding bool   // 1 bit
+	Count   uint8  // 5 bits: report count or feedback message type
+	Type    uint8  // 8 bits
+	Length  uint16 // 16 bits: length in 32-bit words minus one
+}
+
+// Packet is an RTCP packet that can be serialized
+type Packet interface {
+	Marshal() []byte
+}
+
+// IsRTCP reports whether a datagram received on a multiplexed RTP/RTCP port
+// is an RTCP packet (RFC 5761 section 4)
+func IsRTCP(data []byte) bool {
+	return len(data) >= 8 && data[1] >= 192 && data[1] <= 223
+}
+
+// Unmarshal unmarshals the common header from bytes
+func (h *Header) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return errPacketTooShort
+	}
+
+	if version := data[0] >> 6; version != 2 {
+		return fmt.Errorf("rtcp: unsupported version %d", version)
+	}
+
+	h.Padding = (data[0] >> 5 & 0x01) == 1
+	h.Count = data[0] & 0x1F
+	h.Type = data[1]
+	h.Length = binary.BigEndian.Uint16(data[2:4])
+	return nil
+}
+
+// marshalHeader writes the common header for a packet of the given total size
+func marshalHeader(buf []byte, count, typ uint8) {
+	buf[0] = 2<<6 | count&0x1F
+	buf[1] = typ
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)/4-1))
+}
+
+// Unmarshal parses a compound RTCP packet. Packet types that are not
+// understood are returned as *RawPacket.
+func Unmarshal(data []byte) ([]Packet, error) {
+	var packets []Packet
+
+	for len(data) > 0 {
+		var h Header
+		if err := h.Unmarshal(data); err != nil {
+			return packets, err
+		}
+
+		size := (int(h.Length) + 1) * 4
+		if size > len(data) {
+			return packets, errPacketTooShort
+		}
+
+		p, err := unmarshalPacket(&h, data[:size])
+		if err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, p)
+		data = data[size:]
+	}
+
+	return packets, nil
+}
+
+func unmarshalPacket(h *Header, data []byte) (Packet, error) {
+	switch {
+	case h.Type == TypePSFB && h.Count == FormatPLI:
+		p := &PictureLossIndication{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypePSFB && h.Count == FormatFIR:
+		p := &FullIntraRequest{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypeRTPFB && h.Count == FormatTWCC:
+		p := &TransportCC{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypeSR:
+		p := &SenderReport{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypeSDES:
+		p := &SourceDescription{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypeAPP:
+		p := &ApplicationDefined{}
+		return p, p.Unmarshal(data)
+	case h.Type == TypeBYE:
+		p := &Goodbye{}
+		return p, p.Unmarshal(data)
+	default:
+		p := RawPacket(append([]byte(nil), data...))
+		return &p, nil
+	}
+}
+
+// RawPacket is an RTCP packet of a type this package does not parse
+type RawPacket []byte
+
+// Marshal returns the packet bytes
+func (p *RawPacket) Marshal() []byte {
+	return *p
+}
+
+// Header returns the common header of the packet
+func (p *RawPacket) Header() Header {
+	var h Header
+	h.Unmarshal(*p)
+	return h
+}
+
+// PictureLossIndication asks the media sender for a new keyframe because the
+// receiver lost data it cannot conceal (RFC 4585 section 6.3.1)
+type PictureLossIndication struct {
+	SenderSSRC uint32
+	MediaSSRC  uint32
+}
+
+// Marshal marshals the PLI into bytes
+func (p *PictureLossIndication) Marshal() []byte {
+	buf := make([]byte, 12)
+	marshalHeader(buf, FormatPLI, TypePSFB)
+	binary.BigEndian.PutUint32(buf[4:8], p.SenderSSRC)
+	binary.BigEndian.PutUint32(buf[8:12], p.MediaSSRC)
+	return buf
+}
+
+// Unmarshal unmarshals the PLI from bytes
+func (p *PictureLossIndication) Unmarshal(data []byte) error {
+	if len(data) < 12 {
+		return errPacketTooShort
+	}
+	p.SenderSSRC = binary.BigEndian.Uint32(data[4:8])
+	p.MediaSSRC = binary.BigEndian.Uint32(data[8:12])
+	return nil
+}
+
+// FIREntry is one FCI entry of a Full Intra Request
+type FIREntry struct {
+	SSRC           uint32
+	SequenceNumber uint8 // incremented for each new request
+}
+
+// FullIntraRequest forces the media sender to send a decoder refresh point
+// (RFC 5104 section 4.3.1)
+type FullIntraRequest struct {
+	SenderSSRC uint32
+	Entries    []FIREntry
+}
+
+// Marshal marshals the FIR into bytes
+func (p *FullIntraRequest) Marshal() []byte {
+	buf := make([]byte, 12+8*len(p.Entries))
+	marshalHeader(buf, FormatFIR, TypePSFB)
+	binary.BigEndian.PutUint32(buf[4:8], p.SenderSSRC)
+	// media source SSRC is unused for FIR and must be zero
+
+	for i, e := range p.Entries {
+		offset := 12 + 8*i
+		binary.BigEndian.PutUint32(buf[offset:], e.SSRC)
+		buf[offset+4] = e.SequenceNumber
+	}
+	return buf
+}
+
+// Unmarshal unmarshals the FIR from bytes
+func (p *FullIntraRequest) Unmarshal(data []byte) error {
+	if len(data) < 12 {
+		return errPacketTooShort
+	}
+	p.SenderSSRC = binary.BigEndian.Uint32(data[4:8])
+
+	p.Entries = nil
+	for offset := 12; offset+8 <= len(data); offset += 8 {
+		p.Entries = append(p.Entries, FIREntry{
+			SSRC:           binary.BigEndian.Uint32(data[offset:]),
+			SequenceNumber: data[offset+4],
+		})
+	}
+	return nil
+}
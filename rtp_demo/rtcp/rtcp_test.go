@@ -0,0 +1,141 @@
+package rtcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFeedbackRoundTrip(t *testing.T) {
+	pli := &PictureLossIndication{SenderSSRC: 1, MediaSSRC: 2}
+	fir := &FullIntraRequest{SenderSSRC: 1, Entries: []FIREntry{{SSRC: 2, SequenceNumber: 7}}}
+
+	data := append(pli.Marshal(), fir.Marshal()...)
+	if !IsRTCP(data) {
+		t.Fatal("Expected feedback to be recognized as RTCP")
+	}
+
+	packets, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(packets))
+	}
+
+	if got, ok := packets[0].(*PictureLossIndication); !ok || *got != *pli {
+		t.Errorf("Expected %+v, got %+v", pli, packets[0])
+	}
+
+	got, ok := packets[1].(*FullIntraRequest)
+	if !ok || got.SenderSSRC != 1 || len(got.Entries) != 1 || got.Entries[0] != fir.Entries[0] {
+		t.Errorf("Expected %+v, got %+v", fir, packets[1])
+	}
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC)
+	sr := &SenderReport{SSRC: 1, NTPTime: NTPTime(now), RTPTime: 90000, PacketCount: 10, OctetCount: 12000}
+	sdes := &SourceDescription{Chunks: []SDESChunk{{SSRC: 1, CNAME: "a@host"}, {SSRC: 2, CNAME: "a@host"}}}
+	app := &ApplicationDefined{SubType: 0, SSRC: 2, Name: AudioConfigName, Data: []byte{0x11, 0x90}}
+
+	var data []byte
+	for _, p := range []Packet{sr, sdes, app} {
+		data = append(data, p.Marshal()...)
+	}
+	packets, err := Unmarshal(data)
+	if err != nil || len(packets) != 3 {
+		t.Fatalf("Expected 3 packets, got %d (%v)", len(packets), err)
+	}
+
+	if got, ok := packets[0].(*SenderReport); !ok || *got != *sr {
+		t.Errorf("Expected %+v, got %+v", sr, packets[0])
+	}
+	if got, ok := packets[1].(*SourceDescription); !ok || !reflect.DeepEqual(got, sdes) {
+		t.Errorf("Expected %+v, got %+v", sdes, packets[1])
+	}
+	if got, ok := packets[2].(*ApplicationDefined); !ok || got.Name != AudioConfigName || got.SSRC != 2 ||
+		len(got.Data) != 4 || got.Data[0] != 0x11 || got.Data[1] != 0x90 {
+		t.Errorf("Expected %+v, got %+v", app, packets[2])
+	}
+
+	for _, bye := range []*Goodbye{{SSRCs: []uint32{1, 2}, Reason: "end of file"}, {SSRCs: []uint32{3}}} {
+		packets, err := Unmarshal(bye.Marshal())
+		if err != nil || len(packets) != 1 {
+			t.Fatalf("Expected 1 packet, got %d (%v)", len(packets), err)
+		}
+		if got, ok := packets[0].(*Goodbye); !ok || !reflect.DeepEqual(got, bye) {
+			t.Errorf("Expected %+v, got %+v", bye, packets[0])
+		}
+	}
+
+	if back := NTPToTime(sr.NTPTime); back.Sub(now).Abs() > time.Microsecond {
+		t.Errorf("Expected NTP time to convert back to %v, got %v", now, back)
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	data := (&PictureLossIndication{}).Marshal()
+	if _, err := Unmarshal(data[:8]); err == nil {
+		t.Error("Expected error for truncated packet")
+	}
+}
+
+func TestTransportCCRoundTrip(t *testing.T) {
+	fb := &TransportCC{
+		SenderSSRC:    1,
+		MediaSSRC:     2,
+		BaseSequence:  65534, // wraps within the report
+		ReferenceTime: 128 * time.Millisecond,
+		FeedbackCount: 3,
+		Packets: []TWCCPacket{
+			{Received: true, Delta: 500 * time.Microsecond},
+			{Received: false},
+			{Received: true, Delta: 100 * time.Millisecond}, // needs a 2-byte delta
+			{Received: true, Delta: -250 * time.Microsecond},
+			{Received: true},
+			{Received: false},
+			{Received: false},
+			{Received: true, Delta: 1 * time.Millisecond},
+		},
+	}
+
+	packets, err := Unmarshal(fb.Marshal())
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	got, ok := packets[0].(*TransportCC)
+	if !ok {
+		t.Fatalf("Expected *TransportCC, got %T", packets[0])
+	}
+	if !reflect.DeepEqual(got, fb) {
+		t.Errorf("Expected %+v, got %+v", fb, got)
+	}
+
+	arrivals := got.ArrivalTimes()
+	if len(arrivals) != 5 || arrivals[1] != 228250*time.Microsecond {
+		t.Errorf("Unexpected arrival times %v", arrivals)
+	}
+}
+
+func TestTransportCCRunLength(t *testing.T) {
+	// Hand-built feedback: run length chunk of 3 small deltas, then 1 lost
+	data := []byte{
+		0x8F, 205, 0, 5, // header, 6 words
+		0, 0, 0, 1, 0, 0, 0, 2,
+		0, 10, 0, 4, // base 10, count 4
+		0, 0, 1, 0, // reference 64ms, fb count 0
+		0x20, 0x03, // run length: symbol 1, length 3
+		0x00, 0x01, // run length: symbol 0, length 1
+		4, 4, 4, 0, // deltas and padding
+	}
+
+	var fb TransportCC
+	if err := fb.Unmarshal(data); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(fb.Packets) != 4 || !fb.Packets[2].Received || fb.Packets[3].Received || fb.Packets[0].Delta != time.Millisecond {
+		t.Errorf("Unexpected packets %+v", fb.Packets)
+	}
+}
@@ -0,0 +1,258 @@
+package rtcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// FormatTWCC is the RTPFB message type of transport-wide congestion control
+// feedback (draft-holmer-rmcat-transport-wide-cc-extensions-01)
+const FormatTWCC = 15
+
+// Packet status symbols
+const (
+	twccNotReceived = 0
+	twccSmallDelta  = 1 // 1-byte receive delta
+	twccLargeDelta  = 2 // 2-byte signed receive delta
+)
+
+// twccDeltaUnit is the resolution of receive deltas
+const twccDeltaUnit = 250 * time.Microsecond
+
+// twccReferenceUnit is the resolution of the reference time
+const twccReferenceUnit = 64 * time.Millisecond
+
+// TWCCPacket is the receive status of one transport-wide sequence number
+type TWCCPacket struct {
+	Received bool
+	// Delta is the arrival time relative to the previous received packet,
+	// or to the reference time for the first one, in 250µs steps
+	Delta time.Duration
+}
+
+// TransportCC reports the arrival times of a range of packets identified by
+// their transport-wide sequence numbers
+type TransportCC struct {
+	SenderSSRC    uint32
+	MediaSSRC     uint32
+	BaseSequence  uint16
+	ReferenceTime time.Duration // multiple of 64ms, 24-bit on the wire
+	FeedbackCount uint8
+	Packets       []TWCCPacket // one entry per sequence number from BaseSequence
+}
+
+// ArrivalTimes returns the arrival time of every received packet relative to
+// the receiver's clock epoch, keyed by sequence number
+func (p *TransportCC) ArrivalTimes() map[uint16]time.Duration {
+	times := make(map[uint16]time.Duration)
+	t := p.ReferenceTime
+	for i, pkt := range p.Packets {
+		if !pkt.Received {
+			continue
+		}
+		t += pkt.Delta
+		times[p.BaseSequence+uint16(i)] = t
+	}
+	return times
+}
+
+// Marshal marshals the feedback into bytes. Statuses are written as 2-bit
+// status vector chunks, which can describe any mix of symbols.
+func (p *TransportCC) Marshal() []byte {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint32(buf[4:8], p.SenderSSRC)
+	binary.BigEndian.PutUint32(buf[8:12], p.MediaSSRC)
+	binary.BigEndian.PutUint16(buf[12:14], p.BaseSequence)
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(p.Packets)))
+
+	ref := uint32(p.ReferenceTime/twccReferenceUnit) & 0xFFFFFF
+	binary.BigEndian.PutUint32(buf[16:20], ref<<8|uint32(p.FeedbackCount))
+
+	symbols := make([]uint8, len(p.Packets))
+	var deltas []byte
+	for i, pkt := range p.Packets {
+		if !pkt.Received {
+			continue
+		}
+
+		d := int64(pkt.Delta / twccDeltaUnit)
+		if d >= 0 && d <= 0xFF {
+			symbols[i] = twccSmallDelta
+			deltas = append(deltas, byte(d))
+			continue
+		}
+
+		if d > 0x7FFF {
+			d = 0x7FFF
+		} else if d < -0x8000 {
+			d = -0x8000
+		}
+		symbols[i] = twccLargeDelta
+		deltas = append(deltas, byte(d>>8), byte(d))
+	}
+
+	// Status vector chunk: T=1, S=1 (2-bit symbols), 7 symbols per chunk
+	for i := 0; i < len(symbols); i += 7 {
+		chunk := uint16(0xC000)
+		for j := 0; j < 7 && i+j < len(symbols); j++ {
+			chunk |= uint16(symbols[i+j]) << (12 - 2*j)
+		}
+		buf = append(buf, byte(chunk>>8), byte(chunk))
+	}
+
+	buf = append(buf, deltas...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+
+	marshalHeader(buf, FormatTWCC, TypeRTPFB)
+	return buf
+}
+
+// Unmarshal unmarshals the feedback from bytes, accepting run length and
+// both status vector chunk types
+func (p *TransportCC) Unmarshal(data []byte) error {
+	if len(data) < 20 {
+		return errPacketTooShort
+	}
+
+	p.SenderSSRC = binary.BigEndian.Uint32(data[4:8])
+	p.MediaSSRC = binary.BigEndian.Uint32(data[8:12])
+	p.BaseSequence = binary.BigEndian.Uint16(data[12:14])
+	count := int(binary.BigEndian.Uint16(data[14:16]))
+
+	word := binary.BigEndian.Uint32(data[16:20])
+	ref := int32(word) >> 8 // sign-extends the 24-bit reference time
+	p.ReferenceTime = time.Duration(ref) * twccReferenceUnit
+	p.FeedbackCount = uint8(word)
+
+	symbols := make([]uint8, 0, count)
+	offset := 20
+	for len(symbols) < count {
+		if offset+2 > len(data) {
+			return errPacketTooShort
+		}
+		chunk := binary.BigEndian.Uint16(data[offset:])
+		offset += 2
+
+		switch {
+		case chunk&0x8000 == 0: // run length chunk
+			symbol := uint8(chunk >> 13 & 0x03)
+			for n := int(chunk & 0x1FFF); n > 0 && len(symbols) < count; n-- {
+				symbols = append(symbols, symbol)
+			}
+		case chunk&0x4000 == 0: // status vector, 14 1-bit symbols
+			for j := 0; j < 14 && len(symbols) < count; j++ {
+				symbols = append(symbols, uint8(chunk>>(13-j)&0x01))
+			}
+		default: // status vector, 7 2-bit symbols
+			for j := 0; j < 7 && len(symbols) < count; j++ {
+				symbols = append(symbols, uint8(chunk>>(12-2*j)&0x03))
+			}
+		}
+	}
+
+	p.Packets = make([]TWCCPacket, count)
+	for i, symbol := range symbols {
+		switch symbol {
+		case twccSmallDelta:
+			if offset+1 > len(data) {
+				return errPacketTooShort
+			}
+			p.Packets[i] = TWCCPacket{Received: true, Delta: time.Duration(data[offset]) * twccDeltaUnit}
+			offset++
+		case twccLargeDelta:
+			if offset+2 > len(data) {
+				return errPacketTooShort
+			}
+			d := int16(binary.BigEndian.Uint16(data[offset:]))
+			p.Packets[i] = TWCCPacket{Received: true, Delta: time.Duration(d) * twccDeltaUnit}
+			offset += 2
+		case twccNotReceived:
+		default:
+			return fmt.Errorf("rtcp: invalid transport-cc status symbol %d", symbol)
+		}
+	}
+
+	return nil
+}
+
+// TWCCRecorder collects packet arrivals on the receiver and turns them into
+// transport-cc feedback
+type TWCCRecorder struct {
+	arrivals map[uint16]time.Duration
+	nextBase uint16 // first sequence number of the next report
+	maxSeq   uint16
+	started  bool
+	fbCount  uint8
+}
+
+// NewTWCCRecorder creates an empty recorder
+func NewTWCCRecorder() *TWCCRecorder {
+	return &TWCCRecorder{arrivals: make(map[uint16]time.Duration)}
+}
+
+// Record stores the arrival time of a packet, relative to a fixed epoch of
+// the receiver's clock
+func (r *TWCCRecorder) Record(seq uint16, arrival time.Duration) {
+	if !r.started {
+		r.started = true
+		r.nextBase = seq
+		r.maxSeq = seq
+	}
+
+	// Ignore packets older than what was already reported
+	if seq-r.nextBase >= 0x8000 {
+		return
+	}
+	if seq-r.maxSeq < 0x8000 {
+		r.maxSeq = seq
+	}
+	r.arrivals[seq] = arrival
+}
+
+// BuildFeedback returns a report covering every sequence number since the
+// previous report, or nil if no packet arrived in between
+func (r *TWCCRecorder) BuildFeedback(senderSSRC, mediaSSRC uint32) *TransportCC {
+	if len(r.arrivals) == 0 {
+		return nil
+	}
+
+	fb := &TransportCC{
+		SenderSSRC:    senderSSRC,
+		MediaSSRC:     mediaSSRC,
+		BaseSequence:  r.nextBase,
+		FeedbackCount: r.fbCount,
+	}
+	r.fbCount++
+
+	count := int(r.maxSeq-r.nextBase) + 1
+	fb.Packets = make([]TWCCPacket, count)
+
+	// Deltas are relative to the quantized previous time so rounding errors
+	// do not accumulate on the sender
+	var last time.Duration
+	first := true
+	for i := 0; i < count; i++ {
+		seq := r.nextBase + uint16(i)
+		arrival, ok := r.arrivals[seq]
+		if !ok {
+			continue
+		}
+
+		if first {
+			first = false
+			fb.ReferenceTime = arrival / twccReferenceUnit * twccReferenceUnit
+			last = fb.ReferenceTime
+		}
+
+		delta := (arrival - last) / twccDeltaUnit * twccDeltaUnit
+		fb.Packets[i] = TWCCPacket{Received: true, Delta: delta}
+		last += delta
+		delete(r.arrivals, seq)
+	}
+
+	r.nextBase = r.maxSeq + 1
+	return fb
+}
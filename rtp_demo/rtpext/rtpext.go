@@ -0,0 +1,139 @@
+// Package rtpext encodes and decodes RTP header extensions using the
+// one-byte header format of RFC 8285.
+package rtpext
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProfileOneByte is the "defined by profile" value of one-byte extensions
+const ProfileOneByte = 0xBEDE
+
+// Extension IDs used by the demo. Without SDP negotiation both sides agree
+// on these statically.
+const (
+	TransportCCID = 1 // transport-wide sequence number (draft-holmer-rmcat-transport-wide-cc-extensions)
+	AbsSendTimeID = 2 // 24-bit send time (http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time)
+	NTP64ID       = 3 // 64-bit NTP timestamp (RFC 6051 urn:ietf:params:rtp-hdrext:ntp-64)
+)
+
+// Element is one extension element
+type Element struct {
+	ID   uint8 // 1-14
+	Data []byte
+}
+
+// Marshal encodes elements into an extension block, without the 4-byte
+// profile/length header, padded to a multiple of 4 bytes
+func Marshal(elements []Element) []byte {
+	var buf []byte
+	for _, e := range elements {
+		buf = append(buf, e.ID<<4|uint8(len(e.Data)-1)&0x0F)
+		buf = append(buf, e.Data...)
+	}
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// Parse decodes a one-byte extension block. Other profiles return no elements.
+func Parse(profile uint16, data []byte) ([]Element, error) {
+	if profile != ProfileOneByte {
+		return nil, nil
+	}
+
+	var elements []Element
+	for offset := 0; offset < len(data); {
+		b := data[offset]
+		offset++
+
+		if b == 0 { // padding
+			continue
+		}
+
+		id, size := b>>4, int(b&0x0F)+1
+		if id == 15 { // reserved, stop parsing
+			break
+		}
+		if offset+size > len(data) {
+			return elements, fmt.Errorf("rtpext: element %d truncated", id)
+		}
+
+		elements = append(elements, Element{ID: id, Data: data[offset : offset+size]})
+		offset += size
+	}
+
+	return elements, nil
+}
+
+// Find returns the data of the element with the given ID
+func Find(elements []Element, id uint8) ([]byte, bool) {
+	for _, e := range elements {
+		if e.ID == id {
+			return e.Data, true
+		}
+	}
+	return nil, false
+}
+
+// TransportSequence encodes a transport-wide sequence number element
+func TransportSequence(seq uint16) Element {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, seq)
+	return Element{ID: TransportCCID, Data: data}
+}
+
+// ParseTransportSequence decodes a transport-wide sequence number element
+func ParseTransportSequence(data []byte) (uint16, bool) {
+	if len(data) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data), true
+}
+
+// AbsSendTime encodes the abs-send-time element of a 64-bit NTP timestamp:
+// 6.18 fixed point seconds, the bits from 6 bits of seconds down to 18 of
+// the fraction, wrapping every 64 seconds
+func AbsSendTime(ntp uint64) Element {
+	v := ntp >> 14
+	return Element{ID: AbsSendTimeID, Data: []byte{byte(v >> 16), byte(v >> 8), byte(v)}}
+}
+
+// ParseAbsSendTime decodes an abs-send-time element
+func ParseAbsSendTime(data []byte) (uint32, bool) {
+	if len(data) != 3 {
+		return 0, false
+	}
+	return uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]), true
+}
+
+// ExpandAbsSendTime returns the 64-bit NTP timestamp closest to reference,
+// e.g. the arrival time, whose abs-send-time is v. The result is only as
+// meaningful as the agreement between the two clocks.
+func ExpandAbsSendTime(v uint32, reference uint64) uint64 {
+	const period = 1 << 38 // 64 seconds in NTP units
+	t := reference&^(period-1) | uint64(v&0xFFFFFF)<<14
+	if t > reference+period/2 {
+		t -= period
+	} else if t+period/2 < reference {
+		t += period
+	}
+	return t
+}
+
+// NTP64 encodes an NTP-64 element
+func NTP64(ntp uint64) Element {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, ntp)
+	return Element{ID: NTP64ID, Data: data}
+}
+
+// ParseNTP64 decodes an NTP-64 element
+func ParseNTP64(data []byte) (uint64, bool) {
+	if len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
@@ -0,0 +1,54 @@
+package rtpext
+
+import "testing"
+
+func TestMarshalParse(t *testing.T) {
+	ntp := uint64(0x0123456789ABCDEF)
+	data := Marshal([]Element{TransportSequence(513), AbsSendTime(ntp), NTP64(ntp)})
+	if len(data)%4 != 0 {
+		t.Fatalf("Expected padding to 4 bytes, got %d bytes", len(data))
+	}
+
+	elements, err := Parse(ProfileOneByte, data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(elements) != 3 {
+		t.Fatalf("Expected 3 elements, got %d", len(elements))
+	}
+
+	raw, _ := Find(elements, TransportCCID)
+	if seq, ok := ParseTransportSequence(raw); !ok || seq != 513 {
+		t.Errorf("Expected sequence 513, got %d", seq)
+	}
+	raw, _ = Find(elements, AbsSendTimeID)
+	if v, ok := ParseAbsSendTime(raw); !ok || v != uint32(ntp>>14)&0xFFFFFF {
+		t.Errorf("Expected abs-send-time %#x, got %#x", uint32(ntp>>14)&0xFFFFFF, v)
+	}
+	raw, _ = Find(elements, NTP64ID)
+	if v, ok := ParseNTP64(raw); !ok || v != ntp {
+		t.Errorf("Expected NTP time %#x, got %#x", ntp, v)
+	}
+}
+
+func TestExpandAbsSendTime(t *testing.T) {
+	const second = uint64(1) << 32
+
+	tests := []struct {
+		sent, arrival uint64
+	}{
+		{1000*second + second/3, 1000*second + second/2},
+		// Sent just before a 64-second wrap, arriving after it
+		{1023*second + second*9/10, 1024*second + second/10},
+		// Arriving before the send time, as with a clock behind the sender's
+		{1024*second + second/10, 1023*second + second*9/10},
+	}
+	for _, tt := range tests {
+		v, _ := ParseAbsSendTime(AbsSendTime(tt.sent).Data)
+		got := ExpandAbsSendTime(v, tt.arrival)
+		// Only 18 bits of the fraction survive
+		if diff := int64(got - tt.sent); diff > 0 || diff < -(1<<14) {
+			t.Errorf("Expected about %#x, got %#x", tt.sent, got)
+		}
+	}
+}
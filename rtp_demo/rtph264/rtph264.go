@@ -0,0 +1,308 @@
+// Package rtph264 carries H.264 NAL units in RTP payloads (RFC 6184,
+// non-interleaved mode): single NAL unit packets, STAP-A aggregation and FU-A
+// fragmentation, and the keyframe requests a receiver sends when it loses
+// part of a frame.
+package rtph264
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Payload types of RFC 6184 section 5.2, in the NAL unit type field
+const (
+	TypeSTAPA = 24
+	TypeFUA   = 28
+)
+
+// Packetize turns NAL units into RTP payloads of at most mtu bytes: small
+// NAL units are aggregated into STAP-A packets, large ones are split into
+// FU-A fragments
+func Packetize(nalus [][]byte, mtu int) [][]byte {
+	var payloads [][]byte
+	var stap [][]byte
+	stapSize := 1
+
+	flushSTAP := func() {
+		switch len(stap) {
+		case 0:
+		case 1:
+			payloads = append(payloads, stap[0])
+		default:
+			// STAP-A header carries the highest NRI of the aggregated units
+			var nri byte
+			for _, nalu := range stap {
+				if nalu[0]&0x60 > nri {
+					nri = nalu[0] & 0x60
+				}
+			}
+			payload := []byte{nri | TypeSTAPA}
+			for _, nalu := range stap {
+				payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+				payload = append(payload, nalu...)
+			}
+			payloads = append(payloads, payload)
+		}
+		stap = stap[:0]
+		stapSize = 1
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		if len(nalu) <= mtu {
+			if stapSize+2+len(nalu) > mtu {
+				flushSTAP()
+			}
+			stap = append(stap, nalu)
+			stapSize += 2 + len(nalu)
+			continue
+		}
+
+		flushSTAP()
+
+		// FU indicator keeps F and NRI, FU header carries S/E and the type
+		indicator := nalu[0]&0xE0 | TypeFUA
+		nalType := nalu[0] & 0x1F
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			n := mtu - 2
+			if n > len(data) {
+				n = len(data)
+			}
+
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			if n == len(data) {
+				header |= 0x40
+			}
+
+			payload := make([]byte, 0, 2+n)
+			payload = append(payload, indicator, header)
+			payload = append(payload, data[:n]...)
+			payloads = append(payloads, payload)
+			data = data[n:]
+		}
+	}
+	flushSTAP()
+
+	return payloads
+}
+
+// Reasons a fragmented NAL unit is lost
+const (
+	StartMissing = "FU-A start fragment missing"
+	EndMissing   = "FU-A end fragment missing"
+)
+
+// ReassemblyError is a fragmented NAL unit that could not be put together
+type ReassemblyError struct {
+	Reason  string // StartMissing or EndMissing
+	NALType uint8  // of the lost NAL unit, known when its start arrived
+}
+
+func (e *ReassemblyError) Error() string {
+	return "rtph264: " + e.Reason
+}
+
+// NRIError is an FU-A fragment whose NRI differs from the start fragment's.
+// The fragment is still used.
+type NRIError struct {
+	Fragment, Start uint8
+}
+
+func (e *NRIError) Error() string {
+	return fmt.Sprintf("rtph264: FU-A fragment NRI %d, start fragment %d", e.Fragment, e.Start)
+}
+
+// Depacketizer turns RTP payloads back into NAL units. Payloads must be
+// pushed in sequence order, with Reset called where packets were lost.
+type Depacketizer struct {
+	// OnStart is called when a NAL unit begins, with as much of it as has
+	// arrived: all of it, or the start fragment with the NAL header
+	// restored, which holds the slice header
+	OnStart func(head []byte)
+
+	// OnNALU is called with each complete NAL unit. The slice is reused
+	// once it returns.
+	OnNALU func(nalu []byte)
+
+	// OnError is called with each problem of the stream: a
+	// *ReassemblyError for a lost NAL unit, an *NRIError, or an error for
+	// a truncated STAP-A
+	OnError func(err error)
+
+	fragmenting bool
+	buffer      []byte
+}
+
+// Push depacketizes one RTP payload
+func (d *Depacketizer) Push(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	if payload[0]&0x1F == TypeFUA {
+		d.pushFUA(payload)
+		return
+	}
+
+	// Any other packet means an unfinished FU-A lost its end fragment
+	if d.fragmenting {
+		d.fail(EndMissing)
+	}
+
+	if payload[0]&0x1F == TypeSTAPA {
+		d.pushSTAPA(payload)
+		return
+	}
+	d.nalu(payload)
+}
+
+// Fragmenting reports whether a fragmented NAL unit is incomplete
+func (d *Depacketizer) Fragmenting() bool {
+	return d.fragmenting
+}
+
+// Reset discards any partial NAL unit, after a loss
+func (d *Depacketizer) Reset() {
+	d.fragmenting = false
+	d.buffer = d.buffer[:0]
+}
+
+// nalu hands on a NAL unit that arrived whole
+func (d *Depacketizer) nalu(nalu []byte) {
+	if d.OnStart != nil {
+		d.OnStart(nalu)
+	}
+	if d.OnNALU != nil {
+		d.OnNALU(nalu)
+	}
+}
+
+func (d *Depacketizer) pushSTAPA(payload []byte) {
+	data := payload[1:]
+	for len(data) > 0 {
+		if len(data) < 2 {
+			d.error(fmt.Errorf("rtph264: truncated STAP-A length field at offset %d", len(payload)-len(data)))
+			return
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if size > len(data) {
+			d.error(fmt.Errorf("rtph264: truncated STAP-A NAL unit of %d bytes, %d left", size, len(data)))
+			return
+		}
+		if size > 0 {
+			d.nalu(data[:size])
+		}
+		data = data[size:]
+	}
+}
+
+func (d *Depacketizer) pushFUA(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+
+	// The NAL header is F and NRI of the FU indicator with the type of the
+	// FU header
+	indicator, header := payload[0], payload[1]
+	nalHeader := indicator&0xE0 | header&0x1F
+
+	switch {
+	case header&0x80 != 0:
+		if d.fragmenting {
+			d.fail(EndMissing)
+		}
+		d.fragmenting = true
+		d.buffer = append(d.buffer[:0], nalHeader)
+		if d.OnStart != nil {
+			d.OnStart(append([]byte{nalHeader}, payload[2:]...))
+		}
+	case !d.fragmenting:
+		// The start fragment was lost; the rest of this NAL unit is useless
+		d.error(&ReassemblyError{Reason: StartMissing})
+		return
+	case indicator&0x60 != d.buffer[0]&0x60:
+		d.error(&NRIError{Fragment: indicator >> 5 & 0x03, Start: d.buffer[0] >> 5 & 0x03})
+	}
+
+	d.buffer = append(d.buffer, payload[2:]...)
+	if header&0x40 != 0 {
+		d.fragmenting = false
+		if d.OnNALU != nil {
+			d.OnNALU(d.buffer)
+		}
+	}
+}
+
+// fail abandons the partial NAL unit
+func (d *Depacketizer) fail(reason string) {
+	err := &ReassemblyError{Reason: reason, NALType: d.buffer[0] & 0x1F}
+	d.Reset()
+	d.error(err)
+}
+
+func (d *Depacketizer) error(err error) {
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// KeyframeRequester decides when a receiver asks for a keyframe after it
+// lost part of a frame: a PLI straight away (RFC 4585), then a FIR (RFC
+// 5104) each Interval while the keyframe is overdue
+type KeyframeRequester struct {
+	Interval time.Duration
+
+	waiting bool
+	last    time.Time // of the latest request
+	firSeq  uint8
+}
+
+// Waiting reports whether a keyframe is awaited
+func (k *KeyframeRequester) Waiting() bool {
+	return k.waiting
+}
+
+// Lost records that decoding broke at now, returning true if a PLI should
+// be sent, false if a keyframe was already requested
+func (k *KeyframeRequester) Lost(now time.Time) bool {
+	if k.waiting {
+		return false
+	}
+	k.waiting = true
+	k.last = now
+	return true
+}
+
+// Requested records a keyframe request sent for another reason at now,
+// which a FIR then waits for too
+func (k *KeyframeRequester) Requested(now time.Time) {
+	k.last = now
+}
+
+// Keyframe records that a keyframe arrived, returning true if it was
+// awaited
+func (k *KeyframeRequester) Keyframe() bool {
+	waiting := k.waiting
+	k.waiting = false
+	return waiting
+}
+
+// FIR returns the sequence number of a FIR to send at now, and false if
+// none is due
+func (k *KeyframeRequester) FIR(now time.Time) (uint8, bool) {
+	if !k.waiting || now.Sub(k.last) < k.Interval {
+		return 0, false
+	}
+	k.firSeq++
+	k.last = now
+	return k.firSeq, true
+}
@@ -0,0 +1,209 @@
+package rtph264
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// nalu returns a NAL unit of size bytes with the given header, its payload
+// counting up so truncation and reordering show
+func nalu(header byte, size int) []byte {
+	b := make([]byte, size)
+	b[0] = header
+	for i := 1; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// collector records what a depacketizer hands on
+type collector struct {
+	starts [][]byte
+	nalus  [][]byte
+	errs   []error
+}
+
+func (c *collector) depacketizer() *Depacketizer {
+	return &Depacketizer{
+		OnStart: func(head []byte) { c.starts = append(c.starts, append([]byte(nil), head...)) },
+		OnNALU:  func(n []byte) { c.nalus = append(c.nalus, append([]byte(nil), n...)) },
+		OnError: func(err error) { c.errs = append(c.errs, err) },
+	}
+}
+
+func TestPacketize(t *testing.T) {
+	sps, pps, idr := nalu(0x67, 10), nalu(0x68, 4), nalu(0x65, 2500)
+	payloads := Packetize([][]byte{sps, pps, idr}, 1200)
+
+	// SPS and PPS share a STAP-A, the IDR takes three FU-As
+	if len(payloads) != 4 {
+		t.Fatalf("Expected 4 payloads, got %d", len(payloads))
+	}
+	if payloads[0][0] != 0x60|TypeSTAPA {
+		t.Errorf("Expected a STAP-A with NRI 3, got header 0x%02X", payloads[0][0])
+	}
+	for i, p := range payloads[1:] {
+		if len(p) > 1200 {
+			t.Errorf("FU-A %d: %d bytes exceeds the MTU", i, len(p))
+		}
+		wantHeader := byte(5)
+		if i == 0 {
+			wantHeader |= 0x80
+		}
+		if i == 2 {
+			wantHeader |= 0x40
+		}
+		if p[0] != 0x60|TypeFUA || p[1] != wantHeader {
+			t.Errorf("FU-A %d: unexpected headers % X", i, p[:2])
+		}
+	}
+
+	// A NAL unit that fits alone goes as a single NAL unit packet
+	payloads = Packetize([][]byte{nalu(0x41, 1000), nalu(0x41, 1000)}, 1200)
+	if len(payloads) != 2 || payloads[0][0] != 0x41 {
+		t.Errorf("Expected two single NAL unit packets, got %d", len(payloads))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	frame := [][]byte{nalu(0x67, 10), nalu(0x68, 4), nalu(0x06, 30), nalu(0x65, 5000), nalu(0x65, 700)}
+	c := &collector{}
+	d := c.depacketizer()
+	for _, p := range Packetize(frame, 1200) {
+		d.Push(p)
+	}
+
+	if len(c.errs) != 0 {
+		t.Fatalf("Unexpected errors %v", c.errs)
+	}
+	if len(c.nalus) != len(frame) || len(c.starts) != len(frame) {
+		t.Fatalf("Expected %d NAL units, got %d and %d starts", len(frame), len(c.nalus), len(c.starts))
+	}
+	for i := range frame {
+		if !bytes.Equal(c.nalus[i], frame[i]) {
+			t.Errorf("NAL unit %d differs", i)
+		}
+		if !bytes.HasPrefix(frame[i], c.starts[i]) {
+			t.Errorf("Start %d is not a prefix of its NAL unit", i)
+		}
+	}
+	if len(c.starts[3]) != 1200-1 {
+		t.Errorf("Expected the start of the fragmented IDR from its first FU-A, got %d bytes", len(c.starts[3]))
+	}
+}
+
+func TestLostFragments(t *testing.T) {
+	idr := Packetize([][]byte{nalu(0x65, 3000)}, 1200)
+	next := Packetize([][]byte{nalu(0x41, 100)}, 1200)
+
+	// Lost start fragment: the rest of the NAL unit is dropped
+	c := &collector{}
+	d := c.depacketizer()
+	d.Push(idr[1])
+	d.Push(idr[2])
+	d.Push(next[0])
+	var lost *ReassemblyError
+	if len(c.errs) != 2 || !errors.As(c.errs[0], &lost) || lost.Reason != StartMissing {
+		t.Errorf("Expected two missing start errors, got %v", c.errs)
+	}
+	if len(c.nalus) != 1 || c.nalus[0][0] != 0x41 {
+		t.Errorf("Expected only the next NAL unit, got %d", len(c.nalus))
+	}
+
+	// Lost end fragment: noticed at the next packet
+	c = &collector{}
+	d = c.depacketizer()
+	d.Push(idr[0])
+	d.Push(idr[1])
+	if !d.Fragmenting() {
+		t.Error("Expected an incomplete NAL unit")
+	}
+	d.Push(next[0])
+	if len(c.errs) != 1 || !errors.As(c.errs[0], &lost) || lost.Reason != EndMissing || lost.NALType != 5 {
+		t.Errorf("Expected a missing end error for type 5, got %v", c.errs)
+	}
+	if len(c.nalus) != 1 || c.nalus[0][0] != 0x41 {
+		t.Errorf("Expected only the next NAL unit, got %d", len(c.nalus))
+	}
+
+	// After a Reset for a sequence gap, the fragments left are dropped as
+	// missing their start
+	c = &collector{}
+	d = c.depacketizer()
+	d.Push(idr[0])
+	d.Reset()
+	d.Push(idr[2])
+	if len(c.errs) != 1 || !errors.As(c.errs[0], &lost) || lost.Reason != StartMissing || len(c.nalus) != 0 {
+		t.Errorf("Expected the tail dropped after a reset, got %v and %d NAL units", c.errs, len(c.nalus))
+	}
+}
+
+func TestMalformedPayloads(t *testing.T) {
+	c := &collector{}
+	d := c.depacketizer()
+
+	// A STAP-A announcing more than it holds keeps what came before
+	d.Push([]byte{TypeSTAPA, 0, 2, 0x67, 1, 0, 9, 0x68})
+	if len(c.nalus) != 1 || len(c.errs) != 1 {
+		t.Errorf("Expected one NAL unit and one error, got %d and %v", len(c.nalus), c.errs)
+	}
+
+	// Fragments with a different NRI are reported but kept
+	c = &collector{}
+	d = c.depacketizer()
+	d.Push([]byte{0x60 | TypeFUA, 0x85, 1})
+	d.Push([]byte{0x20 | TypeFUA, 0x45, 2})
+	var nri *NRIError
+	if len(c.errs) != 1 || !errors.As(c.errs[0], &nri) || nri.Fragment != 1 || nri.Start != 3 {
+		t.Errorf("Expected an NRI error, got %v", c.errs)
+	}
+	if len(c.nalus) != 1 || !bytes.Equal(c.nalus[0], []byte{0x65, 1, 2}) {
+		t.Errorf("Expected the reassembled NAL unit, got %v", c.nalus)
+	}
+}
+
+func TestKeyframeRequester(t *testing.T) {
+	k := &KeyframeRequester{Interval: time.Second}
+	now := time.Now()
+
+	if _, due := k.FIR(now); due || k.Waiting() {
+		t.Fatal("Expected nothing due before a loss")
+	}
+	if !k.Lost(now) {
+		t.Error("Expected a PLI for the first loss")
+	}
+	if k.Lost(now.Add(100 * time.Millisecond)) {
+		t.Error("Expected no second PLI while waiting")
+	}
+	if _, due := k.FIR(now.Add(500 * time.Millisecond)); due {
+		t.Error("Expected no FIR within the interval of the PLI")
+	}
+
+	// Escalation: a FIR once the keyframe is overdue, then each interval
+	seq, due := k.FIR(now.Add(time.Second))
+	if !due || seq != 1 {
+		t.Errorf("Expected FIR 1 after an interval, got %d, %v", seq, due)
+	}
+	if _, due := k.FIR(now.Add(1500 * time.Millisecond)); due {
+		t.Error("Expected no FIR within the interval of the last one")
+	}
+	k.Requested(now.Add(1900 * time.Millisecond))
+	if _, due := k.FIR(now.Add(2100 * time.Millisecond)); due {
+		t.Error("Expected another request to put the FIR off")
+	}
+	if seq, due := k.FIR(now.Add(3 * time.Second)); !due || seq != 2 {
+		t.Errorf("Expected FIR 2, got %d, %v", seq, due)
+	}
+
+	if !k.Keyframe() || k.Waiting() {
+		t.Error("Expected the keyframe to end the wait")
+	}
+	if k.Keyframe() {
+		t.Error("Expected an unrequested keyframe not to count")
+	}
+	if _, due := k.FIR(now.Add(10 * time.Second)); due {
+		t.Error("Expected no FIR after the keyframe")
+	}
+}
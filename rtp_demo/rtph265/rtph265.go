@@ -0,0 +1,126 @@
+// Package rtph265 carries H.265 NAL units in RTP payloads (RFC 7798,
+// without decoding order numbers): single NAL unit packets, aggregation
+// packets and fragmentation units.
+package rtph265
+
+import "rtp_demo/h265"
+
+// Payload types of RFC 7798 section 4.4, in the NAL unit type field
+const (
+	TypeAP = 48
+	TypeFU = 49
+)
+
+// Packetize turns NAL units into RTP payloads of at most mtu bytes: small
+// NAL units are aggregated into APs, large ones are split into FUs
+func Packetize(nalus [][]byte, mtu int) [][]byte {
+	var payloads [][]byte
+	var ap [][]byte
+	apSize := 2
+
+	flushAP := func() {
+		switch len(ap) {
+		case 0:
+		case 1:
+			payloads = append(payloads, ap[0])
+		default:
+			// The AP header carries F if any aggregated unit has it, and
+			// the lowest layer and temporal IDs
+			f, layer, tid := byte(0), byte(0x3F), byte(7)
+			for _, nalu := range ap {
+				f |= nalu[0] & 0x80
+				if l := (nalu[0]&1)<<5 | nalu[1]>>3; l < layer {
+					layer = l
+				}
+				if t := nalu[1] & 7; t < tid {
+					tid = t
+				}
+			}
+			payload := []byte{f | TypeAP<<1 | layer>>5, layer<<3 | tid}
+			for _, nalu := range ap {
+				payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+				payload = append(payload, nalu...)
+			}
+			payloads = append(payloads, payload)
+		}
+		ap = ap[:0]
+		apSize = 2
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+
+		if len(nalu) <= mtu {
+			if apSize+2+len(nalu) > mtu {
+				flushAP()
+			}
+			ap = append(ap, nalu)
+			apSize += 2 + len(nalu)
+			continue
+		}
+
+		flushAP()
+
+		// The payload header keeps F, layer and temporal IDs, the FU
+		// header carries S/E and the type
+		hdr0, hdr1 := nalu[0]&0x81|TypeFU<<1, nalu[1]
+		nalType := h265.Type(nalu)
+		data := nalu[2:]
+		for start := true; len(data) > 0; start = false {
+			n := mtu - 3
+			if n > len(data) {
+				n = len(data)
+			}
+
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			if n == len(data) {
+				header |= 0x40
+			}
+
+			payload := make([]byte, 0, 3+n)
+			payload = append(payload, hdr0, hdr1, header)
+			payload = append(payload, data[:n]...)
+			payloads = append(payloads, payload)
+			data = data[n:]
+		}
+	}
+	flushAP()
+
+	return payloads
+}
+
+// StartsKeyframe reports whether a payload carries a parameter set or the
+// start of an IRAP picture's slice segment, where a receiver waiting for a
+// keyframe can resume
+func StartsKeyframe(payload []byte) bool {
+	if len(payload) < 3 {
+		return false
+	}
+	keyframe := func(nalType uint8) bool {
+		return h265.IsIRAP(nalType) || nalType == h265.NALUVPS || nalType == h265.NALUSPS
+	}
+
+	switch h265.Type(payload) {
+	case TypeAP:
+		for data := payload[2:]; len(data) >= 3; {
+			size := int(data[0])<<8 | int(data[1])
+			if size < 2 || 2+size > len(data) {
+				return false
+			}
+			if keyframe(h265.Type(data[2:])) {
+				return true
+			}
+			data = data[2+size:]
+		}
+		return false
+	case TypeFU:
+		return payload[2]&0x80 != 0 && keyframe(payload[2]&0x3F)
+	default:
+		return keyframe(h265.Type(payload))
+	}
+}
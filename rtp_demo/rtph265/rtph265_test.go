@@ -0,0 +1,133 @@
+package rtph265
+
+import (
+	"bytes"
+	"testing"
+
+	"rtp_demo/h265"
+)
+
+// nalu returns a NAL unit of size bytes with the given type and temporal
+// ID, its payload counting up so truncation and reordering show
+func nalu(nalType uint8, tid byte, size int) []byte {
+	b := make([]byte, size)
+	b[0], b[1] = nalType<<1, tid+1
+	for i := 2; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// depacketize reassembles the NAL units of payloads, failing the test on
+// malformed ones
+func depacketize(t *testing.T, payloads [][]byte) [][]byte {
+	t.Helper()
+	var nalus [][]byte
+	var fu []byte
+	for i, p := range payloads {
+		switch h265.Type(p) {
+		case TypeAP:
+			for data := p[2:]; len(data) > 0; {
+				size := int(data[0])<<8 | int(data[1])
+				if 2+size > len(data) {
+					t.Fatalf("Payload %d: truncated AP", i)
+				}
+				nalus = append(nalus, data[2:2+size])
+				data = data[2+size:]
+			}
+		case TypeFU:
+			if p[2]&0x80 != 0 {
+				fu = []byte{p[0]&0x81 | (p[2]&0x3F)<<1, p[1]}
+			} else if fu == nil {
+				t.Fatalf("Payload %d: FU without its start", i)
+			}
+			fu = append(fu, p[3:]...)
+			if p[2]&0x40 != 0 {
+				nalus, fu = append(nalus, fu), nil
+			}
+		default:
+			nalus = append(nalus, p)
+		}
+	}
+	return nalus
+}
+
+func TestPacketize(t *testing.T) {
+	vps, sps, pps := nalu(h265.NALUVPS, 0, 24), nalu(h265.NALUSPS, 0, 40), nalu(h265.NALUPPS, 0, 8)
+	idr := nalu(h265.NALUIDRWRADL, 0, 2500)
+	payloads := Packetize([][]byte{vps, sps, pps, idr}, 1200)
+
+	// The parameter sets share an AP, the IDR takes three FUs
+	if len(payloads) != 4 {
+		t.Fatalf("Expected 4 payloads, got %d", len(payloads))
+	}
+	if payloads[0][0] != TypeAP<<1 || payloads[0][1] != 1 {
+		t.Errorf("Expected an AP of layer 0, temporal ID 0, got header % X", payloads[0][:2])
+	}
+	for i, p := range payloads[1:] {
+		if len(p) > 1200 {
+			t.Errorf("FU %d: %d bytes exceeds the MTU", i, len(p))
+		}
+		wantHeader := byte(h265.NALUIDRWRADL)
+		if i == 0 {
+			wantHeader |= 0x80
+		}
+		if i == 2 {
+			wantHeader |= 0x40
+		}
+		if p[0] != TypeFU<<1 || p[1] != 1 || p[2] != wantHeader {
+			t.Errorf("FU %d: unexpected headers % X", i, p[:3])
+		}
+	}
+
+	// The AP takes the lowest temporal ID
+	payloads = Packetize([][]byte{nalu(1, 2, 10), nalu(1, 1, 10)}, 1200)
+	if len(payloads) != 1 || payloads[0][1] != 2 {
+		t.Errorf("Expected one AP with temporal ID 1, got %d payloads", len(payloads))
+	}
+
+	// A NAL unit that fits alone goes as a single NAL unit packet
+	payloads = Packetize([][]byte{nalu(1, 0, 1000), nalu(1, 0, 1000)}, 1200)
+	if len(payloads) != 2 || h265.Type(payloads[0]) != 1 {
+		t.Errorf("Expected two single NAL unit packets, got %d", len(payloads))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	frame := [][]byte{
+		nalu(h265.NALUVPS, 0, 24), nalu(h265.NALUSPS, 0, 40), nalu(h265.NALUPPS, 0, 8),
+		nalu(h265.NALUSEI, 0, 30), nalu(h265.NALUCRA, 0, 5000), nalu(h265.NALUCRA, 0, 700), nalu(h265.NALUSuffix, 0, 12),
+	}
+	got := depacketize(t, Packetize(frame, 1200))
+	if len(got) != len(frame) {
+		t.Fatalf("Expected %d NAL units, got %d", len(frame), len(got))
+	}
+	for i := range frame {
+		if !bytes.Equal(got[i], frame[i]) {
+			t.Errorf("NAL unit %d differs after the round trip", i)
+		}
+	}
+}
+
+func TestStartsKeyframe(t *testing.T) {
+	idr := Packetize([][]byte{nalu(h265.NALUIDRNLP, 0, 3000)}, 1200)
+	sets := Packetize([][]byte{nalu(h265.NALUVPS, 0, 24), nalu(h265.NALUSPS, 0, 40)}, 1200)
+	trail := Packetize([][]byte{nalu(1, 0, 3000)}, 1200)
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"IDR start", idr[0], true},
+		{"IDR continuation", idr[1], false},
+		{"parameter set AP", sets[0], true},
+		{"trailing picture", trail[0], false},
+		{"single CRA", nalu(h265.NALUCRA, 0, 100), true},
+		{"truncated AP", []byte{TypeAP << 1, 1, 0, 40, 0x40}, false},
+	} {
+		if got := StartsKeyframe(tc.payload); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
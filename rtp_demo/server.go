@@ -1,12 +1,72 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"rtp_demo/analyze"
+	"rtp_demo/captions"
+	"rtp_demo/capture"
+	"rtp_demo/config"
+	"rtp_demo/h264"
+	"rtp_demo/hls"
+	"rtp_demo/latency"
+	"rtp_demo/logging"
+	"rtp_demo/metrics"
+	"rtp_demo/mp4"
+	"rtp_demo/mpegts"
+	"rtp_demo/multicast"
+	"rtp_demo/relay"
+	"rtp_demo/rtcp"
+	"rtp_demo/rtpext"
+	"rtp_demo/rtph264"
+	"rtp_demo/rtph265"
+	"rtp_demo/thumbnail"
+	"rtp_demo/validate"
+	"rtp_demo/whip"
 )
 
+// keyframeRequestInterval is how long the server waits for a keyframe after a
+// PLI before escalating to a FIR, and the minimum gap between FIRs
+const keyframeRequestInterval = time.Second
+
+// twccFeedbackInterval is how often transport-cc feedback is sent
+const twccFeedbackInterval = 100 * time.Millisecond
+
+// opusClockRate is the RTP clock rate of Opus
+const opusClockRate = 48000
+
+// exitValidationFailed is the exit status of -validate when a stream broke
+// a rule or no H.264 arrived, told apart from 1 for errors
+const exitValidationFailed = 2
+
+// isAudio reports whether the stream carries audio, whose frames are
+// independent and need no keyframe recovery
+func (st *streamState) isAudio() bool {
+	return st.codec == config.CodecOpus || st.codec == config.CodecAAC
+}
+
 // RTPPacketHeader represents the RTP header   12字节
 type RTPPacketHeader struct {
 	Version        uint8  // 2 bits
@@ -18,6 +78,12 @@ type RTPPacketHeader struct {
 	SequenceNumber uint16 // 16 bits
 	Timestamp      uint32 // 32 bits
 	SSRC           uint32 // 32 bits
+
+	CSRC             []uint32
+	ExtensionProfile uint16
+	ExtensionData    []byte
+	HeaderSize       int // bytes before the payload, including CSRCs and extension
+	PaddingSize      int // bytes of padding after the payload
 }
 
 // RTPServer represents an RTP server
@@ -25,6 +91,133 @@ type RTPServer struct {
 	conn     *net.UDPConn
 	addr     *net.UDPAddr
 	received int
+	ssrc     uint32 // SSRC used as sender of RTCP feedback
+	streams  map[uint32]*streamState
+	epoch    time.Time // reference for arrival times in transport-cc feedback
+	recorder capture.Writer
+	mp4Path  string   // record each stream to a fragmented MP4
+	mp4First *os.File // created up front for the first stream
+	ccPath   string   // extract each stream's closed captions
+	ccFirst  *os.File
+	hls      *hls.Server
+	analyzer *analyze.Analyzer
+	relay    *relay.Relay
+	whip     *whip.Handler
+
+	// Keyframe snapshots, nil unless enabled
+	snapshots *thumbnail.Snapshotter
+
+	// Conformance checking, nil unless enabled. With an idle timeout the
+	// server stops once packets stop arriving, over UDP or WHIP.
+	validator   *validate.Validator
+	idleTimeout time.Duration
+	lastPacket  time.Time // arrival of the latest packet, RTP or RTCP
+
+	// Which codec each payload type carries, nil for the defaults
+	payloadTypes *config.PayloadTypes
+
+	// mu guards the stream state against the HTTP status handlers and the
+	// summary logger
+	mu           sync.Mutex
+	rtcpReceived uint64
+
+	statsInterval time.Duration // between summary log lines, 0 for none
+	statsRunning  bool          // the summary logger is running
+	done          chan struct{} // closed by Close, stopping the summary logger
+	closeOnce     sync.Once
+}
+
+// streamState tracks reassembly and keyframe recovery for one RTP source
+type streamState struct {
+	ssrc    uint32
+	addr    *net.UDPAddr  // where RTCP feedback is sent (RTP/RTCP multiplexed)
+	peer    *whip.Session // WHIP publisher, which gets feedback over WebRTC instead
+	started bool
+	lastSeq uint16
+
+	// RFC 6184 depacketization, set up by getStream
+	depacketizer rtph264.Depacketizer
+
+	// Keyframe recovery
+	recovery rtph264.KeyframeRequester
+	pliSent  int
+	firSent  int
+
+	// Transport-wide congestion control feedback
+	twcc         *rtcp.TWCCRecorder
+	lastFeedback time.Time
+
+	// Frame boundaries and the NAL unit types of the packet being processed
+	haveTimestamp   bool
+	lastTimestamp   uint32
+	idrTimestamp    uint32 // of the latest IDR, which no later frame precedes
+	haveIDR         bool
+	packetNALs      []uint8
+	frameIsKeyframe bool
+	frameStartsGOP  bool // a packet of the frame carried an SPS or IDR start, for the relay
+
+	// Statistics for /metrics and /status
+	payloadType uint8
+	codec       string // of the payload type, "" for an unknown one
+	firstSeen   time.Time
+	lastSeen    time.Time
+	packets     uint64
+	bytes       uint64
+	lost        uint64
+	late        uint64
+	frames      uint64
+	keyframes   uint64
+	jitter      float64 // RFC 3550 interarrival jitter in RTP clock units
+	lastTransit float64
+	haveTransit bool
+
+	// Latest parameter sets, and their NAL units for snapshots
+	sps     *h264.SPS
+	pps     *h264.PPS
+	spsNALU []byte
+	ppsNALU []byte
+
+	// Keyframe being collected for a snapshot: the parameter sets and its
+	// IDR slices
+	snapshot          [][]byte
+	snapshotTimestamp uint32
+
+	// MPEG-TS demultiplexing, nil unless the stream carries payload type 33
+	ts          *mpegts.Demuxer
+	audioFrames uint64
+
+	// Lip-sync: streams from one sender share a CNAME, and its sender
+	// reports map each one's RTP timestamps to a common wallclock
+	cname  string
+	lastSR *rtcp.SenderReport
+	aac    *mp4.AudioConfig // from the sender's APP packet
+	ended  bool             // by an RTCP BYE, until the next packet
+
+	// One-way delay of packets stamped with their send time, and of frames
+	// from their capture time worked out with the sender reports
+	latencySource string // header extension of the send times
+	latency       latency.Tracker
+	frameLatency  latency.Tracker
+
+	// Counters at the previous summary log line
+	summary statsSnapshot
+
+	// MP4 recording, nil unless enabled
+	mp4 *mp4Output
+
+	// SEI: the latest picture timing timecode, the user data UUIDs seen and
+	// the closed captions, extracted to a file if enabled
+	timecode     h264.Timecode
+	haveTimecode bool
+	userData     map[[16]byte]bool
+	captionPairs uint64
+	captions     *captionOutput
+}
+
+// statsSnapshot holds a stream's counters at one point in time
+type statsSnapshot struct {
+	at                           time.Time
+	packets, bytes, lost, frames uint64
 }
 
 // NewRTPServer creates a new RTP server
@@ -34,15 +227,44 @@ func NewRTPServer(listenAddr string) (*RTPServer, error) {
 		return nil, err
 	}
 
+	if addr.IP.IsMulticast() {
+		return NewMulticastRTPServer(listenAddr, nil, nil)
+	}
+
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return nil, err
 	}
 
+	return newRTPServer(conn, addr), nil
+}
+
+// NewMulticastRTPServer creates an RTP server that joins the multicast group
+// in listenAddr on ifi (nil for the default interface). With sources it
+// joins source-specific channels and only receives from those senders.
+func NewMulticastRTPServer(listenAddr string, ifi *net.Interface, sources []net.IP) (*RTPServer, error) {
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := multicast.Listen(addr, ifi, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRTPServer(conn, addr), nil
+}
+
+func newRTPServer(conn *net.UDPConn, addr *net.UDPAddr) *RTPServer {
 	return &RTPServer{
-		conn: conn,
-		addr: addr,
-	}, nil
+		conn:    conn,
+		addr:    addr,
+		ssrc:    54321,
+		streams: make(map[uint32]*streamState),
+		epoch:   time.Now(),
+		done:    make(chan struct{}),
+	}
 }
 
 // UnmarshalHeader unmarshals the RTP header from bytes
@@ -70,168 +292,868 @@ func (h *RTPPacketHeader) UnmarshalHeader(data []byte) error {
 	// SSRC
 	h.SSRC = binary.BigEndian.Uint32(data[8:12])
 
+	// CSRC list
+	offset := 12
+	if len(data) < offset+4*int(h.CSRCCount) {
+		return fmt.Errorf("RTP CSRC list truncated")
+	}
+	h.CSRC = h.CSRC[:0]
+	for i := 0; i < int(h.CSRCCount); i++ {
+		h.CSRC = append(h.CSRC, binary.BigEndian.Uint32(data[offset:]))
+		offset += 4
+	}
+
+	// Header extension: profile(16) length(16, in 32-bit words) data
+	h.ExtensionProfile, h.ExtensionData = 0, nil
+	if h.Extension {
+		if len(data) < offset+4 {
+			return fmt.Errorf("RTP header extension truncated")
+		}
+		h.ExtensionProfile = binary.BigEndian.Uint16(data[offset:])
+		extLen := 4 * int(binary.BigEndian.Uint16(data[offset+2:]))
+		offset += 4
+		if len(data) < offset+extLen {
+			return fmt.Errorf("RTP header extension truncated")
+		}
+		h.ExtensionData = data[offset : offset+extLen]
+		offset += extLen
+	}
+	h.HeaderSize = offset
+
+	// Padding: the last byte holds the padding length
+	h.PaddingSize = 0
+	if h.Padding {
+		h.PaddingSize = int(data[len(data)-1])
+		if h.PaddingSize == 0 || h.HeaderSize+h.PaddingSize > len(data) {
+			return fmt.Errorf("RTP padding length invalid")
+		}
+	}
+
 	return nil
 }
 
-// Start starts the RTP server
-func (s *RTPServer) Start() {
-	fmt.Printf("RTP server listening on %s\n", s.addr.String())
+// Start receives packets until ctx is done or, with an idle timeout, until
+// packets stop arriving. It returns an error only if the socket fails.
+func (s *RTPServer) Start(ctx context.Context) error {
+	slog.Info("RTP server listening", "addr", s.addr.String())
+
+	s.mu.Lock()
+	s.startStats()
+	s.mu.Unlock()
+
+	// Wake up the read below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		s.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
 
 	buffer := make([]byte, 65536) // Max UDP packet size
 
 	for {
+		if s.idleTimeout > 0 {
+			deadline, idle := s.idleDeadline(time.Now())
+			if idle {
+				slog.Info("No packets, stopping", "idle", s.idleTimeout)
+				return nil
+			}
+			s.conn.SetReadDeadline(deadline)
+		}
+		// Checked after setting the deadline, which would otherwise undo
+		// the one set when ctx is done
+		if ctx.Err() != nil {
+			return nil
+		}
 		n, clientAddr, err := s.conn.ReadFromUDP(buffer)
-		if err != nil {
-			fmt.Printf("Error reading UDP message: %v\n", err)
+		var netErr net.Error
+		if ctx.Err() != nil {
+			return nil
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			// WHIP packets may have come in meanwhile
+			continue
+		} else if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if err != nil {
+			slog.Error("Error reading UDP message", "err", err)
 			continue
 		}
+		arrival := time.Now()
+		s.mu.Lock()
+		s.record(buffer[:n], clientAddr, arrival)
+		s.handlePacket(buffer[:n], clientAddr, arrival)
+		s.mu.Unlock()
+	}
+}
+
+// idleDeadline returns when Start stops if no packet arrives from any
+// source, and whether that time has come. Before the first packet it only
+// returns the next time to check.
+func (s *RTPServer) idleDeadline(now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastPacket.IsZero() {
+		return now.Add(s.idleTimeout), false
+	}
+	deadline := s.lastPacket.Add(s.idleTimeout)
+	return deadline, !now.Before(deadline)
+}
+
+// handlePacket processes one received RTP or RTCP packet
+func (s *RTPServer) handlePacket(data []byte, clientAddr *net.UDPAddr, arrival time.Time) {
+	s.lastPacket = arrival
+
+	// RTCP shares the port with RTP (RFC 5761)
+	if rtcp.IsRTCP(data) {
+		s.rtcpReceived++
+		if s.analyzer != nil {
+			s.analyzer.AddRTCP(arrival)
+		}
+		s.processRTCP(data, clientAddr)
+		return
+	}
 
-		s.received++
+	s.received++
 
-		// Parse RTP header
-		header := &RTPPacketHeader{}
-		err = header.UnmarshalHeader(buffer[:n])
-		if err != nil {
-			fmt.Printf("Error parsing RTP header: %v\n", err)
-			continue
+	// Parse RTP header
+	header := &RTPPacketHeader{}
+	err := header.UnmarshalHeader(data)
+	if err != nil {
+		slog.Warn("Error parsing RTP header", "from", clientAddr.String(), "err", err)
+		return
+	}
+
+	// Extract payload (skip header, CSRCs and extension, drop padding)
+	payload := data[header.HeaderSize : len(data)-header.PaddingSize]
+
+	slog.Debug("Received RTP packet", "n", s.received, "from", clientAddr.String(), "ssrc", header.SSRC,
+		"seq", header.SequenceNumber, "ts", header.Timestamp, "pt", header.PayloadType, "size", len(payload))
+
+	if s.analyzer != nil {
+		s.analyzer.AddPacket(analyze.Packet{
+			Arrival:     arrival,
+			SSRC:        header.SSRC,
+			Sequence:    header.SequenceNumber,
+			Timestamp:   header.Timestamp,
+			PayloadType: header.PayloadType,
+			Marker:      header.Marker,
+			Size:        len(data),
+			PayloadSize: len(payload),
+		})
+	}
+
+	stream := s.getStream(header.SSRC, clientAddr)
+	stream.ended = false
+	elements, err := rtpext.Parse(header.ExtensionProfile, header.ExtensionData)
+	if err != nil {
+		slog.Warn("Invalid header extension", "ssrc", stream.ssrc, "err", err)
+	}
+	if s.conn != nil {
+		s.recordTransportCC(stream, elements, arrival)
+	}
+	stream.measureLatency(elements, arrival)
+	s.updateStats(stream, header, len(data), arrival)
+
+	lost, late := stream.updateSequence(header.SequenceNumber)
+	stream.lost += uint64(lost)
+	if late {
+		stream.late++
+		slog.Debug("Late or duplicate packet, ignored", "ssrc", header.SSRC, "seq", header.SequenceNumber)
+		s.forward(stream, header, data, arrival, false)
+		return
+	}
+	if lost > 0 {
+		slog.Warn("Packets lost", "ssrc", header.SSRC, "count", lost, "before_seq", header.SequenceNumber)
+		if !stream.isAudio() {
+			s.reassemblyFailed(stream, "sequence gap")
+		}
+	}
+
+	if s.validator != nil && (stream.codec == config.CodecH264 || stream.codec == config.CodecMP2T) {
+		s.validator.Packet(stream.ssrc)
+	}
+
+	// Transport streams are split into frames by their PES packets instead
+	frameStart := stream.codec != config.CodecMP2T &&
+		(!stream.haveTimestamp || header.Timestamp != stream.lastTimestamp)
+	if frameStart {
+		if stream.codec == config.CodecH264 {
+			s.checkTimestamp(stream, header.Timestamp)
+		}
+		stream.haveTimestamp = true
+		stream.lastTimestamp = header.Timestamp
+		stream.frameIsKeyframe = false
+		stream.frameStartsGOP = false
+		stream.frames++
+	}
+
+	// Process payload based on payload type
+	stream.packetNALs = stream.packetNALs[:0]
+	s.processPayload(stream, header, payload)
+	if header.Marker {
+		s.finishAccessUnit(stream)
+		if stream.codec != config.CodecMP2T {
+			stream.frameArrived(header.Timestamp, arrival)
+			s.offerSnapshot(stream)
+		}
+	}
+
+	// The keyframe may only show after an AUD or SEI packet, so every
+	// packet from the one that shows it on is marked
+	switch stream.codec {
+	case config.CodecMP2T:
+		stream.frameStartsGOP = mpegts.RandomAccess(payload)
+	case config.CodecH265:
+		stream.frameStartsGOP = stream.frameStartsGOP || rtph265.StartsKeyframe(payload)
+	default:
+		stream.frameStartsGOP = stream.frameStartsGOP || stream.packetStartsKeyframe()
+	}
+	s.forward(stream, header, data, arrival, stream.frameStartsGOP)
+
+	// Escalate to FIR if the PLI did not produce a keyframe in time
+	s.checkKeyframeRequest(stream)
+}
+
+// packetStartsKeyframe reports whether the packet just parsed carried an SPS
+// or the start of an IDR slice
+func (st *streamState) packetStartsKeyframe() bool {
+	for _, t := range st.packetNALs {
+		if t == 5 || t == 7 {
+			return true
+		}
+	}
+	return false
+}
+
+// observeNALU notes a NAL unit, or the start of a fragmented one, for the
+// relay and the analyzer
+func (s *RTPServer) observeNALU(stream *streamState, nalu []byte) {
+	nalType := nalu[0] & 0x1F
+	stream.packetNALs = append(stream.packetNALs, nalType)
+	s.violation(stream, validate.CheckNALHeader(nalu[0])...)
+
+	if nalType == h264.NALUIDR && !stream.frameIsKeyframe {
+		stream.frameIsKeyframe = true
+		stream.keyframes++
+		stream.idrTimestamp, stream.haveIDR = stream.lastTimestamp, true
+		if stream.sps == nil || stream.pps == nil {
+			s.violation(stream, validate.Finding{Rule: validate.IDRWithoutParameterSets, Detail: fmt.Sprintf("IDR at timestamp %d", stream.lastTimestamp)})
+		}
+	}
+
+	if s.analyzer != nil {
+		s.analyzer.AddNALU(stream.ssrc, nalu)
+	}
+}
+
+// violation records conformance problems of the packet being processed,
+// logging the first few of each kind, when validating
+func (s *RTPServer) violation(stream *streamState, findings ...validate.Finding) {
+	if s.validator == nil {
+		return
+	}
+	for _, f := range findings {
+		if s.validator.Add(validate.Violation{Finding: f, SSRC: stream.ssrc, Sequence: stream.lastSeq}) {
+			slog.Warn("Conformance violation", "ssrc", stream.ssrc, "seq", stream.lastSeq, "rule", f.Rule, "detail", f.Detail)
+		}
+	}
+}
+
+// checkTimestamp checks the timestamp of a new frame against the previous
+// ones. Presentation timestamps go back with B-frames, but never before the
+// latest IDR, and not at all when the SPS rules out reordering: in the
+// Baseline profile, or with picture order count type 2.
+func (s *RTPServer) checkTimestamp(stream *streamState, timestamp uint32) {
+	if s.validator == nil || !stream.haveTimestamp {
+		return
+	}
+	if stream.haveIDR && int32(timestamp-stream.idrTimestamp) < 0 {
+		s.violation(stream, validate.Finding{Rule: validate.TimestampRegression,
+			Detail: fmt.Sprintf("timestamp %d before the IDR at %d", timestamp, stream.idrTimestamp)})
+		return
+	}
+	reordering := stream.sps == nil || (stream.sps.ProfileIDC != 66 && stream.sps.POCType != 2)
+	if !reordering && int32(timestamp-stream.lastTimestamp) < 0 {
+		s.violation(stream, validate.Finding{Rule: validate.TimestampRegression,
+			Detail: fmt.Sprintf("timestamp %d after %d without reordering", timestamp, stream.lastTimestamp)})
+	}
+}
+
+// forward passes a packet to the relay, if running, and asks the source for
+// a keyframe when subscribers need one
+func (s *RTPServer) forward(stream *streamState, header *RTPPacketHeader, data []byte, arrival time.Time, keyframe bool) {
+	if s.relay == nil {
+		return
+	}
+
+	s.relay.Forward(relay.Packet{
+		Data:      data,
+		SSRC:      header.SSRC,
+		Sequence:  header.SequenceNumber,
+		Timestamp: header.Timestamp,
+		Arrival:   arrival,
+		Keyframe:  keyframe,
+	})
+
+	if ssrc, ok := s.relay.TakeKeyframeRequest(arrival); ok {
+		if source, ok := s.streams[ssrc]; ok {
+			pli := &rtcp.PictureLossIndication{SenderSSRC: s.ssrc, MediaSSRC: ssrc}
+			source.recovery.Requested(arrival)
+			if s.sendRTCP(source, pli) {
+				source.pliSent++
+				slog.Info("Sent PLI on behalf of relay subscribers", "to", source.addr.String(), "ssrc", ssrc)
+			}
+		}
+	}
+}
+
+// getStream returns the state for an SSRC, creating it on first use
+func (s *RTPServer) getStream(ssrc uint32, addr *net.UDPAddr) *streamState {
+	stream, ok := s.streams[ssrc]
+	if !ok {
+		stream = &streamState{ssrc: ssrc}
+		stream.recovery.Interval = keyframeRequestInterval
+		stream.depacketizer = rtph264.Depacketizer{
+			OnStart: func(head []byte) { s.observeNALU(stream, head) },
+			OnNALU: func(nalu []byte) {
+				nalType := nalu[0] & 0x1F
+				slog.Debug("NAL unit", "ssrc", stream.ssrc, "type", nalType, "name", getNALUnitName(nalType), "size", len(nalu))
+				s.handleNALU(stream, nalu)
+			},
+			OnError: func(err error) { s.depacketizationError(stream, err) },
 		}
+		s.streams[ssrc] = stream
+	}
+	stream.addr = addr
+	return stream
+}
+
+// measureLatency records the one-way delay of a packet stamped with its
+// send time. Abs-send-time only holds 64 seconds, so it is taken to be from
+// the minute around the arrival.
+func (st *streamState) measureLatency(elements []rtpext.Element, arrival time.Time) {
+	var sent uint64
+	if data, ok := rtpext.Find(elements, rtpext.NTP64ID); ok {
+		if sent, ok = rtpext.ParseNTP64(data); !ok {
+			return
+		}
+		st.latencySource = "ntp-64"
+	} else if data, ok := rtpext.Find(elements, rtpext.AbsSendTimeID); ok {
+		v, ok := rtpext.ParseAbsSendTime(data)
+		if !ok {
+			return
+		}
+		sent = rtpext.ExpandAbsSendTime(v, rtcp.NTPTime(arrival))
+		st.latencySource = "abs-send-time"
+	} else {
+		return
+	}
+	st.latency.Add(rtcp.NTPToTime(sent), arrival)
+}
+
+// frameArrived records the delay of a frame, from its capture time by the
+// sender's clock to the arrival of its last packet
+func (st *streamState) frameArrived(timestamp uint32, arrival time.Time) {
+	capture, ok := st.captureTime(timestamp)
+	if !ok {
+		return
+	}
+	st.frameLatency.Add(capture, arrival)
+	slog.Debug("Frame arrived", "ssrc", st.ssrc, "ts", timestamp, "capture", capture, "arrival", arrival, "latency", arrival.Sub(capture))
+}
+
+// captureTime maps an RTP timestamp to the sender's wallclock through its
+// latest sender report
+func (st *streamState) captureTime(timestamp uint32) (time.Time, bool) {
+	if st.lastSR == nil {
+		return time.Time{}, false
+	}
+	elapsed := float64(int32(timestamp-st.lastSR.RTPTime)) / st.clockRate()
+	return rtcp.NTPToTime(st.lastSR.NTPTime).Add(time.Duration(elapsed * float64(time.Second))), true
+}
+
+// clockRate returns the RTP clock rate of the stream's payload
+func (st *streamState) clockRate() float64 {
+	switch {
+	case st.codec == config.CodecOpus:
+		return opusClockRate
+	case st.codec == config.CodecAAC && st.aac != nil:
+		return float64(st.aac.SampleRate)
+	}
+	return videoClockRate
+}
+
+// recordTransportCC records the arrival of a packet carrying a transport-wide
+// sequence number and periodically reports arrivals back to the sender
+func (s *RTPServer) recordTransportCC(stream *streamState, elements []rtpext.Element, arrival time.Time) {
+	data, ok := rtpext.Find(elements, rtpext.TransportCCID)
+	if !ok {
+		return
+	}
+	seq, ok := rtpext.ParseTransportSequence(data)
+	if !ok {
+		return
+	}
+
+	if stream.twcc == nil {
+		stream.twcc = rtcp.NewTWCCRecorder()
+		stream.lastFeedback = arrival
+	}
+	stream.twcc.Record(seq, arrival.Sub(s.epoch))
+
+	if arrival.Sub(stream.lastFeedback) < twccFeedbackInterval {
+		return
+	}
+	stream.lastFeedback = arrival
 
-		// Extract payload (skip 12-byte header)
-		payload := buffer[12:n]
+	if fb := stream.twcc.BuildFeedback(s.ssrc, stream.ssrc); fb != nil {
+		if err := s.writeFeedback(stream, fb.Marshal()); err != nil {
+			slog.Error("Error sending RTCP packet", "to", stream.addr.String(), "err", err)
+			return
+		}
+		slog.Debug("Sent transport-cc feedback", "ssrc", stream.ssrc, "base", fb.BaseSequence, "packets", len(fb.Packets))
+	}
+}
 
-		// Print packet info
-		fmt.Printf("Received RTP packet #%d from %s: Seq=%d, TS=%d, PT=%d, Size=%d\n",
-			s.received, clientAddr.String(), header.SequenceNumber, header.Timestamp, header.PayloadType, len(payload))
+// updateSequence records a sequence number and returns how many packets were
+// skipped since the previous one, or late=true for old or duplicate packets
+func (st *streamState) updateSequence(seq uint16) (lost int, late bool) {
+	if !st.started {
+		st.started = true
+		st.lastSeq = seq
+		return 0, false
+	}
 
-		// Process payload based on payload type
-		s.processPayload(header, payload)
+	diff := seq - st.lastSeq // wraps around at 65536
+	if diff == 0 || diff >= 0x8000 {
+		return 0, true
 	}
+
+	st.lastSeq = seq
+	return int(diff) - 1, false
 }
 
-// processPayload processes the RTP payload based on its type
-func (s *RTPServer) processPayload(header *RTPPacketHeader, payload []byte) {
-	switch header.PayloadType {
-	case 96: // Dynamic type, assuming H.264
-		fmt.Printf("  -> H.264 video frame, size: %d bytes\n", len(payload))
+// processPayload processes the RTP payload based on the codec of its type
+func (s *RTPServer) processPayload(stream *streamState, header *RTPPacketHeader, payload []byte) {
+	switch stream.codec {
+	case config.CodecH264:
+		slog.Debug("H.264 video payload", "ssrc", stream.ssrc, "size", len(payload))
 		// Parse H.264 NAL Units
-		s.parseH264NALUs(payload)
+		s.parseH264NALUs(stream, payload)
+	case config.CodecH265:
+		slog.Debug("H.265 video payload", "ssrc", stream.ssrc, "size", len(payload))
+		s.parseH265(stream, payload)
+	case config.CodecMP2T:
+		slog.Debug("MPEG-TS payload", "ssrc", stream.ssrc, "size", len(payload))
+		s.parseMP2T(stream, payload)
+	case config.CodecOpus:
+		stream.audioFrames++
+		slog.Debug("Opus audio payload", "ssrc", stream.ssrc, "size", len(payload))
+	case config.CodecAAC:
+		slog.Debug("AAC audio payload", "ssrc", stream.ssrc, "size", len(payload))
+		s.parseAAC(stream, header, payload)
 	default:
-		fmt.Printf("  -> Unknown payload type: %d\n", header.PayloadType)
+		slog.Debug("Unknown payload type", "ssrc", stream.ssrc, "pt", header.PayloadType)
 	}
 }
 
-// parseH264NALUs parses H.264 NAL Units from the payload
-func (s *RTPServer) parseH264NALUs(payload []byte) {
+// parseH264NALUs depacketizes an RFC 6184 payload, checking its headers
+// when validating
+func (s *RTPServer) parseH264NALUs(stream *streamState, payload []byte) {
 	if len(payload) == 0 {
 		return
 	}
+	switch payload[0] & 0x1F {
+	case rtph264.TypeFUA:
+		s.violation(stream, validate.CheckFUA(payload)...)
+	case rtph264.TypeSTAPA:
+		s.violation(stream, validate.CheckSTAPA(payload)...)
+	}
+	stream.depacketizer.Push(payload)
+}
 
-	// Handle different RTP H.264 payload formats
-	// Check for STAP-A (Single-Time Aggregation Packet type A)
-	if payload[0] == 24 {
-		s.parseSTAPA(payload)
+// parseH265 notes the keyframes of an RFC 7798 payload. H.265 is not
+// depacketized: its streams are counted and asked for keyframes after
+// losses, but not validated, recorded or snapshotted.
+func (s *RTPServer) parseH265(stream *streamState, payload []byte) {
+	if stream.frameIsKeyframe || !rtph265.StartsKeyframe(payload) {
 		return
 	}
+	stream.frameIsKeyframe = true
+	stream.keyframes++
+	if stream.recovery.Keyframe() {
+		slog.Info("Keyframe received, decoding can resume", "ssrc", stream.ssrc)
+	}
+}
+
+// depacketizationError handles a problem reported by a stream's
+// depacketizer
+func (s *RTPServer) depacketizationError(stream *streamState, err error) {
+	var lost *rtph264.ReassemblyError
+	var nri *rtph264.NRIError
+	switch {
+	case errors.As(err, &lost) && lost.Reason == rtph264.EndMissing:
+		// Losses reset the depacketizer first, so without one it is the
+		// sender's fault
+		s.violation(stream, validate.Finding{Rule: validate.FUMissingEnd,
+			Detail: fmt.Sprintf("NAL unit of type %d", lost.NALType)})
+		s.reassemblyFailed(stream, lost.Reason)
+	case errors.As(err, &lost):
+		if !stream.recovery.Waiting() {
+			s.reassemblyFailed(stream, lost.Reason)
+		}
+	case errors.As(err, &nri):
+		s.violation(stream, validate.Finding{Rule: validate.NRI,
+			Detail: fmt.Sprintf("FU-A fragment NRI %d, start fragment %d", nri.Fragment, nri.Start)})
+	default:
+		slog.Warn("Invalid H.264 payload", "ssrc", stream.ssrc, "err", err)
+	}
+}
 
-	// Check for FU-A (Fragmentation Unit type A)
-	if payload[0] == 28 {
-		s.parseFUA(payload)
+// parseAAC splits an RFC 3640 AAC-hbr payload into its frames and records
+// them with the video stream of the same sender
+func (s *RTPServer) parseAAC(stream *streamState, header *RTPPacketHeader, payload []byte) {
+	frames, err := splitAACHbr(payload)
+	if err != nil {
+		slog.Warn("Invalid AAC payload", "ssrc", stream.ssrc, "size", len(payload), "err", err)
 		return
 	}
+	stream.audioFrames += uint64(len(frames))
 
-	// Single NAL unit packet
-	s.parseSingleNALU(payload)
+	video := s.pairedVideo(stream)
+	if video == nil || video.mp4 == nil {
+		return
+	}
+	out := video.mp4
+	if !out.audioSynced {
+		// Audio waits for both sender reports, or it could not be placed
+		if video.lastSR == nil || stream.lastSR == nil {
+			return
+		}
+		out.muxer.SyncAudio(syncTimestamps(video.lastSR, stream.lastSR))
+		out.audioSynced = true
+	}
+	for i, frame := range frames {
+		// Each frame holds 1024 samples
+		if err := out.muxer.WriteAudio(header.Timestamp+uint32(i)*1024, frame); err != nil {
+			slog.Error("Error writing MP4 recording", "ssrc", video.ssrc, "err", err)
+		}
+	}
 }
 
-// parseSingleNALU parses a single NAL unit
-func (s *RTPServer) parseSingleNALU(payload []byte) {
-	if len(payload) < 1 {
-		return
+// splitAACHbr splits an AAC-hbr payload (RFC 3640 section 3.3.6): a 16-bit
+// length in bits of the AU headers, one 16-bit header per frame holding a
+// 13-bit size and 3-bit index, then the frames
+func splitAACHbr(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("payload too short")
+	}
+	headersLen := int(binary.BigEndian.Uint16(payload)+7) / 8
+	if headersLen%2 != 0 || 2+headersLen > len(payload) {
+		return nil, fmt.Errorf("invalid AU headers length %d", headersLen)
+	}
+
+	headers := payload[2 : 2+headersLen]
+	data := payload[2+headersLen:]
+	var frames [][]byte
+	for i := 0; i < len(headers); i += 2 {
+		size := int(binary.BigEndian.Uint16(headers[i:]) >> 3)
+		if size > len(data) {
+			return frames, fmt.Errorf("AU of %d bytes, %d left", size, len(data))
+		}
+		frames = append(frames, data[:size])
+		data = data[size:]
+	}
+	return frames, nil
+}
+
+// pairedVideo returns the H.264 stream sharing an audio stream's CNAME
+func (s *RTPServer) pairedVideo(audio *streamState) *streamState {
+	if audio.cname == "" || audio.aac == nil {
+		return nil
+	}
+	for _, st := range s.streams {
+		if st != audio && st.cname == audio.cname && st.aac == nil && st.codec == config.CodecH264 {
+			return st
+		}
+	}
+	return nil
+}
+
+// pairedAudio returns the AAC stream sharing a video stream's CNAME
+func (s *RTPServer) pairedAudio(video *streamState) *streamState {
+	if video.cname == "" {
+		return nil
+	}
+	for _, st := range s.streams {
+		if st != video && st.cname == video.cname && st.aac != nil {
+			return st
+		}
+	}
+	return nil
+}
+
+// syncTimestamps works out the video RTP timestamp sampled at the same
+// instant as the audio one in the audio sender report
+func syncTimestamps(video, audio *rtcp.SenderReport) (uint32, uint32) {
+	// The NTP difference is in 1/2^32 seconds
+	diff := int64(audio.NTPTime - video.NTPTime)
+	return video.RTPTime + uint32(diff*videoClockRate>>32), audio.RTPTime
+}
+
+// parseMP2T demultiplexes the transport stream packets of an RTP payload
+// (RFC 2250)
+func (s *RTPServer) parseMP2T(stream *streamState, payload []byte) {
+	if stream.ts == nil {
+		stream.ts = mpegts.NewDemuxer(func(pes *mpegts.PES) {
+			s.handlePES(stream, pes)
+		})
+		stream.ts.OnContinuityError = func(pid uint16, streamType, expected, got uint8) {
+			slog.Warn("MPEG-TS continuity error", "ssrc", stream.ssrc, "pid", pid, "expected", expected, "got", got)
+			if streamType == mpegts.StreamTypeH264 {
+				s.reassemblyFailed(stream, "MPEG-TS continuity error")
+			}
+		}
+	}
+
+	if err := stream.ts.Write(payload); err != nil {
+		slog.Warn("Invalid MPEG-TS payload", "ssrc", stream.ssrc, "size", len(payload), "err", err)
 	}
+}
 
-	// First byte contains NAL unit header
-	nalHeader := payload[0]
-	nalType := nalHeader & 0x1F
+// handlePES handles an elementary stream packet from a transport stream.
+// An H.264 PES packet holds one access unit, whose NAL units go through the
+// same handling as those of RFC 6184 payloads, timed by the PTS.
+func (s *RTPServer) handlePES(stream *streamState, pes *mpegts.PES) {
+	switch pes.StreamType {
+	case mpegts.StreamTypeH264:
+		// The lower 32 bits of the 33-bit PTS wrap like an RTP timestamp
+		s.checkTimestamp(stream, uint32(pes.PTS))
+		stream.haveTimestamp = true
+		stream.lastTimestamp = uint32(pes.PTS)
+		stream.frameIsKeyframe = false
+		stream.frames++
 
-	// Get NAL unit name
-	nalTypeName := getNALUnitName(nalType)
+		for _, nalu := range h264.SplitAnnexB(pes.Data) {
+			nalType := nalu[0] & 0x1F
+			slog.Debug("PES NAL unit", "ssrc", stream.ssrc, "type", nalType, "name", getNALUnitName(nalType), "size", len(nalu))
+			s.observeNALU(stream, nalu)
+			s.handleNALU(stream, nalu)
+		}
+		s.finishAccessUnit(stream)
+		s.offerSnapshot(stream)
+	case mpegts.StreamTypeAAC:
+		frames, err := mpegts.SplitADTS(pes.Data)
+		if err != nil {
+			slog.Warn("Invalid AAC PES packet", "ssrc", stream.ssrc, "pid", pes.PID, "err", err)
+		}
+		stream.audioFrames += uint64(len(frames))
+		slog.Debug("AAC PES packet", "ssrc", stream.ssrc, "pid", pes.PID, "pts", pes.PTS, "frames", len(frames))
+	default:
+		slog.Debug("Unsupported elementary stream", "ssrc", stream.ssrc, "pid", pes.PID, "stream_type", pes.StreamType)
+	}
+}
 
-	fmt.Printf("    -> Single NAL Unit - Type: %d (%s), Size: %d bytes\n", nalType, nalTypeName, len(payload))
+// handleNALU handles a complete NAL unit, whether it arrived alone,
+// aggregated or reassembled from fragments
+func (s *RTPServer) handleNALU(stream *streamState, nalu []byte) {
+	nalType := nalu[0] & 0x1F
 
 	// For SPS/PPS, print additional info
 	switch nalType {
+	case 6: // SEI
+		s.parseSEI(stream, nalu)
+	case 5: // IDR
+		if stream.recovery.Keyframe() {
+			slog.Info("Keyframe received, decoding can resume", "ssrc", stream.ssrc)
+		}
+		s.collectSnapshot(stream, nalu)
 	case 7: // SPS
-		s.parseSPS(payload[1:])
+		s.parseSPS(stream, nalu)
+		if s.snapshots != nil {
+			stream.spsNALU = append([]byte(nil), nalu...)
+		}
 	case 8: // PPS
-		s.parsePPS(payload[1:])
+		s.parsePPS(stream, nalu)
+		if s.snapshots != nil {
+			stream.ppsNALU = append([]byte(nil), nalu...)
+		}
 	}
+
+	s.recordNALU(stream, nalu)
 }
 
-// parseSTAPA parses STAP-A packets
-func (s *RTPServer) parseSTAPA(payload []byte) {
-	fmt.Printf("    -> STAP-A Packet\n")
+// reassemblyFailed discards any partial NAL unit and asks the sender for a
+// keyframe, since the decoder cannot continue until the next IDR
+func (s *RTPServer) reassemblyFailed(stream *streamState, reason string) {
+	stream.depacketizer.Reset()
+	stream.snapshot = nil
+	if stream.mp4 != nil {
+		stream.mp4.nalus = nil // the frame is incomplete
+	}
+
+	slog.Warn("Reassembly failed", "ssrc", stream.ssrc, "reason", reason)
 
-	if len(payload) < 1 {
+	if !stream.recovery.Lost(time.Now()) {
 		return
 	}
 
-	// Skip the STAP-A header (first byte)
-	data := payload[1:]
-	offset := 0
+	pli := &rtcp.PictureLossIndication{SenderSSRC: s.ssrc, MediaSSRC: stream.ssrc}
+	if s.sendRTCP(stream, pli) {
+		stream.pliSent++
+		slog.Info("Sent PLI", "to", stream.addr.String(), "ssrc", stream.ssrc)
+	}
+}
 
-	for offset < len(data) {
-		// Check if we have enough bytes for the length field
-		if offset+2 > len(data) {
-			break
+// collectSnapshot keeps an IDR slice of the current frame when the stream
+// is due a snapshot
+func (s *RTPServer) collectSnapshot(stream *streamState, nalu []byte) {
+	if s.snapshots == nil || stream.spsNALU == nil || stream.ppsNALU == nil {
+		return
+	}
+	if len(stream.snapshot) == 0 || stream.snapshotTimestamp != stream.lastTimestamp {
+		stream.snapshot = nil
+		if !s.snapshots.Due(snapshotName(stream)) {
+			return
 		}
+		stream.snapshot = [][]byte{stream.spsNALU, stream.ppsNALU}
+		stream.snapshotTimestamp = stream.lastTimestamp
+	}
+	stream.snapshot = append(stream.snapshot, append([]byte(nil), nalu...))
+}
 
-		// Get NAL unit length (16-bit big endian)
-		nalLength := int(binary.BigEndian.Uint16(data[offset : offset+2]))
-		offset += 2
+// offerSnapshot hands a completed keyframe to the snapshotter
+func (s *RTPServer) offerSnapshot(stream *streamState) {
+	if len(stream.snapshot) == 0 || stream.snapshotTimestamp != stream.lastTimestamp {
+		return
+	}
+	if s.snapshots.Offer(snapshotName(stream), stream.snapshot) {
+		slog.Debug("Taking snapshot", "ssrc", stream.ssrc, "timestamp", stream.snapshotTimestamp)
+	}
+	stream.snapshot = nil
+}
 
-		// Check if we have enough bytes for the NAL unit
-		if offset+nalLength > len(data) {
-			break
-		}
+// snapshotName names a stream's snapshot file and URL
+func snapshotName(stream *streamState) string {
+	return strconv.FormatUint(uint64(stream.ssrc), 10)
+}
 
-		// Extract NAL unit
-		nalUnit := data[offset : offset+nalLength]
-		offset += nalLength
+// TakeSnapshots saves a JPEG snapshot of every stream's keyframes to dir,
+// at most one per interval, and serves the latest on /snapshots/ of the
+// HTTP listener
+func (s *RTPServer) TakeSnapshots(decoder thumbnail.Decoder, dir string, interval time.Duration) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s.snapshots = thumbnail.New(decoder, thumbnail.Options{
+		Dir:      dir,
+		Interval: interval,
+		Done: func(name string, size int, err error) {
+			if err != nil {
+				slog.Warn("Snapshot failed", "ssrc", name, "err", err)
+				return
+			}
+			slog.Debug("Saved snapshot", "ssrc", name, "file", filepath.Join(dir, name+".jpg"), "size", size)
+		},
+	})
+	return nil
+}
 
-		if len(nalUnit) > 0 {
-			nalHeader := nalUnit[0]
-			nalType := nalHeader & 0x1F
-			nalTypeName := getNALUnitName(nalType)
+// checkKeyframeRequest sends a FIR while a requested keyframe is overdue
+func (s *RTPServer) checkKeyframeRequest(stream *streamState) {
+	seq, due := stream.recovery.FIR(time.Now())
+	if !due {
+		return
+	}
 
-			fmt.Printf("      -> NAL Unit - Type: %d (%s), Size: %d bytes\n", nalType, nalTypeName, len(nalUnit))
-		}
+	fir := &rtcp.FullIntraRequest{
+		SenderSSRC: s.ssrc,
+		Entries:    []rtcp.FIREntry{{SSRC: stream.ssrc, SequenceNumber: seq}},
+	}
+	if s.sendRTCP(stream, fir) {
+		stream.firSent++
+		slog.Info("Sent FIR", "to", stream.addr.String(), "ssrc", stream.ssrc, "fir_seq", seq)
 	}
 }
 
-// parseFUA parses FU-A packets
-func (s *RTPServer) parseFUA(payload []byte) {
-	if len(payload) < 2 {
-		return
+// sendRTCP sends an RTCP packet back to the stream source
+func (s *RTPServer) sendRTCP(stream *streamState, packet rtcp.Packet) bool {
+	// Nobody to answer when analyzing a capture
+	if s.conn == nil && stream.peer == nil {
+		return false
+	}
+
+	if err := s.writeFeedback(stream, packet.Marshal()); err != nil {
+		slog.Error("Error sending RTCP packet", "to", stream.addr.String(), "err", err)
+		return false
 	}
+	return true
+}
 
-	// FU-A header is the second byte
-	fuHeader := payload[1]
-	startBit := (fuHeader >> 7) & 0x01
-	endBit := (fuHeader >> 6) & 0x01
-	nalType := fuHeader & 0x1F
+// writeFeedback sends an RTCP packet to the stream source, through the
+// PeerConnection for WHIP publishers
+func (s *RTPServer) writeFeedback(stream *streamState, data []byte) error {
+	if stream.peer != nil {
+		return stream.peer.WriteRTCP(data)
+	}
+	_, err := s.conn.WriteToUDP(data, stream.addr)
+	return err
+}
 
-	nalTypeName := getNALUnitName(nalType)
+// processRTCP prints RTCP packets received from senders
+func (s *RTPServer) processRTCP(data []byte, addr *net.UDPAddr) {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		slog.Warn("Error parsing RTCP packet", "from", addr.String(), "err", err)
+	}
 
-	// Reconstruct the NAL header from the FU indicator (first byte) and FU header
-	fuIndicator := payload[0]
-	nalHeader := (fuIndicator & 0xE0) | nalType // Keep F, NRI from FU indicator, use type from FU header
+	for _, p := range packets {
+		slog.Debug("Received RTCP packet", "from", addr.String(), "type", fmt.Sprintf("%T", p))
 
-	fmt.Printf("    -> FU-A Packet - NAL Type: %d (%s), Start: %d, End: %d, Size: %d bytes\n",
-		nalType, nalTypeName, startBit, endBit, len(payload))
+		switch p := p.(type) {
+		case *rtcp.SenderReport:
+			s.getStream(p.SSRC, addr).lastSR = p
+		case *rtcp.SourceDescription:
+			for _, chunk := range p.Chunks {
+				stream := s.getStream(chunk.SSRC, addr)
+				if stream.cname != chunk.CNAME {
+					slog.Info("Stream named", "ssrc", chunk.SSRC, "cname", chunk.CNAME)
+					stream.cname = chunk.CNAME
+				}
+			}
+		case *rtcp.ApplicationDefined:
+			if p.Name != rtcp.AudioConfigName {
+				break
+			}
+			stream := s.getStream(p.SSRC, addr)
+			if stream.aac != nil {
+				break
+			}
+			config, err := mp4.ParseAudioConfig(p.Data)
+			if err != nil {
+				slog.Warn("Invalid AAC configuration", "ssrc", p.SSRC, "err", err)
+				break
+			}
+			stream.aac = config
+			slog.Info("AAC stream", "ssrc", p.SSRC, "sample_rate", config.SampleRate, "channels", config.Channels)
+		case *rtcp.Goodbye:
+			for _, ssrc := range p.SSRCs {
+				stream := s.streams[ssrc]
+				if stream == nil || stream.ended {
+					continue
+				}
+				stream.ended = true
+				s.finishAccessUnit(stream)
+				slog.Info("Stream ended", "ssrc", ssrc, "reason", p.Reason)
+			}
+		}
 
-	// If this is the start of a fragmented NAL unit, show the reconstructed header
-	if startBit == 1 {
-		fmt.Printf("      -> Reconstructed NAL Header: 0x%02X\n", nalHeader)
+		// Relay subscribers' keyframe requests go to the source
+		if s.relay != nil && s.relay.IsSubscriber(addr) {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				slog.Info("Keyframe request from subscriber", "from", addr.String())
+				s.relay.RequestKeyframe()
+			}
+		}
 	}
 }
 
@@ -274,37 +1196,1305 @@ func getNALUnitName(nalType uint8) string {
 }
 
 // parseSPS parses Sequence Parameter Set
-func (s *RTPServer) parseSPS(spsData []byte) {
-	fmt.Printf("      -> SPS Data: %d bytes\n", len(spsData))
-	// In a full implementation, you would parse the SPS fields here
-	// For now, we just acknowledge that we received SPS data
+func (s *RTPServer) parseSPS(stream *streamState, nalu []byte) {
+	sps, err := h264.ParseSPS(nalu)
+	if err != nil {
+		slog.Warn("Invalid SPS", "ssrc", stream.ssrc, "size", len(nalu), "err", err)
+		return
+	}
+
+	// Senders repeat the SPS before every keyframe, only changes are news
+	level := slog.LevelDebug
+	if stream.sps == nil || *stream.sps != *sps {
+		level = slog.LevelInfo
+	}
+	stream.sps = sps
+
+	slog.Log(context.Background(), level, "SPS", "ssrc", stream.ssrc, "profile", sps.ProfileName(), "level", sps.Level(),
+		"width", sps.Width, "height", sps.Height, "fps", sps.FrameRate)
+}
+
+// parseSEI logs the timecodes and user data of an SEI NAL unit and passes
+// its closed captions on. Most senders repeat them with every frame, so only
+// news is logged at info level.
+func (s *RTPServer) parseSEI(stream *streamState, nalu []byte) {
+	messages, err := h264.ParseSEI(nalu)
+	if err != nil {
+		slog.Debug("Invalid SEI", "ssrc", stream.ssrc, "size", len(nalu), "err", err)
+	}
+
+	for _, m := range messages {
+		switch m.Type {
+		case h264.SEIPicTiming:
+			if stream.sps == nil {
+				continue // the field lengths are in the SPS
+			}
+			pt, err := h264.ParsePicTiming(m.Payload, stream.sps)
+			if err != nil {
+				slog.Debug("Invalid picture timing SEI", "ssrc", stream.ssrc, "err", err)
+				continue
+			}
+			for _, tc := range pt.Timecodes {
+				tc = tc.Fill(stream.timecode)
+				level := slog.LevelDebug
+				if !stream.haveTimecode || tc.Discontinuity {
+					level = slog.LevelInfo
+				}
+				stream.timecode, stream.haveTimecode = tc, true
+				slog.Log(context.Background(), level, "Timecode", "ssrc", stream.ssrc, "timecode", tc.String(),
+					"ts", stream.lastTimestamp, "pic_struct", pt.PicStruct)
+			}
+		case h264.SEIRecoveryPoint:
+			rp, err := h264.ParseRecoveryPoint(m.Payload)
+			if err != nil {
+				slog.Debug("Invalid recovery point SEI", "ssrc", stream.ssrc, "err", err)
+				continue
+			}
+			slog.Debug("Recovery point", "ssrc", stream.ssrc, "ts", stream.lastTimestamp, "frames", rp.FrameCount,
+				"exact_match", rp.ExactMatch, "broken_link", rp.BrokenLink)
+		case h264.SEIUserDataUnregistered:
+			u, err := h264.ParseUserDataUnregistered(m.Payload)
+			if err != nil {
+				slog.Debug("Invalid user data SEI", "ssrc", stream.ssrc, "err", err)
+				continue
+			}
+			level := slog.LevelDebug
+			if !stream.userData[u.UUID] {
+				if stream.userData == nil {
+					stream.userData = make(map[[16]byte]bool)
+				}
+				stream.userData[u.UUID] = true
+				level = slog.LevelInfo
+			}
+			args := []any{"ssrc", stream.ssrc, "uuid", u.UUIDString(), "size", len(u.Data)}
+			if text := u.Text(); text != "" {
+				if len(text) > 200 {
+					text = text[:200] + "..."
+				}
+				args = append(args, "text", text)
+			}
+			slog.Log(context.Background(), level, "SEI user data", args...)
+		case h264.SEIUserDataRegistered:
+			cc, err := h264.ParseCaptions(m.Payload)
+			if err != nil {
+				slog.Debug("Invalid caption data", "ssrc", stream.ssrc, "err", err)
+			}
+			if len(cc) > 0 {
+				s.addCaptions(stream, cc)
+			}
+		default:
+			slog.Debug("SEI message", "ssrc", stream.ssrc, "type", m.Type, "size", len(m.Payload))
+		}
+	}
 }
 
 // parsePPS parses Picture Parameter Set
-func (s *RTPServer) parsePPS(ppsData []byte) {
-	fmt.Printf("      -> PPS Data: %d bytes\n", len(ppsData))
-	// In a full implementation, you would parse the PPS fields here
-	// For now, we just acknowledge that we received PPS data
+func (s *RTPServer) parsePPS(stream *streamState, nalu []byte) {
+	pps, err := h264.ParsePPS(nalu)
+	if err != nil {
+		slog.Warn("Invalid PPS", "ssrc", stream.ssrc, "size", len(nalu), "err", err)
+		return
+	}
+	stream.pps = pps
+
+	entropy := "CAVLC"
+	if pps.EntropyCABAC {
+		entropy = "CABAC"
+	}
+	slog.Debug("PPS", "ssrc", stream.ssrc, "id", pps.ID, "sps_id", pps.SPSID, "entropy", entropy)
+}
+
+// videoClockRate is the RTP clock rate of H.264 video (RFC 6184)
+const videoClockRate = 90000
+
+// streamTimeout is how long a stream counts as active after its last packet
+const streamTimeout = 5 * time.Second
+
+// active reports whether the stream sent packets recently and has not said
+// goodbye
+func (st *streamState) active(now time.Time) bool {
+	return now.Sub(st.lastSeen) < streamTimeout && !st.ended
+}
+
+// updateStats counts a packet and updates the RFC 3550 jitter estimate
+func (s *RTPServer) updateStats(stream *streamState, header *RTPPacketHeader, size int, arrival time.Time) {
+	if stream.packets == 0 {
+		stream.firstSeen = arrival
+	}
+	stream.packets++
+	stream.bytes += uint64(size)
+	stream.lastSeen = arrival
+	stream.payloadType = header.PayloadType
+	stream.codec = s.payloadTypes.Codec(header.PayloadType)
+
+	// Jitter is kept on the video clock; Opus timestamps count at 48 kHz
+	// and AAC ones at the sample rate
+	timestamp := float64(header.Timestamp) * videoClockRate / stream.clockRate()
+	transit := arrival.Sub(s.epoch).Seconds()*videoClockRate - timestamp
+	if stream.haveTransit {
+		d := math.Abs(transit - stream.lastTransit)
+		// Ignore timestamp jumps, e.g. after the sender restarted
+		if d < videoClockRate {
+			stream.jitter += (d - stream.jitter) / 16
+		}
+	}
+	stream.lastTransit = transit
+	stream.haveTransit = true
+}
+
+// SetStatsInterval changes the interval between summary log lines, 0 to
+// stop them, from the next line on
+func (s *RTPServer) SetStatsInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statsInterval = interval
+	s.startStats()
+}
+
+// startStats starts the summary logger unless it is disabled or running.
+// s.mu must be held.
+func (s *RTPServer) startStats() {
+	if s.statsInterval > 0 && !s.statsRunning {
+		s.statsRunning = true
+		go s.logStats(s.statsInterval)
+	}
+}
+
+// logStats logs a summary line for every stream that received packets,
+// once per interval, until the interval is set to 0 or the server closed
+func (s *RTPServer) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		if s.statsInterval != interval {
+			if s.statsInterval <= 0 {
+				s.statsRunning = false
+				s.mu.Unlock()
+				return
+			}
+			interval = s.statsInterval
+			ticker.Reset(interval)
+		}
+		for _, st := range s.sortedStreams() {
+			prev := st.summary
+			if st.packets == prev.packets {
+				continue
+			}
+
+			since := prev.at
+			if since.IsZero() {
+				since = st.firstSeen
+			}
+			elapsed := now.Sub(since).Seconds()
+
+			args := []any{"ssrc", st.ssrc, "from", st.addr.String(),
+				"packets", st.packets - prev.packets,
+				"lost", st.lost - prev.lost,
+				"kbps", math.Round(float64(st.bytes-prev.bytes) * 8 / elapsed / 1000),
+				"fps", math.Round(float64(st.frames-prev.frames)/elapsed*10) / 10,
+				"jitter_ms", math.Round(st.jitter/videoClockRate*1e4) / 10,
+				"keyframes", st.keyframes,
+				"waiting_for_keyframe", st.recovery.Waiting()}
+			if stats := st.latency.Stats(); stats.Samples > 0 {
+				args = append(args, "latency_ms", milliseconds(stats.Average))
+			}
+			if stats := st.frameLatency.Stats(); stats.Samples > 0 {
+				args = append(args, "frame_latency_ms", milliseconds(stats.Average))
+			}
+			slog.Info("Stream stats", args...)
+
+			st.summary = statsSnapshot{at: now, packets: st.packets, bytes: st.bytes, lost: st.lost, frames: st.frames}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// collectMetrics returns the server's metrics for a Prometheus scrape
+func (s *RTPServer) collectMetrics() []*metrics.Family {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	packets := metrics.NewCounter("rtp_packets_received_total", "RTP packets received.")
+	bytes := metrics.NewCounter("rtp_bytes_received_total", "RTP bytes received, including headers.")
+	lost := metrics.NewCounter("rtp_packets_lost_total", "RTP packets missing from the sequence.")
+	late := metrics.NewCounter("rtp_packets_late_total", "RTP packets that arrived late or duplicated.")
+	jitter := metrics.NewGauge("rtp_jitter_seconds", "RFC 3550 interarrival jitter.")
+	frames := metrics.NewCounter("rtp_frames_received_total", "Video frames received, counted by RTP timestamp.")
+	keyframes := metrics.NewCounter("rtp_keyframes_received_total", "IDR frames received.")
+	requests := metrics.NewCounter("rtp_keyframe_requests_sent_total", "RTCP keyframe requests sent to the sender.")
+	lastSeen := metrics.NewGauge("rtp_last_packet_timestamp_seconds", "Unix time of the last packet.")
+	continuity := metrics.NewCounter("rtp_mpegts_continuity_errors_total", "MPEG-TS continuity counter errors, for payload type 33.")
+	delay := metrics.NewGauge("rtp_latency_seconds", "Average one-way delay of packets from their send time header extension, or of frames from their capture time by sender reports.")
+	drift := metrics.NewGauge("rtp_clock_drift_ppm", "How much faster the receiver's clock runs than the sender's, from packet send times.")
+
+	active := 0
+	now := time.Now()
+	for _, st := range s.sortedStreams() {
+		ssrc := metrics.Label{Name: "ssrc", Value: strconv.FormatUint(uint64(st.ssrc), 10)}
+
+		packets.Add(float64(st.packets), ssrc)
+		bytes.Add(float64(st.bytes), ssrc)
+		lost.Add(float64(st.lost), ssrc)
+		late.Add(float64(st.late), ssrc)
+		jitter.Add(st.jitter/videoClockRate, ssrc)
+		frames.Add(float64(st.frames), ssrc)
+		keyframes.Add(float64(st.keyframes), ssrc)
+		requests.Add(float64(st.pliSent), ssrc, metrics.Label{Name: "type", Value: "pli"})
+		requests.Add(float64(st.firSent), ssrc, metrics.Label{Name: "type", Value: "fir"})
+		lastSeen.Add(float64(st.lastSeen.UnixNano())/1e9, ssrc)
+		if st.ts != nil {
+			continuity.Add(float64(st.ts.ContinuityErrors), ssrc)
+		}
+		if stats := st.latency.Stats(); stats.Samples > 0 {
+			delay.Add(stats.Average.Seconds(), ssrc, metrics.Label{Name: "of", Value: "packet"})
+			if stats.Drift {
+				drift.Add(stats.DriftPPM, ssrc)
+			}
+		}
+		if stats := st.frameLatency.Stats(); stats.Samples > 0 {
+			delay.Add(stats.Average.Seconds(), ssrc, metrics.Label{Name: "of", Value: "frame"})
+		}
+
+		if st.active(now) {
+			active++
+		}
+	}
+
+	streams := metrics.NewGauge("rtp_active_streams", "Streams that received a packet in the last 5 seconds.")
+	streams.Add(float64(active))
+	rtcpPackets := metrics.NewCounter("rtcp_packets_received_total", "RTCP packets received.")
+	rtcpPackets.Add(float64(s.rtcpReceived))
+
+	return []*metrics.Family{packets, bytes, lost, late, jitter, frames, keyframes, requests, lastSeen, continuity, delay, drift, streams, rtcpPackets}
+}
+
+// sortedStreams returns the streams ordered by SSRC
+func (s *RTPServer) sortedStreams() []*streamState {
+	list := make([]*streamState, 0, len(s.streams))
+	for _, st := range s.streams {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ssrc < list[j].ssrc })
+	return list
+}
+
+// sessionStatus is one stream on the /status page
+type sessionStatus struct {
+	SSRC        uint32          `json:"ssrc"`
+	Source      string          `json:"source"`
+	Active      bool            `json:"active"`
+	Ended       bool            `json:"ended,omitempty"` // by an RTCP BYE
+	PayloadType uint8           `json:"payload_type"`
+	Codec       *codecStatus    `json:"codec,omitempty"`
+	FirstSeen   time.Time       `json:"first_seen"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Packets     uint64          `json:"packets"`
+	Bytes       uint64          `json:"bytes"`
+	Lost        uint64          `json:"lost"`
+	Late        uint64          `json:"late"`
+	JitterMs    float64         `json:"jitter_ms"`
+	Frames      uint64          `json:"frames"`
+	Keyframes   uint64          `json:"keyframes"`
+	Waiting     bool            `json:"waiting_for_keyframe"`
+	Requests    map[string]int  `json:"keyframe_requests"`
+	AudioFrames uint64          `json:"audio_frames,omitempty"`
+	CNAME       string          `json:"cname,omitempty"`
+	Snapshot    *snapshotStatus `json:"snapshot,omitempty"`
+
+	// From SEI messages
+	Timecode     string `json:"timecode,omitempty"`
+	CaptionPairs uint64 `json:"caption_pairs,omitempty"`
+
+	// Only with send time header extensions and sender reports
+	Latency      *latencyStatus `json:"latency,omitempty"`
+	FrameLatency *latencyStatus `json:"frame_latency,omitempty"`
+
+	// MPEG-TS only
+	ContinuityErrors uint64 `json:"continuity_errors,omitempty"`
+}
+
+// snapshotStatus locates a stream's latest snapshot
+type snapshotStatus struct {
+	URL   string    `json:"url"`
+	Taken time.Time `json:"taken"`
+}
+
+// latencyStatus summarizes a stream's one-way delay
+type latencyStatus struct {
+	Source    string   `json:"source"`
+	Samples   uint64   `json:"samples"`
+	LastMs    float64  `json:"last_ms"`
+	MinMs     float64  `json:"min_ms"`
+	AverageMs float64  `json:"average_ms"`
+	MaxMs     float64  `json:"max_ms"`
+	DriftPPM  *float64 `json:"drift_ppm,omitempty"` // once known, see latency.MinDriftSpan
+}
+
+// newLatencyStatus returns the summary of a tracker, nil if it is empty
+func newLatencyStatus(source string, tracker *latency.Tracker) *latencyStatus {
+	stats := tracker.Stats()
+	if stats.Samples == 0 {
+		return nil
+	}
+	status := &latencyStatus{
+		Source:    source,
+		Samples:   stats.Samples,
+		LastMs:    milliseconds(stats.Last),
+		MinMs:     milliseconds(stats.Min),
+		AverageMs: milliseconds(stats.Average),
+		MaxMs:     milliseconds(stats.Max),
+	}
+	if stats.Drift {
+		status.DriftPPM = &stats.DriftPPM
+	}
+	return status
+}
+
+// milliseconds rounds a duration to tenths of milliseconds
+func milliseconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1e4) / 10
+}
+
+// codecStatus describes the stream's latest SPS/PPS
+type codecStatus struct {
+	Name      string  `json:"name"`
+	Codecs    string  `json:"codecs"` // RFC 6381
+	Profile   string  `json:"profile"`
+	Level     string  `json:"level"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	Entropy   string  `json:"entropy,omitempty"`
+}
+
+// status returns the /status page contents
+func (s *RTPServer) status() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessions := []sessionStatus{}
+	for _, st := range s.sortedStreams() {
+		session := sessionStatus{
+			SSRC:         st.ssrc,
+			Active:       st.active(now),
+			Ended:        st.ended,
+			PayloadType:  st.payloadType,
+			FirstSeen:    st.firstSeen,
+			LastSeen:     st.lastSeen,
+			Packets:      st.packets,
+			Bytes:        st.bytes,
+			Lost:         st.lost,
+			Late:         st.late,
+			JitterMs:     st.jitter / videoClockRate * 1000,
+			Frames:       st.frames,
+			Keyframes:    st.keyframes,
+			Waiting:      st.recovery.Waiting(),
+			Requests:     map[string]int{"pli": st.pliSent, "fir": st.firSent},
+			AudioFrames:  st.audioFrames,
+			CNAME:        st.cname,
+			CaptionPairs: st.captionPairs,
+
+			Latency:      newLatencyStatus(st.latencySource, &st.latency),
+			FrameLatency: newLatencyStatus("sender-report", &st.frameLatency),
+		}
+		if st.addr != nil {
+			session.Source = st.addr.String()
+		}
+		if st.ts != nil {
+			session.ContinuityErrors = st.ts.ContinuityErrors
+		}
+		if st.haveTimecode {
+			session.Timecode = st.timecode.String()
+		}
+		if s.snapshots != nil {
+			name := snapshotName(st)
+			if data, taken := s.snapshots.Latest(name); data != nil {
+				session.Snapshot = &snapshotStatus{URL: "/snapshots/" + name + ".jpg", Taken: taken}
+			}
+		}
+		if st.sps != nil {
+			session.Codec = &codecStatus{
+				Name:      "H264",
+				Codecs:    st.sps.Codec(),
+				Profile:   st.sps.ProfileName(),
+				Level:     st.sps.Level(),
+				Width:     st.sps.Width,
+				Height:    st.sps.Height,
+				FrameRate: st.sps.FrameRate,
+			}
+			if st.pps != nil {
+				session.Codec.Entropy = "CAVLC"
+				if st.pps.EntropyCABAC {
+					session.Codec.Entropy = "CABAC"
+				}
+			}
+		}
+		sessions = append(sessions, session)
+	}
+
+	return map[string]interface{}{
+		"listen":       s.addr.String(),
+		"uptime":       now.Sub(s.epoch).Round(time.Second).String(),
+		"packets":      s.received,
+		"rtcp_packets": s.rtcpReceived,
+		"sessions":     sessions,
+	}
 }
 
-// Close closes the RTP server
+// registerHTTP adds the /metrics and /status handlers to mux
+func (s *RTPServer) registerHTTP(mux *http.ServeMux) {
+	mux.Handle("/metrics", metrics.Handler(s.collectMetrics))
+	if s.hls != nil {
+		mux.Handle("/hls/", http.StripPrefix("/hls", s.hls))
+	}
+	if s.whip != nil {
+		mux.Handle("/whip", http.StripPrefix("/whip", s.whip))
+		mux.Handle("/whip/", http.StripPrefix("/whip", s.whip))
+	}
+	if s.snapshots != nil {
+		mux.Handle("/snapshots/", http.StripPrefix("/snapshots", s.snapshots))
+	}
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.status())
+	})
+}
+
+// ServeHTTP starts an HTTP listener for /metrics and /status
+func (s *RTPServer) ServeHTTP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	s.registerHTTP(mux)
+	go http.Serve(listener, mux)
+
+	slog.Info("Serving /metrics and /status", "addr", listener.Addr().String())
+	return nil
+}
+
+// Close closes the RTP server. The WHIP publishers are disconnected first so
+// that no packet arrives while the recording and outputs are finished.
+// Calls after the first return nil.
 func (s *RTPServer) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.close()
+	})
+	return err
+}
+
+func (s *RTPServer) close() error {
+	close(s.done)
+	if s.whip != nil {
+		s.whip.Close()
+	}
+
+	s.mu.Lock()
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	s.sayGoodbye()
+	s.logSummary()
+	for _, stream := range s.streams {
+		if stream.mp4 != nil {
+			stream.mp4.close()
+		}
+		if stream.captions != nil {
+			stream.captions.close(stream.ssrc)
+		}
+	}
+	if s.mp4First != nil {
+		s.mp4First.Close()
+	}
+	if s.ccFirst != nil {
+		s.ccFirst.Close()
+	}
+	s.mu.Unlock()
+	if s.snapshots != nil {
+		s.snapshots.Wait()
+	}
 	return s.conn.Close()
 }
 
-func main() {
+// sayGoodbye sends an RTCP BYE to the source of every active stream, so
+// that senders know the receiver is gone. s.mu must be held.
+func (s *RTPServer) sayGoodbye() {
+	bye := &rtcp.Goodbye{SSRCs: []uint32{s.ssrc}, Reason: "receiver shutting down"}
+	sent := make(map[string]bool)
+	now := time.Now()
+	for _, st := range s.sortedStreams() {
+		if st.addr == nil || !st.active(now) || sent[st.addr.String()] {
+			continue
+		}
+		sent[st.addr.String()] = true
+		s.sendRTCP(st, bye)
+	}
+}
+
+// logSummary logs the totals of every stream and of the server. s.mu must
+// be held.
+func (s *RTPServer) logSummary() {
+	for _, st := range s.sortedStreams() {
+		elapsed := st.lastSeen.Sub(st.firstSeen).Seconds()
+		args := []any{"ssrc", st.ssrc, "packets", st.packets, "bytes", st.bytes, "lost", st.lost, "late", st.late,
+			"frames", st.frames, "keyframes", st.keyframes, "seconds", math.Round(elapsed*10) / 10}
+		if elapsed > 0 {
+			args = append(args, "kbps", math.Round(float64(st.bytes)*8/elapsed/1000))
+		}
+		if st.audioFrames > 0 {
+			args = append(args, "audio_frames", st.audioFrames)
+		}
+		if requests := st.pliSent + st.firSent; requests > 0 {
+			args = append(args, "keyframe_requests", requests)
+		}
+		slog.Info("Stream summary", args...)
+	}
+	slog.Info("Server summary", "streams", len(s.streams), "packets", s.received, "rtcp_packets", s.rtcpReceived,
+		"uptime", time.Since(s.epoch).Round(time.Second).String())
+}
+
+// Record saves every received packet, RTP and RTCP, to a pcap file or, for
+// .rtpdump/.rtp names, an rtpdump file
+func (s *RTPServer) Record(filename string) error {
+	w, err := capture.Create(filename, s.addr.AddrPort())
+	if err != nil {
+		return err
+	}
+	s.recorder = w
+	return nil
+}
+
+// RecordMP4 muxes the H.264 of each received stream into a fragmented MP4.
+// The first stream is written to filename, later ones get their SSRC added
+// to the name.
+func (s *RTPServer) RecordMP4(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	s.mp4Path = filename
+	s.mp4First = file
+	return nil
+}
+
+// streamFileName adds a stream's SSRC to a file name, for the streams after
+// the first
+func streamFileName(path string, ssrc uint32) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), ssrc, ext)
+}
+
+// mp4Output collects a stream's NAL units into access units for the muxer,
+// whose fragments go to an MP4 file and to HLS. Fragments are written as
+// they complete, so the file stays playable if the server is killed.
+type mp4Output struct {
+	file      *os.File    // nil unless recording
+	hls       *hls.Stream // nil unless publishing HLS
+	muxer     *mp4.Muxer
+	nalus     [][]byte // access unit being collected
+	timestamp uint32
+
+	audioSynced bool // SyncAudio was called for the paired AAC stream
+}
+
+// startMuxer creates the MP4 output for a stream
+func (s *RTPServer) startMuxer(stream *streamState) *mp4Output {
+	out := &mp4Output{}
+
+	if s.mp4Path != "" {
+		out.file = s.mp4First
+		s.mp4First = nil
+		if out.file == nil {
+			var err error
+			if out.file, err = os.Create(streamFileName(s.mp4Path, stream.ssrc)); err != nil {
+				slog.Error("Error creating MP4 recording", "ssrc", stream.ssrc, "err", err)
+			}
+		}
+		if out.file != nil {
+			slog.Info("Recording stream to MP4", "ssrc", stream.ssrc, "file", out.file.Name())
+		}
+	}
+
+	if s.hls != nil {
+		name := strconv.FormatUint(uint64(stream.ssrc), 10)
+		out.hls = s.hls.Stream(name)
+		slog.Info("Publishing stream as HLS", "ssrc", stream.ssrc, "path", "/hls/"+name+"/index.m3u8")
+	}
+
+	out.muxer = mp4.NewMuxer(func(seg mp4.Segment) error {
+		if out.hls != nil {
+			if err := out.hls.Write(seg); err != nil {
+				slog.Warn("HLS segment too long", "ssrc", stream.ssrc, "err", err)
+			}
+		}
+		if out.file != nil {
+			_, err := out.file.Write(seg.Data)
+			return err
+		}
+		return nil
+	})
+	if out.hls != nil {
+		// Fragments short enough for segments to keep to the target
+		// duration when GOPs are longer
+		out.muxer.MaxFragment = min(out.muxer.MaxFragment, out.hls.MaxFragment())
+	}
+
+	// The sender's AAC stream is announced before its first keyframe
+	if audio := s.pairedAudio(stream); audio != nil {
+		out.muxer.SetAudio(*audio.aac)
+		slog.Info("Recording audio with the stream", "ssrc", stream.ssrc, "audio_ssrc", audio.ssrc)
+	}
+	return out
+}
+
+// recordNALU adds a complete NAL unit to the stream's MP4 output. Slices
+// are skipped while waiting for a keyframe, since they cannot be decoded.
+func (s *RTPServer) recordNALU(stream *streamState, nalu []byte) {
+	if s.mp4Path == "" && s.hls == nil {
+		return
+	}
+	if stream.mp4 == nil {
+		stream.mp4 = s.startMuxer(stream)
+	}
+
+	out := stream.mp4
+	if len(out.nalus) > 0 && out.timestamp != stream.lastTimestamp {
+		s.finishAccessUnit(stream)
+	}
+	nalType := nalu[0] & 0x1F
+	if stream.recovery.Waiting() && nalType != h264.NALUSPS && nalType != h264.NALUPPS {
+		return
+	}
+	out.timestamp = stream.lastTimestamp
+	out.nalus = append(out.nalus, append([]byte(nil), nalu...))
+}
+
+// finishAccessUnit passes the collected access unit to the muxer
+func (s *RTPServer) finishAccessUnit(stream *streamState) {
+	out := stream.mp4
+	if out == nil || len(out.nalus) == 0 {
+		return
+	}
+	if err := out.muxer.WriteVideo(out.timestamp, out.nalus); err != nil {
+		slog.Error("Error writing MP4 recording", "ssrc", stream.ssrc, "err", err)
+	}
+	out.nalus = nil
+}
+
+// close writes the last fragment, closes the file and ends the playlist
+func (out *mp4Output) close() {
+	if len(out.nalus) > 0 {
+		out.muxer.WriteVideo(out.timestamp, out.nalus)
+	}
+	out.muxer.Flush()
+	if out.file != nil {
+		out.file.Close()
+	}
+	if out.hls != nil {
+		out.hls.End()
+	}
+}
+
+// ExtractCaptions writes the CEA-608 closed captions in the H.264 SEI of
+// each stream to filename, as SubRip subtitles for .srt and as raw caption
+// data for .scc. The first stream with captions is written to filename,
+// later ones get their SSRC added to the name.
+func (s *RTPServer) ExtractCaptions(filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".srt", ".scc":
+	default:
+		return fmt.Errorf("unsupported caption format %q, expected .srt or .scc", filepath.Ext(filename))
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	s.ccPath = filename
+	s.ccFirst = file
+	return nil
+}
+
+// captionReorderDepth is how many frames of caption data wait to be put in
+// presentation order, more than the B-frame reordering of common encoders
+const captionReorderDepth = 16
+
+// captionOutput writes a stream's closed captions to a file. Caption data
+// comes with each frame in decoding order but must be decoded in
+// presentation order, so it waits in a short reorder buffer.
+type captionOutput struct {
+	file    *os.File
+	writer  captions.Writer
+	start   uint32         // RTP timestamp of media time zero
+	pending []captionFrame // by timestamp
+	end     time.Duration  // latest media time written
+	pairs   int            // CEA-608 field 1 pairs written
+	dtvcc   int            // CEA-708 pairs, which are not decoded
+}
+
+// captionFrame is the field 1 caption data of one frame
+type captionFrame struct {
+	timestamp uint32
+	pairs     [][2]byte
+}
+
+// addCaptions counts a frame's caption data and queues it for the file
+func (s *RTPServer) addCaptions(stream *streamState, cc []h264.CCData) {
+	stream.captionPairs += uint64(len(cc))
+	if s.ccPath == "" {
+		return
+	}
+	if stream.captions == nil {
+		stream.captions = s.startCaptions(stream)
+	}
+
+	out := stream.captions
+	frame := captionFrame{timestamp: stream.lastTimestamp}
+	for _, c := range cc {
+		switch c.Type {
+		case h264.CC608Field1:
+			frame.pairs = append(frame.pairs, c.Data)
+		case h264.DTVCCData, h264.DTVCCStart:
+			out.dtvcc++
+		}
+	}
+	if len(frame.pairs) == 0 {
+		return
+	}
+
+	// Insert in timestamp order, then write what can no longer be preceded
+	i := len(out.pending)
+	for i > 0 && int32(frame.timestamp-out.pending[i-1].timestamp) < 0 {
+		i--
+	}
+	out.pending = slices.Insert(out.pending, i, frame)
+	for len(out.pending) > captionReorderDepth {
+		out.write(stream.ssrc, out.pending[0])
+		out.pending = out.pending[1:]
+	}
+}
+
+// startCaptions creates the caption output for a stream
+func (s *RTPServer) startCaptions(stream *streamState) *captionOutput {
+	out := &captionOutput{file: s.ccFirst, start: stream.lastTimestamp}
+	s.ccFirst = nil
+	if out.file == nil {
+		var err error
+		if out.file, err = os.Create(streamFileName(s.ccPath, stream.ssrc)); err != nil {
+			slog.Error("Error creating caption file", "ssrc", stream.ssrc, "err", err)
+			return out
+		}
+	}
+	if strings.EqualFold(filepath.Ext(s.ccPath), ".scc") {
+		out.writer = captions.NewSCCWriter(out.file)
+	} else {
+		out.writer = captions.NewSRTWriter(out.file)
+	}
+	slog.Info("Extracting captions", "ssrc", stream.ssrc, "file", out.file.Name())
+	return out
+}
+
+// write passes a frame's caption data to the writer
+func (out *captionOutput) write(ssrc uint32, frame captionFrame) {
+	if out.writer == nil {
+		return
+	}
+	t := time.Duration(max(int32(frame.timestamp-out.start), 0)) * time.Second / videoClockRate
+	out.end = max(out.end, t)
+	for _, p := range frame.pairs {
+		if err := out.writer.Push(t, p[0], p[1]); err != nil {
+			slog.Error("Error writing captions", "ssrc", ssrc, "err", err)
+			out.writer = nil
+			return
+		}
+		out.pairs++
+	}
+}
+
+// close writes the waiting caption data and closes the file
+func (out *captionOutput) close(ssrc uint32) {
+	for _, frame := range out.pending {
+		out.write(ssrc, frame)
+	}
+	if out.writer != nil {
+		if err := out.writer.Close(out.end); err != nil {
+			slog.Error("Error writing captions", "ssrc", ssrc, "err", err)
+		}
+	}
+	if out.file != nil {
+		out.file.Close()
+		slog.Info("Captions written", "ssrc", ssrc, "file", out.file.Name(), "cea608_pairs", out.pairs, "cea708_pairs", out.dtvcc)
+	}
+}
+
+// PublishHLS republishes every received stream as live HLS under /hls/ on
+// the HTTP listener
+func (s *RTPServer) PublishHLS(opts hls.Options) {
+	s.hls = hls.NewServer(opts)
+}
+
+// AcceptWHIP accepts WebRTC publishers on /whip of the HTTP listener. Their
+// decrypted packets go through the same handling as those from the socket,
+// and keyframe requests go back over the PeerConnection.
+func (s *RTPServer) AcceptWHIP(opts whip.Options) error {
+	h, err := whip.NewHandler(opts, s.handleWHIPPacket)
+	if err != nil {
+		return err
+	}
+	h.OnConnect = func(session *whip.Session) {
+		slog.Info("WHIP publisher connected", "session", session.ID, "from", session.RemoteAddr().String())
+	}
+	h.OnClose = func(session *whip.Session) {
+		slog.Info("WHIP publisher left", "session", session.ID)
+	}
+	s.whip = h
+	return nil
+}
+
+// handleWHIPPacket handles an RTP or RTCP packet from a WHIP publisher
+func (s *RTPServer) handleWHIPPacket(session *whip.Session, packet []byte) {
+	arrival := time.Now()
+	addr := session.RemoteAddr()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(packet, addr, arrival)
+	if !rtcp.IsRTCP(packet) {
+		s.getStream(binary.BigEndian.Uint32(packet[8:12]), addr).peer = session
+	}
+	s.handlePacket(packet, addr, arrival)
+}
+
+// record writes a received packet to the recording, if any. s.mu must be
+// held: packets come from the UDP socket and from the WHIP sessions' reader
+// goroutines, and the capture writers are not safe for concurrent use.
+func (s *RTPServer) record(data []byte, clientAddr *net.UDPAddr, arrival time.Time) {
+	if s.recorder == nil {
+		return
+	}
+
+	src := clientAddr.AddrPort()
+	dst := s.addr.AddrPort()
+
+	// Fill in a wildcard listen address with one of the client's family
+	if local := dst.Addr(); !local.IsValid() || local.IsUnspecified() {
+		if src.Addr().Unmap().Is4() {
+			dst = netip.AddrPortFrom(netip.IPv4Unspecified(), dst.Port())
+		} else {
+			dst = netip.AddrPortFrom(netip.IPv6Unspecified(), dst.Port())
+		}
+	}
+
+	packet := &capture.Packet{
+		Time: arrival,
+		Src:  src,
+		Dst:  dst,
+		Data: append([]byte(nil), data...),
+	}
+	if err := s.recorder.WritePacket(packet); err != nil {
+		slog.Error("Error recording packet", "err", err)
+	}
+}
+
+// newMulticastServer parses the -iface and -source flags and joins the group
+func newMulticastServer(listenAddr, iface, sources string) (*RTPServer, error) {
+	ifi, err := multicast.Interface(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, s := range strings.Split(sources, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+
+	server, err := NewMulticastRTPServer(listenAddr, ifi, ips)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > 0 {
+		slog.Info("Joined multicast group", "group", listenAddr, "sources", ips)
+	} else {
+		slog.Info("Joined multicast group", "group", listenAddr)
+	}
+	return server, nil
+}
+
+// runRelay implements "server relay": it receives a stream and forwards it
+// to subscribers managed through an HTTP control API
+func runRelay(args []string) error {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	control := fs.String("control", "127.0.0.1:8080", "address of the HTTP control API")
+	subscribers := fs.String("subscribe", "", "comma-separated initial subscribers, host:port")
+	sourceTimeout := fs.Duration("source-timeout", relay.DefaultSourceTimeout, "silence after which another sender may take over")
+	payloadTypes := &config.PayloadTypes{}
+	fs.Var(payloadTypes, "payload-types", "codec of each RTP payload type as codec=type pairs, of h264, h265, aac, opus and mp2t")
+	logOpts := logging.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: server relay [flags] [listen_address:port]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := logOpts.Setup(); err != nil {
+		return err
+	}
+
 	listenAddr := ":5004"
-	if len(os.Args) > 1 {
-		listenAddr = os.Args[1]
+	if fs.NArg() > 0 {
+		listenAddr = fs.Arg(0)
 	}
 
 	server, err := NewRTPServer(listenAddr)
 	if err != nil {
-		fmt.Printf("Failed to create RTP server: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 	defer server.Close()
+	server.statsInterval = logOpts.Interval
+	server.payloadTypes = payloadTypes
+
+	server.relay = relay.New(func(packet []byte, addr *net.UDPAddr) error {
+		_, err := server.conn.WriteToUDP(packet, addr)
+		return err
+	})
+	server.relay.SourceTimeout = *sourceTimeout
 
-	fmt.Printf("Starting RTP server on %s\n", listenAddr)
-	server.Start()
+	for _, sub := range strings.Split(*subscribers, ",") {
+		if sub = strings.TrimSpace(sub); sub == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", sub)
+		if err != nil {
+			return err
+		}
+		if err := server.relay.Add(addr); err != nil {
+			return err
+		}
+		slog.Info("Added subscriber", "addr", addr.String())
+	}
+
+	controlListener, err := net.Listen("tcp", *control)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/subscribers", relay.Handler(server.relay))
+	server.registerHTTP(mux)
+	go http.Serve(controlListener, mux)
+
+	slog.Info("Relaying", "listen", listenAddr, "control", "http://"+controlListener.Addr().String()+"/subscribers")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return server.Start(ctx)
+}
+
+// runAnalyze implements "server analyze": it feeds the RTP packets of a
+// capture through the normal header and NAL parsing and prints a report
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "write the report as JSON")
+	verbose := fs.Bool("v", false, "also print the per-packet parsing log")
+	port := fs.Uint("port", 0, "only analyze UDP packets from or to this port")
+	ssrc := fs.Uint("ssrc", 0, "only analyze packets with this SSRC")
+	validateStreams := fs.Bool("validate", false, "check H.264 conformance instead, exiting with status 2 on violations")
+	payloadTypes := &config.PayloadTypes{}
+	fs.Var(payloadTypes, "payload-types", "codec of each RTP payload type as codec=type pairs, of h264, h265, aac, opus and mp2t")
+	fs.Usage = func() {
+		fmt.Println("Usage: server analyze [flags] <pcap|pcapng|rtpdump>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	reader, err := capture.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// An offline server: no socket, so no feedback is sent
+	server := &RTPServer{
+		ssrc:         54321,
+		streams:      make(map[uint32]*streamState),
+		analyzer:     analyze.NewAnalyzer(),
+		payloadTypes: payloadTypes,
+	}
+	if *validateStreams {
+		server.validator = validate.NewValidator()
+	}
+	filter := capture.Filter{Port: uint16(*port), SSRC: uint32(*ssrc)}
+
+	// The parsing code logs as it goes; hide that unless asked for
+	if *verbose {
+		opts := logging.Options{Verbose: true, Format: logging.FormatText}
+		opts.Setup()
+	} else {
+		logging.Discard()
+	}
+
+	for {
+		p, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !filter.Match(p) {
+			continue
+		}
+		if server.epoch.IsZero() {
+			server.epoch = p.Time
+		}
+		server.handlePacket(p.Data, net.UDPAddrFromAddrPort(p.Src), p.Time)
+	}
+
+	if server.validator != nil {
+		if err := server.validator.WriteReport(os.Stdout); err != nil {
+			return err
+		}
+		if !server.validator.Passed() {
+			os.Exit(exitValidationFailed)
+		}
+		return nil
+	}
+
+	report := server.analyzer.Report()
+	if *jsonOutput {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+// watchConfig reloads the config file on every SIGHUP, applying the changed
+// settings that are reloadable and then calling apply
+func watchConfig(loader *config.Loader, reloadable []string, apply func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			applied, restart, err := loader.Reload(reloadable...)
+			if err != nil {
+				slog.Error("Config reload failed, keeping the current settings", "err", err)
+				continue
+			}
+			if err := apply(); err != nil {
+				slog.Error("Error applying reloaded config", "err", err)
+			}
+			slog.Info("Reloaded config", "changed", applied)
+			if len(restart) > 0 {
+				slog.Warn("Changed settings take effect after a restart", "settings", restart)
+			}
+		}
+	}()
+}
+
+// newSnapshotDecoder runs the named ffmpeg executable, which must exist
+func newSnapshotDecoder(name string) (thumbnail.Decoder, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return &thumbnail.ProcessDecoder{Path: path}, nil
+}
+
+func main() {
+	subcommands := map[string]func(args []string) error{
+		"relay":   runRelay,
+		"analyze": runAnalyze,
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				logging.Fatal(os.Args[1]+" failed", "err", err)
+			}
+			return
+		}
+	}
+
+	recordFile := flag.String("record", "", "save every received packet to a .pcap or .rtpdump file")
+	mp4File := flag.String("mp4", "", "mux received H.264 into a fragmented MP4 file")
+	captionsFile := flag.String("captions", "", "extract CEA-608 closed captions from H.264 SEI to an .srt or .scc file")
+	publishHLS := flag.Bool("hls", false, "republish received streams as live HLS under /hls/ on the -http address")
+	hlsSegment := flag.Duration("hls-segment", hls.DefaultTargetDuration, "HLS segment duration, cut at the next keyframe; the first segment fixes the playlist target duration")
+	hlsWindow := flag.Int("hls-window", hls.DefaultWindow, "number of segments in the live HLS playlist")
+	hlsPlayer := flag.String("hls-js", "", "hls.min.js to serve for the HLS player pages instead of loading it from jsDelivr")
+	iface := flag.String("iface", "", "network interface to join the multicast group on")
+	sources := flag.String("source", "", "comma-separated senders for source-specific multicast")
+	httpAddr := flag.String("http", "", "serve Prometheus /metrics and JSON /status on this address, e.g. :9090")
+	acceptWHIP := flag.Bool("whip", false, "accept WebRTC publishers with WHIP on /whip of the -http address")
+	whipUDP := flag.String("whip-udp", "", "UDP address shared by all WHIP sessions, e.g. :8189 (default: a port per session)")
+	validateStreams := flag.Bool("validate", false, "check received H.264 for RFC 6184 and H.264 conformance, print a report once packets stop and exit with status 2 on violations")
+	validateIdle := flag.Duration("validate-idle", 3*time.Second, "with -validate, how long without packets ends the run")
+	snapshotDir := flag.String("snapshots", "", "save a JPEG snapshot of each stream's keyframes to this directory, also served on /snapshots/ of the -http address")
+	snapshotInterval := flag.Duration("snapshot-interval", thumbnail.DefaultInterval, "least time between snapshots of a stream")
+	snapshotDecoder := flag.String("snapshot-decoder", "ffmpeg", "ffmpeg executable decoding snapshots")
+	payloadTypes := &config.PayloadTypes{}
+	flag.Var(payloadTypes, "payload-types", "codec of each RTP payload type as codec=type pairs, of h264, h265, aac, opus and mp2t")
+	configFile := flag.String("config", "", "read settings from a JSON file of flag names and values, overridden by the command line; SIGHUP reloads -v, -log-format, -stats and -snapshot-interval")
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Println("Usage: server [flags] [listen_address:port]")
+		fmt.Println("       server relay [flags] [listen_address:port]")
+		fmt.Println("       server analyze [flags] <capture_file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	var loader *config.Loader
+	if *configFile != "" {
+		var err error
+		if loader, err = config.NewLoader(flag.CommandLine, *configFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		args = loader.Args()
+	}
+	if err := logOpts.Setup(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	listenAddr := ":5004"
+	if len(args) > 0 {
+		listenAddr = args[0]
+	}
+
+	var server *RTPServer
+	var err error
+	if multicast.IsMulticast(listenAddr) {
+		server, err = newMulticastServer(listenAddr, *iface, *sources)
+	} else {
+		server, err = NewRTPServer(listenAddr)
+	}
+	if err != nil {
+		logging.Fatal("Failed to create RTP server", "err", err)
+	}
+	server.statsInterval = logOpts.Interval
+	server.payloadTypes = payloadTypes
+
+	if *validateStreams {
+		server.validator = validate.NewValidator()
+		server.idleTimeout = *validateIdle
+		slog.Info("Validating received streams", "idle", *validateIdle)
+	}
+
+	if *recordFile != "" {
+		if err := server.Record(*recordFile); err != nil {
+			logging.Fatal("Failed to create recording", "err", err)
+		}
+		slog.Info("Recording received packets", "file", *recordFile)
+	}
+
+	if *mp4File != "" {
+		if err := server.RecordMP4(*mp4File); err != nil {
+			logging.Fatal("Failed to create MP4 recording", "err", err)
+		}
+	}
+
+	if *captionsFile != "" {
+		if err := server.ExtractCaptions(*captionsFile); err != nil {
+			logging.Fatal("Failed to create caption file", "err", err)
+		}
+	}
+
+	if *publishHLS {
+		opts := hls.Options{TargetDuration: *hlsSegment, Window: *hlsWindow}
+		if *hlsPlayer != "" {
+			player, err := os.ReadFile(*hlsPlayer)
+			if err != nil {
+				logging.Fatal("Failed to read hls.js", "err", err)
+			}
+			opts.Player = player
+		}
+		server.PublishHLS(opts)
+		if *httpAddr == "" {
+			*httpAddr = ":8080"
+		}
+	}
+
+	if *snapshotDir != "" {
+		decoder, err := newSnapshotDecoder(*snapshotDecoder)
+		if err != nil {
+			logging.Fatal("Failed to set up snapshot decoder", "err", err)
+		}
+		if err := server.TakeSnapshots(decoder, *snapshotDir, *snapshotInterval); err != nil {
+			logging.Fatal("Failed to create snapshot directory", "err", err)
+		}
+		slog.Info("Taking keyframe snapshots", "dir", *snapshotDir, "interval", *snapshotInterval, "decoder", *snapshotDecoder)
+	}
+
+	if *acceptWHIP {
+		if err := server.AcceptWHIP(whip.Options{
+			UDPAddr:         *whipUDP,
+			H264PayloadType: payloadTypes.Of(config.CodecH264),
+			OpusPayloadType: payloadTypes.Of(config.CodecOpus),
+		}); err != nil {
+			logging.Fatal("Failed to start WHIP endpoint", "err", err)
+		}
+		if *httpAddr == "" {
+			*httpAddr = ":8080"
+		}
+	}
+
+	if *httpAddr != "" {
+		if err := server.ServeHTTP(*httpAddr); err != nil {
+			logging.Fatal("Failed to start HTTP listener", "err", err)
+		}
+	}
+
+	if loader != nil {
+		watchConfig(loader, []string{"v", "log-format", "stats", "snapshot-interval"}, func() error {
+			server.SetStatsInterval(logOpts.Interval)
+			if server.snapshots != nil {
+				server.snapshots.SetInterval(*snapshotInterval)
+			}
+			return logOpts.Setup()
+		})
+	}
+
+	// On SIGINT or SIGTERM, say goodbye to the senders, finish the output
+	// files and log the totals before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	code := 0
+	if err := server.Start(ctx); err != nil {
+		slog.Error("Failed to receive packets", "err", err)
+		code = 1
+	} else if ctx.Err() != nil {
+		slog.Info("Signal received, shutting down")
+	}
+
+	if server.validator != nil {
+		server.validator.WriteReport(os.Stdout)
+		if !server.validator.Passed() && code == 0 {
+			code = exitValidationFailed
+		}
+	}
+	server.Close()
+	os.Exit(code)
 }
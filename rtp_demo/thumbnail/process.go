@@ -0,0 +1,53 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strings"
+	"time"
+
+	"rtp_demo/h264"
+)
+
+// DefaultTimeout bounds a ProcessDecoder run
+const DefaultTimeout = 5 * time.Second
+
+// ProcessDecoder decodes with an ffmpeg executable, one process per
+// snapshot: the access unit goes in as an Annex B elementary stream on
+// stdin and the picture comes back as PNG on stdout
+type ProcessDecoder struct {
+	Path    string        // executable, looked up in PATH if it has no slash
+	Timeout time.Duration // 0 for DefaultTimeout
+}
+
+// Decode implements Decoder
+func (d *ProcessDecoder) Decode(nalus [][]byte) (image.Image, error) {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, d.Path, "-hide_banner", "-loglevel", "error",
+		"-f", "h264", "-i", "pipe:0", "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	cmd.Stdin = bytes.NewReader(h264.AppendAnnexB(nil, nalus))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("thumbnail: %s: %w: %s", d.Path, err, msg)
+		}
+		return nil, fmt.Errorf("thumbnail: %s: %w", d.Path, err)
+	}
+
+	img, err := png.Decode(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail: %s output: %w", d.Path, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,251 @@
+// Package thumbnail takes periodic JPEG snapshots of live H.264 streams, a
+// quick visual check that a camera is alive. The receiver offers each
+// keyframe's access unit; when a stream is due, it is decoded in the
+// background, scaled down and saved to a file and served over HTTP.
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for Options
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultWidth    = 320
+	DefaultQuality  = 75
+)
+
+// Decoder decodes the picture of an IDR access unit, given as its NAL units
+// preceded by the SPS and PPS
+type Decoder interface {
+	Decode(nalus [][]byte) (image.Image, error)
+}
+
+// Options controls snapshotting
+type Options struct {
+	// Dir is where each stream's latest snapshot is written as
+	// <name>.jpg, none are written if empty
+	Dir string
+
+	// Interval is the least time between snapshots of a stream; a snapshot
+	// is taken at the first keyframe after it
+	Interval time.Duration
+
+	// Width is the width snapshots are scaled down to, keeping the aspect
+	// ratio; pictures narrower than it keep their size
+	Width int
+
+	// Quality is the JPEG quality, 1 to 100
+	Quality int
+
+	// Done, if set, is called after each snapshot with its size or the
+	// error. It is called from the decoding goroutine.
+	Done func(name string, size int, err error)
+}
+
+// Snapshotter decodes and stores the snapshots of every stream
+type Snapshotter struct {
+	opts    Options
+	decoder Decoder
+
+	mu      sync.Mutex
+	streams map[string]*snapshot
+	wg      sync.WaitGroup
+}
+
+// snapshot is the state of one stream
+type snapshot struct {
+	attempted time.Time // when the latest decode started
+	busy      bool      // a decode is in progress
+	jpeg      []byte    // latest snapshot, nil before the first
+	taken     time.Time
+}
+
+// New creates a snapshotter decoding with decoder
+func New(decoder Decoder, opts Options) *Snapshotter {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Width <= 0 {
+		opts.Width = DefaultWidth
+	}
+	if opts.Quality <= 0 || opts.Quality > 100 {
+		opts.Quality = DefaultQuality
+	}
+	return &Snapshotter{opts: opts, decoder: decoder, streams: make(map[string]*snapshot)}
+}
+
+// SetInterval changes the least time between snapshots of a stream
+func (s *Snapshotter) SetInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	s.opts.Interval = interval
+}
+
+// Due reports whether a stream is due for a snapshot, so that callers can
+// skip collecting keyframes that would not be used
+func (s *Snapshotter) Due(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.due(name, time.Now())
+}
+
+func (s *Snapshotter) due(name string, now time.Time) bool {
+	st := s.streams[name]
+	return st == nil || (!st.busy && now.Sub(st.attempted) >= s.opts.Interval)
+}
+
+// Offer hands over a stream's keyframe and reports whether it is decoded,
+// which happens in the background when the stream is due. The NAL units are
+// not copied and must not be modified afterwards.
+func (s *Snapshotter) Offer(name string, nalus [][]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.due(name, now) {
+		return false
+	}
+	st := s.streams[name]
+	if st == nil {
+		st = &snapshot{}
+		s.streams[name] = st
+	}
+	// A failed decode is retried after a full interval too, so a missing
+	// decoder does not cost a process per keyframe
+	st.attempted, st.busy = now, true
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		data, err := s.take(name, nalus)
+
+		s.mu.Lock()
+		st.busy = false
+		if err == nil {
+			st.jpeg, st.taken = data, time.Now()
+		}
+		s.mu.Unlock()
+
+		if s.opts.Done != nil {
+			s.opts.Done(name, len(data), err)
+		}
+	}()
+	return true
+}
+
+// take decodes, scales, encodes and saves one snapshot
+func (s *Snapshotter) take(name string, nalus [][]byte) ([]byte, error) {
+	img, err := s.decoder.Decode(nalus)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scale(img, s.opts.Width), &jpeg.Options{Quality: s.opts.Quality}); err != nil {
+		return nil, fmt.Errorf("thumbnail: %w", err)
+	}
+	if s.opts.Dir != "" {
+		if err := writeFile(filepath.Join(s.opts.Dir, name+".jpg"), buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFile replaces a file by renaming a complete temporary one over it,
+// so that readers never see a partial image
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+	return nil
+}
+
+// Latest returns a stream's latest snapshot and when it was taken, nil
+// before the first
+func (s *Snapshotter) Latest(name string) ([]byte, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[name]; st != nil {
+		return st.jpeg, st.taken
+	}
+	return nil, time.Time{}
+}
+
+// Wait waits for the snapshots in progress
+func (s *Snapshotter) Wait() {
+	s.wg.Wait()
+}
+
+// ServeHTTP serves the latest snapshot of each stream at /<name>.jpg
+func (s *Snapshotter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".jpg")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	data, taken := s.Latest(name)
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name+".jpg", taken, bytes.NewReader(data))
+}
+
+// scale shrinks an image to the given width, averaging the source pixels
+// under each destination pixel
+func scale(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return src
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+cr>>8, g+cg>>8, bl+cb>>8, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xFF})
+		}
+	}
+	return dst
+}
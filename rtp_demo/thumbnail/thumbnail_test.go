@@ -0,0 +1,180 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDecoder returns a fixed picture or error
+type fakeDecoder struct {
+	img   image.Image
+	err   error
+	calls int
+}
+
+func (d *fakeDecoder) Decode(nalus [][]byte) (image.Image, error) {
+	d.calls++
+	return d.img, d.err
+}
+
+// testPicture returns a picture whose left half is red and right half blue
+func testPicture(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{0xFF, 0, 0, 0xFF}
+			if x >= width/2 {
+				c = color.RGBA{0, 0, 0xFF, 0xFF}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestSnapshotter(t *testing.T) {
+	dir := t.TempDir()
+	decoder := &fakeDecoder{img: testPicture(640, 480)}
+	var sizes []int
+	s := New(decoder, Options{Dir: dir, Interval: time.Hour, Done: func(name string, size int, err error) {
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		sizes = append(sizes, size)
+	}})
+
+	if !s.Offer("1234", nil) {
+		t.Fatal("Expected the first keyframe to be taken")
+	}
+	if s.Offer("1234", nil) || s.Due("1234") {
+		t.Error("Expected the next keyframe within the interval to be skipped")
+	}
+	if !s.Due("5678") {
+		t.Error("Expected another stream to be due")
+	}
+	s.Wait()
+	if decoder.calls != 1 || len(sizes) != 1 {
+		t.Fatalf("Expected 1 decode, got %d", decoder.calls)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "1234.jpg"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(data) != sizes[0] {
+		t.Errorf("Expected %d bytes, got %d", sizes[0], len(data))
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != DefaultWidth || b.Dy() != 240 {
+		t.Errorf("Expected 320x240, got %dx%d", b.Dx(), b.Dy())
+	}
+	if r, _, b, _ := img.At(10, 120).RGBA(); r>>8 < 0xE0 || b>>8 > 0x20 {
+		t.Errorf("Expected red on the left, got %v", img.At(10, 120))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/1234.jpg", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/jpeg" || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Expected the snapshot, got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+	for _, path := range []string{"/5678.jpg", "/1234", "/"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestSnapshotterDecodeError(t *testing.T) {
+	dir := t.TempDir()
+	var got error
+	s := New(&fakeDecoder{err: errors.New("no decoder")}, Options{Dir: dir, Interval: time.Hour,
+		Done: func(name string, size int, err error) { got = err }})
+
+	s.Offer("1", nil)
+	s.Wait()
+	if got == nil {
+		t.Error("Expected the decode error")
+	}
+	if data, _ := s.Latest("1"); data != nil {
+		t.Error("Expected no snapshot")
+	}
+	if s.Due("1") {
+		t.Error("Expected a failed stream to wait for the interval")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files, got %d", len(entries))
+	}
+}
+
+func TestScale(t *testing.T) {
+	img := scale(testPicture(8, 4), 4)
+	if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 2 {
+		t.Fatalf("Expected 4x2, got %dx%d", b.Dx(), b.Dy())
+	}
+	if c := color.RGBAModel.Convert(img.At(1, 1)); c != (color.RGBA{0xFF, 0, 0, 0xFF}) {
+		t.Errorf("Expected red, got %v", c)
+	}
+	if c := color.RGBAModel.Convert(img.At(2, 0)); c != (color.RGBA{0, 0, 0xFF, 0xFF}) {
+		t.Errorf("Expected blue, got %v", c)
+	}
+
+	small := testPicture(100, 50)
+	if scale(small, 320) != image.Image(small) {
+		t.Error("Expected a narrow picture to keep its size")
+	}
+}
+
+// fakeFFmpeg writes a shell script standing in for ffmpeg
+func fakeFFmpeg(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessDecoder(t *testing.T) {
+	dir := t.TempDir()
+	var picture bytes.Buffer
+	png.Encode(&picture, testPicture(16, 8))
+	os.WriteFile(filepath.Join(dir, "out.png"), picture.Bytes(), 0o644)
+
+	// Saves its input and answers with the picture
+	input := filepath.Join(dir, "in.h264")
+	d := &ProcessDecoder{Path: fakeFFmpeg(t, "cat > "+input+"\ncat "+filepath.Join(dir, "out.png")+"\n")}
+	img, err := d.Decode([][]byte{{0x67, 0x42}, {0x68, 0xCE}, {0x65, 0x88}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("Expected 16x8, got %dx%d", b.Dx(), b.Dy())
+	}
+	want := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xCE, 0, 0, 0, 1, 0x65, 0x88}
+	if got, _ := os.ReadFile(input); !bytes.Equal(got, want) {
+		t.Errorf("Expected Annex B input % X, got % X", want, got)
+	}
+
+	d = &ProcessDecoder{Path: fakeFFmpeg(t, "cat > /dev/null\necho 'Invalid data found' >&2\nexit 1\n")}
+	if _, err := d.Decode(nil); err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Errorf("Expected the error output, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Package validate checks received H.264 streams against RFC 6184 and the
+// NAL unit rules of H.264 section 7.4.1, collecting the violations into a
+// pass/fail report. The stateless checks live here; the receiver applies
+// the ones that need reassembly state and reports them with Add.
+package validate
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Rule names a kind of violation
+type Rule string
+
+// Rules checked
+const (
+	ForbiddenBit            Rule = "forbidden-zero-bit"         // F bit set in a NAL unit or payload header
+	NRI                     Rule = "nri"                        // nal_ref_idc inconsistent with the type or the aggregated units
+	FUStartAndEnd           Rule = "fu-a-start-and-end"         // an FU-A with both S and E set
+	FUType                  Rule = "fu-a-type"                  // an FU-A carrying a type that cannot be fragmented
+	FUMissingEnd            Rule = "fu-a-missing-end"           // a fragmented NAL unit left unfinished without packet loss
+	STAPTruncated           Rule = "stap-a-truncated"           // a STAP-A whose length fields run past the payload
+	IDRWithoutParameterSets Rule = "idr-without-parameter-sets" // an IDR before any SPS and PPS
+	TimestampRegression     Rule = "timestamp-regression"       // an RTP timestamp going back where it cannot
+)
+
+// maxExamples is how many violations of each rule are kept per stream
+const maxExamples = 5
+
+// Finding is a violation found in one packet
+type Finding struct {
+	Rule   Rule
+	Detail string
+}
+
+// Violation is a finding in a given packet of a stream
+type Violation struct {
+	Finding
+	SSRC     uint32
+	Sequence uint16
+}
+
+// Validator collects the violations of every stream
+type Validator struct {
+	packets  map[uint32]uint64
+	counts   map[uint32]map[Rule]int
+	examples map[uint32]map[Rule][]Violation
+}
+
+// NewValidator creates an empty validator
+func NewValidator() *Validator {
+	return &Validator{
+		packets:  make(map[uint32]uint64),
+		counts:   make(map[uint32]map[Rule]int),
+		examples: make(map[uint32]map[Rule][]Violation),
+	}
+}
+
+// Packet counts a checked packet of a stream
+func (v *Validator) Packet(ssrc uint32) {
+	v.packets[ssrc]++
+}
+
+// Add records a violation and reports whether it is among the first few of
+// its rule in the stream, which are kept as examples
+func (v *Validator) Add(violation Violation) bool {
+	if v.counts[violation.SSRC] == nil {
+		v.counts[violation.SSRC] = make(map[Rule]int)
+		v.examples[violation.SSRC] = make(map[Rule][]Violation)
+	}
+	v.counts[violation.SSRC][violation.Rule]++
+
+	examples := v.examples[violation.SSRC][violation.Rule]
+	if len(examples) >= maxExamples {
+		return false
+	}
+	v.examples[violation.SSRC][violation.Rule] = append(examples, violation)
+	return true
+}
+
+// Violations returns the total number of violations
+func (v *Validator) Violations() int {
+	total := 0
+	for _, counts := range v.counts {
+		for _, n := range counts {
+			total += n
+		}
+	}
+	return total
+}
+
+// Passed reports whether packets were checked and none broke a rule
+func (v *Validator) Passed() bool {
+	return len(v.packets) > 0 && v.Violations() == 0
+}
+
+// WriteReport writes the result, each stream's violations by rule and the
+// first few of each
+func (v *Validator) WriteReport(w io.Writer) error {
+	var packets uint64
+	for _, n := range v.packets {
+		packets += n
+	}
+	result := "PASSED"
+	if !v.Passed() {
+		result = "FAILED"
+	}
+	if _, err := fmt.Fprintf(w, "Validation %s: %d violations in %d packets of %d streams\n",
+		result, v.Violations(), packets, len(v.packets)); err != nil {
+		return err
+	}
+
+	for _, ssrc := range sortedKeys(v.packets) {
+		counts := v.counts[ssrc]
+		fmt.Fprintf(w, "\nSSRC %d: %d packets\n", ssrc, v.packets[ssrc])
+		rules := make([]Rule, 0, len(counts))
+		for rule := range counts {
+			rules = append(rules, rule)
+		}
+		sort.Slice(rules, func(i, j int) bool { return rules[i] < rules[j] })
+
+		for _, rule := range rules {
+			fmt.Fprintf(w, "  %s: %d\n", rule, counts[rule])
+			for _, e := range v.examples[ssrc][rule] {
+				fmt.Fprintf(w, "    seq %d: %s\n", e.Sequence, e.Detail)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the SSRCs of a map in order
+func sortedKeys(m map[uint32]uint64) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// CheckNALHeader checks a NAL unit header: the forbidden bit, and the
+// nal_ref_idc H.264 requires of its type, nonzero for parameter sets and
+// IDR slices and zero for SEI, delimiters and filler
+func CheckNALHeader(header byte) []Finding {
+	var findings []Finding
+	nalType, nri := header&0x1F, header>>5&0x03
+	if header&0x80 != 0 {
+		findings = append(findings, Finding{ForbiddenBit, fmt.Sprintf("NAL unit of type %d", nalType)})
+	}
+	switch nalType {
+	case 5, 7, 8:
+		if nri == 0 {
+			findings = append(findings, Finding{NRI, fmt.Sprintf("nal_ref_idc 0 on NAL unit type %d", nalType)})
+		}
+	case 6, 9, 10, 11, 12:
+		if nri != 0 {
+			findings = append(findings, Finding{NRI, fmt.Sprintf("nal_ref_idc %d on NAL unit type %d", nri, nalType)})
+		}
+	}
+	return findings
+}
+
+// CheckFUA checks the FU header of an FU-A (RFC 6184 section 5.8): a NAL
+// unit must not fit in one fragment, and aggregation and fragmentation
+// units cannot be fragmented. The F and NRI bits of the FU indicator belong
+// to the fragmented NAL unit, for CheckNALHeader.
+func CheckFUA(payload []byte) []Finding {
+	if len(payload) < 2 {
+		return []Finding{{FUType, "FU-A shorter than its headers"}}
+	}
+	var findings []Finding
+	header := payload[1]
+	if header&0xC0 == 0xC0 {
+		findings = append(findings, Finding{FUStartAndEnd, fmt.Sprintf("FU-A of type %d", header&0x1F)})
+	}
+	if t := header & 0x1F; t == 0 || t >= 24 {
+		findings = append(findings, Finding{FUType, fmt.Sprintf("FU-A carrying type %d", t)})
+	}
+	return findings
+}
+
+// CheckSTAPA checks the structure of a STAP-A (RFC 6184 section 5.7.1):
+// its length fields must add up to the payload, and its NRI must be the
+// highest of the aggregated NAL units
+func CheckSTAPA(payload []byte) []Finding {
+	if len(payload) < 1 {
+		return nil
+	}
+	var findings []Finding
+	if payload[0]&0x80 != 0 {
+		findings = append(findings, Finding{ForbiddenBit, "STAP-A header"})
+	}
+
+	data := payload[1:]
+	units := 0
+	var maxNRI byte
+	for offset := 0; offset < len(data); {
+		if offset+2 > len(data) {
+			findings = append(findings, Finding{STAPTruncated, fmt.Sprintf("1 byte left for a length field at offset %d", offset+1)})
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+		if size == 0 || offset+size > len(data) {
+			findings = append(findings, Finding{STAPTruncated, fmt.Sprintf("NAL unit of %d bytes at offset %d, %d left", size, offset+1, len(data)-offset)})
+			break
+		}
+		if nri := data[offset] >> 5 & 0x03; nri > maxNRI {
+			maxNRI = nri
+		}
+		units++
+		offset += size
+	}
+
+	if nri := payload[0] >> 5 & 0x03; units > 0 && nri != maxNRI {
+		findings = append(findings, Finding{NRI, fmt.Sprintf("STAP-A NRI %d, aggregated units up to %d", nri, maxNRI)})
+	}
+	return findings
+}
@@ -0,0 +1,126 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+// rules returns the rules of the findings
+func rules(findings []Finding) []Rule {
+	var list []Rule
+	for _, f := range findings {
+		list = append(list, f.Rule)
+	}
+	return list
+}
+
+func equalRules(a, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCheckNALHeader(t *testing.T) {
+	tests := []struct {
+		header byte
+		want   []Rule
+	}{
+		{0x67, nil},                  // SPS
+		{0x65, nil},                  // IDR
+		{0x01, nil},                  // non-reference P slice
+		{0x06, nil},                  // SEI
+		{0x07, []Rule{NRI}},          // SPS with nal_ref_idc 0
+		{0x05, []Rule{NRI}},          // IDR with nal_ref_idc 0
+		{0x29, []Rule{NRI}},          // AUD with nal_ref_idc 1
+		{0xC1, []Rule{ForbiddenBit}}, // F bit on a slice
+		{0x86, []Rule{ForbiddenBit}}, // F bit on an SEI
+	}
+	for _, tt := range tests {
+		if got := rules(CheckNALHeader(tt.header)); !equalRules(got, tt.want) {
+			t.Errorf("Header 0x%02X: expected %v, got %v", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestCheckFUA(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		want    []Rule
+	}{
+		{[]byte{0x7C, 0x85, 0x88}, nil},
+		{[]byte{0x7C, 0x45, 0x88}, nil},
+		{[]byte{0x7C, 0xC5, 0x88}, []Rule{FUStartAndEnd}},
+		{[]byte{0x7C, 0x98, 0x00}, []Rule{FUType}},
+		{[]byte{0x7C, 0x9C, 0x00}, []Rule{FUType}},
+		{[]byte{0x7C, 0x80, 0x00}, []Rule{FUType}},
+		{[]byte{0x7C}, []Rule{FUType}},
+	}
+	for _, tt := range tests {
+		if got := rules(CheckFUA(tt.payload)); !equalRules(got, tt.want) {
+			t.Errorf("FU-A % X: expected %v, got %v", tt.payload, tt.want, got)
+		}
+	}
+}
+
+func TestCheckSTAPA(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []Rule
+	}{
+		{"valid", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xCE}, nil},
+		{"forbidden bit", []byte{0xF8, 0x00, 0x02, 0x67, 0x42}, []Rule{ForbiddenBit}},
+		{"length past the end", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x09, 0x68}, []Rule{STAPTruncated}},
+		{"half a length field", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00}, []Rule{STAPTruncated}},
+		{"empty unit", []byte{0x78, 0x00, 0x00}, []Rule{STAPTruncated}},
+		{"NRI below the units", []byte{0x58, 0x00, 0x02, 0x67, 0x42}, []Rule{NRI}},
+		{"NRI above the units", []byte{0x78, 0x00, 0x02, 0x41, 0x9A}, []Rule{NRI}},
+	}
+	for _, tt := range tests {
+		if got := rules(CheckSTAPA(tt.payload)); !equalRules(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestValidatorReport(t *testing.T) {
+	v := NewValidator()
+	if v.Passed() {
+		t.Error("Expected a validator without packets to fail")
+	}
+
+	v.Packet(1)
+	v.Packet(2)
+	if !v.Passed() {
+		t.Error("Expected clean packets to pass")
+	}
+
+	for i := 0; i < maxExamples+2; i++ {
+		kept := v.Add(Violation{Finding: Finding{FUStartAndEnd, "FU-A of type 5"}, SSRC: 2, Sequence: uint16(i)})
+		if kept != (i < maxExamples) {
+			t.Errorf("Violation %d: expected kept=%v, got %v", i, i < maxExamples, kept)
+		}
+	}
+	if v.Passed() || v.Violations() != maxExamples+2 {
+		t.Errorf("Expected failure with %d violations, got %d", maxExamples+2, v.Violations())
+	}
+
+	var report strings.Builder
+	if err := v.WriteReport(&report); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, want := range []string{"Validation FAILED", "SSRC 1: 1 packets", "fu-a-start-and-end: 7", "seq 4: FU-A of type 5"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Expected %q in the report:\n%s", want, report.String())
+		}
+	}
+	if strings.Contains(report.String(), "seq 5:") {
+		t.Errorf("Expected only %d examples:\n%s", maxExamples, report.String())
+	}
+}
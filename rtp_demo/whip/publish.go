@@ -0,0 +1,155 @@
+package whip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// ConnectTimeout bounds how long Publish waits for ICE and DTLS
+const ConnectTimeout = 10 * time.Second
+
+// Publisher sends H.264 RTP packets to a WHIP endpoint. It is an
+// io.Writer of RTP packets and an io.Reader of the RTCP coming back.
+type Publisher struct {
+	pc       *webrtc.PeerConnection
+	track    *webrtc.TrackLocalStaticRTP
+	sender   *webrtc.RTPSender
+	resource string // session URL for DELETE
+}
+
+// Publish offers an H.264 track to the endpoint and returns once the
+// connection is up
+func Publish(endpoint string) (*Publisher, error) {
+	media := &webrtc.MediaEngine{}
+	if err := registerCodecs(media); err != nil {
+		return nil, err
+	}
+	settings := webrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithSettingEngine(settings),
+		webrtc.WithInterceptorRegistry(&interceptor.Registry{}))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{pc: pc}
+	if err := p.connect(endpoint); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Publisher) connect(endpoint string) error {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "rtp_demo")
+	if err != nil {
+		return err
+	}
+	transceiver, err := p.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		return err
+	}
+	p.track, p.sender = track, transceiver.Sender()
+
+	result := make(chan error, 1)
+	p.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		var err error
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+		case webrtc.PeerConnectionStateFailed:
+			err = errors.New("whip: connection failed")
+		default:
+			return
+		}
+		select {
+		case result <- err:
+		default: // only the first outcome counts
+		}
+	})
+
+	// Without trickle ICE the offer carries all candidates
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gathered
+
+	resp, err := http.Post(endpoint, "application/sdp", strings.NewReader(p.pc.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxOfferSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("whip: endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+
+	// The Location is resolved against the endpoint URL
+	if loc, err := resp.Location(); err == nil {
+		p.resource = loc.String()
+	}
+
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(ConnectTimeout):
+		return errors.New("whip: timed out connecting")
+	}
+}
+
+// SSRC returns the SSRC the packets are sent with; Write replaces the one
+// in each packet
+func (p *Publisher) SSRC() uint32 {
+	params := p.sender.GetParameters()
+	if len(params.Encodings) == 0 {
+		return 0
+	}
+	return uint32(params.Encodings[0].SSRC)
+}
+
+// Write sends an RTP packet with the negotiated payload type and SSRC
+func (p *Publisher) Write(packet []byte) (int, error) {
+	return p.track.Write(packet)
+}
+
+// Read reads RTCP packets from the endpoint
+func (p *Publisher) Read(buf []byte) (int, error) {
+	n, _, err := p.sender.Read(buf)
+	return n, err
+}
+
+// Close ends the session at the endpoint and closes the connection
+func (p *Publisher) Close() error {
+	if p.resource != "" {
+		if req, err := http.NewRequest(http.MethodDelete, p.resource, nil); err == nil {
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	return p.pc.Close()
+}
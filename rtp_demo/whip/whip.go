@@ -0,0 +1,372 @@
+// Package whip implements WebRTC-HTTP ingestion (WHIP, RFC 9725) on top of
+// pion: an ICE-lite endpoint that answers SDP offers and hands the decrypted
+// RTP and RTCP to a callback, and a publisher that pushes RTP to such an
+// endpoint, standing in for a browser.
+package whip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	pionrtcp "github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Default payload types packets are rewritten to, whatever the offer
+// negotiated, so the receiver can tell the codecs apart as with plain RTP
+const (
+	PayloadTypeH264 = 96
+	PayloadTypeOpus = 111
+)
+
+// maxOfferSize bounds the SDP offer read from a request
+const maxOfferSize = 64 << 10
+
+// Options configures the endpoint
+type Options struct {
+	// UDPAddr, if set, is a single UDP address shared by all sessions, e.g.
+	// ":8189" for a firewall rule; otherwise each session gets its own port
+	UDPAddr string
+
+	// H264PayloadType and OpusPayloadType, if set, replace PayloadTypeH264
+	// and PayloadTypeOpus in the packets passed on
+	H264PayloadType, OpusPayloadType uint8
+}
+
+// Session is one publishing peer
+type Session struct {
+	ID string
+
+	pc     *webrtc.PeerConnection
+	mu     sync.Mutex
+	remote *net.UDPAddr
+}
+
+// WriteRTCP sends RTCP packets, e.g. a PLI, to the publisher
+func (s *Session) WriteRTCP(data []byte) error {
+	packets, err := pionrtcp.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	return s.pc.WriteRTCP(packets)
+}
+
+// RemoteAddr returns the publisher's address from the selected ICE
+// candidate pair, or nil before it is known
+func (s *Session) RemoteAddr() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// Handler is the WHIP endpoint. POST with an SDP offer creates a session,
+// DELETE on the returned resource ends it.
+type Handler struct {
+	// OnConnect and OnClose, if set, are called when a session's
+	// connection is established and when it ends
+	OnConnect func(*Session)
+	OnClose   func(*Session)
+
+	api      *webrtc.API
+	onPacket func(*Session, []byte)
+	udp      net.PacketConn // nil without Options.UDPAddr
+	h264PT   uint8
+	opusPT   uint8
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	closed   bool
+	readers  sync.WaitGroup // readTrack and readRTCP goroutines
+}
+
+// NewHandler creates an endpoint that passes every RTP and RTCP packet it
+// receives to onPacket. H.264 packets carry PayloadTypeH264 and Opus packets
+// PayloadTypeOpus, unless opts says otherwise. onPacket is called from one goroutine per track.
+func NewHandler(opts Options, onPacket func(*Session, []byte)) (*Handler, error) {
+	media := &webrtc.MediaEngine{}
+	if err := registerCodecs(media); err != nil {
+		return nil, err
+	}
+
+	settings := webrtc.SettingEngine{}
+	settings.SetLite(true)
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+
+	h := &Handler{onPacket: onPacket, sessions: make(map[string]*Session), h264PT: PayloadTypeH264, opusPT: PayloadTypeOpus}
+	if opts.H264PayloadType != 0 {
+		h.h264PT = opts.H264PayloadType
+	}
+	if opts.OpusPayloadType != 0 {
+		h.opusPT = opts.OpusPayloadType
+	}
+	if opts.UDPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", opts.UDPAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		h.udp = conn
+		settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+
+	// No interceptors: the receiver sends its own feedback
+	h.api = webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithSettingEngine(settings),
+		webrtc.WithInterceptorRegistry(&interceptor.Registry{}))
+	return h, nil
+}
+
+// registerCodecs accepts H.264 in packetization mode 1, in the profiles
+// browsers offer, and Opus
+func registerCodecs(media *webrtc.MediaEngine) error {
+	profiles := []string{"42e01f", "42001f", "4d001f", "64001f"}
+	for i, profile := range profiles {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH264,
+				ClockRate:   90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+				RTCPFeedback: []webrtc.RTCPFeedback{
+					{Type: "nack", Parameter: "pli"},
+					{Type: "ccm", Parameter: "fir"},
+				},
+			},
+			PayloadType: webrtc.PayloadType(PayloadTypeH264 + i),
+		}
+		if err := media.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+
+	return media.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: PayloadTypeOpus,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// ServeHTTP serves, relative to where the handler is mounted:
+//
+//	POST /          SDP offer in, 201 with the answer and a Location
+//	DELETE /<id>    end the session
+//
+// Trickle ICE (PATCH) is not supported since an ICE-lite endpoint has all
+// its candidates in the answer. CORS headers let browser pages publish.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	id := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && id == "":
+		h.servePost(w, r)
+	case r.Method == http.MethodDelete && id != "":
+		h.mu.Lock()
+		s, ok := h.sessions[id]
+		h.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.pc.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) servePost(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, answer, err := h.accept(string(offer))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The resource URL is relative to the request, wherever the handler is
+	// mounted
+	base := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		base = u.Path
+	}
+	w.Header().Set("Location", path.Join(base, s.ID))
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// accept creates a session for an offer and returns the complete answer
+func (h *Handler) accept(offer string) (*Session, string, error) {
+	pc, err := h.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	s := &Session{ID: newID(), pc: pc}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			return
+		}
+		h.readers.Add(2)
+		h.mu.Unlock()
+
+		go func() {
+			defer h.readers.Done()
+			h.readRTCP(s, receiver)
+		}()
+		defer h.readers.Done()
+		h.readTrack(s, track)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			s.updateRemote(pc.SCTP().Transport())
+			if h.OnConnect != nil {
+				h.OnConnect(s)
+			}
+		case webrtc.PeerConnectionStateFailed:
+			pc.Close()
+		case webrtc.PeerConnectionStateClosed:
+			h.mu.Lock()
+			_, ok := h.sessions[s.ID]
+			delete(h.sessions, s.ID)
+			h.mu.Unlock()
+			if ok && h.OnClose != nil {
+				h.OnClose(s)
+			}
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	<-gathered
+
+	h.mu.Lock()
+	h.sessions[s.ID] = s
+	h.mu.Unlock()
+	return s, pc.LocalDescription().SDP, nil
+}
+
+// readTrack passes the track's packets on with the payload type rewritten
+func (h *Handler) readTrack(s *Session, track *webrtc.TrackRemote) {
+	pt := h.h264PT
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		pt = h.opusPT
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := track.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		buf[1] = buf[1]&0x80 | pt
+		h.onPacket(s, buf[:n])
+	}
+}
+
+// readRTCP passes the RTCP packets from the publisher on, e.g. sender
+// reports
+func (h *Handler) readRTCP(s *Session, receiver *webrtc.RTPReceiver) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := receiver.Read(buf)
+		if err != nil {
+			return
+		}
+		h.onPacket(s, buf[:n])
+	}
+}
+
+// updateRemote records the publisher's address from the selected ICE
+// candidate pair
+func (s *Session) updateRemote(dtls *webrtc.DTLSTransport) {
+	pair, err := dtls.ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil || pair.Remote == nil {
+		return
+	}
+	s.mu.Lock()
+	s.remote = &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address), Port: int(pair.Remote.Port)}
+	s.mu.Unlock()
+}
+
+// Sessions returns the number of sessions
+func (h *Handler) Sessions() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+// Close ends all sessions, waits until onPacket is no longer called and
+// releases the shared UDP port
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	var errs []error
+	for _, s := range sessions {
+		errs = append(errs, s.pc.Close())
+	}
+	h.readers.Wait()
+	if h.udp != nil {
+		errs = append(errs, h.udp.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,131 @@
+package whip
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	var mu sync.Mutex
+	var packets [][]byte
+	received := make(chan struct{}, 100)
+
+	h, err := NewHandler(Options{}, func(s *Session, packet []byte) {
+		if packet[1]&0x7F >= 72 && packet[1]&0x7F <= 76 {
+			return // RTCP
+		}
+		mu.Lock()
+		packets = append(packets, append([]byte(nil), packet...))
+		mu.Unlock()
+		received <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	defer h.Close()
+	closed := make(chan *Session, 1)
+	h.OnClose = func(s *Session) { closed <- s }
+
+	mux := http.NewServeMux()
+	mux.Handle("/whip/", http.StripPrefix("/whip", h))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	pub, err := Publish(srv.URL + "/whip/")
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if !strings.HasPrefix(pub.resource, srv.URL+"/whip/") {
+		t.Errorf("Unexpected resource URL %q", pub.resource)
+	}
+	if h.Sessions() != 1 {
+		t.Errorf("Expected 1 session, got %d", h.Sessions())
+	}
+
+	// A single NAL unit packet with payload type 0, replaced on the way
+	for seq := uint16(1); seq <= 3; seq++ {
+		packet := make([]byte, 12, 20)
+		packet[0] = 0x80
+		binary.BigEndian.PutUint16(packet[2:], seq)
+		binary.BigEndian.PutUint32(packet[4:], uint32(seq)*3000)
+		packet = append(packet, 0x65, 0x88, 0x84, 0x00)
+		if _, err := pub.Write(packet); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d packets", i)
+		}
+	}
+
+	mu.Lock()
+	for _, p := range packets {
+		if pt := p[1] & 0x7F; pt != PayloadTypeH264 {
+			t.Errorf("Expected payload type %d, got %d", PayloadTypeH264, pt)
+		}
+		if ssrc := binary.BigEndian.Uint32(p[8:]); ssrc != pub.SSRC() {
+			t.Errorf("Expected SSRC %d, got %d", pub.SSRC(), ssrc)
+		}
+		if p[12] != 0x65 {
+			t.Errorf("Unexpected payload % X", p[12:])
+		}
+	}
+	mu.Unlock()
+
+	pub.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session not closed after DELETE")
+	}
+	if h.Sessions() != 0 {
+		t.Errorf("Expected no sessions, got %d", h.Sessions())
+	}
+}
+
+func TestRejectsOffer(t *testing.T) {
+	h, err := NewHandler(Options{}, func(*Session, []byte) {})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader("v=0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL, "application/sdp", strings.NewReader("not sdp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/unknown", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+}